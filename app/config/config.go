@@ -3,13 +3,100 @@ package config
 import (
 	"log"
 	"strconv"
+	"time"
 )
 
+// AppConfig is shared by the server and the cli. It is loaded
+// in layers, see Load. The cfg tag is the key in the config file
+// and the flag name, env is an older env var for the same key.
 type AppConfig struct {
-	AppPort    string
-	SeedSize   string
-	DomainName string
-	CacheAddrs []string
+	AppPort    string `cfg:"server.port" env:"PORT" desc:"port the server listens on"`
+	DomainName string `cfg:"server.domain" env:"DOMAIN" desc:"public url of the server. defaults to http://localhost:<port>"`
+
+	// Maintenance answers every request with a 503, without opening
+	// the shards, so that cli restore can swap them in place.
+	Maintenance bool `cfg:"server.maintenance" desc:"answer every request with a 503, with the shards closed"`
+
+	RateLimit       int           `cfg:"server.rate_limit" desc:"requests allowed per window, per client. needs memcached"`
+	RateLimitWindow time.Duration `cfg:"server.rate_limit_window" desc:"window of the rate limit"`
+
+	// StoreDriver picks where the links are kept,
+	// sqlite, postgres or memory. StoreDSN is only
+	// needed for postgres. Only the links move, the
+	// clicks stay in the shards, and the accounts,
+	// reports and topology in the coordinator db, so
+	// the shards are seeded and opened with any driver.
+	StoreDriver string `cfg:"store.driver" env:"STORE_DRIVER" desc:"where links are kept. sqlite, postgres or memory"`
+	StoreDSN    string `cfg:"store.dsn" env:"STORE_DSN" secret:"true" desc:"connection string for postgres"`
+
+	CacheAddrs []string `cfg:"cache.memcached" env:"MEMCACHED_URLS" desc:"comma separated memcached addresses"`
+
+	// LinkCacheSize is the number of links cached
+	// in memory for redirects, 0 turns caching off.
+	LinkCacheSize int `cfg:"cache.link_cache_size" env:"LINK_CACHE_SIZE" desc:"links cached in memory for redirects. 0 turns it off"`
+	// ModerationInterval is how often the server drops the links,
+	// moderated, deleted or retargeted by the other servers or the
+	// cli, from its cache.
+	ModerationInterval time.Duration `cfg:"cache.moderation_interval" desc:"how often the links moderated or changed elsewhere are dropped from the cache. 0 leaves them till the cache ttl"`
+
+	// KeyRanges, ShardPaths and SeedStarts make the shard topology,
+	// which is recorded in the coordinator db, and checked on start.
+	KeyRanges       []string          `cfg:"shards.key_ranges" desc:"comma separated key ranges of the shards, like a-e,f-z"`
+	ShardPaths      map[string]string `cfg:"shards.paths" desc:"comma separated key_range=file.db. defaults to db_<start>_<end>.db"`
+	CoordinatorPath string            `cfg:"shards.coordinator_path" desc:"file of the coordinator db"`
+	// ReloadInterval is how often the server checks the coordinator
+	// db for a reshard, to switch its routing. 0 turns it off.
+	ReloadInterval time.Duration `cfg:"shards.reload_interval" desc:"how often the server picks up a reshard. 0 turns it off"`
+
+	// ShardReplicas are read only copies of the shard files, the server
+	// reads from them, while they are healthy. They aren't part of the
+	// recorded topology, every server can have its own.
+	ShardReplicas        map[string][]string `cfg:"shards.replicas" desc:"comma separated key_range=replica.db, several are separated by |"`
+	ReplicaMaxLag        time.Duration       `cfg:"shards.replica_max_lag" desc:"replicas further behind their shard aren't read from"`
+	ReplicaCheckInterval time.Duration       `cfg:"shards.replica_check_interval" desc:"how often the replicas are health checked"`
+
+	// ChangelogDest is where the changelog of the shards is shipped,
+	// s3://bucket/prefix or a local directory. Empty turns it off.
+	ChangelogDest        string        `cfg:"changelog.dest" desc:"where the shard changelog is shipped. s3://bucket/prefix, gs://bucket/prefix or a directory. empty turns it off"`
+	ChangelogInterval    time.Duration `cfg:"changelog.ship_interval" desc:"how often the changelog is shipped"`
+	ChangelogSegmentSize int           `cfg:"changelog.segment_size" desc:"changes per shipped segment, at most"`
+
+	AWSRegion    string `cfg:"aws.region" env:"AWS_REGION" desc:"region of the s3 bucket"`
+	AWSAccessKey string `cfg:"aws.access_key" env:"AWS_ACCESS_KEY" secret:"true" desc:"access key for s3"`
+	AWSSecretKey string `cfg:"aws.secret_key" env:"AWS_SECRET_KEY" secret:"true" desc:"secret key for s3"`
+	AWSEndpoint  string `cfg:"aws.endpoint" desc:"endpoint of an s3 compatible store, like minio. gs:// always uses storage.googleapis.com"`
+
+	// BackupDest is where cli backup puts the snapshots, one
+	// directory per run, with a manifest of what's in it.
+	BackupDest     string        `cfg:"backup.dest" desc:"where the snapshots are put. s3://bucket/prefix, gs://bucket/prefix or a directory"`
+	BackupKeep     int           `cfg:"backup.keep" desc:"complete backup runs to keep, older ones are deleted. 0 keeps all"`
+	BackupMaxAge   time.Duration `cfg:"backup.max_age" desc:"backup runs older than this are deleted, the latest is always kept. 0 keeps all"`
+	BackupCompress bool          `cfg:"backup.compress" desc:"gzip the snapshots"`
+
+	// KeyPoolSize is the most free keys the server leases ahead
+	// from the shards, for the new links. 0 turns the pool off,
+	// it's off with the other drivers, which have their own keys.
+	KeyPoolSize int           `cfg:"keys.pool_size" desc:"free keys leased ahead for new links. 0 turns it off"`
+	KeyLeaseTTL time.Duration `cfg:"keys.lease_ttl" desc:"how long the leased keys are held, unused ones are free again after"`
+
+	// KeyRecycleAfter is the quarantine of the deleted and expired
+	// links, their keys are recycled by sweep -recycle after it.
+	KeyRecycleAfter time.Duration `cfg:"keys.recycle_after" desc:"how long deleted and expired links are kept, before sweep -recycle frees their keys"`
+
+	SeedSize string `cfg:"seed.size" desc:"keys seeded per lowercase prefix. like 1M"`
+	// SeedStarts is the number the base58 keys are generated from,
+	// by key range. A prefix, like b, overrides the start of its range.
+	SeedStarts    map[string]uint64 `cfg:"seed.starts" desc:"comma separated key_range=start or prefix=start, the first number keys are generated from"`
+	FillThreshold int               `cfg:"seed.fill_threshold" desc:"refill a shard when it has fewer free keys"`
+
+	URLChecker *URLCheckerOptions `cfg:"url_checker"`
+
+	// ScanWorkers run the network checks of url_checker on the links,
+	// after they are created, and mark the ones scoring ScanThreshold,
+	// or more, malicious. 0 turns the scanner off.
+	ScanWorkers   int           `cfg:"scanner.workers" desc:"links scanned at once, in the background. 0 turns the scanner off"`
+	ScanThreshold int           `cfg:"scanner.threshold" desc:"score of the issues, lexical and network, at which a scanned link is marked malicious"`
+	RescanAfter   time.Duration `cfg:"scanner.rescan_after" desc:"links scanned longer ago are scanned again. 0 only scans the new links"`
 }
 
 var sizeMap = map[string]uint64{
@@ -0,0 +1,747 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/go-batteries/shortner/app/seed"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// EnvPrefix, every key can be set from the env as SHORTNER_<KEY>,
+	// upper cased, with the dots as underscores.
+	// Like SHORTNER_SERVER_PORT for server.port
+	EnvPrefix = "SHORTNER_"
+	// EnvConfigFile is the config file, if -config isn't passed
+	EnvConfigFile = "SHORTNER_CONFIG"
+)
+
+const (
+	PrintFormatTOML = "toml"
+	PrintFormatYAML = "yaml"
+	PrintFormatJSON = "json"
+)
+
+var storeDrivers = []string{"sqlite", "postgres", "memory"}
+
+// Defaults is the first layer of the config
+func Defaults() *AppConfig {
+	return &AppConfig{
+		AppPort:            "9091",
+		RateLimit:          100,
+		RateLimitWindow:    60 * time.Second,
+		StoreDriver:        "sqlite",
+		CacheAddrs:         []string{},
+		LinkCacheSize:      10000,
+		ModerationInterval: 2 * time.Second,
+		KeyRanges:          append([]string{}, seed.DefaultKeyRanges...),
+		ShardPaths:         map[string]string{},
+		CoordinatorPath:    "db_shard_coordinator.db",
+		ReloadInterval:     10 * time.Second,
+
+		ShardReplicas:        map[string][]string{},
+		ReplicaMaxLag:        30 * time.Second,
+		ReplicaCheckInterval: 5 * time.Second,
+
+		ChangelogInterval:    10 * time.Second,
+		ChangelogSegmentSize: 10000,
+
+		BackupKeep:     7,
+		BackupCompress: true,
+
+		KeyPoolSize: 2000,
+		KeyLeaseTTL: 10 * time.Minute,
+
+		KeyRecycleAfter: 30 * 24 * time.Hour,
+
+		SeedSize: "12M",
+		SeedStarts: map[string]uint64{
+			"a-e": 1000000000,
+			"f-j": 2000000000,
+			"k-p": 3000000000,
+			"q-u": 4000000000,
+			"v-z": 5000000000,
+		},
+		FillThreshold: 10000,
+		URLChecker:    DefaultOptions(),
+
+		ScanWorkers:   2,
+		ScanThreshold: CutoffMaxIssues + 1,
+		RescanAfter:   7 * 24 * time.Hour,
+	}
+}
+
+type setting struct {
+	key    string
+	env    string
+	desc   string
+	secret bool
+	value  reflect.Value
+}
+
+// settings lists the keys of cfg, in the order of the fields.
+// Nested structs are flattened, with their keys joined by dots.
+func settings(cfg *AppConfig) []*setting {
+	out := []*setting{}
+	walkSettings(reflect.ValueOf(cfg).Elem(), "", &out)
+	return out
+}
+
+func walkSettings(v reflect.Value, prefix string, out *[]*setting) {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		tag := field.Tag.Get("cfg")
+		if tag == "" {
+			continue
+		}
+
+		key := prefix + tag
+		fv := v.Field(i)
+
+		if fv.Kind() == reflect.Ptr && fv.Type().Elem().Kind() == reflect.Struct {
+			if fv.IsNil() {
+				fv.Set(reflect.New(fv.Type().Elem()))
+			}
+
+			walkSettings(fv.Elem(), key+".", out)
+			continue
+		}
+
+		*out = append(*out, &setting{
+			key:    key,
+			env:    field.Tag.Get("env"),
+			desc:   field.Tag.Get("desc"),
+			secret: field.Tag.Get("secret") == "true",
+			value:  fv,
+		})
+	}
+}
+
+func (s *setting) envName() string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(s.key, ".", "_"))
+}
+
+func splitList(raw string) []string {
+	items := []string{}
+
+	for _, item := range strings.Split(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// set parses raw, the way it is given in the env or as a flag.
+// Lists are comma separated, and maps are comma separated k=v.
+// Maps of lists separate the values with |, like k=v1|v2.
+func (s *setting) set(raw string) error {
+	raw = strings.TrimSpace(raw)
+
+	switch p := s.value.Addr().Interface().(type) {
+	case *string:
+		*p = raw
+	case *int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("%s: expected a number, got %q", s.key, raw)
+		}
+		*p = n
+	case *bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%s: expected true or false, got %q", s.key, raw)
+		}
+		*p = b
+	case *float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("%s: expected a number, got %q", s.key, raw)
+		}
+		*p = f
+	case *time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("%s: expected a duration like 60s, got %q", s.key, raw)
+		}
+		*p = d
+	case *[]string:
+		*p = splitList(raw)
+	case *map[string]uint64:
+		m := map[string]uint64{}
+
+		for _, pair := range splitList(raw) {
+			k, v, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("%s: expected key=value, got %q", s.key, pair)
+			}
+
+			n, err := strconv.ParseUint(strings.TrimSpace(v), 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s: expected a number for %s, got %q", s.key, k, v)
+			}
+
+			m[strings.TrimSpace(k)] = n
+		}
+
+		*p = m
+	case *map[string]string:
+		m := map[string]string{}
+
+		for _, pair := range splitList(raw) {
+			k, v, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("%s: expected key=value, got %q", s.key, pair)
+			}
+
+			m[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+
+		*p = m
+	case *map[string][]string:
+		m := map[string][]string{}
+
+		for _, pair := range splitList(raw) {
+			k, v, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("%s: expected key=value|value, got %q", s.key, pair)
+			}
+
+			for _, item := range strings.Split(v, "|") {
+				if item = strings.TrimSpace(item); item != "" {
+					m[strings.TrimSpace(k)] = append(m[strings.TrimSpace(k)], item)
+				}
+			}
+		}
+
+		*p = m
+	default:
+		return fmt.Errorf("%s: unsupported type %s", s.key, s.value.Type())
+	}
+
+	return nil
+}
+
+// setAny sets a value decoded from a config file
+func (s *setting) setAny(v any) error {
+	switch x := v.(type) {
+	case string:
+		return s.set(x)
+	case []any:
+		p, ok := s.value.Addr().Interface().(*[]string)
+		if !ok {
+			return fmt.Errorf("%s: unexpected list", s.key)
+		}
+
+		items := make([]string, 0, len(x))
+		for _, item := range x {
+			items = append(items, fmt.Sprint(item))
+		}
+
+		*p = items
+		return nil
+	case map[string]any:
+		if p, ok := s.value.Addr().Interface().(*map[string]string); ok {
+			m := map[string]string{}
+			for k, item := range x {
+				m[k] = fmt.Sprint(item)
+			}
+
+			*p = m
+			return nil
+		}
+
+		if p, ok := s.value.Addr().Interface().(*map[string][]string); ok {
+			m := map[string][]string{}
+			for k, item := range x {
+				switch values := item.(type) {
+				case []any:
+					for _, value := range values {
+						m[k] = append(m[k], fmt.Sprint(value))
+					}
+				default:
+					m[k] = strings.Split(fmt.Sprint(values), "|")
+				}
+			}
+
+			*p = m
+			return nil
+		}
+
+		p, ok := s.value.Addr().Interface().(*map[string]uint64)
+		if !ok {
+			return fmt.Errorf("%s: unexpected table", s.key)
+		}
+
+		m := map[string]uint64{}
+
+		for k, item := range x {
+			n, err := strconv.ParseUint(fmt.Sprint(item), 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s: expected a number for %s, got %v", s.key, k, item)
+			}
+
+			m[k] = n
+		}
+
+		*p = m
+		return nil
+	}
+
+	return s.set(fmt.Sprint(v))
+}
+
+func (s *setting) String() string {
+	switch v := s.value.Interface().(type) {
+	case []string:
+		return strings.Join(v, ",")
+	case map[string]uint64:
+		pairs := []string{}
+		for k, n := range v {
+			pairs = append(pairs, fmt.Sprintf("%s=%d", k, n))
+		}
+
+		sort.Strings(pairs)
+		return strings.Join(pairs, ",")
+	case map[string]string:
+		pairs := []string{}
+		for k, v := range v {
+			pairs = append(pairs, k+"="+v)
+		}
+
+		sort.Strings(pairs)
+		return strings.Join(pairs, ",")
+	case map[string][]string:
+		pairs := []string{}
+		for k, v := range v {
+			pairs = append(pairs, k+"="+strings.Join(v, "|"))
+		}
+
+		sort.Strings(pairs)
+		return strings.Join(pairs, ",")
+	}
+
+	return fmt.Sprint(s.value.Interface())
+}
+
+// display is the value to print, secrets are masked
+func (s *setting) display() any {
+	if s.secret && !s.value.IsZero() {
+		return "********"
+	}
+
+	if d, ok := s.value.Interface().(time.Duration); ok {
+		return d.String()
+	}
+
+	return s.value.Interface()
+}
+
+// flagValue records the flags which were passed, so
+// only those override the file and the env.
+type flagValue struct {
+	key     string
+	def     string
+	flagged map[string]string
+}
+
+func (f *flagValue) String() string {
+	if f == nil {
+		return ""
+	}
+
+	return f.def
+}
+
+func (f *flagValue) Set(value string) error {
+	f.flagged[f.key] = value
+	return nil
+}
+
+// Loader builds the AppConfig in layers, each overriding the
+// one before. The defaults, the config file (toml, yaml or json),
+// the env vars and then the flags.
+type Loader struct {
+	configPath string
+	flagged    map[string]string
+}
+
+// NewLoader registers -config, and a flag for every key, like
+// -server.port, on fs. Load is to be called after fs is parsed.
+func NewLoader(fs *flag.FlagSet) *Loader {
+	loader := &Loader{flagged: map[string]string{}}
+
+	fs.StringVar(&loader.configPath, "config", "", "config file, toml, yaml or json. defaults to $"+EnvConfigFile)
+
+	for _, s := range settings(Defaults()) {
+		fs.Var(&flagValue{key: s.key, def: s.String(), flagged: loader.flagged}, s.key, s.desc)
+	}
+
+	return loader
+}
+
+func (loader *Loader) Load() (*AppConfig, error) {
+	cfg := Defaults()
+	all := settings(cfg)
+
+	byKey := map[string]*setting{}
+	for _, s := range all {
+		byKey[s.key] = s
+	}
+
+	configPath := loader.configPath
+	if configPath == "" {
+		configPath = os.Getenv(EnvConfigFile)
+	}
+
+	if configPath != "" {
+		if err := loadFile(configPath, byKey); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range all {
+		for _, env := range []string{s.env, s.envName()} {
+			if env == "" {
+				continue
+			}
+
+			if raw, ok := os.LookupEnv(env); ok && raw != "" {
+				if err := s.set(raw); err != nil {
+					return nil, fmt.Errorf("env %s: %w", env, err)
+				}
+			}
+		}
+	}
+
+	for key, raw := range loader.flagged {
+		if err := byKey[key].set(raw); err != nil {
+			return nil, fmt.Errorf("flag: %w", err)
+		}
+	}
+
+	if cfg.DomainName == "" {
+		cfg.DomainName = "http://localhost:" + cfg.AppPort
+	}
+
+	return cfg, cfg.Validate()
+}
+
+// MustLoad parses args with fs, and loads the config.
+// It returns the args left after the flags.
+func MustLoad(fs *flag.FlagSet, args []string) (*AppConfig, []string) {
+	loader := NewLoader(fs)
+
+	if err := fs.Parse(args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	cfg, err := loader.Load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid config:", err)
+		os.Exit(2)
+	}
+
+	return cfg, fs.Args()
+}
+
+func loadFile(path string, byKey map[string]*setting) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	tree := map[string]any{}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".toml":
+		err = toml.Unmarshal(data, &tree)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &tree)
+	case ".json":
+		err = json.Unmarshal(data, &tree)
+	default:
+		return fmt.Errorf("unsupported config file %s, expected .toml, .yaml or .json", path)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	return applyTree(tree, "", byKey)
+}
+
+func applyTree(tree map[string]any, prefix string, byKey map[string]*setting) error {
+	for k, v := range tree {
+		key := prefix + k
+
+		if s, ok := byKey[key]; ok {
+			if err := s.setAny(v); err != nil {
+				return err
+			}
+			continue
+		}
+
+		sub, ok := v.(map[string]any)
+		if !ok {
+			return fmt.Errorf("unknown config key %s", key)
+		}
+
+		if err := applyTree(sub, key+".", byKey); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Tree is the config as nested maps, keyed like the config file
+func (cfg *AppConfig) Tree() map[string]any {
+	tree := map[string]any{}
+
+	for _, s := range settings(cfg) {
+		parts := strings.Split(s.key, ".")
+		node := tree
+
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := node[part].(map[string]any)
+			if !ok {
+				child = map[string]any{}
+				node[part] = child
+			}
+
+			node = child
+		}
+
+		node[parts[len(parts)-1]] = s.display()
+	}
+
+	return tree
+}
+
+// Print writes the config in a format Load can read back,
+// apart from the secrets, which are masked.
+func Print(w io.Writer, cfg *AppConfig, format string) error {
+	tree := cfg.Tree()
+
+	switch format {
+	case PrintFormatTOML:
+		return toml.NewEncoder(w).Encode(tree)
+	case PrintFormatYAML:
+		enc := yaml.NewEncoder(w)
+		defer enc.Close()
+		return enc.Encode(tree)
+	case PrintFormatJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(tree)
+	}
+
+	return fmt.Errorf("unsupported format %s, expected toml, yaml or json", format)
+}
+
+func validKeyRange(keyRange string) (byte, byte, bool) {
+	start, end, ok := strings.Cut(keyRange, "-")
+	if !ok || len(start) != 1 || len(end) != 1 {
+		return 0, 0, false
+	}
+
+	s, e := start[0], end[0]
+	if s < 'a' || e > 'z' || s > e {
+		return 0, 0, false
+	}
+
+	return s, e, true
+}
+
+// Validate checks the values, which the defaults can't guarantee
+func (cfg *AppConfig) Validate() error {
+	errs := []error{}
+
+	if port, err := strconv.Atoi(cfg.AppPort); err != nil || port < 1 || port > 65535 {
+		errs = append(errs, fmt.Errorf("server.port: invalid port %q", cfg.AppPort))
+	}
+
+	if cfg.RateLimit < 1 || cfg.RateLimitWindow <= 0 {
+		errs = append(errs, errors.New("server.rate_limit and server.rate_limit_window should be positive"))
+	}
+
+	knownDriver := false
+	for _, driver := range storeDrivers {
+		knownDriver = knownDriver || driver == cfg.StoreDriver
+	}
+
+	if !knownDriver {
+		errs = append(errs, fmt.Errorf("store.driver: expected one of %v, got %q", storeDrivers, cfg.StoreDriver))
+	}
+
+	if cfg.StoreDriver == "postgres" && cfg.StoreDSN == "" {
+		errs = append(errs, errors.New("store.dsn: required for postgres"))
+	}
+
+	// the replicas and the changelog are of the shard files, with
+	// another driver they'd have the clicks, but none of the links
+	if cfg.StoreDriver != "sqlite" && len(cfg.ShardReplicas) > 0 {
+		errs = append(errs, fmt.Errorf("shards.replicas: the links of %s aren't in the shards, they can't be read from replicas", cfg.StoreDriver))
+	}
+
+	if cfg.StoreDriver != "sqlite" && cfg.ChangelogDest != "" {
+		errs = append(errs, fmt.Errorf("changelog.dest: the links of %s aren't in the shards, they aren't in the changelog", cfg.StoreDriver))
+	}
+
+	if cfg.LinkCacheSize < 0 {
+		errs = append(errs, errors.New("cache.link_cache_size: can't be negative"))
+	}
+
+	if cfg.ModerationInterval < 0 {
+		errs = append(errs, errors.New("cache.moderation_interval: can't be negative"))
+	}
+
+	if len(cfg.KeyRanges) == 0 {
+		errs = append(errs, errors.New("shards.key_ranges: at least one is needed"))
+	}
+
+	var lastEnd byte
+	ranges := map[string]bool{}
+
+	for i, keyRange := range cfg.KeyRanges {
+		start, end, ok := validKeyRange(keyRange)
+		if !ok {
+			errs = append(errs, fmt.Errorf("shards.key_ranges: invalid key range %q, expected like a-e", keyRange))
+			continue
+		}
+
+		if i > 0 && start <= lastEnd {
+			errs = append(errs, fmt.Errorf("shards.key_ranges: %q overlaps or is out of order", keyRange))
+		}
+		lastEnd = end
+		ranges[keyRange] = true
+
+		if _, ok := cfg.SeedStarts[keyRange]; !ok {
+			errs = append(errs, fmt.Errorf("seed.starts: missing start for key range %q", keyRange))
+		}
+	}
+
+	for keyRange, path := range cfg.ShardPaths {
+		if !ranges[keyRange] {
+			errs = append(errs, fmt.Errorf("shards.paths: %q is not one of the key ranges", keyRange))
+		}
+
+		if !strings.HasSuffix(path, ".db") {
+			errs = append(errs, fmt.Errorf("shards.paths: %q should end with .db", path))
+		}
+	}
+
+	for keyRange, paths := range cfg.ShardReplicas {
+		if !ranges[keyRange] {
+			errs = append(errs, fmt.Errorf("shards.replicas: %q is not one of the key ranges", keyRange))
+		}
+
+		for _, path := range paths {
+			if !strings.HasSuffix(path, ".db") {
+				errs = append(errs, fmt.Errorf("shards.replicas: %q should end with .db", path))
+			}
+		}
+	}
+
+	if len(cfg.ShardReplicas) > 0 && (cfg.ReplicaMaxLag <= 0 || cfg.ReplicaCheckInterval <= 0) {
+		errs = append(errs, errors.New("shards.replica_max_lag and shards.replica_check_interval should be positive"))
+	}
+
+	if cfg.ChangelogDest != "" && (cfg.ChangelogInterval <= 0 || cfg.ChangelogSegmentSize < 1) {
+		errs = append(errs, errors.New("changelog.ship_interval and changelog.segment_size should be positive"))
+	}
+
+	if strings.HasPrefix(cfg.ChangelogDest, "s3://") && cfg.AWSRegion == "" {
+		errs = append(errs, errors.New("aws.region: required to ship the changelog to s3"))
+	}
+
+	if cfg.KeyPoolSize < 0 || (cfg.KeyPoolSize > 0 && cfg.KeyLeaseTTL < time.Minute) {
+		errs = append(errs, errors.New("keys.pool_size can't be negative, keys.lease_ttl should be a minute or more"))
+	}
+
+	if cfg.KeyRecycleAfter < 0 {
+		errs = append(errs, errors.New("keys.recycle_after: can't be negative"))
+	}
+
+	if cfg.BackupKeep < 0 || cfg.BackupMaxAge < 0 {
+		errs = append(errs, errors.New("backup.keep and backup.max_age: can't be negative"))
+	}
+
+	if strings.HasPrefix(cfg.BackupDest, "s3://") && cfg.AWSRegion == "" {
+		errs = append(errs, errors.New("aws.region: required to back up to s3"))
+	}
+
+	if cfg.ReloadInterval < 0 {
+		errs = append(errs, errors.New("shards.reload_interval: can't be negative"))
+	}
+
+	if !strings.HasSuffix(cfg.CoordinatorPath, ".db") {
+		errs = append(errs, fmt.Errorf("shards.coordinator_path: %q should end with .db", cfg.CoordinatorPath))
+	}
+
+	for key := range cfg.SeedStarts {
+		if ranges[key] {
+			continue
+		}
+
+		inRange := false
+		for keyRange := range ranges {
+			start, end, _ := validKeyRange(keyRange)
+			inRange = inRange || (len(key) == 1 && key[0] >= start && key[0] <= end)
+		}
+
+		if !inRange {
+			errs = append(errs, fmt.Errorf("seed.starts: %q is neither a key range nor a prefix in one", key))
+		}
+	}
+
+	if cfg.SeedSize == "" {
+		errs = append(errs, errors.New("seed.size: required"))
+	}
+
+	if cfg.FillThreshold < 1 {
+		errs = append(errs, errors.New("seed.fill_threshold: should be positive"))
+	}
+
+	if cfg.URLChecker.MaxURLLength < 1 {
+		errs = append(errs, errors.New("url_checker.max_url_length: should be positive"))
+	}
+
+	for key, weight := range map[string]int{
+		"blocklist_weight": cfg.URLChecker.BlocklistWeight,
+		"hash_list_weight": cfg.URLChecker.HashListWeight,
+		"dnsbl_weight":     cfg.URLChecker.DNSBLWeight,
+	} {
+		if weight < 1 {
+			errs = append(errs, fmt.Errorf("url_checker.%s: should be positive", key))
+		}
+	}
+
+	if cfg.URLChecker.ScanTimeout <= 0 {
+		errs = append(errs, errors.New("url_checker.scan_timeout: should be positive"))
+	}
+
+	if cfg.ScanWorkers > 0 && cfg.ScanThreshold < 1 {
+		errs = append(errs, errors.New("scanner.threshold: should be positive"))
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,108 @@
+package config_test
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-batteries/shortner/app/config"
+)
+
+func Test_LoaderLayers(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "shortner.toml")
+
+	err := os.WriteFile(path, []byte(`
+[server]
+port = "8000"
+rate_limit = 20
+rate_limit_window = "30s"
+
+[shards]
+key_ranges = ["a-m", "n-z"]
+
+[seed.starts]
+a-m = 1000
+n-z = 2000
+
+[url_checker]
+max_url_length = 120
+`), 0644)
+	if err != nil {
+		t.Fatalf("failed to write config %v", err)
+	}
+
+	t.Setenv("PORT", "")
+	t.Setenv("SHORTNER_SERVER_RATE_LIMIT", "30")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	loader := config.NewLoader(fs)
+
+	if err := fs.Parse([]string{"-config", path, "-server.rate_limit", "40", "seed"}); err != nil {
+		t.Fatalf("failed to parse flags %v", err)
+	}
+
+	cfg, err := loader.Load()
+	if err != nil {
+		t.Fatalf("failed to load config %v", err)
+	}
+
+	if cfg.AppPort != "8000" || cfg.DomainName != "http://localhost:8000" {
+		t.Fatalf("expected the port from the file, got %s %s", cfg.AppPort, cfg.DomainName)
+	}
+
+	if cfg.RateLimit != 40 || cfg.RateLimitWindow != 30*time.Second {
+		t.Fatalf("expected the flag to win over env and file, got %d %s", cfg.RateLimit, cfg.RateLimitWindow)
+	}
+
+	if strings.Join(cfg.KeyRanges, ",") != "a-m,n-z" || cfg.SeedStarts["n-z"] != 2000 {
+		t.Fatalf("expected key ranges from the file, got %v %v", cfg.KeyRanges, cfg.SeedStarts)
+	}
+
+	if cfg.URLChecker.MaxURLLength != 120 || !cfg.URLChecker.CheckSSL {
+		t.Fatalf("expected url checker defaults to be kept, got %+v", cfg.URLChecker)
+	}
+
+	if fs.Arg(0) != "seed" {
+		t.Fatalf("expected the command to be left in args, got %v", fs.Args())
+	}
+
+	out := &bytes.Buffer{}
+	if err := config.Print(out, cfg, config.PrintFormatTOML); err != nil {
+		t.Fatalf("failed to print config %v", err)
+	}
+
+	if !strings.Contains(out.String(), `rate_limit_window = "30s"`) {
+		t.Fatalf("expected printed config to have the window, got\n%s", out.String())
+	}
+}
+
+func Test_LoaderValidation(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	loader := config.NewLoader(fs)
+
+	err := fs.Parse([]string{
+		"-shards.key_ranges", "a-m,k-z",
+		"-store.driver", "postgres",
+		"-shards.replicas", "a-m=replica_a_m.db",
+		"-changelog.dest", "/tmp/changelog",
+	})
+	if err != nil {
+		t.Fatalf("failed to parse flags %v", err)
+	}
+
+	_, err = loader.Load()
+	if err == nil {
+		t.Fatalf("expected overlapping key ranges, a missing dsn and the shard only settings with postgres to fail")
+	}
+
+	for _, key := range []string{"shards.key_ranges", "store.dsn", "seed.starts", "shards.replicas: the links", "changelog.dest"} {
+		if !strings.Contains(err.Error(), key) {
+			t.Errorf("expected an error for %s, got %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package config
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// ReputationProvider knows of bad urls from elsewhere, like a
+// blocklist. Lookup returns why the url is bad, nothing if it isn't
+// known to be. A provider which can't tell, like a blocklist that's
+// down, returns nothing too, so that it doesn't flag every url.
+//
+// Remote providers talk to other hosts, they are looked up by ScanURL,
+// in the background. The others are looked up inline, by ValidateURL.
+type ReputationProvider interface {
+	Name() string
+	Remote() bool
+	Lookup(ctx context.Context, u *url.URL) []string
+}
+
+// readListFile returns the lines of the file, without the
+// blank lines and the # comments.
+func readListFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lines := []string{}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines, scanner.Err()
+}
+
+// BlocklistProvider matches the urls against a list of domains, and
+// patterns. A domain blocks its subdomains too. A line starting with
+// re: is a regular expression, matched against the whole url.
+type BlocklistProvider struct {
+	domains  map[string]bool
+	patterns []*regexp.Regexp
+}
+
+func LoadBlocklistProvider(path string) (*BlocklistProvider, error) {
+	lines, err := readListFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blocklist %s. %w", path, err)
+	}
+
+	p := &BlocklistProvider{domains: map[string]bool{}}
+
+	for i, line := range lines {
+		pattern, ok := strings.CutPrefix(line, "re:")
+		if !ok {
+			p.domains[strings.TrimSuffix(strings.ToLower(line), ".")] = true
+			continue
+		}
+
+		re, err := regexp.Compile(strings.TrimSpace(pattern))
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern in blocklist %s, entry %d. %w", path, i+1, err)
+		}
+
+		p.patterns = append(p.patterns, re)
+	}
+
+	return p, nil
+}
+
+func (p *BlocklistProvider) Name() string { return "blocklist" }
+func (p *BlocklistProvider) Remote() bool { return false }
+
+func (p *BlocklistProvider) Lookup(ctx context.Context, u *url.URL) []string {
+	issues := []string{}
+
+	for _, domain := range parentDomains(u.Hostname()) {
+		if p.domains[domain] {
+			issues = append(issues, fmt.Sprintf("domain %s is blocklisted", domain))
+			break
+		}
+	}
+
+	for _, re := range p.patterns {
+		if re.MatchString(u.String()) {
+			issues = append(issues, fmt.Sprintf("url matches blocklisted pattern %s", re))
+			break
+		}
+	}
+
+	return issues
+}
+
+// parentDomains returns the host, and the domains it's under, down
+// to the last two labels. a.b.example.com is a.b.example.com,
+// b.example.com and example.com. An ip is returned as is.
+func parentDomains(host string) []string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	if net.ParseIP(host) != nil {
+		return []string{host}
+	}
+
+	labels := strings.Split(host, ".")
+	domains := []string{}
+
+	for i := 0; i < len(labels)-1 || i == 0; i++ {
+		domains = append(domains, strings.Join(labels[i:], "."))
+	}
+
+	return domains
+}
+
+// HashListProvider works like a safe browsing list. The list has the
+// hex prefixes of the sha256 of the bad url expressions, host and path
+// like evil.example.com/login/, and the url is looked up by the hashes
+// of its expressions. A prefix can be of 4 to 32 bytes, a full hash
+// matches only its expression, shorter ones may match others too.
+type HashListProvider struct {
+	prefixes map[string]bool
+	lengths  []int
+}
+
+func LoadHashListProvider(path string) (*HashListProvider, error) {
+	lines, err := readListFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hash list %s. %w", path, err)
+	}
+
+	p := &HashListProvider{prefixes: map[string]bool{}}
+	seen := map[int]bool{}
+
+	for i, line := range lines {
+		prefix, err := hex.DecodeString(line)
+		if err != nil || len(prefix) < 4 || len(prefix) > sha256.Size {
+			return nil, fmt.Errorf("invalid hash prefix in %s, entry %d. expected 4 to 32 hex bytes", path, i+1)
+		}
+
+		p.prefixes[string(prefix)] = true
+
+		if !seen[len(prefix)] {
+			seen[len(prefix)] = true
+			p.lengths = append(p.lengths, len(prefix))
+		}
+	}
+
+	return p, nil
+}
+
+func (p *HashListProvider) Name() string { return "hash_list" }
+func (p *HashListProvider) Remote() bool { return false }
+
+func (p *HashListProvider) Lookup(ctx context.Context, u *url.URL) []string {
+	for _, expression := range URLExpressions(u) {
+		hash := sha256.Sum256([]byte(expression))
+
+		for _, n := range p.lengths {
+			if p.prefixes[string(hash[:n])] {
+				return []string{fmt.Sprintf("%s is on the hash list", expression)}
+			}
+		}
+	}
+
+	return nil
+}
+
+// URLExpressions are the host and path combinations the url is looked
+// up by, in a hash list. They're a simpler take on the ones of safe
+// browsing, the host and the domains it's under, by the path with and
+// without the query, and the first directories of it.
+func URLExpressions(u *url.URL) []string {
+	hosts := parentDomains(u.Hostname())
+	if len(hosts) > 5 {
+		hosts = append(hosts[:1], hosts[len(hosts)-4:]...)
+	}
+
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	paths := []string{}
+	if u.RawQuery != "" {
+		paths = append(paths, path+"?"+u.RawQuery)
+	}
+
+	paths = append(paths, path)
+
+	dirs := strings.Split(strings.Trim(path, "/"), "/")
+	prefix := "/"
+
+	for i := 0; i < len(dirs) && i < 4; i++ {
+		if prefix != path {
+			paths = append(paths, prefix)
+		}
+
+		prefix += dirs[i] + "/"
+	}
+
+	expressions := []string{}
+	seen := map[string]bool{}
+
+	for _, host := range hosts {
+		for _, p := range paths {
+			expression := host + p
+			if !seen[expression] {
+				seen[expression] = true
+				expressions = append(expressions, expression)
+			}
+		}
+	}
+
+	return expressions
+}
+
+// HostResolver is the part of net.Resolver the dns blocklists need
+type HostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// StaticResolver answers from a hosts file, in place of a dns server.
+// It stands in for the blocklist zones, for tests and local runs.
+type StaticResolver struct {
+	hosts map[string][]string
+}
+
+// LoadStaticResolver reads lines of an address, and the names
+// resolving to it, like /etc/hosts.
+func LoadStaticResolver(path string) (*StaticResolver, error) {
+	lines, err := readListFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read hosts %s. %w", path, err)
+	}
+
+	r := &StaticResolver{hosts: map[string][]string{}}
+
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+			return nil, fmt.Errorf("invalid entry in hosts %s, entry %d. expected an address and names", path, i+1)
+		}
+
+		for _, name := range fields[1:] {
+			name = strings.TrimSuffix(strings.ToLower(name), ".")
+			r.hosts[name] = append(r.hosts[name], fields[0])
+		}
+	}
+
+	return r, nil
+}
+
+func (r *StaticResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	addrs, ok := r.hosts[strings.TrimSuffix(strings.ToLower(host), ".")]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	return addrs, nil
+}
+
+// DNSBLProvider looks the urls up in dns blocklists. A domain is
+// looked up as domain.zone, and so are the domains it's under. An ip
+// is looked up with its octets reversed, like 4.3.2.1.zone for 1.2.3.4.
+// It's listed, if the answer is in 127.0.0.0/8, except 127.255.255.0/24,
+// which the lists answer with, when they refuse the query.
+type DNSBLProvider struct {
+	zones    []string
+	resolver HostResolver
+}
+
+func NewDNSBLProvider(zones []string, resolver HostResolver) *DNSBLProvider {
+	return &DNSBLProvider{zones: zones, resolver: resolver}
+}
+
+func (p *DNSBLProvider) Name() string { return "dnsbl" }
+func (p *DNSBLProvider) Remote() bool { return true }
+
+func (p *DNSBLProvider) Lookup(ctx context.Context, u *url.URL) []string {
+	names := parentDomains(u.Hostname())
+
+	if ip := net.ParseIP(u.Hostname()).To4(); ip != nil {
+		names = []string{fmt.Sprintf("%d.%d.%d.%d", ip[3], ip[2], ip[1], ip[0])}
+	}
+
+	issues := []string{}
+
+	for _, zone := range p.zones {
+		for _, name := range names {
+			if p.listed(ctx, name+"."+strings.Trim(zone, ".")) {
+				issues = append(issues, fmt.Sprintf("%s is listed on %s", name, zone))
+				break
+			}
+		}
+	}
+
+	return issues
+}
+
+func (p *DNSBLProvider) listed(ctx context.Context, query string) bool {
+	addrs, err := p.resolver.LookupHost(ctx, query)
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr).To4()
+		if ip != nil && ip[0] == 127 && !(ip[1] == 255 && ip[2] == 255) {
+			return true
+		}
+	}
+
+	return false
+}
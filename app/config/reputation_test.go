@@ -0,0 +1,89 @@
+package config_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-batteries/shortner/app/config"
+)
+
+func writeList(t *testing.T, dir string, name string, lines ...string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		t.Fatalf("failed to write %s %v", name, err)
+	}
+
+	return path
+}
+
+func Test_ReputationProviders(t *testing.T) {
+	dir := t.TempDir()
+	hash := sha256.Sum256([]byte("phish.example.org/login/"))
+
+	opts := config.DefaultOptions()
+	opts.CheckLength = false
+	opts.CheckSSL = false
+	opts.BlocklistPath = writeList(t, dir, "blocklist.txt",
+		"# known bad",
+		"evil.example.com",
+		"re: ^https?://[^/]+/wp-admin/.*\\.zip$",
+	)
+	opts.HashListPath = writeList(t, dir, "hashes.txt", hex.EncodeToString(hash[:4]))
+	opts.DNSBLZones = []string{"dbl.test"}
+	opts.DNSBLHostsPath = writeList(t, dir, "hosts",
+		"127.0.1.2 spam.example.net.dbl.test",
+		"127.255.255.254 example.io.dbl.test",
+	)
+
+	checker, err := config.LoadURLChecker(opts)
+	if err != nil {
+		t.Fatalf("failed to load checker %v", err)
+	}
+
+	for _, tc := range []struct {
+		url   string
+		score int
+	}{
+		{url: "https://github.com/go-batteries", score: 0},
+		{url: "https://cdn.evil.example.com/a", score: opts.BlocklistWeight},
+		{url: "https://notevil.example.com/a", score: 0},
+		{url: "https://blog.example.net/wp-admin/x.zip", score: opts.BlocklistWeight},
+		{url: "https://m.phish.example.org/login/verify?id=1", score: opts.HashListWeight},
+		{url: "https://phish.example.org/logout", score: 0},
+	} {
+		issues, err := checker.ValidateURL(tc.url)
+		if err != nil || checker.Score(issues) != tc.score {
+			t.Fatalf("expected %s to score %d, got %v. %v", tc.url, tc.score, issues, err)
+		}
+	}
+
+	// the dns blocklist is remote, it's only asked by the scan
+	if issues, _ := checker.ValidateURL("https://www.spam.example.net"); len(issues) != 0 {
+		t.Fatalf("expected no inline issues, got %v", issues)
+	}
+
+	issues, err := checker.ScanURL("https://www.spam.example.net")
+	if err != nil || checker.Score(issues) != opts.DNSBLWeight || issues[0].Provider != "dnsbl" {
+		t.Fatalf("expected the parent domain to be listed, got %v. %v", issues, err)
+	}
+
+	if issues, _ := checker.ScanURL("https://example.io"); len(issues) != 0 {
+		t.Fatalf("expected a refused query to not list, got %v", issues)
+	}
+
+	// a single hit of the local lists is enough to reject the url
+	if opts.BlocklistWeight <= config.CutoffMaxIssues || opts.HashListWeight <= config.CutoffMaxIssues {
+		t.Fatalf("expected the list weights to be over the cutoff, got %+v", opts)
+	}
+
+	opts.BlocklistPath = writeList(t, dir, "broken.txt", "re: ([a-z")
+	if _, err := config.LoadURLChecker(opts); err == nil {
+		t.Fatalf("expected an invalid pattern to fail the load")
+	}
+}
@@ -1,9 +1,11 @@
 package config
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"net"
 	"net/url"
 	"regexp"
 	"strings"
@@ -15,25 +17,44 @@ import (
 
 // Options struct to enable or disable specific heuristics
 type URLCheckerOptions struct {
-	CheckLength             bool
-	CheckCharToNumberRatio  bool
-	CheckSpecialCharCount   bool
-	CheckIPBasedURL         bool
-	CheckSuspiciousKeywords bool
-	CheckSubdomainCount     bool
-	CheckDomainAge          bool
-	MaxURLLength            int
-	MaxSubdomains           int
-	MaxCharToNumberRatio    float64
-	MaxSpecialCharCount     int
-	Keywords                []string
-	MinDomainAgeDays        int
-	CheckSSL                bool
+	CheckLength             bool     `cfg:"check_length"`
+	CheckCharToNumberRatio  bool     `cfg:"check_char_to_number_ratio"`
+	CheckSpecialCharCount   bool     `cfg:"check_special_char_count"`
+	CheckIPBasedURL         bool     `cfg:"check_ip_based_url"`
+	CheckSuspiciousKeywords bool     `cfg:"check_suspicious_keywords"`
+	CheckSubdomainCount     bool     `cfg:"check_subdomain_count"`
+	CheckDomainAge          bool     `cfg:"check_domain_age"`
+	MaxURLLength            int      `cfg:"max_url_length"`
+	MaxSubdomains           int      `cfg:"max_subdomains"`
+	MaxCharToNumberRatio    float64  `cfg:"max_char_to_number_ratio"`
+	MaxSpecialCharCount     int      `cfg:"max_special_char_count"`
+	Keywords                []string `cfg:"keywords"`
+	MinDomainAgeDays        int      `cfg:"min_domain_age_days"`
+	CheckSSL                bool     `cfg:"check_ssl"`
+
+	// ScanTimeout bounds each of the network checks of ScanURL,
+	// the tls dial and the whois lookup.
+	ScanTimeout time.Duration `cfg:"scan_timeout"`
+
+	// The reputation providers, see reputation.go. An empty path, or
+	// no zones, leaves the provider out. An issue found by a provider
+	// weighs what it's configured to, the others weigh 1.
+	BlocklistPath   string   `cfg:"blocklist_path"`
+	BlocklistWeight int      `cfg:"blocklist_weight"`
+	HashListPath    string   `cfg:"hash_list_path"`
+	HashListWeight  int      `cfg:"hash_list_weight"`
+	DNSBLZones      []string `cfg:"dnsbl_zones"`
+	DNSBLWeight     int      `cfg:"dnsbl_weight"`
+	// DNSBLHostsPath is a hosts file, answering the dnsbl
+	// queries in place of dns. Empty uses the system resolver.
+	DNSBLHostsPath string `cfg:"dnsbl_hosts_path"`
 }
 
 // URLChecker contains the options and rules
 type URLChecker struct {
-	options *URLCheckerOptions
+	options   *URLCheckerOptions
+	providers []ReputationProvider
+	weights   map[string]int
 }
 
 // DefaultOptions provides default thresholds
@@ -53,6 +74,10 @@ func DefaultOptions() *URLCheckerOptions {
 		Keywords:                []string{"free", "win", "offer", "prize", "localhost"},
 		MinDomainAgeDays:        30,
 		CheckSSL:                true,
+		ScanTimeout:             5 * time.Second,
+		BlocklistWeight:         CutoffMaxIssues + 1,
+		HashListWeight:          CutoffMaxIssues + 1,
+		DNSBLWeight:             2,
 	}
 }
 
@@ -71,32 +96,142 @@ func WithCheckLength(check bool) WithOpts {
 }
 
 func NewURLChecker(opts *URLCheckerOptions) *URLChecker {
-	return &URLChecker{options: opts}
+	return &URLChecker{options: opts, weights: map[string]int{}}
 }
 
-// ValidateURL applies all selected checks to a given URL
-func (checker URLChecker) ValidateURL(inputURL string) ([]string, error) {
-	parsed, err := url.Parse(inputURL)
-	if err != nil {
-		return []string{"Invalid URL format"}, errors.New("fuck him")
+// LoadURLChecker is NewURLChecker, with the reputation
+// providers of opts loaded from their files.
+func LoadURLChecker(opts *URLCheckerOptions) (*URLChecker, error) {
+	checker := NewURLChecker(opts)
+
+	if opts.BlocklistPath != "" {
+		p, err := LoadBlocklistProvider(opts.BlocklistPath)
+		if err != nil {
+			return nil, err
+		}
+
+		checker.AddProvider(p, opts.BlocklistWeight)
 	}
 
-	if parsed.Hostname() == "" || parsed.Scheme == "" {
-		return []string{"Invalid URL format"}, errors.New("fuck golang, invalid url")
+	if opts.HashListPath != "" {
+		p, err := LoadHashListProvider(opts.HashListPath)
+		if err != nil {
+			return nil, err
+		}
+
+		checker.AddProvider(p, opts.HashListWeight)
 	}
 
-	var issues []string
+	if len(opts.DNSBLZones) > 0 {
+		var resolver HostResolver = net.DefaultResolver
+
+		if opts.DNSBLHostsPath != "" {
+			r, err := LoadStaticResolver(opts.DNSBLHostsPath)
+			if err != nil {
+				return nil, err
+			}
+
+			resolver = r
+		}
+
+		checker.AddProvider(NewDNSBLProvider(opts.DNSBLZones, resolver), opts.DNSBLWeight)
+	}
+
+	return checker, nil
+}
+
+// AddProvider adds a reputation provider, the issues it finds weigh
+// weight each. The names of the providers are expected to be unique.
+func (checker *URLChecker) AddProvider(provider ReputationProvider, weight int) {
+	checker.providers = append(checker.providers, provider)
+	checker.weights[provider.Name()] = weight
+}
+
+// Issue is a problem found with a url. Provider is the reputation
+// provider which found it, empty for the checks of the checker.
+type Issue struct {
+	Reason   string `json:"reason"`
+	Provider string `json:"provider,omitempty"`
+	Weight   int    `json:"weight"`
+}
+
+func (issue Issue) String() string {
+	if issue.Provider == "" {
+		return issue.Reason
+	}
+
+	return issue.Provider + ": " + issue.Reason
+}
+
+// IssueStrings is the issues, as they are logged
+func IssueStrings(issues []Issue) []string {
+	reasons := make([]string, 0, len(issues))
+
+	for _, issue := range issues {
+		reasons = append(reasons, issue.String())
+	}
+
+	return reasons
+}
+
+// checkIssue is an issue found by the checks of the checker, they weigh 1
+func checkIssue(format string, args ...any) Issue {
+	return Issue{Reason: fmt.Sprintf(format, args...), Weight: 1}
+}
+
+// Score is the weight of the issues, to compare with CutoffMaxIssues
+func (checker URLChecker) Score(issues []Issue) int {
+	score := 0
+
+	for _, issue := range issues {
+		score += issue.Weight
+	}
+
+	return score
+}
+
+// lookup asks the providers, remote or not, about the url
+func (checker URLChecker) lookup(ctx context.Context, parsed *url.URL, remote bool) []Issue {
+	var issues []Issue
+
+	for _, provider := range checker.providers {
+		if provider.Remote() != remote {
+			continue
+		}
+
+		for _, reason := range provider.Lookup(ctx, parsed) {
+			issues = append(issues, Issue{
+				Reason:   reason,
+				Provider: provider.Name(),
+				Weight:   checker.weights[provider.Name()],
+			})
+		}
+	}
+
+	return issues
+}
+
+// ValidateURL applies the lexical checks, and the local reputation
+// providers, to a given URL. They don't leave the process, so they
+// run inline, when links are created. The network checks are in ScanURL.
+func (checker URLChecker) ValidateURL(inputURL string) ([]Issue, error) {
+	parsed, err := parseURL(inputURL)
+	if err != nil {
+		return []Issue{checkIssue("Invalid URL format")}, err
+	}
+
+	var issues []Issue
 
 	// Check URL Length
 	if checker.options.CheckLength && len(inputURL) > checker.options.MaxURLLength {
-		issues = append(issues, fmt.Sprintf("URL is too long: %d characters", len(inputURL)))
+		issues = append(issues, checkIssue("URL is too long: %d characters", len(inputURL)))
 	}
 
 	// Check Char-to-Number Ratio
 	if checker.options.CheckCharToNumberRatio {
 		ratio := charToNumberRatio(parsed.Host)
 		if ratio > checker.options.MaxCharToNumberRatio {
-			issues = append(issues, fmt.Sprintf("Character-to-number ratio is too high: %.2f", ratio))
+			issues = append(issues, checkIssue("Character-to-number ratio is too high: %.2f", ratio))
 		}
 	}
 
@@ -104,66 +239,101 @@ func (checker URLChecker) ValidateURL(inputURL string) ([]string, error) {
 	if checker.options.CheckSpecialCharCount {
 		specialCharCount := countSpecialCharacters(inputURL)
 		if specialCharCount > checker.options.MaxSpecialCharCount {
-			issues = append(issues, fmt.Sprintf("Excessive special characters: %d", specialCharCount))
+			issues = append(issues, checkIssue("Excessive special characters: %d", specialCharCount))
 		}
 	}
 
 	// Check for IP-Based URL
 	if checker.options.CheckIPBasedURL && isIPBasedURL(parsed.Host) {
-		issues = append(issues, "URL uses an IP address instead of a domain name")
+		issues = append(issues, checkIssue("URL uses an IP address instead of a domain name"))
 	}
 
 	// Check for Suspicious Keywords
 	if checker.options.CheckSuspiciousKeywords && containsKeywords(parsed.Host+parsed.Path, checker.options.Keywords) {
-		issues = append(issues, "URL contains suspicious keywords")
+		issues = append(issues, checkIssue("URL contains suspicious keywords"))
 	}
 
 	// Check Subdomain Count
 	if checker.options.CheckSubdomainCount {
 		subdomainCount := countSubdomains(parsed.Host)
 		if subdomainCount > checker.options.MaxSubdomains {
-			issues = append(issues, fmt.Sprintf("Too many subdomains: %d", subdomainCount))
+			issues = append(issues, checkIssue("Too many subdomains: %d", subdomainCount))
 		}
 	}
 
+	issues = append(issues, checker.lookup(context.Background(), parsed, false)...)
+
+	return issues, nil
+}
+
+// ScanURL applies the checks which talk to other hosts, the domain age,
+// the ssl certificate and the remote reputation providers. A slow host
+// holds it up to ScanTimeout per check, so it runs in the background,
+// after the link is created.
+func (checker URLChecker) ScanURL(inputURL string) ([]Issue, error) {
+	parsed, err := parseURL(inputURL)
+	if err != nil {
+		return []Issue{checkIssue("Invalid URL format")}, err
+	}
+
+	var issues []Issue
+
 	// Check Domain Age (WHOIS required)
 	if checker.options.CheckDomainAge {
-		whoisInfo, err := getWHOISInfo(parsed.Hostname())
+		whoisInfo, err := getWHOISInfo(parsed.Hostname(), checker.options.ScanTimeout)
 
 		if err != nil {
-			issues = append(issues, fmt.Sprintf("WHOIS error: %v", err))
+			issues = append(issues, checkIssue("WHOIS error: %v", err))
 		} else {
 			if whoisInfo.DomainAgeDays < checker.options.MinDomainAgeDays {
-				issues = append(issues, fmt.Sprintf("Domain is too new: %d days old", whoisInfo.DomainAgeDays))
+				issues = append(issues, checkIssue("Domain is too new: %d days old", whoisInfo.DomainAgeDays))
 			}
 			if time.Until(whoisInfo.ExpirationDate).Hours() < 30*24 {
-				issues = append(issues, "Domain expires in less than 30 days")
+				issues = append(issues, checkIssue("Domain expires in less than 30 days"))
 			}
 		}
 	}
 
 	if checker.options.CheckSSL {
-		sslInfo, err := validateSSL(parsed.Hostname())
+		sslInfo, err := validateSSL(parsed.Hostname(), checker.options.ScanTimeout)
 		if err != nil {
-			issues = append(issues, fmt.Sprintf("SSL error: %v", err))
+			issues = append(issues, checkIssue("SSL error: %v", err))
 		} else {
 			if !sslInfo.IsValid {
-				issues = append(issues, "SSL certificate is not valid")
+				issues = append(issues, checkIssue("SSL certificate is not valid"))
 			}
 			if !sslInfo.HostnameMatch {
-				issues = append(issues, "SSL certificate hostname does not match")
+				issues = append(issues, checkIssue("SSL certificate hostname does not match"))
 			}
 			if sslInfo.ExpirationDays < 30 {
-				issues = append(issues, fmt.Sprintf("SSL certificate expires in %d days", sslInfo.ExpirationDays))
+				issues = append(issues, checkIssue("SSL certificate expires in %d days", sslInfo.ExpirationDays))
 			}
 		}
 	}
 
+	ctx, cancel := context.WithTimeout(context.Background(), checker.options.ScanTimeout)
+	defer cancel()
+
+	issues = append(issues, checker.lookup(ctx, parsed, true)...)
+
 	return issues, nil
 }
 
 // Helper Functions
 
+func parseURL(inputURL string) (*url.URL, error) {
+	parsed, err := url.Parse(inputURL)
+	if err != nil {
+		return nil, errors.New("invalid url")
+	}
+
+	if parsed.Hostname() == "" || parsed.Scheme == "" {
+		return nil, errors.New("invalid url, expected a scheme and a host")
+	}
+
+	return parsed, nil
+}
+
 // charToNumberRatio calculates the ratio of characters to numbers in a string
 func charToNumberRatio(s string) float64 {
 	numDigits := 0
@@ -218,9 +388,9 @@ type WHOISInfo struct {
 	DomainAgeDays  int
 }
 
-func getWHOISInfo(domain string) (*WHOISInfo, error) {
+func getWHOISInfo(domain string, timeout time.Duration) (*WHOISInfo, error) {
 	// Perform WHOIS query
-	rawWhois, err := whois.Whois(domain)
+	rawWhois, err := whois.NewClient().SetTimeout(timeout).Whois(domain)
 	if err != nil {
 		return nil, fmt.Errorf("failed to fetch WHOIS data: %v", err)
 	}
@@ -263,8 +433,8 @@ type SSLInfo struct {
 }
 
 // validateSSL checks the SSL certificate for a given hostname
-func validateSSL(hostname string) (*SSLInfo, error) {
-	conn, err := tls.Dial("tcp", hostname+":443", nil)
+func validateSSL(hostname string, timeout time.Duration) (*SSLInfo, error) {
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", hostname+":443", nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to %s: %v", hostname, err)
 	}
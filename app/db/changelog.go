@@ -0,0 +1,79 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	ChangeOpUpsert = "upsert"
+	ChangeOpDelete = "delete"
+)
+
+// ChangelogColumns are the columns of urls captured in the changelog.
+// They should be kept in sync with CREATE_TABLE_QUERY, the triggers
+// are recreated by MigrateShards, so a new column is picked up there.
+// leased_until is left out, the leases are local to a server, and so
+// are scanned_at and scan_score, the scans are redone after a restore.
+var ChangelogColumns = []string{
+	"url",
+	"short_key",
+	"malicious",
+	"generation",
+	"vanity",
+	"created_at",
+	"updated_at",
+	"deleted_at",
+	"expires_at",
+	"url_hash",
+	"owner_id",
+}
+
+// changedAtExpr is the time of the change, in unix milliseconds
+const changedAtExpr = `CAST(unixepoch('subsec') * 1000 AS INTEGER)`
+
+const DropChangelogTriggersQuery = `
+DROP TRIGGER IF EXISTS changelog_urls_insert;
+DROP TRIGGER IF EXISTS changelog_urls_update;
+DROP TRIGGER IF EXISTS changelog_urls_delete;
+`
+
+// ChangelogTriggersQuery records every write to urls in the changelog,
+// in the transaction of the write. Inserts and updates are recorded
+// with the whole row, so replaying them doesn't depend on what the
+// row was before.
+func ChangelogTriggersQuery() string {
+	pairs := make([]string, 0, len(ChangelogColumns))
+	for _, column := range ChangelogColumns {
+		pairs = append(pairs, fmt.Sprintf("'%s', NEW.%s", column, column))
+	}
+
+	data := fmt.Sprintf("json_object(%s)", strings.Join(pairs, ", "))
+
+	var query strings.Builder
+	query.WriteString(DropChangelogTriggersQuery)
+
+	// updates of the other columns, like the key leases, aren't captured,
+	// nor are the free keys seeded, else the changelog grows with the key
+	// pool. A key is captured once it's handed out, with the whole row.
+	events := map[string]string{
+		"insert": "INSERT ON urls WHEN NEW.url IS NOT NULL",
+		"update": "UPDATE OF " + strings.Join(ChangelogColumns, ", ") + " ON urls",
+	}
+
+	for _, event := range []string{"insert", "update"} {
+		fmt.Fprintf(&query, `
+CREATE TRIGGER changelog_urls_%s AFTER %s BEGIN
+	INSERT INTO changelog (op, short_key, data, changed_at) VALUES ('%s', NEW.short_key, %s, %s);
+END;
+`, event, events[event], ChangeOpUpsert, data, changedAtExpr)
+	}
+
+	fmt.Fprintf(&query, `
+CREATE TRIGGER changelog_urls_delete AFTER DELETE ON urls BEGIN
+	INSERT INTO changelog (op, short_key, data, changed_at) VALUES ('%s', OLD.short_key, NULL, %s);
+END;
+`, ChangeOpDelete, changedAtExpr)
+
+	return query.String()
+}
@@ -0,0 +1,50 @@
+//go:build unix
+
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+var ErrLocked = errors.New("locked")
+
+// FileLock is an advisory lock on a file next to the dbs. The servers
+// hold it shared while they have the shards open, the tools which
+// replace the files take it exclusive, so they can't while a server
+// is running. The lock goes away with the process.
+type FileLock struct {
+	file *os.File
+}
+
+// LockFile takes the lock without waiting,
+// ErrLocked is returned if it's held.
+func LockFile(path string, exclusive bool) (*FileLock, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+
+	if err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB); err != nil {
+		file.Close()
+
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%w. %s", ErrLocked, path)
+		}
+
+		return nil, err
+	}
+
+	return &FileLock{file: file}, nil
+}
+
+func (l *FileLock) Unlock() error {
+	return l.file.Close()
+}
@@ -0,0 +1,29 @@
+//go:build !unix
+
+package db
+
+import (
+	"errors"
+	"os"
+)
+
+var ErrLocked = errors.New("locked")
+
+// FileLock only creates the file on the platforms without flock,
+// nothing is locked. Stop the servers before replacing the files.
+type FileLock struct {
+	file *os.File
+}
+
+func LockFile(path string, exclusive bool) (*FileLock, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileLock{file: file}, nil
+}
+
+func (l *FileLock) Unlock() error {
+	return l.file.Close()
+}
@@ -0,0 +1,42 @@
+//go:build unix
+
+package db_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-batteries/shortner/app/db"
+)
+
+func Test_LockFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "db_shard_coordinator.db.lock")
+
+	first, err := db.LockFile(path, false)
+	if err != nil {
+		t.Fatalf("failed to take shared lock %v", err)
+	}
+
+	second, err := db.LockFile(path, false)
+	if err != nil {
+		t.Fatalf("expected servers to share the lock, got %v", err)
+	}
+
+	if _, err := db.LockFile(path, true); !errors.Is(err, db.ErrLocked) {
+		t.Fatalf("expected the exclusive lock to fail while shared, got %v", err)
+	}
+
+	first.Unlock()
+	second.Unlock()
+
+	exclusive, err := db.LockFile(path, true)
+	if err != nil {
+		t.Fatalf("expected the exclusive lock once released, got %v", err)
+	}
+	defer exclusive.Unlock()
+
+	if _, err := db.LockFile(path, false); !errors.Is(err, db.ErrLocked) {
+		t.Fatalf("expected the shared lock to fail while exclusive, got %v", err)
+	}
+}
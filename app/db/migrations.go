@@ -0,0 +1,106 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// ColumnMigration adds a column to a table, if it is missing.
+// sqlite doesn't have ADD COLUMN IF NOT EXISTS.
+type ColumnMigration struct {
+	Table      string
+	Column     string
+	Definition string
+}
+
+const TableColumnExistsQuery = `SELECT COUNT(1) FROM pragma_table_info(?) WHERE name = ?`
+
+func (m ColumnMigration) Apply(ctx context.Context, conn *sql.DB) error {
+	var count int
+
+	row := conn.QueryRowContext(ctx, TableColumnExistsQuery, m.Table, m.Column)
+	if err := row.Scan(&count); err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return nil
+	}
+
+	_, err := conn.ExecContext(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", m.Table, m.Column, m.Definition))
+	return err
+}
+
+// UniqueIndexMigration makes an index unique, if it's missing or
+// isn't. sqlite can't alter an index, so it's dropped and created
+// again, which fails if the table has duplicates already.
+type UniqueIndexMigration struct {
+	Table   string
+	Index   string
+	Columns string
+}
+
+const UniqueIndexExistsQuery = `SELECT COUNT(1) FROM pragma_index_list(?) WHERE name = ? AND "unique" = 1`
+
+func (m UniqueIndexMigration) Apply(ctx context.Context, conn *sql.DB) error {
+	var count int
+
+	row := conn.QueryRowContext(ctx, UniqueIndexExistsQuery, m.Table, m.Index)
+	if err := row.Scan(&count); err != nil {
+		return err
+	}
+
+	if count > 0 {
+		return nil
+	}
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("DROP INDEX IF EXISTS %s", m.Index)); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf("CREATE UNIQUE INDEX %s ON %s (%s)", m.Index, m.Table, m.Columns)); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("%s has duplicate %s. %v", m.Table, m.Columns, err)
+	}
+
+	return tx.Commit()
+}
+
+// URL_INDEX_MIGRATIONS should be kept in sync with CREATE_TABLE_QUERY.
+// A short key was only checked for, before it was written, so a
+// seeded key could be written twice, once as an alias.
+var URL_INDEX_MIGRATIONS = []UniqueIndexMigration{
+	{Table: "urls", Index: "idx_short_key", Columns: "short_key"},
+}
+
+// URL_COLUMN_MIGRATIONS should be kept in sync with CREATE_TABLE_QUERY.
+// New databases get the columns from the create statement,
+// older ones get them from here.
+var URL_COLUMN_MIGRATIONS = []ColumnMigration{
+	{Table: "urls", Column: "vanity", Definition: "INTEGER NOT NULL DEFAULT 0"},
+	{Table: "urls", Column: "expires_at", Definition: "TIMESTAMP"},
+	{Table: "urls", Column: "url_hash", Definition: "TEXT"},
+	{Table: "urls", Column: "owner_id", Definition: "TEXT"},
+	{Table: "urls", Column: "leased_until", Definition: "INTEGER"},
+	{Table: "urls", Column: "scanned_at", Definition: "TIMESTAMP"},
+	{Table: "urls", Column: "scan_score", Definition: "INTEGER"},
+}
+
+// COORDINATOR_COLUMN_MIGRATIONS, same as URL_COLUMN_MIGRATIONS,
+// for CREATE_SHARD_STATUS_QUERY.
+var COORDINATOR_COLUMN_MIGRATIONS = []ColumnMigration{
+	{Table: "shard_status", Column: "generation", Definition: "INTEGER NOT NULL DEFAULT 1"},
+}
+
+// MODERATION_COLUMN_MIGRATIONS, same as URL_COLUMN_MIGRATIONS, for
+// MIGRATE_COORDINATOR_QUERY. They are applied after it.
+var MODERATION_COLUMN_MIGRATIONS = []ColumnMigration{
+	{Table: "link_decisions", Column: "generation", Definition: "INTEGER"},
+}
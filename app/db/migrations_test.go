@@ -0,0 +1,54 @@
+package db_test
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-batteries/shortner/app/db"
+)
+
+func Test_UniqueIndexMigration(t *testing.T) {
+	ctx := context.Background()
+
+	conn, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "db_a_z.db"))
+	if err != nil {
+		t.Fatalf("failed to open db %v", err)
+	}
+	defer conn.Close()
+
+	// a shard from before the index was unique, with a key written twice
+	_, err = conn.ExecContext(ctx, `CREATE TABLE urls (url TEXT, short_key TEXT NOT NULL);
+		CREATE INDEX idx_short_key ON urls (short_key);
+		INSERT INTO urls (url, short_key) VALUES (NULL, 'a001'), ('https://github.com', 'a001'), (NULL, 'a002');`)
+	if err != nil {
+		t.Fatalf("failed to create old shard %v", err)
+	}
+
+	migration := db.URL_INDEX_MIGRATIONS[0]
+
+	if err := migration.Apply(ctx, conn); err == nil {
+		t.Fatalf("expected the duplicates to fail the migration")
+	}
+
+	// the old index is kept, when the migration fails
+	var indexes int
+	if err := conn.QueryRowContext(ctx, `SELECT COUNT(1) FROM pragma_index_list('urls') WHERE name = 'idx_short_key'`).Scan(&indexes); err != nil || indexes != 1 {
+		t.Fatalf("expected the old index to be rolled back, got %d. %v", indexes, err)
+	}
+
+	if _, err := conn.ExecContext(ctx, `DELETE FROM urls WHERE short_key = 'a001' AND url IS NULL`); err != nil {
+		t.Fatalf("failed to drop the duplicate %v", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := migration.Apply(ctx, conn); err != nil {
+			t.Fatalf("failed to migrate %v", err)
+		}
+	}
+
+	if _, err := conn.ExecContext(ctx, `INSERT INTO urls (url, short_key) VALUES (NULL, 'a002')`); err == nil {
+		t.Fatalf("expected the short key to be unique")
+	}
+}
@@ -1,12 +1,13 @@
 package db
 
 const CREATE_SHARD_STATUS_QUERY = `
-CREATE TABLE shard_status (
+CREATE TABLE IF NOT EXISTS shard_status (
     shard_id VARCHAR(255) NOT NULL,
     shard_char VARCHAR(255) NOT NULL,
     start INTEGER NOT NULL,
     end INTEGER NOT NULL,
     status TEXT NOT NULL,
+    generation INTEGER NOT NULL DEFAULT 1,
     created_at TIMESTAMP NOT NULL,
     updated_at TIMESTAMP NOT NULL,
     PRIMARY KEY (shard_id, shard_char)
@@ -21,18 +22,89 @@ PRAGMA mmap_size = 30000000000;
 PRAGMA journal_size_limit = 104857600;
 `
 
+// MIGRATE_COORDINATOR_QUERY holds the tables in the coordinator db,
+// which came after shard_status. Everything here needs to be idempotent.
+const MIGRATE_COORDINATOR_QUERY = `
+CREATE TABLE IF NOT EXISTS shard_topology (
+	key_range TEXT NOT NULL PRIMARY KEY,
+	db_path TEXT NOT NULL,
+	starts TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS accounts (
+	id TEXT NOT NULL PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE,
+	created_at TIMESTAMP NOT NULL,
+	updated_at TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+	id TEXT NOT NULL PRIMARY KEY,
+	key_hash TEXT NOT NULL UNIQUE,
+	account_id TEXT NOT NULL REFERENCES accounts(id),
+	scopes TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	revoked_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_api_keys_account_id ON api_keys (account_id);
+
+CREATE TABLE IF NOT EXISTS link_reports (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	short_key TEXT NOT NULL,
+	reason TEXT NOT NULL,
+	details TEXT,
+	reporter TEXT NOT NULL,
+	status TEXT NOT NULL DEFAULT 'pending',
+	decision_id INTEGER,
+	created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_link_reports_status ON link_reports (status, short_key);
+CREATE INDEX IF NOT EXISTS idx_link_reports_short_key ON link_reports (short_key);
+
+CREATE TABLE IF NOT EXISTS link_invalidations (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	short_key TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_link_invalidations_created_at ON link_invalidations (created_at);
+
+CREATE TABLE IF NOT EXISTS link_decisions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	short_key TEXT NOT NULL,
+	action TEXT NOT NULL,
+	note TEXT,
+	decided_by TEXT NOT NULL,
+	reports INTEGER NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	generation INTEGER
+);
+
+CREATE INDEX IF NOT EXISTS idx_link_decisions_short_key ON link_decisions (short_key);
+`
+
 const CREATE_TABLE_QUERY = `
 CREATE TABLE IF NOT EXISTS urls (
 	url TEXT DEFAULT NULL,
 	short_key TEXT NOT NULL,
 	malicious INTEGER DEFAULT NULL,
 	generation INTEGER NOT NULL DEFAULT 1,
+	vanity INTEGER NOT NULL DEFAULT 0,
 	created_at TIMESTAMP NOT NULL,
 	updated_at TIMESTAMP NOT NULL,
-	deleted_at TIMESTAMP 
+	deleted_at TIMESTAMP,
+	expires_at TIMESTAMP,
+	url_hash TEXT,
+	owner_id TEXT,
+	leased_until INTEGER,
+	scanned_at TIMESTAMP,
+	scan_score INTEGER
 );
 
-CREATE INDEX IF NOT EXISTS idx_short_key ON urls (short_key);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_short_key ON urls (short_key);
 CREATE INDEX IF NOT EXISTS idx_null_url ON urls(url) WHERE url is NULL;
 
 PRAGMA journal_mode=WAL;
@@ -45,6 +117,62 @@ PRAGMA journal_size_limit = 104857600;
 PRAGMA threads = 10
 `
 
+// MIGRATE_SHARD_QUERY runs after the column migrations,
+// so it can index the newly added columns.
+// Everything here needs to be idempotent.
+const MIGRATE_SHARD_QUERY = `
+CREATE INDEX IF NOT EXISTS idx_expires_at ON urls(expires_at) WHERE expires_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_url_hash ON urls(url_hash) WHERE url_hash IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_owner_short_key ON urls(owner_id, short_key) WHERE owner_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_deleted_at ON urls(deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_scanned_at ON urls(scanned_at) WHERE url IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS clicks (
+	short_key TEXT NOT NULL,
+	clicked_at TIMESTAMP NOT NULL,
+	referrer TEXT,
+	user_agent TEXT,
+	country TEXT
+);
+
+CREATE INDEX IF NOT EXISTS idx_clicks_short_key ON clicks (short_key, clicked_at);
+
+CREATE TABLE IF NOT EXISTS replica_heartbeat (
+	id INTEGER NOT NULL PRIMARY KEY CHECK (id = 1),
+	beat_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS changelog (
+	seq INTEGER PRIMARY KEY AUTOINCREMENT,
+	op TEXT NOT NULL,
+	short_key TEXT NOT NULL,
+	data TEXT,
+	changed_at INTEGER NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS changelog_state (
+	id INTEGER NOT NULL PRIMARY KEY CHECK (id = 1),
+	timeline TEXT NOT NULL,
+	shipped_seq INTEGER NOT NULL
+);
+
+INSERT INTO changelog_state (id, timeline, shipped_seq)
+	SELECT 1, lower(hex(randomblob(8))), 0 WHERE NOT EXISTS (SELECT 1 FROM changelog_state);
+
+CREATE TABLE IF NOT EXISTS recycled_keys (
+	short_key TEXT NOT NULL,
+	generation INTEGER NOT NULL,
+	url TEXT,
+	owner_id TEXT,
+	vanity INTEGER NOT NULL,
+	reason TEXT NOT NULL,
+	deleted_at TIMESTAMP NOT NULL,
+	recycled_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_recycled_keys_short_key ON recycled_keys (short_key);
+`
+
 const DROP_TABLE_QUERY = `
 	DROP INDEX IF EXISTS urls.idx_null_url;
 	DROP INDEX IF EXISTS urls.idx_short_key;
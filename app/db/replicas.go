@@ -0,0 +1,225 @@
+package db
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	HeartbeatQuery       = `INSERT INTO replica_heartbeat (id, beat_at) VALUES (1, ?) ON CONFLICT (id) DO UPDATE SET beat_at = excluded.beat_at`
+	SelectHeartbeatQuery = `SELECT COALESCE(MAX(beat_at), 0) FROM replica_heartbeat`
+)
+
+// Replica is a read only copy of a shard file, like one restored by
+// litestream. It's only read from while it's healthy, which is decided
+// by the health checks of SqliteCoordinator.CheckReplicas.
+type Replica struct {
+	Path string
+	conn *sql.DB
+
+	mu        sync.RWMutex
+	healthy   bool
+	lag       time.Duration
+	lastErr   string
+	checkedAt time.Time
+}
+
+type ReplicaStatus struct {
+	Shard     string    `json:"shard"`
+	Path      string    `json:"path"`
+	Healthy   bool      `json:"healthy"`
+	Lag       string    `json:"lag"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+func (r *Replica) Healthy() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.healthy
+}
+
+func (r *Replica) mark(healthy bool, lag time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.healthy = healthy
+	r.lag = lag
+	r.lastErr = ""
+	r.checkedAt = time.Now().UTC()
+
+	if err != nil {
+		r.lastErr = err.Error()
+	}
+}
+
+func (r *Replica) status(shard string) *ReplicaStatus {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return &ReplicaStatus{
+		Shard:     shard,
+		Path:      r.Path,
+		Healthy:   r.healthy,
+		Lag:       r.lag.String(),
+		Error:     r.lastErr,
+		CheckedAt: r.checkedAt,
+	}
+}
+
+// ReplicaFailed takes the replica behind conn out of the
+// rotation, until the next health check passes.
+func (shard *DBShard[E]) ReplicaFailed(conn *sql.DB, err error) {
+	for _, replica := range shard.replicas {
+		if replica.conn == conn {
+			log.Printf("replica %s of %s failed. %v", replica.Path, shard.id, err)
+			replica.mark(false, 0, err)
+		}
+	}
+}
+
+func openReplica(path string) (*sql.DB, error) {
+	conn, err := sql.Open("sqlite3", fmt.Sprintf("%s?cache=shared&_threadsafe=1&mode=ro", path))
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to replica %s: %v", path, err)
+	}
+
+	return conn, nil
+}
+
+// ReadFrom runs read on a replica of the shard, if there is a healthy
+// one, otherwise on the primary. Replicas lag, so when read fails on a
+// replica, it's run again on the primary. The errors in notFound are
+// expected from a lagging replica, and the others take it out of the
+// rotation.
+func ReadFrom[E cmp.Ordered](shard Shard[E], read func(conn *sql.DB) error, notFound ...error) error {
+	conn := shard.ReadConn()
+
+	err := read(conn)
+	if err == nil || conn == shard.Conn() {
+		return err
+	}
+
+	missing := false
+	for _, target := range notFound {
+		missing = missing || errors.Is(err, target)
+	}
+
+	if failer, ok := shard.(interface{ ReplicaFailed(*sql.DB, error) }); ok && !missing {
+		failer.ReplicaFailed(conn, err)
+	}
+
+	return read(shard.Conn())
+}
+
+// Heartbeat records the time on the primaries, the
+// replicas are as far behind, as their last heartbeat.
+func (ss *SqliteCoordinator[E]) Heartbeat(ctx context.Context) error {
+	shards, ok := ss.router.GetShards()
+	if !ok {
+		return fmt.Errorf("no shards to beat")
+	}
+
+	now := time.Now().UTC().UnixNano()
+
+	var errr error
+
+	for _, shard := range shards {
+		if _, err := shard.Conn().ExecContext(ctx, HeartbeatQuery, now); err != nil {
+			errr = fmt.Errorf("failed to beat %s. %v", shard.ID(), err)
+		}
+	}
+
+	return errr
+}
+
+func heartbeat(ctx context.Context, conn *sql.DB) (int64, error) {
+	var beatAt int64
+
+	err := conn.QueryRowContext(ctx, SelectHeartbeatQuery).Scan(&beatAt)
+	return beatAt, err
+}
+
+// CheckReplicas compares the heartbeat of every replica with its primary.
+// The ones which error, or lag more than maxLag, are taken out of the
+// rotation, and put back when they catch up.
+func (ss *SqliteCoordinator[E]) CheckReplicas(ctx context.Context, maxLag time.Duration) []*ReplicaStatus {
+	statuses := []*ReplicaStatus{}
+
+	shards, ok := ss.router.GetShards()
+	if !ok {
+		return statuses
+	}
+
+	for _, s := range shards {
+		shard, ok := s.(*DBShard[E])
+		if !ok || len(shard.replicas) == 0 {
+			continue
+		}
+
+		primaryBeat, primaryErr := heartbeat(ctx, shard.conn)
+
+		for _, replica := range shard.replicas {
+			replicaBeat, err := heartbeat(ctx, replica.conn)
+			lag := time.Duration(primaryBeat - replicaBeat)
+
+			switch {
+			case primaryErr != nil:
+				replica.mark(false, 0, fmt.Errorf("primary heartbeat failed. %v", primaryErr))
+			case err != nil:
+				replica.mark(false, 0, err)
+			case lag > maxLag:
+				replica.mark(false, lag, fmt.Errorf("lagging %s behind", lag))
+			default:
+				replica.mark(true, max(lag, 0), nil)
+			}
+
+			statuses = append(statuses, replica.status(shard.id))
+		}
+	}
+
+	sortStatuses(statuses)
+	return statuses
+}
+
+func sortStatuses(statuses []*ReplicaStatus) {
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].Shard != statuses[j].Shard {
+			return statuses[i].Shard < statuses[j].Shard
+		}
+
+		return statuses[i].Path < statuses[j].Path
+	})
+}
+
+// ReplicaStatuses is the result of the last health checks
+func (ss *SqliteCoordinator[E]) ReplicaStatuses() []*ReplicaStatus {
+	statuses := []*ReplicaStatus{}
+
+	shards, ok := ss.router.GetShards()
+	if !ok {
+		return statuses
+	}
+
+	for _, s := range shards {
+		shard, ok := s.(*DBShard[E])
+		if !ok {
+			continue
+		}
+
+		for _, replica := range shard.replicas {
+			statuses = append(statuses, replica.status(shard.id))
+		}
+	}
+
+	sortStatuses(statuses)
+	return statuses
+}
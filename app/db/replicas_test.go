@@ -0,0 +1,109 @@
+package db_test
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-batteries/shortner/app/db"
+)
+
+func Test_ReplicaRouting(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	toDbName := func(keyRange string) string {
+		return filepath.Join(dir, "db_a_z")
+	}
+
+	primary := db.NewSqliteCoordinator([]string{"a-z"})
+	primary.ToDbName = toDbName
+
+	if err := primary.RegisterShards(ctx); err != nil {
+		t.Fatalf("failed to create shard %v", err)
+	}
+	defer primary.DeInit()
+
+	if err := primary.Heartbeat(ctx); err != nil {
+		t.Fatalf("failed to beat %v", err)
+	}
+
+	replicaPath := filepath.Join(dir, "replica_a_z.db")
+
+	shards, _ := primary.GetShards()
+	if _, err := shards[0].Conn().ExecContext(ctx, "VACUUM INTO ?", replicaPath); err != nil {
+		t.Fatalf("failed to copy the replica %v", err)
+	}
+
+	readers := db.NewSqliteCoordinator([]string{"a-z"})
+	readers.ToDbName = toDbName
+	readers.ReplicaPaths = func(string) []string { return []string{replicaPath} }
+
+	if err := readers.ConnectShards(ctx, db.DBReadOnlyMode); err != nil {
+		t.Fatalf("failed to connect %v", err)
+	}
+	defer readers.DeInit()
+
+	shards, _ = readers.GetShards()
+	shard := shards[0]
+
+	if shard.ReadConn() != shard.Conn() {
+		t.Fatalf("expected the replica to be out of rotation, till it's checked")
+	}
+
+	statuses := readers.CheckReplicas(ctx, time.Hour)
+	if len(statuses) != 1 || !statuses[0].Healthy {
+		t.Fatalf("expected the copied replica to be healthy, got %+v", statuses[0])
+	}
+
+	if shard.ReadConn() == shard.Conn() {
+		t.Fatalf("expected reads to go to the replica")
+	}
+
+	now := time.Now().UTC()
+
+	primaryShards, _ := primary.GetShards()
+	_, err := primaryShards[0].Conn().ExecContext(ctx,
+		"INSERT INTO urls (url, short_key, created_at, updated_at) VALUES (?, ?, ?, ?)",
+		"https://example.com", "abc", now, now)
+	if err != nil {
+		t.Fatalf("failed to insert %v", err)
+	}
+
+	errMissing := errors.New("missing")
+	reads := 0
+
+	var link string
+	readErr := db.ReadFrom(shard, func(conn *sql.DB) error {
+		reads++
+
+		err := conn.QueryRowContext(ctx, "SELECT url FROM urls WHERE short_key = ?", "abc").Scan(&link)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errMissing
+		}
+
+		return err
+	}, errMissing)
+
+	if readErr != nil || link != "https://example.com" || reads != 2 {
+		t.Fatalf("expected the primary to have the link missing on the replica, got %q after %d reads, %v", link, reads, readErr)
+	}
+
+	if shard.ReadConn() == shard.Conn() {
+		t.Fatalf("expected a missing row to keep the replica in rotation")
+	}
+
+	time.Sleep(5 * time.Millisecond)
+
+	if err := primary.Heartbeat(ctx); err != nil {
+		t.Fatalf("failed to beat %v", err)
+	}
+
+	statuses = readers.CheckReplicas(ctx, time.Millisecond)
+	if statuses[0].Healthy || shard.ReadConn() != shard.Conn() {
+		t.Fatalf("expected the lagging replica out of rotation, got %+v", statuses[0])
+	}
+}
@@ -0,0 +1,222 @@
+package db
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+)
+
+const DefaultVirtualNodes = 160
+
+// HashRing is a consistent hash ring over node names. Each node gets
+// virtual nodes in proportion to its weight, so adding or removing a
+// node only moves the keys of its share of the ring.
+type HashRing struct {
+	points []uint64
+	nodes  []string
+}
+
+type HashRingOpts struct {
+	// VirtualNodes is the number of points on
+	// the ring, for a node with weight 1.
+	VirtualNodes int
+
+	// Weights by node name, nodes without
+	// one get a weight of 1.
+	Weights map[string]float64
+}
+
+func DefaultHashRingOpts() *HashRingOpts {
+	return &HashRingOpts{VirtualNodes: DefaultVirtualNodes, Weights: map[string]float64{}}
+}
+
+func ringHash(key string) uint64 {
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+
+	// fnv of keys differing in the last characters end up close,
+	// the finalizer spreads them over the ring.
+	h := hash.Sum64()
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+
+	return h
+}
+
+func NewHashRing(nodes []string, opts *HashRingOpts) (*HashRing, error) {
+	if len(nodes) == 0 {
+		return nil, errors.New("hash ring needs at least one node")
+	}
+
+	if opts == nil {
+		opts = DefaultHashRingOpts()
+	}
+
+	if opts.VirtualNodes < 1 {
+		return nil, fmt.Errorf("virtual nodes should be positive, got %d", opts.VirtualNodes)
+	}
+
+	type point struct {
+		hash uint64
+		node string
+	}
+
+	points := []point{}
+	seen := map[string]bool{}
+
+	for _, node := range nodes {
+		if seen[node] {
+			return nil, fmt.Errorf("node %s is on the ring twice", node)
+		}
+		seen[node] = true
+
+		weight, ok := opts.Weights[node]
+		if !ok {
+			weight = 1
+		}
+
+		if weight <= 0 {
+			return nil, fmt.Errorf("weight of %s should be positive, got %v", node, weight)
+		}
+
+		vnodes := int(math.Max(1, math.Round(weight*float64(opts.VirtualNodes))))
+
+		for i := 0; i < vnodes; i++ {
+			points = append(points, point{hash: ringHash(fmt.Sprintf("%s#%d", node, i)), node: node})
+		}
+	}
+
+	// ties are broken by name, so the ring doesn't
+	// depend on the order the nodes were given in.
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash != points[j].hash {
+			return points[i].hash < points[j].hash
+		}
+
+		return points[i].node < points[j].node
+	})
+
+	ring := &HashRing{
+		points: make([]uint64, len(points)),
+		nodes:  make([]string, len(points)),
+	}
+
+	for i, p := range points {
+		ring.points[i] = p.hash
+		ring.nodes[i] = p.node
+	}
+
+	return ring, nil
+}
+
+// Locate is the node owning the key, the first
+// point clockwise from the hash of the key.
+func (r *HashRing) Locate(key string) string {
+	hash := ringHash(key)
+
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= hash
+	})
+
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.nodes[i]
+}
+
+// ConsistentHashPolicy places keys on a HashRing of the shard ids.
+// Unlike HashBasedPolicy, adding a shard only moves about 1/n of
+// the keys, instead of nearly all of them.
+//
+// It isn't a shards.policy of the server, and can't be one as is. The
+// keys are seeded by prefix, into the shard of their key range, and the
+// new links take a free key of the shard they are written to. So a key
+// lives in the shard of its first character, where the ring would rarely
+// look for it. Switching would need the seeder, the reshard and the key
+// pool to place keys by the ring too, cli ring reports what would move.
+type ConsistentHashPolicy[E cmp.Ordered] struct {
+	ring   *HashRing
+	shards map[string]Shard[E]
+}
+
+// NewConsistentHashPolicy, the weights in opts are by shard id
+func NewConsistentHashPolicy[E cmp.Ordered](shards []Shard[E], opts *HashRingOpts) (*ConsistentHashPolicy[E], error) {
+	byID := map[string]Shard[E]{}
+	ids := make([]string, 0, len(shards))
+
+	for _, shard := range shards {
+		byID[shard.ID()] = shard
+		ids = append(ids, shard.ID())
+	}
+
+	ring, err := NewHashRing(ids, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ConsistentHashPolicy[E]{ring: ring, shards: byID}, nil
+}
+
+func (p *ConsistentHashPolicy[E]) RoutedShard(shardKey string) (Shard[E], error) {
+	if shardKey == "" {
+		return nil, errors.New("not_found")
+	}
+
+	return p.shards[p.ring.Locate(shardKey)], nil
+}
+
+// RingMoves is how the keys would be placed, before and
+// after a change of the ring, and how many of them move.
+type RingMoves struct {
+	Total int64 `json:"total"`
+	Moved int64 `json:"moved"`
+
+	Before map[string]int64 `json:"before"`
+	After  map[string]int64 `json:"after"`
+
+	// Flows counts the moved keys, by from and to node
+	Flows map[string]map[string]int64 `json:"flows"`
+}
+
+func NewRingMoves() *RingMoves {
+	return &RingMoves{
+		Before: map[string]int64{},
+		After:  map[string]int64{},
+		Flows:  map[string]map[string]int64{},
+	}
+}
+
+// Add places the key on both rings
+func (m *RingMoves) Add(key string, current, proposed *HashRing) {
+	from, to := current.Locate(key), proposed.Locate(key)
+
+	m.Total++
+	m.Before[from]++
+	m.After[to]++
+
+	if from == to {
+		return
+	}
+
+	m.Moved++
+
+	if m.Flows[from] == nil {
+		m.Flows[from] = map[string]int64{}
+	}
+	m.Flows[from][to]++
+}
+
+func (m *RingMoves) MovedRatio() float64 {
+	if m.Total == 0 {
+		return 0
+	}
+
+	return float64(m.Moved) / float64(m.Total)
+}
@@ -0,0 +1,69 @@
+package db_test
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/go-batteries/shortner/app/db"
+)
+
+func Test_HashRingMoves(t *testing.T) {
+	current, err := db.NewHashRing([]string{"db_1", "db_2", "db_3", "db_4"}, nil)
+	if err != nil {
+		t.Fatalf("failed to build ring %v", err)
+	}
+
+	proposed, err := db.NewHashRing([]string{"db_4", "db_3", "db_2", "db_1", "db_5"}, nil)
+	if err != nil {
+		t.Fatalf("failed to build ring %v", err)
+	}
+
+	moves := db.NewRingMoves()
+	for i := 0; i < 50000; i++ {
+		moves.Add(fmt.Sprintf("key%d", i), current, proposed)
+	}
+
+	// adding the fifth shard should move about a fifth of the keys,
+	// all of them to the new shard.
+	if ratio := moves.MovedRatio(); ratio < 0.15 || ratio > 0.25 {
+		t.Fatalf("expected about 20%% of the keys to move, got %.2f", ratio)
+	}
+
+	for from, flows := range moves.Flows {
+		for to := range flows {
+			if to != "db_5" {
+				t.Errorf("expected keys to only move to db_5, %s moved to %s", from, to)
+			}
+		}
+	}
+
+	for node, count := range moves.Before {
+		if math.Abs(float64(count)-12500) > 12500*0.2 {
+			t.Errorf("expected %s to have about a quarter of the keys, got %d", node, count)
+		}
+	}
+}
+
+func Test_HashRingWeights(t *testing.T) {
+	opts := db.DefaultHashRingOpts()
+	opts.Weights["db_big"] = 3
+
+	ring, err := db.NewHashRing([]string{"db_small", "db_big"}, opts)
+	if err != nil {
+		t.Fatalf("failed to build ring %v", err)
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 40000; i++ {
+		counts[ring.Locate(fmt.Sprintf("key%d", i))]++
+	}
+
+	if ratio := float64(counts["db_big"]) / 40000; ratio < 0.68 || ratio > 0.82 {
+		t.Fatalf("expected db_big to get about 75%% of the keys, got %.2f", ratio)
+	}
+
+	if _, err := db.NewHashRing([]string{"db_a", "db_a"}, nil); err == nil {
+		t.Errorf("expected a node twice on the ring to fail")
+	}
+}
@@ -0,0 +1,24 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// SnapshotInto writes a consistent copy of the db at src to dst, with
+// whatever is still in its wal. It's safe while src is being written
+// to, unlike copying the file. dst must not exist.
+func SnapshotInto(ctx context.Context, src string, dst string) error {
+	conn, err := sql.Open("sqlite3", fmt.Sprintf("%s?mode=ro", src))
+	if err != nil {
+		return fmt.Errorf("Error connecting to database %s: %v", src, err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "VACUUM INTO ?", dst); err != nil {
+		return fmt.Errorf("failed to snapshot %s. %v", src, err)
+	}
+
+	return nil
+}
@@ -10,6 +10,7 @@ import (
 	"log"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 
@@ -20,6 +21,10 @@ type Shard[E cmp.Ordered] interface {
 	ID() string
 	Conn() *sql.DB
 	ShardKey() E
+
+	// ReadConn is a healthy replica, or the primary
+	// Conn, if there are none. See ReadFrom.
+	ReadConn() *sql.DB
 }
 
 type ShardingPolicy[E cmp.Ordered] interface {
@@ -32,6 +37,10 @@ type KeyBasedPolicy[E cmp.Ordered] struct {
 }
 
 func (p *KeyBasedPolicy[E]) RoutedShard(shardKey string) (Shard[E], error) {
+	if shardKey == "" {
+		return nil, errors.New("not_found")
+	}
+
 	firstChar := unicode.ToLower(rune(shardKey[0]))
 
 	for keyRange, db := range p.Shards {
@@ -74,9 +83,43 @@ func (p *RoundRobinPolicy[E]) RoutedShard(shardKey string) (Shard[E], error) {
 	return shard, nil
 }
 
+// KeyOrRoundRobinPolicy is meant for the write connections.
+// Writes for a known key, like vanity aliases and deletes, need to land
+// on the key range shard. While new key assignments, which come with an
+// empty key, are spread across all shards.
+type KeyOrRoundRobinPolicy[E cmp.Ordered] struct {
+	Keyed *KeyBasedPolicy[E]
+	Robin *RoundRobinPolicy[E]
+}
+
+func (p *KeyOrRoundRobinPolicy[E]) RoutedShard(shardKey string) (Shard[E], error) {
+	if shardKey == "" {
+		return p.Robin.RoutedShard(shardKey)
+	}
+
+	return p.Keyed.RoutedShard(shardKey)
+}
+
+// ShardsByKeyRange maps the key ranges to their connected shards,
+// which is what KeyBasedPolicy expects.
+func ShardsByKeyRange[E ~string](keyRanges []E, shards []Shard[E]) map[string]Shard[E] {
+	shardMapper := map[string]Shard[E]{}
+
+	for _, keyRange := range keyRanges {
+		for _, shard := range shards {
+			if shard.ShardKey() == keyRange {
+				shardMapper[string(keyRange)] = shard
+			}
+		}
+	}
+
+	return shardMapper
+}
+
 type Router[E cmp.Ordered] interface {
 	AddShard(shard Shard[E])
 	SetPolicy(policy ShardingPolicy[E])
+	Replace(shards []Shard[E], policy ShardingPolicy[E])
 	GetShard(key E) (Shard[E], error)
 	GetShards() ([]Shard[E], bool)
 }
@@ -85,6 +128,9 @@ type DBShard[E cmp.Ordered] struct {
 	id       string
 	conn     *sql.DB
 	shardKey E
+
+	replicas []*Replica
+	next     atomic.Uint64
 }
 
 func (shard *DBShard[E]) ID() string {
@@ -99,12 +145,60 @@ func (shard *DBShard[E]) ShardKey() E {
 	return shard.shardKey
 }
 
+// ReadConn goes round the healthy replicas
+func (shard *DBShard[E]) ReadConn() *sql.DB {
+	n := uint64(len(shard.replicas))
+	if n == 0 {
+		return shard.conn
+	}
+
+	start := shard.next.Add(1)
+
+	for i := uint64(0); i < n; i++ {
+		replica := shard.replicas[(start+i)%n]
+		if replica.Healthy() {
+			return replica.conn
+		}
+	}
+
+	return shard.conn
+}
+
+func (shard *DBShard[E]) close() {
+	shard.conn.Close()
+
+	for _, replica := range shard.replicas {
+		replica.conn.Close()
+	}
+}
+
+func (shard *DBShard[E]) connectReplicas(paths []string) error {
+	for _, path := range paths {
+		log.Printf("connecting to replica %s of %s.db", path, shard.id)
+
+		conn, err := openReplica(path)
+		if err != nil {
+			return err
+		}
+
+		shard.replicas = append(shard.replicas, &Replica{Path: path, conn: conn})
+	}
+
+	return nil
+}
+
+// DBRouter is safe to reroute while it's serving,
+// the shards and the policy are swapped together.
 type DBRouter[E ~string] struct {
+	mu     sync.RWMutex
 	shards map[string]Shard[E]
 	policy ShardingPolicy[E]
 }
 
 func (r *DBRouter[E]) AddShard(shard Shard[E]) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	if r.shards == nil {
 		r.shards = make(map[string]Shard[E])
 	}
@@ -112,15 +206,39 @@ func (r *DBRouter[E]) AddShard(shard Shard[E]) {
 }
 
 func (r *DBRouter[E]) SetPolicy(policy ShardingPolicy[E]) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.policy = policy
+}
+
+// Replace swaps all the shards and the policy at once
+func (r *DBRouter[E]) Replace(shards []Shard[E], policy ShardingPolicy[E]) {
+	shardMap := make(map[string]Shard[E], len(shards))
+	for _, shard := range shards {
+		shardMap[shard.ID()] = shard
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.shards = shardMap
 	r.policy = policy
 }
 
 func (r *DBRouter[E]) GetShard(key E) (Shard[E], error) {
+	r.mu.RLock()
+	policy := r.policy
+	r.mu.RUnlock()
+
 	shardKey := string(key)
-	return r.policy.RoutedShard(shardKey)
+	return policy.RoutedShard(shardKey)
 }
 
 func (r *DBRouter[E]) GetShards() ([]Shard[E], bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
 	if len(r.shards) == 0 {
 		return nil, false
 	}
@@ -142,13 +260,25 @@ type Coordinator[E cmp.Ordered] interface {
 	RegisterShards(context.Context) error
 }
 
+const DefaultCoordinatorPath = "db_shard_coordinator.db"
+
 type SqliteCoordinator[E cmp.Ordered] struct {
 	ToDbName  func(keyRange E) string
 	router    Router[E]
 	policy    ShardingPolicy[E]
 	keyRanges []E
 
-	CoordinatorDB *sql.DB
+	CoordinatorPath string
+	CoordinatorDB   *sql.DB
+
+	// ReplicaPaths are the replica files of a key range. They
+	// are connected along with the shards, when it is set.
+	ReplicaPaths func(keyRange E) []string
+
+	// Changelog, MigrateShards installs the triggers which record
+	// the writes to urls in the changelog of the shard. Otherwise
+	// it removes them.
+	Changelog bool
 }
 
 func DefaultSqliteDBNameBuilder[E ~string](keyRange E) string {
@@ -160,6 +290,8 @@ func NewSqliteCoordinator[E ~string](keyRanges []E) *SqliteCoordinator[E] {
 		ToDbName:  DefaultSqliteDBNameBuilder[E],
 		router:    &DBRouter[E]{},
 		keyRanges: keyRanges,
+
+		CoordinatorPath: DefaultCoordinatorPath,
 	}
 }
 
@@ -181,6 +313,11 @@ func (ss *SqliteCoordinator[E]) DeInit() {
 	}
 
 	for _, shard := range shards {
+		if dbShard, ok := shard.(*DBShard[E]); ok {
+			dbShard.close()
+			continue
+		}
+
 		shard.Conn().Close()
 	}
 }
@@ -199,16 +336,41 @@ func (ss *SqliteCoordinator[E]) RegisterCoordinator(cx context.Context) (*sql.DB
 		ss.ConnectCoordinatorDB(cx)
 	}
 
-	_, err := ss.CoordinatorDB.ExecContext(cx, CREATE_SHARD_STATUS_QUERY)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create tables")
+	return ss.CoordinatorDB, ss.MigrateCoordinator(cx)
+}
+
+// MigrateCoordinator creates shard_status, brings it up to date,
+// and creates the tables added to the coordinator db after it.
+func (ss *SqliteCoordinator[E]) MigrateCoordinator(ctx context.Context) error {
+	if ss.CoordinatorDB == nil {
+		return fmt.Errorf("coordinator db is not connected")
+	}
+
+	if _, err := ss.CoordinatorDB.ExecContext(ctx, CREATE_SHARD_STATUS_QUERY); err != nil {
+		return fmt.Errorf("failed to create tables. %v", err)
+	}
+
+	for _, migration := range COORDINATOR_COLUMN_MIGRATIONS {
+		if err := migration.Apply(ctx, ss.CoordinatorDB); err != nil {
+			return fmt.Errorf("failed to migrate %s on coordinator. %v", migration.Column, err)
+		}
+	}
+
+	if _, err := ss.CoordinatorDB.ExecContext(ctx, MIGRATE_COORDINATOR_QUERY); err != nil {
+		return fmt.Errorf("failed to migrate coordinator db. %v", err)
+	}
+
+	for _, migration := range MODERATION_COLUMN_MIGRATIONS {
+		if err := migration.Apply(ctx, ss.CoordinatorDB); err != nil {
+			return fmt.Errorf("failed to migrate %s.%s on coordinator. %v", migration.Table, migration.Column, err)
+		}
 	}
 
-	return ss.CoordinatorDB, nil
+	return nil
 }
 
 func (ss *SqliteCoordinator[E]) ConnectCoordinatorDB(ctx context.Context) (*sql.DB, error) {
-	conn, err := sql.Open("sqlite3", "db_shard_coordinator.db")
+	conn, err := sql.Open("sqlite3", ss.CoordinatorPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create coordinator db")
 	}
@@ -234,22 +396,112 @@ func (ss *SqliteCoordinator[E]) ConnectShards(cx context.Context, mode DBmode) e
 		shards = append(shards, shard)
 	}
 
+	for _, shard := range shards {
+		conn, err := openShard(shard.id, mode)
+		if err != nil {
+			return err
+		}
+
+		shard.conn = conn
+
+		if ss.ReplicaPaths != nil {
+			if err := shard.connectReplicas(ss.ReplicaPaths(shard.shardKey)); err != nil {
+				return err
+			}
+		}
+
+		ss.router.AddShard(shard)
+	}
+
+	return nil
+}
+
+func openShard(id string, mode DBmode) (*sql.DB, error) {
 	connQuery := "cache=shared&_threadsafe=1"
 
-	if mode == DBReadOnlyMode || mode == DBReadOnlyMode {
+	if mode == DBReadOnlyMode {
 		connQuery = fmt.Sprintf("%s&mode=%s", connQuery, mode)
 	}
 
-	for _, shard := range shards {
-		log.Printf("connecting to %s.db", shard.id)
+	log.Printf("connecting to %s.db", id)
+
+	conn, err := sql.Open("sqlite3", fmt.Sprintf("%s.db?%s", id, connQuery))
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to database %s: %v", id, err)
+	}
+
+	return conn, nil
+}
+
+// Reroute switches the coordinator to new key ranges, while it's serving.
+// Shard files which are kept, keep their connections and replicas, even
+// if their key range changed. The ones which aren't, are closed. ToDbName
+// and ReplicaPaths should be updated for the new key ranges, before it.
+func (ss *SqliteCoordinator[E]) Reroute(ctx context.Context, mode DBmode, keyRanges []E, policyFor func([]Shard[E]) ShardingPolicy[E]) error {
+	existing := map[string]*DBShard[E]{}
+
+	if shards, ok := ss.router.GetShards(); ok {
+		for _, shard := range shards {
+			if dbShard, ok := shard.(*DBShard[E]); ok {
+				existing[shard.ID()] = dbShard
+			}
+		}
+	}
+
+	shards := []Shard[E]{}
+	opened := []*DBShard[E]{}
+
+	fail := func(err error) error {
+		for _, shard := range opened {
+			shard.close()
+		}
+
+		return err
+	}
+
+	for _, keyRange := range keyRanges {
+		shard := &DBShard[E]{id: ss.ToDbName(keyRange), shardKey: keyRange}
 
-		conn, err := sql.Open("sqlite3", fmt.Sprintf("%s.db?%s", shard.id, connQuery))
+		if kept, ok := existing[shard.id]; ok {
+			shard.conn = kept.conn
+			shard.replicas = kept.replicas
+			shards = append(shards, shard)
+			continue
+		}
+
+		conn, err := openShard(shard.id, mode)
 		if err != nil {
-			return fmt.Errorf("Error connecting to database %s: %v", shard.id, err)
+			return fail(err)
 		}
 
 		shard.conn = conn
-		ss.router.AddShard(shard)
+		opened = append(opened, shard)
+
+		if err := conn.PingContext(ctx); err != nil {
+			return fail(err)
+		}
+
+		if ss.ReplicaPaths != nil {
+			if err := shard.connectReplicas(ss.ReplicaPaths(keyRange)); err != nil {
+				return fail(err)
+			}
+		}
+
+		shards = append(shards, shard)
+	}
+
+	ss.router.Replace(shards, policyFor(shards))
+	ss.keyRanges = keyRanges
+
+	kept := map[string]bool{}
+	for _, shard := range shards {
+		kept[shard.ID()] = true
+	}
+
+	for id, shard := range existing {
+		if !kept[id] {
+			shard.close()
+		}
 	}
 
 	return nil
@@ -313,5 +565,43 @@ func (ss *SqliteCoordinator[E]) RegisterShards(cx context.Context) error {
 		return fmt.Errorf("failed to bootstrap databases")
 	}
 
+	return ss.MigrateShards(cx)
+}
+
+// MigrateShards brings shards created by an older version
+// of CREATE_TABLE_QUERY up to date. It needs a writable connection.
+func (ss *SqliteCoordinator[E]) MigrateShards(ctx context.Context) error {
+	shards, ok := ss.router.GetShards()
+	if !ok {
+		return fmt.Errorf("no shards to migrate")
+	}
+
+	for _, shard := range shards {
+		for _, migration := range URL_COLUMN_MIGRATIONS {
+			if err := migration.Apply(ctx, shard.Conn()); err != nil {
+				return fmt.Errorf("failed to migrate %s on %s. %v", migration.Column, shard.ID(), err)
+			}
+		}
+
+		for _, migration := range URL_INDEX_MIGRATIONS {
+			if err := migration.Apply(ctx, shard.Conn()); err != nil {
+				return fmt.Errorf("failed to migrate %s on %s. %v", migration.Index, shard.ID(), err)
+			}
+		}
+
+		if _, err := shard.Conn().ExecContext(ctx, MIGRATE_SHARD_QUERY); err != nil {
+			return fmt.Errorf("failed to migrate %s. %v", shard.ID(), err)
+		}
+
+		triggers := DropChangelogTriggersQuery
+		if ss.Changelog {
+			triggers = ChangelogTriggersQuery()
+		}
+
+		if _, err := shard.Conn().ExecContext(ctx, triggers); err != nil {
+			return fmt.Errorf("failed to set up the changelog of %s. %v", shard.ID(), err)
+		}
+	}
+
 	return nil
 }
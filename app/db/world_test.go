@@ -28,7 +28,7 @@ func Cleanup(database *db.SqliteCoordinator[string]) {
 func Test_SqliteCoordinator(t *testing.T) {
 	ctx := context.Background()
 	seeder := seed.RegisterUrlSeeder()
-	keyRanges := seeder.Shards(5)
+	keyRanges := seeder.Shards()
 
 	database := db.NewSqliteCoordinator(keyRanges)
 
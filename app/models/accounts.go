@@ -0,0 +1,288 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	ScopeLinksRead  = "links:read"
+	ScopeLinksWrite = "links:write"
+	ScopeAdmin      = "admin"
+)
+
+var AllScopes = []string{ScopeLinksRead, ScopeLinksWrite, ScopeAdmin}
+
+var (
+	ErrInvalidAPIKey = errors.New("invalid_api_key")
+	ErrInvalidScope  = errors.New("invalid_scope")
+	ErrKeyNotFound   = errors.New("api_key_not_found")
+)
+
+// api keys look like sk_<id>_<secret>, the id is
+// stored as is, to be able to list and revoke keys.
+const apiKeyPrefix = "sk"
+
+type Account struct {
+	ID        string    `db:"id"`
+	Name      string    `db:"name"`
+	CreatedAt time.Time `db:"created_at"`
+	UpdatedAt time.Time `db:"updated_at"`
+
+	// Scopes of the api key used to resolve the account
+	Scopes []string `db:"-"`
+}
+
+func (a *Account) HasScope(scope string) bool {
+	return slices.Contains(a.Scopes, scope) || slices.Contains(a.Scopes, ScopeAdmin)
+}
+
+type APIKey struct {
+	ID          string     `db:"id"`
+	AccountID   string     `db:"account_id"`
+	AccountName string     `db:"-"`
+	Scopes      []string   `db:"scopes"`
+	CreatedAt   time.Time  `db:"created_at"`
+	RevokedAt   *time.Time `db:"revoked_at"`
+}
+
+type accountCtxKey struct{}
+
+func ContextWithAccount(ctx context.Context, account *Account) context.Context {
+	return context.WithValue(ctx, accountCtxKey{}, account)
+}
+
+// AccountFromContext returns nil for anonymous requests
+func AccountFromContext(ctx context.Context) *Account {
+	account, _ := ctx.Value(accountCtxKey{}).(*Account)
+	return account
+}
+
+// ParseScopes validates a comma separated list of scopes
+func ParseScopes(scopesStr string) ([]string, error) {
+	scopes := []string{}
+
+	for _, scope := range strings.Split(scopesStr, ",") {
+		scope = strings.TrimSpace(scope)
+		if scope == "" {
+			continue
+		}
+
+		if !slices.Contains(AllScopes, scope) {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidScope, scope)
+		}
+
+		scopes = append(scopes, scope)
+	}
+
+	if len(scopes) == 0 {
+		return nil, ErrInvalidScope
+	}
+
+	return scopes, nil
+}
+
+// LegacyOwnerID is the owner of the links created before the accounts,
+// the hex of the sha256 of the AuthKey they were created with. The
+// AuthKey could be anything, the index page sent a random one. Those
+// links are moved to an account with ReassignOwner, keys adopt on the cli.
+func LegacyOwnerID(authKey string) string {
+	h := sha256.Sum256([]byte(authKey))
+	return hex.EncodeToString(h[:])
+}
+
+func hashAPIKey(rawKey string) string {
+	h := sha256.Sum256([]byte(rawKey))
+	return hex.EncodeToString(h[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+const (
+	AccountInsertQuery     = `INSERT INTO accounts (id, name, created_at, updated_at) VALUES (?, ?, ?, ?) ON CONFLICT (name) DO NOTHING`
+	AccountSelectByName    = `SELECT id, name, created_at, updated_at FROM accounts WHERE name = ?`
+	APIKeyInsertQuery      = `INSERT INTO api_keys (id, key_hash, account_id, scopes, created_at) VALUES (?, ?, ?, ?, ?)`
+	APIKeyRevokeQuery      = `UPDATE api_keys SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL`
+	AccountSelectByKeyHash = `
+		SELECT a.id, a.name, a.created_at, a.updated_at, k.scopes
+		FROM api_keys k
+		JOIN accounts a ON a.id = k.account_id
+		WHERE k.key_hash = ?
+		AND k.revoked_at IS NULL
+	`
+	APIKeysSelectQuery = `
+		SELECT k.id, k.account_id, a.name, k.scopes, k.created_at, k.revoked_at
+		FROM api_keys k
+		JOIN accounts a ON a.id = k.account_id
+		WHERE (? = '' OR a.name = ?)
+		ORDER BY k.created_at
+	`
+)
+
+// AccountRepo lives in the coordinator db
+type AccountRepo struct {
+	db *sql.DB
+}
+
+func NewAccountRepo(db *sql.DB) *AccountRepo {
+	return &AccountRepo{db: db}
+}
+
+// FindOrCreate returns the account with the name, creating it if needed
+func (repo *AccountRepo) FindOrCreate(ctx context.Context, name string) (*Account, error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	_, err = repo.db.ExecContext(ctx, AccountInsertQuery, fmt.Sprintf("acc_%s", id), name, now, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return repo.FindByName(ctx, name)
+}
+
+func (repo *AccountRepo) FindByName(ctx context.Context, name string) (*Account, error) {
+	account := &Account{}
+
+	err := repo.db.QueryRowContext(ctx, AccountSelectByName, name).Scan(
+		&account.ID,
+		&account.Name,
+		&account.CreatedAt,
+		&account.UpdatedAt,
+	)
+
+	return account, err
+}
+
+// CreateKey returns the raw key, which is not stored anywhere.
+// So it can only be shown once.
+func (repo *AccountRepo) CreateKey(ctx context.Context, account *Account, scopes []string) (string, *APIKey, error) {
+	id, err := randomHex(4)
+	if err != nil {
+		return "", nil, err
+	}
+
+	secret, err := randomHex(24)
+	if err != nil {
+		return "", nil, err
+	}
+
+	rawKey := fmt.Sprintf("%s_%s_%s", apiKeyPrefix, id, secret)
+
+	key := &APIKey{
+		ID:          id,
+		AccountID:   account.ID,
+		AccountName: account.Name,
+		Scopes:      scopes,
+		CreatedAt:   time.Now().UTC(),
+	}
+
+	_, err = repo.db.ExecContext(
+		ctx,
+		APIKeyInsertQuery,
+		key.ID,
+		hashAPIKey(rawKey),
+		key.AccountID,
+		strings.Join(key.Scopes, ","),
+		key.CreatedAt,
+	)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return rawKey, key, nil
+}
+
+func (repo *AccountRepo) RevokeKey(ctx context.Context, keyID string) error {
+	res, err := repo.db.ExecContext(ctx, APIKeyRevokeQuery, time.Now().UTC(), keyID)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return ErrKeyNotFound
+	}
+
+	return nil
+}
+
+// ListKeys lists the keys of an account, or all keys for an empty name
+func (repo *AccountRepo) ListKeys(ctx context.Context, accountName string) ([]*APIKey, error) {
+	rows, err := repo.db.QueryContext(ctx, APIKeysSelectQuery, accountName, accountName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+
+	for rows.Next() {
+		key := &APIKey{}
+		var scopes string
+
+		if err := rows.Scan(
+			&key.ID,
+			&key.AccountID,
+			&key.AccountName,
+			&scopes,
+			&key.CreatedAt,
+			&key.RevokedAt,
+		); err != nil {
+			return nil, err
+		}
+
+		key.Scopes = strings.Split(scopes, ",")
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// FindByKey resolves a raw api key to its account.
+// ErrInvalidAPIKey is returned for unknown or revoked keys.
+func (repo *AccountRepo) FindByKey(ctx context.Context, rawKey string) (*Account, error) {
+	if !strings.HasPrefix(rawKey, apiKeyPrefix+"_") {
+		return nil, ErrInvalidAPIKey
+	}
+
+	account := &Account{}
+	var scopes string
+
+	err := repo.db.QueryRowContext(ctx, AccountSelectByKeyHash, hashAPIKey(rawKey)).Scan(
+		&account.ID,
+		&account.Name,
+		&account.CreatedAt,
+		&account.UpdatedAt,
+		&scopes,
+	)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrInvalidAPIKey
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	account.Scopes = strings.Split(scopes, ",")
+	return account, nil
+}
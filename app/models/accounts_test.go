@@ -0,0 +1,121 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/go-batteries/shortner/app/models"
+)
+
+func Test_AccountRepo(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	database, _ := changelogShard(t, filepath.Join(dir, "db_a_z"), false)
+	database.CoordinatorPath = filepath.Join(dir, "coordinator.db")
+
+	cdb, err := database.ConnectCoordinatorDB(ctx)
+	if err != nil {
+		t.Fatalf("failed to open coordinator %v", err)
+	}
+	defer cdb.Close()
+
+	if err := database.MigrateCoordinator(ctx); err != nil {
+		t.Fatalf("failed to migrate coordinator %v", err)
+	}
+
+	repo := models.NewAccountRepo(cdb)
+
+	account, err := repo.FindOrCreate(ctx, "acme")
+	if err != nil {
+		t.Fatalf("failed to create account %v", err)
+	}
+
+	if again, err := repo.FindOrCreate(ctx, "acme"); err != nil || again.ID != account.ID {
+		t.Fatalf("expected the same account by name, got %+v. %v", again, err)
+	}
+
+	rawKey, key, err := repo.CreateKey(ctx, account, []string{models.ScopeLinksRead})
+	if err != nil {
+		t.Fatalf("failed to create key %v", err)
+	}
+
+	if !regexp.MustCompile(`^sk_` + key.ID + `_[0-9a-f]{48}$`).MatchString(rawKey) {
+		t.Fatalf("expected a key like sk_<id>_<secret>, got %s", rawKey)
+	}
+
+	var stored int
+	if err := cdb.QueryRowContext(ctx, `SELECT COUNT(1) FROM api_keys WHERE key_hash = ? OR id = ?`, rawKey, rawKey).Scan(&stored); err != nil || stored != 0 {
+		t.Fatalf("expected only the hash of the key to be stored, got %d. %v", stored, err)
+	}
+
+	found, err := repo.FindByKey(ctx, rawKey)
+	if err != nil || found.ID != account.ID {
+		t.Fatalf("expected the key to resolve to %s, got %+v. %v", account.ID, found, err)
+	}
+
+	if !found.HasScope(models.ScopeLinksRead) || found.HasScope(models.ScopeLinksWrite) {
+		t.Fatalf("expected only the scopes of the key, got %v", found.Scopes)
+	}
+
+	admin := &models.Account{Scopes: []string{models.ScopeAdmin}}
+	if !admin.HasScope(models.ScopeLinksWrite) {
+		t.Fatalf("expected admin to have every scope")
+	}
+
+	for _, bad := range []string{"", "not-a-key", rawKey + "0", "sk_" + key.ID + "_guess"} {
+		if _, err := repo.FindByKey(ctx, bad); !errors.Is(err, models.ErrInvalidAPIKey) {
+			t.Fatalf("expected %q to be invalid, got %v", bad, err)
+		}
+	}
+
+	if _, err := models.ParseScopes("links:read, root"); !errors.Is(err, models.ErrInvalidScope) {
+		t.Fatalf("expected an unknown scope to be invalid, got %v", err)
+	}
+
+	if scopes, err := models.ParseScopes("links:read, links:write,"); err != nil || len(scopes) != 2 {
+		t.Fatalf("expected 2 scopes, got %v. %v", scopes, err)
+	}
+
+	if err := repo.RevokeKey(ctx, key.ID); err != nil {
+		t.Fatalf("failed to revoke %v", err)
+	}
+
+	if _, err := repo.FindByKey(ctx, rawKey); !errors.Is(err, models.ErrInvalidAPIKey) {
+		t.Fatalf("expected a revoked key to be invalid, got %v", err)
+	}
+
+	if err := repo.RevokeKey(ctx, key.ID); !errors.Is(err, models.ErrKeyNotFound) {
+		t.Fatalf("expected a revoked key to not be revoked again, got %v", err)
+	}
+
+	keys, err := repo.ListKeys(ctx, "acme")
+	if err != nil || len(keys) != 1 || keys[0].RevokedAt == nil || keys[0].AccountName != "acme" {
+		t.Fatalf("expected the revoked key to be listed, got %+v. %v", keys, err)
+	}
+
+	// the links created with an AuthKey, before the accounts
+	links := models.NewURLRepo(database)
+	legacy := models.LegacyOwnerID("browser-key-1")
+
+	u, err := links.AssignAlias(ctx, "old-link", "https://github.com", models.WithOwner(legacy))
+	if err != nil {
+		t.Fatalf("failed to assign alias %v", err)
+	}
+
+	moved, err := links.ReassignOwner(ctx, legacy, account.ID)
+	if err != nil || moved != 1 {
+		t.Fatalf("expected the legacy link to be moved, got %d. %v", moved, err)
+	}
+
+	if _, err := links.FindOwned(ctx, account.ID, u.ShortKey); err != nil {
+		t.Fatalf("expected the account to own the link, got %v", err)
+	}
+
+	if moved, _ := links.ReassignOwner(ctx, legacy, account.ID); moved != 0 {
+		t.Fatalf("expected nothing left to move, got %d", moved)
+	}
+}
@@ -0,0 +1,173 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrInvalidManifest = errors.New("invalid_manifest")
+
+const (
+	// SnapshotsPrefix is where the backup runs are put,
+	// one directory per run, named by its id.
+	SnapshotsPrefix = "snapshots/"
+	ManifestName    = "manifest.json"
+
+	backupIDLayout = "20060102T150405Z"
+)
+
+// BackupFile is a snapshot of a db file in a backup run. SHA256 and
+// Size are of the snapshot, before it's compressed. Timeline and
+// Position are where its changelog was, for the shards, the changes
+// after Position are replayed on top of it.
+type BackupFile struct {
+	Name       string `json:"name"`
+	Key        string `json:"key"`
+	KeyRange   string `json:"key_range,omitempty"`
+	Size       int64  `json:"size"`
+	StoredSize int64  `json:"stored_size"`
+	SHA256     string `json:"sha256"`
+	Compressed bool   `json:"compressed"`
+	Timeline   string `json:"timeline,omitempty"`
+	Position   int64  `json:"position,omitempty"`
+}
+
+// BackupManifest is written last, a run without
+// one didn't finish, and isn't restored from.
+type BackupManifest struct {
+	ID        string        `json:"id"`
+	CreatedAt time.Time     `json:"created_at"`
+	Files     []*BackupFile `json:"files"`
+}
+
+func NewBackupManifest(createdAt time.Time) *BackupManifest {
+	createdAt = createdAt.UTC().Truncate(time.Second)
+
+	return &BackupManifest{
+		ID:        createdAt.Format(backupIDLayout),
+		CreatedAt: createdAt,
+		Files:     []*BackupFile{},
+	}
+}
+
+// Prefix is the directory of the run
+func (m *BackupManifest) Prefix() string {
+	return SnapshotsPrefix + m.ID + "/"
+}
+
+func (m *BackupManifest) Key() string {
+	return m.Prefix() + ManifestName
+}
+
+func WriteManifest(w io.Writer, manifest *BackupManifest) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(manifest)
+}
+
+func ReadManifest(r io.Reader) (*BackupManifest, error) {
+	manifest := &BackupManifest{}
+
+	if err := json.NewDecoder(r).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("%w. %v", ErrInvalidManifest, err)
+	}
+
+	if _, err := time.Parse(backupIDLayout, manifest.ID); err != nil {
+		return nil, fmt.Errorf("%w. id %s", ErrInvalidManifest, manifest.ID)
+	}
+
+	return manifest, nil
+}
+
+// BackupRun is a directory under SnapshotsPrefix, as listed. The
+// manifest is the first of Keys, so that a run which is partly
+// deleted is no longer complete.
+type BackupRun struct {
+	ID        string
+	CreatedAt time.Time
+	Keys      []string
+	Complete  bool
+}
+
+// BackupRuns groups the listed keys by run, oldest first.
+// Keys which aren't of a run are left out.
+func BackupRuns(keys []string) []*BackupRun {
+	byID := map[string]*BackupRun{}
+
+	for _, key := range keys {
+		id, name, ok := strings.Cut(strings.TrimPrefix(key, SnapshotsPrefix), "/")
+		if !ok || !strings.HasPrefix(key, SnapshotsPrefix) {
+			continue
+		}
+
+		createdAt, err := time.Parse(backupIDLayout, id)
+		if err != nil {
+			continue
+		}
+
+		run, ok := byID[id]
+		if !ok {
+			run = &BackupRun{ID: id, CreatedAt: createdAt}
+			byID[id] = run
+		}
+
+		if path.Base(name) != ManifestName {
+			run.Keys = append(run.Keys, key)
+			continue
+		}
+
+		run.Keys = append([]string{key}, run.Keys...)
+		run.Complete = true
+	}
+
+	runs := make([]*BackupRun, 0, len(byID))
+	for _, run := range byID {
+		runs = append(runs, run)
+	}
+
+	sort.Slice(runs, func(i, j int) bool { return runs[i].ID < runs[j].ID })
+	return runs
+}
+
+// ExpiredBackupRuns picks the runs to delete. Past the latest keep
+// complete runs, and the ones older than maxAge, are expired, 0 turns
+// either off. The latest complete run is never expired. Incomplete
+// runs are expired once a later run is complete, the ones after it
+// may still be running.
+func ExpiredBackupRuns(runs []*BackupRun, keep int, maxAge time.Duration, now time.Time) []*BackupRun {
+	expired := []*BackupRun{}
+	latest := ""
+	complete := 0
+
+	for i := len(runs) - 1; i >= 0; i-- {
+		run := runs[i]
+
+		if !run.Complete {
+			if latest != "" {
+				expired = append(expired, run)
+			}
+			continue
+		}
+
+		if latest == "" {
+			latest = run.ID
+			complete++
+			continue
+		}
+
+		complete++
+
+		if (keep > 0 && complete > keep) || (maxAge > 0 && now.Sub(run.CreatedAt) > maxAge) {
+			expired = append(expired, run)
+		}
+	}
+
+	return expired
+}
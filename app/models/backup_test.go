@@ -0,0 +1,103 @@
+package models_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/go-batteries/shortner/app/models"
+)
+
+func Test_BackupRetention(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+
+	keys := []string{"db_a_e/t1/00000000000000000001-00000000000000000002.jsonl.gz"}
+	ids := []string{}
+
+	for days := 5; days >= 0; days-- {
+		manifest := models.NewBackupManifest(now.Add(-time.Duration(days) * 24 * time.Hour))
+		ids = append(ids, manifest.ID)
+
+		keys = append(keys, manifest.Prefix()+"db_a_e.db.gz")
+
+		// the run of 3 days ago didn't finish
+		if days != 3 {
+			keys = append(keys, manifest.Key())
+		}
+	}
+
+	runs := models.BackupRuns(keys)
+	if len(runs) != 6 || runs[0].ID != ids[0] || runs[5].ID != ids[5] {
+		t.Fatalf("expected 6 runs, oldest first, got %d", len(runs))
+	}
+
+	if runs[2].Complete || !runs[1].Complete || runs[1].Keys[0] != models.SnapshotsPrefix+runs[1].ID+"/"+models.ManifestName {
+		t.Fatalf("expected the manifest first, and the unfinished run incomplete, got %+v", runs[1])
+	}
+
+	expiredIDs := func(expired []*models.BackupRun) map[string]bool {
+		found := map[string]bool{}
+		for _, run := range expired {
+			found[run.ID] = true
+		}
+		return found
+	}
+
+	expired := expiredIDs(models.ExpiredBackupRuns(runs, 2, 0, now))
+	if len(expired) != 4 || !expired[ids[0]] || !expired[ids[2]] || expired[ids[4]] || expired[ids[5]] {
+		t.Fatalf("expected all but the latest 2 runs to expire, got %v", expired)
+	}
+
+	expired = expiredIDs(models.ExpiredBackupRuns(runs, 0, 36*time.Hour, now))
+	if len(expired) != 4 || expired[ids[4]] || expired[ids[5]] {
+		t.Fatalf("expected the runs older than 36h to expire, got %v", expired)
+	}
+
+	// the latest complete run is kept, however old
+	expired = expiredIDs(models.ExpiredBackupRuns(runs, 0, time.Hour, now.Add(30*24*time.Hour)))
+	if len(expired) != 5 || expired[ids[5]] {
+		t.Fatalf("expected the latest run to be kept, got %v", expired)
+	}
+
+	// a run after the latest complete one may be running
+	inProgress := models.NewBackupManifest(now.Add(time.Hour))
+	runs = models.BackupRuns(append(keys, inProgress.Prefix()+"db_a_e.db.gz"))
+
+	expired = expiredIDs(models.ExpiredBackupRuns(runs, 0, 0, now))
+	if len(expired) != 1 || !expired[ids[2]] {
+		t.Fatalf("expected only the unfinished run before the latest to expire, got %v", expired)
+	}
+}
+
+func Test_BackupManifest(t *testing.T) {
+	manifest := models.NewBackupManifest(time.Date(2026, 10, 16, 22, 10, 0, 0, time.UTC))
+	if manifest.Key() != "snapshots/20261016T221000Z/manifest.json" {
+		t.Fatalf("unexpected manifest key %s", manifest.Key())
+	}
+
+	manifest.Files = append(manifest.Files, &models.BackupFile{
+		Name:       "db_a_e.db",
+		Key:        manifest.Prefix() + "db_a_e.db.gz",
+		KeyRange:   "a-e",
+		Size:       4096,
+		StoredSize: 512,
+		SHA256:     "abc",
+		Compressed: true,
+		Timeline:   "t1",
+		Position:   10,
+	})
+
+	var body bytes.Buffer
+	if err := models.WriteManifest(&body, manifest); err != nil {
+		t.Fatalf("failed to write manifest %v", err)
+	}
+
+	read, err := models.ReadManifest(&body)
+	if err != nil || read.ID != manifest.ID || len(read.Files) != 1 || *read.Files[0] != *manifest.Files[0] {
+		t.Fatalf("expected the manifest to read back, got %+v. %v", read, err)
+	}
+
+	if _, err := models.ReadManifest(bytes.NewBufferString(`{"id": "latest"}`)); err == nil {
+		t.Fatalf("expected an invalid id to fail")
+	}
+}
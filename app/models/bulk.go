@@ -0,0 +1,108 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/go-batteries/shortner/app/db"
+)
+
+// assignShards is the next shard of the round robin, followed by
+// the others in order, for the new keys to fall back on, when the
+// shard runs out of them.
+func (repo *URLRepo) assignShards() ([]db.Shard[string], error) {
+	first, err := repo.sharder.GetShard("")
+	if err != nil {
+		return nil, err
+	}
+
+	shards, ok := repo.sharder.GetShards()
+	start := slices.IndexFunc(shards, func(shard db.Shard[string]) bool { return shard.ID() == first.ID() })
+
+	if !ok || start < 0 {
+		return []db.Shard[string]{first}, nil
+	}
+
+	return append(shards[start:len(shards):len(shards)], shards[:start]...), nil
+}
+
+// AssignURLs reserves keys for all the urls in a transaction per
+// shard, instead of one per url. It starts on the next shard of the
+// round robin, and moves on to the ones after it, when a shard runs
+// out of keys. Either all the urls get a key, or none do, unless a
+// commit fails after an earlier shard committed.
+func (repo *URLRepo) AssignURLs(ctx context.Context, urlStrs []string, opts ...WithAssignOpts) ([]*URL, error) {
+	assignOpts := buildAssignOpts(opts)
+
+	shards, err := repo.assignShards()
+	if err != nil {
+		return nil, err
+	}
+
+	txs := []*sql.Tx{}
+
+	rollback := func() {
+		for _, tx := range txs {
+			tx.Rollback()
+		}
+	}
+
+	now := time.Now().UTC()
+	urls := make([]*URL, 0, len(urlStrs))
+
+	for _, shard := range shards {
+		if len(urls) == len(urlStrs) {
+			break
+		}
+
+		tx, err := shard.Conn().BeginTx(ctx, nil)
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+
+		txs = append(txs, tx)
+
+		for _, urlStr := range urlStrs[len(urls):] {
+			shortKey, generation, err := reserveKey(ctx, tx, urlStr, assignOpts, now)
+			if errors.Is(err, ErrNoFreeKeys) {
+				break
+			}
+
+			if err != nil {
+				rollback()
+				return nil, err
+			}
+
+			link := urlStr
+			urls = append(urls, &URL{
+				Link:       &link,
+				ShortKey:   shortKey,
+				UpdatedAt:  now,
+				ExpiresAt:  assignOpts.ExpiresAt,
+				OwnerID:    assignOpts.OwnerID,
+				Generation: generation,
+			})
+		}
+	}
+
+	if len(urls) < len(urlStrs) {
+		rollback()
+		return nil, ErrNoFreeKeys
+	}
+
+	for i, tx := range txs {
+		if err := tx.Commit(); err != nil {
+			for _, rest := range txs[i+1:] {
+				rest.Rollback()
+			}
+
+			return nil, err
+		}
+	}
+
+	return urls, nil
+}
@@ -0,0 +1,48 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/go-batteries/shortner/app/models"
+)
+
+func Test_AssignURLsFallback(t *testing.T) {
+	ctx := context.Background()
+	repo := models.NewURLRepo(rangeShards(t, 3, "a-m", "n-z"))
+
+	urlStrs := []string{}
+	for i := 0; i < 5; i++ {
+		urlStrs = append(urlStrs, fmt.Sprintf("https://example.com/%d", i))
+	}
+
+	// more than a shard has, the rest goes to the next one
+	urls, err := repo.AssignURLs(ctx, urlStrs)
+	if err != nil || len(urls) != 5 {
+		t.Fatalf("expected the remainder to fall back to the next shard, got %d. %v", len(urls), err)
+	}
+
+	shards := map[byte]int{}
+	for i, u := range urls {
+		shards[u.ShortKey[0]]++
+
+		if found, err := repo.Find(ctx, u.ShortKey); err != nil || *found.Link != fmt.Sprintf("https%%3A%%2F%%2Fexample.com%%2F%d", i) {
+			t.Fatalf("expected %s to point to url %d, got %v", u.ShortKey, i, err)
+		}
+	}
+
+	if len(shards) != 2 {
+		t.Fatalf("expected the keys of both shards, got %v", shards)
+	}
+
+	// a key left in all, none of the 2 are assigned
+	if _, err := repo.AssignURLs(ctx, []string{"https://a.com", "https://b.com"}); !errors.Is(err, models.ErrNoFreeKeys) {
+		t.Fatalf("expected no free keys, got %v", err)
+	}
+
+	if _, err := repo.AssignURL(ctx, "https://a.com"); err != nil {
+		t.Fatalf("expected the rolled back key to be free, got %v", err)
+	}
+}
@@ -0,0 +1,451 @@
+package models
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultLinkCacheSize         = 10000
+	DefaultLinkCacheTTL          = 5 * time.Minute
+	DefaultLinkCacheNegativeTTL  = 30 * time.Second
+	DefaultLinkCacheTombstoneTTL = 10 * time.Second
+)
+
+// linkCacheStripes are the versions of the keys, a key shares
+// its version with the others hashing to the same stripe. An
+// invalidation skips the set of those, till they are read again.
+const linkCacheStripes = 1024
+
+// linkCachePrefix namespaces the keys in memcached,
+// which is shared with the rate limiter.
+const linkCachePrefix = "link:"
+
+type LinkCacheOpts struct {
+	// Size is the number of short keys kept in memory
+	Size int
+	// TTL bounds how stale a link can be, when it was changed
+	// through another server, and the change didn't reach this
+	// one, see CachedStore.Broadcaster.
+	TTL time.Duration
+	// NegativeTTL is how long a missing key is remembered
+	NegativeTTL time.Duration
+	// TombstoneTTL is how long an invalidated key isn't cached
+	// in memcached. It should be longer than a Find takes, so
+	// the reads from before the change can't cache it again.
+	TombstoneTTL time.Duration
+}
+
+func DefaultLinkCacheOpts() *LinkCacheOpts {
+	return &LinkCacheOpts{
+		Size:         DefaultLinkCacheSize,
+		TTL:          DefaultLinkCacheTTL,
+		NegativeTTL:  DefaultLinkCacheNegativeTTL,
+		TombstoneTTL: DefaultLinkCacheTombstoneTTL,
+	}
+}
+
+type CacheStats struct {
+	Hits         int64 `json:"hits"`
+	NegativeHits int64 `json:"negative_hits"`
+	RemoteHits   int64 `json:"remote_hits"`
+	Misses       int64 `json:"misses"`
+	Evictions    int64 `json:"evictions"`
+	Size         int   `json:"size"`
+}
+
+// cacheEntry is a Find result. Either a link, or the error
+// for a key which doesn't resolve.
+type cacheEntry struct {
+	ShortKey  string     `json:"short_key"`
+	Link      string     `json:"link,omitempty"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Err       string     `json:"err,omitempty"`
+	StoredAt  time.Time  `json:"stored_at"`
+
+	// Tombstone is left in memcached by Invalidate, for TombstoneTTL
+	Tombstone bool `json:"tombstone,omitempty"`
+}
+
+func (entry *cacheEntry) negative() bool {
+	return entry.Err != ""
+}
+
+func (entry *cacheEntry) result(now time.Time) (*URL, error) {
+	switch entry.Err {
+	case ErrLinkExpired.Error():
+		return nil, ErrLinkExpired
+	case ErrLinkNotFound.Error():
+		return nil, ErrLinkNotFound
+	case ErrLinkMalicious.Error():
+		return nil, ErrLinkMalicious
+	}
+
+	// the link was cached before it expired
+	if entry.ExpiresAt != nil && !entry.ExpiresAt.After(now) {
+		return nil, ErrLinkExpired
+	}
+
+	link := entry.Link
+
+	return &URL{
+		ShortKey:  entry.ShortKey,
+		Link:      &link,
+		UpdatedAt: entry.UpdatedAt,
+		ExpiresAt: entry.ExpiresAt,
+	}, nil
+}
+
+// LinkCache is a bounded LRU of Find results, with memcached
+// as an optional second tier shared by the servers.
+type LinkCache struct {
+	opts   *LinkCacheOpts
+	remote *memcache.Client
+
+	mu    sync.Mutex
+	items map[string]*list.Element
+	order *list.List
+
+	// versions are bumped by Invalidate, a read which started
+	// at an older version, doesn't cache what it read.
+	versions [linkCacheStripes]uint64
+
+	hits, negativeHits, remoteHits, misses, evictions atomic.Int64
+}
+
+// NewLinkCache, remote can be nil, to only cache in memory.
+func NewLinkCache(opts *LinkCacheOpts, remote *memcache.Client) *LinkCache {
+	return &LinkCache{
+		opts:   opts,
+		remote: remote,
+		items:  map[string]*list.Element{},
+		order:  list.New(),
+	}
+}
+
+func stripe(shortKey string) int {
+	h := fnv.New32a()
+	h.Write([]byte(shortKey))
+
+	return int(h.Sum32() % linkCacheStripes)
+}
+
+// version is taken before reading a key, to set it later
+func (cache *LinkCache) version(shortKey string) uint64 {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	return cache.versions[stripe(shortKey)]
+}
+
+func (cache *LinkCache) ttl(entry *cacheEntry) time.Duration {
+	if entry.negative() {
+		return cache.opts.NegativeTTL
+	}
+
+	return cache.opts.TTL
+}
+
+func (cache *LinkCache) getLocal(shortKey string, now time.Time) (*cacheEntry, bool) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	elem, ok := cache.items[shortKey]
+	if !ok {
+		return nil, false
+	}
+
+	entry := elem.Value.(*cacheEntry)
+
+	if now.Sub(entry.StoredAt) > cache.ttl(entry) {
+		cache.order.Remove(elem)
+		delete(cache.items, shortKey)
+		return nil, false
+	}
+
+	cache.order.MoveToFront(elem)
+	return entry, true
+}
+
+// setLocal is false, if the key was invalidated after version
+func (cache *LinkCache) setLocal(entry *cacheEntry, version uint64) bool {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if cache.versions[stripe(entry.ShortKey)] != version {
+		return false
+	}
+
+	if elem, ok := cache.items[entry.ShortKey]; ok {
+		elem.Value = entry
+		cache.order.MoveToFront(elem)
+		return true
+	}
+
+	cache.items[entry.ShortKey] = cache.order.PushFront(entry)
+
+	for cache.order.Len() > cache.opts.Size {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.items, oldest.Value.(*cacheEntry).ShortKey)
+		cache.evictions.Add(1)
+	}
+
+	return true
+}
+
+func (cache *LinkCache) getRemote(shortKey string) (*cacheEntry, bool) {
+	if cache.remote == nil {
+		return nil, false
+	}
+
+	item, err := cache.remote.Get(linkCachePrefix + shortKey)
+	if err != nil {
+		if !errors.Is(err, memcache.ErrCacheMiss) {
+			log.Error().Err(err).Msg("failed to read link from memcached")
+		}
+		return nil, false
+	}
+
+	entry := &cacheEntry{}
+	if err := json.Unmarshal(item.Value, entry); err != nil || entry.Tombstone {
+		return nil, false
+	}
+
+	return entry, true
+}
+
+// setRemote only adds the key, so it doesn't replace the tombstone of
+// an invalidation, which happened on another server, during the read.
+func (cache *LinkCache) setRemote(entry *cacheEntry) {
+	if cache.remote == nil {
+		return
+	}
+
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	err = cache.remote.Add(&memcache.Item{
+		Key:        linkCachePrefix + entry.ShortKey,
+		Value:      value,
+		Expiration: int32(cache.ttl(entry).Seconds()),
+	})
+	if err != nil && !errors.Is(err, memcache.ErrNotStored) {
+		log.Error().Err(err).Msg("failed to write link to memcached")
+	}
+}
+
+func (cache *LinkCache) get(shortKey string, now time.Time, version uint64) (*cacheEntry, bool) {
+	if entry, ok := cache.getLocal(shortKey, now); ok {
+		if entry.negative() {
+			cache.negativeHits.Add(1)
+		} else {
+			cache.hits.Add(1)
+		}
+
+		return entry, true
+	}
+
+	if entry, ok := cache.getRemote(shortKey); ok {
+		cache.remoteHits.Add(1)
+		cache.setLocal(entry, version)
+		return entry, true
+	}
+
+	cache.misses.Add(1)
+	return nil, false
+}
+
+// set caches what was read at version, unless the
+// key was invalidated since, then it's stale.
+func (cache *LinkCache) set(entry *cacheEntry, version uint64) {
+	if cache.setLocal(entry, version) {
+		cache.setRemote(entry)
+	}
+}
+
+// Invalidate drops the keys from both the tiers. In memcached,
+// they are replaced by tombstones, see LinkCacheOpts.TombstoneTTL.
+func (cache *LinkCache) Invalidate(shortKeys ...string) {
+	cache.mu.Lock()
+	for _, shortKey := range shortKeys {
+		cache.versions[stripe(shortKey)]++
+
+		if elem, ok := cache.items[shortKey]; ok {
+			cache.order.Remove(elem)
+			delete(cache.items, shortKey)
+		}
+	}
+	cache.mu.Unlock()
+
+	if cache.remote == nil {
+		return
+	}
+
+	for _, shortKey := range shortKeys {
+		value, _ := json.Marshal(&cacheEntry{ShortKey: shortKey, Tombstone: true})
+
+		err := cache.remote.Set(&memcache.Item{
+			Key:        linkCachePrefix + shortKey,
+			Value:      value,
+			Expiration: int32(max(1, cache.opts.TombstoneTTL.Seconds())),
+		})
+		if err != nil {
+			log.Error().Err(err).Str("shortKey", shortKey).Msg("failed to invalidate link in memcached")
+		}
+	}
+}
+
+func (cache *LinkCache) Stats() CacheStats {
+	cache.mu.Lock()
+	size := cache.order.Len()
+	cache.mu.Unlock()
+
+	return CacheStats{
+		Hits:         cache.hits.Load(),
+		NegativeHits: cache.negativeHits.Load(),
+		RemoteHits:   cache.remoteHits.Load(),
+		Misses:       cache.misses.Load(),
+		Evictions:    cache.evictions.Load(),
+		Size:         size,
+	}
+}
+
+// Broadcaster tells the other servers about the keys a write changed,
+// so they drop them from their cache. InvalidationRepo is one.
+type Broadcaster interface {
+	Broadcast(ctx context.Context, shortKeys ...string) error
+}
+
+// CachedStore reads through the cache on Find, and invalidates the
+// keys it writes. The read and the write stores should share the
+// same LinkCache, so writes invalidate what the reads cached.
+type CachedStore struct {
+	Store
+	cache *LinkCache
+
+	// Broadcaster, if set, is told about the deletes and the
+	// retargets. Without it, the other servers serve the link
+	// from memory, till LinkCacheOpts.TTL.
+	Broadcaster Broadcaster
+}
+
+func NewCachedStore(store Store, cache *LinkCache) *CachedStore {
+	return &CachedStore{Store: store, cache: cache}
+}
+
+func (store *CachedStore) Find(ctx context.Context, shortKey string) (*URL, error) {
+	now := time.Now().UTC()
+	version := store.cache.version(shortKey)
+
+	if entry, ok := store.cache.get(shortKey, now, version); ok {
+		return entry.result(now)
+	}
+
+	u, err := store.Store.Find(ctx, shortKey)
+
+	entry := &cacheEntry{ShortKey: shortKey, StoredAt: now}
+
+	switch {
+	case errors.Is(err, ErrLinkNotFound), errors.Is(err, ErrLinkExpired), errors.Is(err, ErrLinkMalicious):
+		entry.Err = err.Error()
+	case err != nil:
+		return u, err
+	case u == nil || u.Link == nil:
+		// a seeded key, which isn't handed out yet
+		entry.Err = ErrLinkNotFound.Error()
+	default:
+		entry.Link = *u.Link
+		entry.UpdatedAt = u.UpdatedAt
+		entry.ExpiresAt = u.ExpiresAt
+	}
+
+	store.cache.set(entry, version)
+	return entry.result(now)
+}
+
+func (store *CachedStore) AssignURL(ctx context.Context, urlStr string, opts ...WithAssignOpts) (*URL, error) {
+	u, err := store.Store.AssignURL(ctx, urlStr, opts...)
+	if err == nil {
+		store.cache.Invalidate(u.ShortKey)
+	}
+
+	return u, err
+}
+
+func (store *CachedStore) AssignURLs(ctx context.Context, urlStrs []string, opts ...WithAssignOpts) ([]*URL, error) {
+	urls, err := store.Store.AssignURLs(ctx, urlStrs, opts...)
+	if err != nil {
+		return urls, err
+	}
+
+	shortKeys := make([]string, 0, len(urls))
+	for _, u := range urls {
+		shortKeys = append(shortKeys, u.ShortKey)
+	}
+
+	store.cache.Invalidate(shortKeys...)
+	return urls, nil
+}
+
+func (store *CachedStore) AssignAlias(ctx context.Context, alias string, urlStr string, opts ...WithAssignOpts) (*URL, error) {
+	u, err := store.Store.AssignAlias(ctx, alias, urlStr, opts...)
+	if err == nil {
+		store.cache.Invalidate(alias)
+	}
+
+	return u, err
+}
+
+// broadcast doesn't fail the write, which went through
+// already. The other servers catch up by the cache ttl.
+func (store *CachedStore) broadcast(ctx context.Context, shortKey string) {
+	if store.Broadcaster == nil {
+		return
+	}
+
+	if err := store.Broadcaster.Broadcast(ctx, shortKey); err != nil {
+		log.Error().Err(err).Str("shortKey", shortKey).Msg("failed to broadcast the invalidation")
+	}
+}
+
+func (store *CachedStore) Retarget(ctx context.Context, ownerID string, shortKey string, urlStr string, generation int64) (*URL, error) {
+	u, err := store.Store.Retarget(ctx, ownerID, shortKey, urlStr, generation)
+	if err == nil {
+		store.cache.Invalidate(shortKey)
+		store.broadcast(ctx, shortKey)
+	}
+
+	return u, err
+}
+
+func (store *CachedStore) Delete(ctx context.Context, ownerID string, shortKey string, generation int64) error {
+	err := store.Store.Delete(ctx, ownerID, shortKey, generation)
+	if err == nil {
+		store.cache.Invalidate(shortKey)
+		store.broadcast(ctx, shortKey)
+	}
+
+	return err
+}
+
+func (store *CachedStore) SetMalicious(ctx context.Context, shortKey string, malicious bool, generation int64) (*URL, error) {
+	u, err := store.Store.SetMalicious(ctx, shortKey, malicious, generation)
+	if err == nil {
+		store.cache.Invalidate(shortKey)
+	}
+
+	return u, err
+}
@@ -0,0 +1,127 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-batteries/shortner/app/models"
+)
+
+func Test_CachedStore(t *testing.T) {
+	ctx := context.Background()
+
+	opts := models.DefaultLinkCacheOpts()
+	opts.Size = 2
+
+	cache := models.NewLinkCache(opts, nil)
+	store := models.NewCachedStore(models.NewMemoryStore(), cache)
+
+	if _, err := store.Find(ctx, "gh-home"); !errors.Is(err, models.ErrLinkNotFound) {
+		t.Fatalf("expected link_not_found, got %v", err)
+	}
+
+	if _, err := store.Find(ctx, "gh-home"); !errors.Is(err, models.ErrLinkNotFound) {
+		t.Fatalf("expected cached link_not_found, got %v", err)
+	}
+
+	if stats := cache.Stats(); stats.Misses != 1 || stats.NegativeHits != 1 {
+		t.Fatalf("expected 1 miss and 1 negative hit, got %+v", stats)
+	}
+
+	// the alias should not stay negatively cached
+	if _, err := store.AssignAlias(ctx, "gh-home", "https://github.com", models.WithOwner("acc_1")); err != nil {
+		t.Fatalf("failed to assign alias %v", err)
+	}
+
+	u, err := store.Find(ctx, "gh-home")
+	if err != nil || *u.Link != "https%3A%2F%2Fgithub.com" {
+		t.Fatalf("expected the alias to resolve, got %v", err)
+	}
+
+	if _, err := store.Retarget(ctx, "acc_1", "gh-home", "https://gitlab.com", models.AnyGeneration); err != nil {
+		t.Fatalf("failed to retarget %v", err)
+	}
+
+	u, err = store.Find(ctx, "gh-home")
+	if err != nil || *u.Link != "https%3A%2F%2Fgitlab.com" {
+		t.Fatalf("expected the retargeted link, got %v", err)
+	}
+
+	if err := store.Delete(ctx, "acc_1", "gh-home", models.AnyGeneration); err != nil {
+		t.Fatalf("failed to delete %v", err)
+	}
+
+	if _, err := store.Find(ctx, "gh-home"); !errors.Is(err, models.ErrLinkNotFound) {
+		t.Fatalf("expected link_not_found after delete, got %v", err)
+	}
+
+	for _, key := range []string{"k1", "k2", "k3"} {
+		store.Find(ctx, key)
+	}
+
+	if stats := cache.Stats(); stats.Size != 2 || stats.Evictions == 0 {
+		t.Fatalf("expected the cache to stay bounded, got %+v", stats)
+	}
+}
+
+// pausedStore holds Find after the read, till it's released
+type pausedStore struct {
+	models.Store
+	read    chan struct{}
+	release chan struct{}
+}
+
+func (store *pausedStore) Find(ctx context.Context, shortKey string) (*models.URL, error) {
+	u, err := store.Store.Find(ctx, shortKey)
+
+	store.read <- struct{}{}
+	<-store.release
+
+	return u, err
+}
+
+func Test_CachedStoreInvalidateDuringFind(t *testing.T) {
+	ctx := context.Background()
+
+	memory := models.NewMemoryStore()
+	if _, err := memory.AssignAlias(ctx, "gh-home", "https://github.com", models.WithOwner("acc_1")); err != nil {
+		t.Fatalf("failed to assign alias %v", err)
+	}
+
+	cache := models.NewLinkCache(models.DefaultLinkCacheOpts(), nil)
+	paused := &pausedStore{Store: memory, read: make(chan struct{}), release: make(chan struct{})}
+
+	reads := models.NewCachedStore(paused, cache)
+	writes := models.NewCachedStore(memory, cache)
+
+	found := make(chan *models.URL)
+	go func() {
+		u, _ := reads.Find(ctx, "gh-home")
+		found <- u
+	}()
+
+	// the retarget lands between the read and the set
+	<-paused.read
+
+	if _, err := writes.Retarget(ctx, "acc_1", "gh-home", "https://gitlab.com", models.AnyGeneration); err != nil {
+		t.Fatalf("failed to retarget %v", err)
+	}
+
+	close(paused.release)
+
+	if u := <-found; u == nil || *u.Link != "https%3A%2F%2Fgithub.com" {
+		t.Fatalf("expected the read from before the retarget, got %+v", u)
+	}
+
+	go func() { <-paused.read }()
+
+	u, err := reads.Find(ctx, "gh-home")
+	if err != nil || *u.Link != "https%3A%2F%2Fgitlab.com" {
+		t.Fatalf("expected the stale read to not be cached, got %v", err)
+	}
+
+	if stats := cache.Stats(); stats.Hits != 0 || stats.Misses != 2 {
+		t.Fatalf("expected both the finds to miss, got %+v", stats)
+	}
+}
@@ -0,0 +1,276 @@
+package models
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-batteries/shortner/app/db"
+)
+
+var ErrInvalidSegment = errors.New("invalid_segment")
+
+// ChangeEntry is a write to urls, as recorded by the changelog
+// triggers. Data is the row after an upsert, and empty on a delete.
+type ChangeEntry struct {
+	Seq       int64           `json:"seq"`
+	Op        string          `json:"op"`
+	ShortKey  string          `json:"short_key"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	ChangedAt int64           `json:"changed_at"`
+}
+
+func (e *ChangeEntry) ChangedTime() time.Time {
+	return time.UnixMilli(e.ChangedAt).UTC()
+}
+
+// ChangelogState is where the changelog of a shard is. Shipped is the
+// last change shipped, and Position the last one written to the shard.
+// Changes are numbered per timeline, which changes when a shard is
+// restored, since the restored one goes its own way from there.
+type ChangelogState struct {
+	Timeline string
+	Shipped  int64
+	Position int64
+}
+
+const (
+	ChangelogStateQuery = `SELECT timeline, shipped_seq, MAX(shipped_seq, COALESCE((SELECT MAX(seq) FROM changelog), 0)) FROM changelog_state WHERE id = 1`
+	ReadChangelogQuery  = `SELECT seq, op, short_key, data, changed_at FROM changelog WHERE seq > ? ORDER BY seq LIMIT ?`
+	MarkShippedQuery    = `UPDATE changelog_state SET shipped_seq = MAX(shipped_seq, ?) WHERE id = 1`
+	TrimChangelogQuery  = `DELETE FROM changelog WHERE seq <= ?`
+	NewTimelineQuery    = `UPDATE changelog_state SET timeline = lower(hex(randomblob(8))) WHERE id = 1`
+	InsertChangeQuery   = `INSERT INTO changelog (seq, op, short_key, data, changed_at) VALUES (?, ?, ?, ?, ?)`
+	DeleteChangedQuery  = `DELETE FROM urls WHERE short_key = ?`
+)
+
+// replayUpdateQuery and replayInsertQuery write the row of an upsert,
+// the columns are picked out of the json by sqlite.
+var replayUpdateQuery, replayInsertQuery = func() (string, string) {
+	sets := make([]string, 0, len(db.ChangelogColumns))
+	values := make([]string, 0, len(db.ChangelogColumns))
+
+	for _, column := range db.ChangelogColumns {
+		sets = append(sets, fmt.Sprintf("%s = json_extract(?1, '$.%s')", column, column))
+		values = append(values, fmt.Sprintf("json_extract(?1, '$.%s')", column))
+	}
+
+	return fmt.Sprintf("UPDATE urls SET %s WHERE short_key = ?2", strings.Join(sets, ", ")),
+		fmt.Sprintf("INSERT INTO urls (%s) VALUES (%s)", strings.Join(db.ChangelogColumns, ", "), strings.Join(values, ", "))
+}()
+
+type ChangelogRepo struct {
+	name string
+	conn *sql.DB
+}
+
+func NewChangelogRepo(name string, conn *sql.DB) *ChangelogRepo {
+	return &ChangelogRepo{name: name, conn: conn}
+}
+
+func (repo *ChangelogRepo) State(ctx context.Context) (*ChangelogState, error) {
+	state := &ChangelogState{}
+
+	err := repo.conn.QueryRowContext(ctx, ChangelogStateQuery).Scan(&state.Timeline, &state.Shipped, &state.Position)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the changelog state of %s. %v", repo.name, err)
+	}
+
+	return state, nil
+}
+
+// Read returns upto limit changes after the seq, in order
+func (repo *ChangelogRepo) Read(ctx context.Context, after int64, limit int) ([]*ChangeEntry, error) {
+	rows, err := repo.conn.QueryContext(ctx, ReadChangelogQuery, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*ChangeEntry{}
+
+	for rows.Next() {
+		entry := &ChangeEntry{}
+		var data sql.NullString
+
+		if err := rows.Scan(&entry.Seq, &entry.Op, &entry.ShortKey, &data, &entry.ChangedAt); err != nil {
+			return nil, err
+		}
+
+		if data.Valid {
+			entry.Data = json.RawMessage(data.String)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// MarkShipped records the changes upto seq as shipped,
+// and removes them from the shard.
+func (repo *ChangelogRepo) MarkShipped(ctx context.Context, seq int64) error {
+	tx, err := repo.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, MarkShippedQuery, seq); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, TrimChangelogQuery, seq); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Replay writes the changes to the shard, and records them in its
+// changelog with their seq, as if they happened there. The triggers
+// should be off, see db.SqliteCoordinator.Changelog.
+func (repo *ChangelogRepo) Replay(ctx context.Context, entries []*ChangeEntry) error {
+	tx, err := repo.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := replay(ctx, tx, entry); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("failed to replay change %d of %s. %v", entry.Seq, repo.name, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+func replay(ctx context.Context, tx *sql.Tx, entry *ChangeEntry) error {
+	var data *string
+
+	switch entry.Op {
+	case db.ChangeOpUpsert:
+		row := string(entry.Data)
+		data = &row
+
+		res, err := tx.ExecContext(ctx, replayUpdateQuery, row, entry.ShortKey)
+		if err != nil {
+			return err
+		}
+
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			if _, err := tx.ExecContext(ctx, replayInsertQuery, row); err != nil {
+				return err
+			}
+		}
+	case db.ChangeOpDelete:
+		if _, err := tx.ExecContext(ctx, DeleteChangedQuery, entry.ShortKey); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown op %q", entry.Op)
+	}
+
+	_, err := tx.ExecContext(ctx, InsertChangeQuery, entry.Seq, entry.Op, entry.ShortKey, data, entry.ChangedAt)
+	return err
+}
+
+// NewTimeline starts a new timeline for the shard, from its position
+func (repo *ChangelogRepo) NewTimeline(ctx context.Context) (*ChangelogState, error) {
+	if _, err := repo.conn.ExecContext(ctx, NewTimelineQuery); err != nil {
+		return nil, err
+	}
+
+	return repo.State(ctx)
+}
+
+// Segment is a file of shipped changes, First to Last of a timeline.
+// They are named so that they list in order.
+type Segment struct {
+	ShardID  string
+	Timeline string
+	First    int64
+	Last     int64
+}
+
+const segmentExt = ".jsonl.gz"
+
+// SegmentPrefix is where the segments of the shard's timeline are
+// kept. The directory of the shard file isn't a part of it.
+func SegmentPrefix(shardID string, timeline string) string {
+	return path.Join(filepath.Base(shardID), timeline) + "/"
+}
+
+func (s *Segment) Key() string {
+	return fmt.Sprintf("%s%020d-%020d%s", SegmentPrefix(s.ShardID, s.Timeline), s.First, s.Last, segmentExt)
+}
+
+// ParseSegmentKey is the reverse of Segment.Key
+func ParseSegmentKey(key string) (*Segment, error) {
+	parts := strings.Split(strings.TrimSuffix(key, segmentExt), "/")
+	if len(parts) < 3 || !strings.HasSuffix(key, segmentExt) {
+		return nil, fmt.Errorf("%w. %s", ErrInvalidSegment, key)
+	}
+
+	segment := &Segment{
+		ShardID:  parts[len(parts)-3],
+		Timeline: parts[len(parts)-2],
+	}
+
+	if _, err := fmt.Sscanf(parts[len(parts)-1], "%d-%d", &segment.First, &segment.Last); err != nil {
+		return nil, fmt.Errorf("%w. %s", ErrInvalidSegment, key)
+	}
+
+	return segment, nil
+}
+
+// WriteSegment writes the changes as gzipped json lines
+func WriteSegment(w io.Writer, entries []*ChangeEntry) error {
+	zw := gzip.NewWriter(w)
+	enc := json.NewEncoder(zw)
+
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			zw.Close()
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+// ReadSegment is the reverse of WriteSegment
+func ReadSegment(r io.Reader) ([]*ChangeEntry, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w. %v", ErrInvalidSegment, err)
+	}
+	defer zr.Close()
+
+	entries := []*ChangeEntry{}
+	scanner := bufio.NewScanner(zr)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		entry := &ChangeEntry{}
+
+		if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+			return nil, fmt.Errorf("%w. %v", ErrInvalidSegment, err)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
@@ -0,0 +1,137 @@
+package models_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-batteries/shortner/app/db"
+	"github.com/go-batteries/shortner/app/models"
+)
+
+func changelogShard(t *testing.T, path string, changelog bool) (*db.SqliteCoordinator[string], db.Shard[string]) {
+	t.Helper()
+
+	database := db.NewSqliteCoordinator([]string{"a-z"})
+	database.ToDbName = func(string) string { return path }
+	database.Changelog = changelog
+
+	if err := database.RegisterShards(context.Background()); err != nil {
+		t.Fatalf("failed to create shard %v", err)
+	}
+	t.Cleanup(database.DeInit)
+
+	shards, _ := database.GetShards()
+	database.SetPolicy(&db.KeyOrRoundRobinPolicy[string]{
+		Keyed: &db.KeyBasedPolicy[string]{Shards: db.ShardsByKeyRange([]string{"a-z"}, shards)},
+		Robin: &db.RoundRobinPolicy[string]{Shards: shards},
+	})
+
+	return database, shards[0]
+}
+
+func Test_ChangelogReplay(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	database, shard := changelogShard(t, filepath.Join(dir, "db_a_z"), true)
+	repo := models.NewURLRepo(database)
+
+	now := time.Now().UTC()
+	err := repo.CreateBatches(ctx, []*models.URL{
+		{ShortKey: "abc", CreatedAt: now, UpdatedAt: now},
+		{ShortKey: "abd", CreatedAt: now, UpdatedAt: now},
+	})
+	if err != nil {
+		t.Fatalf("failed to seed keys %v", err)
+	}
+
+	if _, err := repo.AssignAlias(ctx, "my-link", "https://github.com", models.WithOwner("acc_1")); err != nil {
+		t.Fatalf("failed to assign alias %v", err)
+	}
+
+	assigned, err := repo.AssignURL(ctx, "https://gitlab.com")
+	if err != nil {
+		t.Fatalf("failed to assign url %v", err)
+	}
+
+	if err := repo.Delete(ctx, "acc_1", "my-link", models.AnyGeneration); err != nil {
+		t.Fatalf("failed to delete %v", err)
+	}
+
+	changelog := models.NewChangelogRepo("db_a_z", shard.Conn())
+
+	entries, err := changelog.Read(ctx, 0, 100)
+	// the seeded keys aren't in it, till they are handed out
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("expected an alias, an assign and a delete, got %d. %v", len(entries), err)
+	}
+
+	if entries[1].ShortKey != assigned.ShortKey {
+		t.Fatalf("expected the assigned key, got %+v", entries[1])
+	}
+
+	for i, entry := range entries {
+		if entry.Seq != int64(i+1) || entry.Op != db.ChangeOpUpsert {
+			t.Fatalf("expected upserts in order, got %+v", entry)
+		}
+	}
+
+	var body bytes.Buffer
+	if err := models.WriteSegment(&body, entries); err != nil {
+		t.Fatalf("failed to write segment %v", err)
+	}
+
+	segment := &models.Segment{ShardID: "shards/db_a_z", Timeline: "t1", First: 1, Last: 3}
+	parsed, err := models.ParseSegmentKey("prefix/" + segment.Key())
+	if err != nil || *parsed != (models.Segment{ShardID: "db_a_z", Timeline: "t1", First: 1, Last: 3}) {
+		t.Fatalf("expected the segment key to parse back, got %+v. %v", parsed, err)
+	}
+
+	shipped, err := models.ReadSegment(&body)
+	if err != nil || len(shipped) != len(entries) {
+		t.Fatalf("failed to read segment back %v", err)
+	}
+
+	if err := changelog.MarkShipped(ctx, 3); err != nil {
+		t.Fatalf("failed to mark shipped %v", err)
+	}
+
+	if state, _ := changelog.State(ctx); state.Shipped != 3 || state.Position != 3 {
+		t.Fatalf("expected shipped and position at 3, got %+v", state)
+	}
+
+	// everything but the delete
+	restoredDB, restored := changelogShard(t, filepath.Join(dir, "restored_a_z"), false)
+	restoredLog := models.NewChangelogRepo("restored_a_z", restored.Conn())
+
+	if err := restoredLog.Replay(ctx, shipped[:2]); err != nil {
+		t.Fatalf("failed to replay %v", err)
+	}
+
+	u, err := models.NewURLRepo(restoredDB).Find(ctx, "my-link")
+	if err != nil || *u.Link != "https%3A%2F%2Fgithub.com" {
+		t.Fatalf("expected the alias before it was deleted, got %v", err)
+	}
+
+	// the key was never seeded in the restored shard
+	u, err = models.NewURLRepo(restoredDB).Find(ctx, assigned.ShortKey)
+	if err != nil || *u.Link != "https%3A%2F%2Fgitlab.com" {
+		t.Fatalf("expected the assigned key to be replayed, got %v", err)
+	}
+
+	if err := restoredLog.Replay(ctx, shipped[2:]); err != nil {
+		t.Fatalf("failed to replay %v", err)
+	}
+
+	if _, err := models.NewURLRepo(restoredDB).Find(ctx, "my-link"); !errors.Is(err, models.ErrLinkNotFound) {
+		t.Fatalf("expected the alias to be deleted, got %v", err)
+	}
+
+	if state, _ := restoredLog.State(ctx); state.Position != 3 || state.Shipped != 0 {
+		t.Fatalf("expected the replayed changes to be unshipped, got %+v", state)
+	}
+}
@@ -0,0 +1,139 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-batteries/shortner/app/db"
+)
+
+type Click struct {
+	ShortKey  string    `db:"short_key"`
+	ClickedAt time.Time `db:"clicked_at"`
+	Referrer  string    `db:"referrer"`
+	UserAgent string    `db:"user_agent"`
+	Country   string    `db:"country"`
+
+	// IP is only used to resolve the country, it isn't stored
+	IP string `db:"-"`
+}
+
+func (Click) TableName() string {
+	return "clicks"
+}
+
+type DailyClicks struct {
+	Day    string `json:"day"`
+	Clicks int64  `json:"clicks"`
+}
+
+type ClickStats struct {
+	ShortKey string         `json:"short_key"`
+	Total    int64          `json:"total"`
+	Daily    []*DailyClicks `json:"daily"`
+}
+
+type ClickRepo struct {
+	sharder db.Coordinator[string]
+}
+
+func NewClickRepo(sharder db.Coordinator[string]) *ClickRepo {
+	return &ClickRepo{sharder: sharder}
+}
+
+const CreateClickBatchesQuery = `INSERT INTO clicks (
+	short_key
+	,clicked_at
+	,referrer
+	,user_agent
+	,country
+) VALUES %s;
+`
+
+// timestamps are stored as text, 2006-01-02 15:04:05...
+// so the first 10 characters are the day
+const DailyClicksQuery = `
+	SELECT substr(clicked_at, 1, 10) AS day
+		,COUNT(1) AS clicks
+	FROM clicks
+	WHERE short_key = ?
+	AND clicked_at >= ?
+	GROUP BY day
+	ORDER BY day
+`
+
+// CreateBatches writes the clicks to the shard owning
+// the short key. Clicks are grouped per shard, so one
+// insert is done per shard.
+func (repo *ClickRepo) CreateBatches(ctx context.Context, clicks []*Click) error {
+	var shardClicks = map[db.Shard[string]][]*Click{}
+
+	for _, click := range clicks {
+		shard, err := repo.sharder.GetShard(click.ShortKey)
+		if err != nil {
+			return fmt.Errorf("failed to get shard for %s. %v", click.ShortKey, err)
+		}
+
+		shardClicks[shard] = append(shardClicks[shard], click)
+	}
+
+	var errr error
+
+	for shard, batch := range shardClicks {
+		placeholders := strings.TrimSuffix(strings.Repeat("(?,?,?,?,?),", len(batch)), ",")
+		query := fmt.Sprintf(CreateClickBatchesQuery, placeholders)
+		values := []interface{}{}
+
+		for _, c := range batch {
+			values = append(values, c.ShortKey, c.ClickedAt, c.Referrer, c.UserAgent, c.Country)
+		}
+
+		if _, err := shard.Conn().ExecContext(ctx, query, values...); err != nil {
+			errr = fmt.Errorf("failed to write clicks to %s. %v", shard.ID(), err)
+		}
+	}
+
+	return errr
+}
+
+// Stats returns the total and the per day clicks since the given time
+func (repo *ClickRepo) Stats(ctx context.Context, shortKey string, since time.Time) (*ClickStats, error) {
+	shard, err := repo.sharder.GetShard(shortKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var stats *ClickStats
+
+	err = db.ReadFrom(shard, func(conn *sql.DB) error {
+		rows, err := conn.QueryContext(ctx, DailyClicksQuery, shortKey, since.UTC())
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		stats = &ClickStats{ShortKey: shortKey, Daily: []*DailyClicks{}}
+
+		for rows.Next() {
+			daily := &DailyClicks{}
+
+			if err := rows.Scan(&daily.Day, &daily.Clicks); err != nil {
+				return err
+			}
+
+			stats.Total += daily.Clicks
+			stats.Daily = append(stats.Daily, daily)
+		}
+
+		return rows.Err()
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
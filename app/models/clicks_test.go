@@ -0,0 +1,64 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-batteries/shortner/app/models"
+)
+
+func Test_ClickStats(t *testing.T) {
+	ctx := context.Background()
+	database, _ := changelogShard(t, filepath.Join(t.TempDir(), "db_a_z"), false)
+
+	repo := models.NewURLRepo(database)
+	clicks := models.NewClickRepo(database)
+
+	past := time.Now().UTC().Add(-time.Minute)
+
+	if _, err := repo.AssignAlias(ctx, "old-sale", "https://sale.com", models.WithOwner("acc_1"), models.WithExpiry(&past)); err != nil {
+		t.Fatalf("failed to assign alias %v", err)
+	}
+
+	owned, err := repo.FindOwned(ctx, "acc_1", "old-sale")
+	if err != nil || !owned.Vanity || owned.ExpiresAt == nil {
+		t.Fatalf("expected the owner to find the expired link, got %+v %v", owned, err)
+	}
+
+	if _, err := repo.FindOwned(ctx, "acc_2", "old-sale"); !errors.Is(err, models.ErrLinkNotFound) {
+		t.Fatalf("expected link_not_found for another owner, got %v", err)
+	}
+
+	today := time.Now().UTC()
+	yesterday := today.AddDate(0, 0, -1)
+
+	if err := clicks.CreateBatches(ctx, []*models.Click{
+		{ShortKey: "old-sale", ClickedAt: yesterday, Referrer: "https://news.com"},
+		{ShortKey: "old-sale", ClickedAt: today},
+		{ShortKey: "old-sale", ClickedAt: today},
+		{ShortKey: "old-sale", ClickedAt: today.AddDate(0, 0, -40)},
+		{ShortKey: "other", ClickedAt: today},
+	}); err != nil {
+		t.Fatalf("failed to write clicks %v", err)
+	}
+
+	stats, err := clicks.Stats(ctx, "old-sale", today.AddDate(0, 0, -30))
+	if err != nil {
+		t.Fatalf("failed to get stats %v", err)
+	}
+
+	if stats.Total != 3 || len(stats.Daily) != 2 {
+		t.Fatalf("expected 3 clicks over 2 days, got %d over %d", stats.Total, len(stats.Daily))
+	}
+
+	if stats.Daily[0].Day != yesterday.Format(time.DateOnly) || stats.Daily[0].Clicks != 1 || stats.Daily[1].Clicks != 2 {
+		t.Fatalf("expected the days in order, got %+v %+v", stats.Daily[0], stats.Daily[1])
+	}
+
+	if stats, _ := clicks.Stats(ctx, "nope", today.AddDate(0, 0, -30)); stats.Total != 0 || len(stats.Daily) != 0 {
+		t.Fatalf("expected no clicks, got %+v", stats)
+	}
+}
@@ -28,8 +28,10 @@ const (
 const DefaultSeedStart uint64 = 1000000000
 
 const (
-	ShardStatusInsertCreateQuery = `INSERT INTO shard_status (shard_id, shard_char, start, end, status, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)`
+	ShardStatusInsertCreateQuery = `INSERT INTO shard_status (shard_id, shard_char, start, end, status, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (shard_id, shard_char) DO UPDATE SET start = excluded.start, end = excluded.end, status = excluded.status, updated_at = excluded.updated_at, generation = generation + 1`
 	ShardStatusSelectQuery       = `SELECT shard_id, shard_char, start, end, status, generation, updated_at FROM shard_status WHERE shard_id = ? AND shard_char = ?`
+	ShardStatusListQuery         = `SELECT shard_id, shard_char, start, end, status, generation, updated_at FROM shard_status ORDER BY shard_id, shard_char`
 	ShardStatusUpdateStatusQuery = `UPDATE shard_status SET end = ?, updated_at = ?, generation = generation + 1, status = ? WHERE shard_id = ? AND shard_char = ? AND generation = ? AND status = ?`
 )
 
@@ -65,6 +67,7 @@ func (repo *ShardStatusRepo) GetLastState(ctx context.Context, shardID, shardCha
 		&shardStatus.ShardChar,
 		&shardStatus.Start,
 		&shardStatus.End,
+		&shardStatus.Status,
 		&shardStatus.Generation,
 		&shardStatus.UpdatedAt,
 	)
@@ -72,6 +75,37 @@ func (repo *ShardStatusRepo) GetLastState(ctx context.Context, shardID, shardCha
 	return shardStatus, err
 }
 
+func (repo *ShardStatusRepo) List(ctx context.Context) ([]*ShardStatus, error) {
+	rows, err := repo.db.QueryContext(ctx, ShardStatusListQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	statuses := []*ShardStatus{}
+
+	for rows.Next() {
+		status := &ShardStatus{}
+
+		err := rows.Scan(
+			&status.ShardID,
+			&status.ShardChar,
+			&status.Start,
+			&status.End,
+			&status.Status,
+			&status.Generation,
+			&status.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses, rows.Err()
+}
+
 func (repo *ShardStatusRepo) UpdateState(ctx context.Context, status *ShardStatus) error {
 	log.Println("updating shard generation info", status.ShardID, status.ShardChar)
 
@@ -0,0 +1,141 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Expired links are tombstoned, which keeps the key taken, so that
+// Get can respond with a 410. The tombstones, of the expired and the
+// deleted links, are quarantined for a cool down, after which they are
+// recycled. The seeded keys are put back in the free pool, and the
+// vanity keys are released. Malicious links are never recycled. Every
+// recycled key is recorded in recycled_keys, with the link it had, and
+// only a row still at the generation recorded is recycled. The clicks
+// of the old link are deleted with it, the next one starts at none.
+const (
+	TombstoneExpiredQuery = `UPDATE urls SET deleted_at = expires_at, updated_at = ?, generation = generation + 1
+		WHERE expires_at IS NOT NULL AND expires_at <= ? AND deleted_at IS NULL AND url IS NOT NULL`
+	AuditRecycledQuery = `INSERT INTO recycled_keys (short_key, generation, url, owner_id, vanity, reason, deleted_at, recycled_at)
+		SELECT short_key, generation, url, owner_id, vanity,
+			CASE WHEN expires_at IS NOT NULL AND expires_at <= deleted_at THEN 'expired' ELSE 'deleted' END,
+			deleted_at, ?
+		FROM urls WHERE deleted_at IS NOT NULL AND deleted_at <= ? AND (malicious IS NULL OR malicious = 0)`
+	RecycleDeletedQuery = `UPDATE urls SET url = NULL, url_hash = NULL, owner_id = NULL, expires_at = NULL, deleted_at = NULL, generation = generation + 1, updated_at = ?1
+		WHERE deleted_at IS NOT NULL AND deleted_at <= ?2 AND vanity = 0 AND (malicious IS NULL OR malicious = 0)
+		AND EXISTS (SELECT 1 FROM recycled_keys r WHERE r.short_key = urls.short_key AND r.generation = urls.generation AND r.recycled_at = ?1)`
+	ReleaseDeletedAliasQuery = `DELETE FROM urls
+		WHERE deleted_at IS NOT NULL AND deleted_at <= ?2 AND vanity = 1 AND (malicious IS NULL OR malicious = 0)
+		AND EXISTS (SELECT 1 FROM recycled_keys r WHERE r.short_key = urls.short_key AND r.generation = urls.generation AND r.recycled_at = ?1)`
+	DeleteRecycledClicksQuery = `DELETE FROM clicks WHERE short_key IN (SELECT short_key FROM recycled_keys WHERE recycled_at = ?)`
+	RecycledKeysQuery         = `SELECT short_key FROM recycled_keys WHERE recycled_at = ? ORDER BY short_key`
+	CountQuarantinedQuery     = `SELECT COUNT(1) FROM urls WHERE deleted_at IS NOT NULL AND (deleted_at > ? OR malicious = 1)`
+)
+
+type SweepStats struct {
+	ShardKey   string
+	Tombstoned int64
+	Recycled   int64
+	Released   int64
+	Clicks     int64
+
+	// Keys are the recycled and the released keys, their
+	// pending reports are of the old links, see ReportRepo.
+	Keys []string
+
+	// Quarantined are the tombstones left, still cooling
+	// down, or malicious, which are never recycled.
+	Quarantined int64
+}
+
+type ExpiryRepo struct {
+	name string
+	conn *sql.DB
+}
+
+func NewExpiryRepo(name string, conn *sql.DB) *ExpiryRepo {
+	return &ExpiryRepo{name: name, conn: conn}
+}
+
+// Sweep tombstones the expired links in the shard. With recycle, the
+// tombstones older than coolDown are recycled, except the malicious
+// ones, which are always kept.
+func (repo *ExpiryRepo) Sweep(ctx context.Context, recycle bool, coolDown time.Duration) (*SweepStats, error) {
+	stats := &SweepStats{ShardKey: repo.name}
+	now := time.Now().UTC()
+	cutoff := now.Add(-coolDown)
+
+	tx, err := repo.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := tx.ExecContext(ctx, TombstoneExpiredQuery, now, now)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	stats.Tombstoned, _ = res.RowsAffected()
+
+	if recycle {
+		if _, err := tx.ExecContext(ctx, AuditRecycledQuery, now, cutoff); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+
+		res, err := tx.ExecContext(ctx, RecycleDeletedQuery, now, cutoff)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		stats.Recycled, _ = res.RowsAffected()
+
+		res, err = tx.ExecContext(ctx, ReleaseDeletedAliasQuery, now, cutoff)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		stats.Released, _ = res.RowsAffected()
+
+		res, err = tx.ExecContext(ctx, DeleteRecycledClicksQuery, now)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		stats.Clicks, _ = res.RowsAffected()
+
+		if stats.Keys, err = recycledKeys(ctx, tx, now); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	if err := tx.QueryRowContext(ctx, CountQuarantinedQuery, cutoff).Scan(&stats.Quarantined); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return stats, tx.Commit()
+}
+
+func recycledKeys(ctx context.Context, tx *sql.Tx, recycledAt time.Time) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, RecycledKeysQuery, recycledAt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shortKeys := []string{}
+
+	for rows.Next() {
+		var shortKey string
+		if err := rows.Scan(&shortKey); err != nil {
+			return nil, err
+		}
+
+		shortKeys = append(shortKeys, shortKey)
+	}
+
+	return shortKeys, rows.Err()
+}
@@ -0,0 +1,177 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-batteries/shortner/app/models"
+)
+
+func Test_SweepRecycle(t *testing.T) {
+	ctx := context.Background()
+
+	database, shard := changelogShard(t, filepath.Join(t.TempDir(), "db_a_z"), false)
+	repo := models.NewURLRepo(database)
+
+	now := time.Now().UTC()
+	free := []*models.URL{}
+
+	for i := 0; i < 4; i++ {
+		free = append(free, &models.URL{ShortKey: fmt.Sprintf("a%03d", i), CreatedAt: now, UpdatedAt: now})
+	}
+
+	if err := repo.CreateBatches(ctx, free); err != nil {
+		t.Fatalf("failed to seed keys %v", err)
+	}
+
+	deleted, _ := repo.AssignURL(ctx, "https://deleted.com", models.WithOwner("acc_1"))
+	malicious, _ := repo.AssignURL(ctx, "https://malicious.com", models.WithOwner("acc_1"))
+
+	past := now.Add(-time.Minute)
+	expired, err := repo.AssignURL(ctx, "https://expired.com", models.WithExpiry(&past))
+	if err != nil {
+		t.Fatalf("failed to assign %v", err)
+	}
+
+	if _, err := repo.AssignAlias(ctx, "my-link", "https://alias.com", models.WithOwner("acc_1")); err != nil {
+		t.Fatalf("failed to assign alias %v", err)
+	}
+
+	for _, shortKey := range []string{deleted.ShortKey, malicious.ShortKey, "my-link"} {
+		if err := repo.Delete(ctx, "acc_1", shortKey, models.AnyGeneration); err != nil {
+			t.Fatalf("failed to delete %s %v", shortKey, err)
+		}
+	}
+
+	if _, err := shard.Conn().ExecContext(ctx, `UPDATE urls SET malicious = 1 WHERE short_key = ?`, malicious.ShortKey); err != nil {
+		t.Fatalf("failed to flag %v", err)
+	}
+
+	clicks := models.NewClickRepo(database)
+
+	err = clicks.CreateBatches(ctx, []*models.Click{
+		{ShortKey: deleted.ShortKey, ClickedAt: now},
+		{ShortKey: deleted.ShortKey, ClickedAt: now},
+		{ShortKey: malicious.ShortKey, ClickedAt: now},
+	})
+	if err != nil {
+		t.Fatalf("failed to record clicks %v", err)
+	}
+
+	sweeper := models.NewExpiryRepo("a-z", shard.Conn())
+
+	// all of them are still cooling down
+	stats, err := sweeper.Sweep(ctx, true, time.Hour)
+	if err != nil || stats.Tombstoned != 1 || stats.Recycled != 0 || stats.Released != 0 || stats.Quarantined != 4 {
+		t.Fatalf("expected the expired link tombstoned, and nothing recycled, got %+v. %v", stats, err)
+	}
+
+	if _, err := repo.Find(ctx, deleted.ShortKey); !errors.Is(err, models.ErrLinkNotFound) {
+		t.Fatalf("expected the deleted link to be gone while quarantined, got %v", err)
+	}
+
+	stats, err = sweeper.Sweep(ctx, true, 0)
+	if err != nil || stats.Recycled != 2 || stats.Released != 1 || stats.Quarantined != 1 {
+		t.Fatalf("expected 2 keys recycled, the alias released, and the malicious one kept, got %+v. %v", stats, err)
+	}
+
+	if len(stats.Keys) != 3 || stats.Clicks != 2 {
+		t.Fatalf("expected the 3 keys and the clicks of the deleted link, got %+v", stats)
+	}
+
+	if clickStats, err := clicks.Stats(ctx, deleted.ShortKey, now.Add(-time.Hour)); err != nil || clickStats.Total != 0 {
+		t.Fatalf("expected the recycled key to start without clicks, got %+v. %v", clickStats, err)
+	}
+
+	if clickStats, err := clicks.Stats(ctx, malicious.ShortKey, now.Add(-time.Hour)); err != nil || clickStats.Total != 1 {
+		t.Fatalf("expected the clicks of the quarantined link kept, got %+v. %v", clickStats, err)
+	}
+
+	var audited, generation int
+	var reason string
+
+	row := shard.Conn().QueryRowContext(ctx, `SELECT COUNT(1) FROM recycled_keys`)
+	if err := row.Scan(&audited); err != nil || audited != 3 {
+		t.Fatalf("expected 3 recycled keys in the audit trail, got %d. %v", audited, err)
+	}
+
+	row = shard.Conn().QueryRowContext(ctx, `SELECT reason FROM recycled_keys WHERE short_key = ?`, expired.ShortKey)
+	if err := row.Scan(&reason); err != nil || reason != "expired" {
+		t.Fatalf("expected the expired key audited as expired, got %s. %v", reason, err)
+	}
+
+	row = shard.Conn().QueryRowContext(ctx, `SELECT generation FROM recycled_keys WHERE short_key = ?`, deleted.ShortKey)
+	if err := row.Scan(&audited); err != nil {
+		t.Fatalf("failed to read the audited generation %v", err)
+	}
+
+	row = shard.Conn().QueryRowContext(ctx, `SELECT generation FROM urls WHERE short_key = ?`, deleted.ShortKey)
+	if err := row.Scan(&generation); err != nil || generation != audited+1 || generation <= int(deleted.Generation) {
+		t.Fatalf("expected the recycled key to be a new generation, got %d after %d. %v", generation, audited, err)
+	}
+
+	// the 2 recycled keys and the unused one are free, the malicious one isn't
+	if _, err := repo.AssignURLs(ctx, []string{"https://a.com", "https://b.com", "https://c.com"}); err != nil {
+		t.Fatalf("expected the recycled keys to be free, got %v", err)
+	}
+
+	if _, err := repo.AssignURL(ctx, "https://d.com"); !errors.Is(err, models.ErrNoFreeKeys) {
+		t.Fatalf("expected the malicious key to stay taken, got %v", err)
+	}
+
+	if _, err := repo.AssignAlias(ctx, "my-link", "https://alias.com"); err != nil {
+		t.Fatalf("expected the released alias to be free, got %v", err)
+	}
+}
+
+func Test_SweepTombstone(t *testing.T) {
+	ctx := context.Background()
+
+	database, shard := changelogShard(t, filepath.Join(t.TempDir(), "db_a_z"), false)
+	repo := models.NewURLRepo(database)
+
+	past := time.Now().UTC().Add(-time.Minute)
+	future := time.Now().UTC().Add(time.Hour)
+
+	expired, err := repo.AssignAlias(ctx, "old-sale", "https://sale.com", models.WithExpiry(&past))
+	if err != nil {
+		t.Fatalf("failed to assign alias %v", err)
+	}
+
+	if _, err := repo.AssignAlias(ctx, "new-sale", "https://sale.com", models.WithExpiry(&future)); err != nil {
+		t.Fatalf("failed to assign alias %v", err)
+	}
+
+	if _, err := repo.Find(ctx, expired.ShortKey); !errors.Is(err, models.ErrLinkExpired) {
+		t.Fatalf("expected link_expired before the sweep, got %v", err)
+	}
+
+	if _, err := repo.Find(ctx, "new-sale"); err != nil {
+		t.Fatalf("expected the link not yet expired to resolve, got %v", err)
+	}
+
+	sweeper := models.NewExpiryRepo("a-z", shard.Conn())
+
+	stats, err := sweeper.Sweep(ctx, false, 0)
+	if err != nil || stats.Tombstoned != 1 || stats.Recycled != 0 {
+		t.Fatalf("expected the expired link tombstoned, got %+v. %v", stats, err)
+	}
+
+	stats, err = sweeper.Sweep(ctx, false, 0)
+	if err != nil || stats.Tombstoned != 0 {
+		t.Fatalf("expected the tombstone to be swept once, got %+v. %v", stats, err)
+	}
+
+	// the tombstone keeps the key taken, and still answers as expired
+	if _, err := repo.Find(ctx, expired.ShortKey); !errors.Is(err, models.ErrLinkExpired) {
+		t.Fatalf("expected link_expired after the sweep, got %v", err)
+	}
+
+	if _, err := repo.AssignAlias(ctx, "old-sale", "https://other.com"); !errors.Is(err, models.ErrAliasTaken) {
+		t.Fatalf("expected the tombstoned alias to stay taken, got %v", err)
+	}
+}
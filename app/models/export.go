@@ -0,0 +1,167 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	ExportStatusAll       = "all"
+	ExportStatusActive    = "active"
+	ExportStatusDeleted   = "deleted"
+	ExportStatusMalicious = "malicious"
+)
+
+type ExportFilter struct {
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+	Status      string
+
+	// KeyStart and KeyEnd are the first characters
+	// of the short keys to export, inclusive
+	KeyStart byte
+	KeyEnd   byte
+}
+
+// ExportURLsQuery only exports assigned keys. The free
+// keys in the pool are not interesting.
+const ExportURLsQuery = `
+	SELECT url
+		,short_key
+		,owner_id
+		,vanity
+		,malicious
+		,created_at
+		,updated_at
+		,deleted_at
+		,expires_at
+	FROM urls
+	WHERE url IS NOT NULL
+	AND short_key > ?
+	%s
+	ORDER BY short_key
+	LIMIT ?
+`
+
+func (f *ExportFilter) where() (string, []any) {
+	clauses := []string{}
+	args := []any{}
+
+	if f.CreatedFrom != nil {
+		clauses = append(clauses, "AND created_at >= ?")
+		args = append(args, f.CreatedFrom.UTC())
+	}
+
+	if f.CreatedTo != nil {
+		clauses = append(clauses, "AND created_at < ?")
+		args = append(args, f.CreatedTo.UTC())
+	}
+
+	switch f.Status {
+	case ExportStatusActive:
+		clauses = append(clauses, "AND deleted_at IS NULL AND (malicious IS NULL OR malicious = 0)")
+	case ExportStatusDeleted:
+		clauses = append(clauses, "AND deleted_at IS NOT NULL")
+	case ExportStatusMalicious:
+		clauses = append(clauses, "AND malicious = 1")
+	}
+
+	if f.KeyStart != 0 && f.KeyEnd != 0 {
+		clauses = append(clauses, "AND lower(substr(short_key, 1, 1)) BETWEEN ? AND ?")
+		args = append(args, string(f.KeyStart), string(f.KeyEnd))
+	}
+
+	return strings.Join(clauses, "\n\t"), args
+}
+
+// ShardExporter pages through the assigned keys of
+// a shard, in the order of the short keys.
+type ShardExporter struct {
+	name     string
+	conn     *sql.DB
+	filter   *ExportFilter
+	pageSize int
+
+	after string
+	page  []*URL
+	done  bool
+}
+
+func NewShardExporter(name string, conn *sql.DB, filter *ExportFilter, after string, pageSize int) *ShardExporter {
+	return &ShardExporter{
+		name:     name,
+		conn:     conn,
+		filter:   filter,
+		after:    after,
+		pageSize: pageSize,
+	}
+}
+
+// Peek returns the next row without consuming it,
+// nil when the shard is exhausted.
+func (e *ShardExporter) Peek(ctx context.Context) (*URL, error) {
+	if len(e.page) == 0 && !e.done {
+		if err := e.fetch(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(e.page) == 0 {
+		return nil, nil
+	}
+
+	return e.page[0], nil
+}
+
+func (e *ShardExporter) Next() {
+	if len(e.page) > 0 {
+		e.page = e.page[1:]
+	}
+}
+
+func (e *ShardExporter) fetch(ctx context.Context) error {
+	where, args := e.filter.where()
+	query := fmt.Sprintf(ExportURLsQuery, where)
+
+	args = append([]any{e.after}, args...)
+	args = append(args, e.pageSize)
+
+	rows, err := e.conn.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to export from %s. %v", e.name, err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		u := &URL{}
+
+		if err := rows.Scan(
+			&u.Link,
+			&u.ShortKey,
+			&u.OwnerID,
+			&u.Vanity,
+			&u.Malicious,
+			&u.CreatedAt,
+			&u.UpdatedAt,
+			&u.DeletedAt,
+			&u.ExpiresAt,
+		); err != nil {
+			return err
+		}
+
+		e.page = append(e.page, u)
+	}
+
+	if len(e.page) < e.pageSize {
+		e.done = true
+	}
+
+	if len(e.page) > 0 {
+		e.after = e.page[len(e.page)-1].ShortKey
+	}
+
+	return rows.Err()
+}
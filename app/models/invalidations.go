@@ -0,0 +1,97 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// InvalidationRetention is how long an invalidation is kept, past the
+// cache ttl, the servers which didn't read it have dropped the key.
+const InvalidationRetention = time.Hour
+
+const (
+	InsertInvalidationQuery = `INSERT INTO link_invalidations (short_key, created_at) VALUES (?, ?)`
+	InvalidationsAfterQuery = `SELECT id, short_key, created_at FROM link_invalidations WHERE id > ? ORDER BY id LIMIT ?`
+	LastInvalidationIDQuery = `SELECT COALESCE(MAX(id), 0) FROM link_invalidations`
+	TrimInvalidationsQuery  = `DELETE FROM link_invalidations WHERE created_at < ?`
+)
+
+// Invalidation is a key written by a server, which
+// the other servers have to drop from their cache.
+type Invalidation struct {
+	ID        int64     `db:"id" json:"id"`
+	ShortKey  string    `db:"short_key" json:"short_key"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// InvalidationRepo keeps the invalidations in the coordinator db,
+// it's how a delete or a retarget reaches the caches of the other
+// servers, like the decisions do.
+type InvalidationRepo struct {
+	db *sql.DB
+}
+
+func NewInvalidationRepo(db *sql.DB) *InvalidationRepo {
+	return &InvalidationRepo{db: db}
+}
+
+func (repo *InvalidationRepo) Broadcast(ctx context.Context, shortKeys ...string) error {
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+
+	for _, shortKey := range shortKeys {
+		if _, err := tx.ExecContext(ctx, InsertInvalidationQuery, shortKey, now); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// After lists the invalidations after the id afterID, oldest first
+func (repo *InvalidationRepo) After(ctx context.Context, afterID int64, limit int) ([]*Invalidation, error) {
+	rows, err := repo.db.QueryContext(ctx, InvalidationsAfterQuery, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invalidations := []*Invalidation{}
+
+	for rows.Next() {
+		invalidation := &Invalidation{}
+
+		if err := rows.Scan(&invalidation.ID, &invalidation.ShortKey, &invalidation.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		invalidations = append(invalidations, invalidation)
+	}
+
+	return invalidations, rows.Err()
+}
+
+// LastID is the id of the last invalidation, 0 if there is none.
+// The ids aren't reused, after the older ones are trimmed.
+func (repo *InvalidationRepo) LastID(ctx context.Context) (int64, error) {
+	var id int64
+	err := repo.db.QueryRowContext(ctx, LastInvalidationIDQuery).Scan(&id)
+
+	return id, err
+}
+
+// Trim deletes the invalidations older than before
+func (repo *InvalidationRepo) Trim(ctx context.Context, before time.Time) (int64, error) {
+	res, err := repo.db.ExecContext(ctx, TrimInvalidationsQuery, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
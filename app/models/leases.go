@@ -0,0 +1,164 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"net/url"
+	"time"
+)
+
+// KeyLease is a free key, set aside for a key pool till Until, in unix
+// milliseconds. Until is the token of the lease too, a key is only
+// assigned or released by the pool which holds it. The key is assigned
+// only if it's still at the generation it was leased at.
+type KeyLease struct {
+	ShortKey   string
+	Until      int64
+	Generation int64
+}
+
+func (l *KeyLease) Expired(at time.Time) bool {
+	return at.UnixMilli() >= l.Until
+}
+
+const (
+	LeaseKeysQuery = `UPDATE urls SET leased_until = ?1
+		WHERE rowid IN (SELECT rowid FROM urls WHERE url IS NULL AND (leased_until IS NULL OR leased_until < ?2) LIMIT ?3)
+		RETURNING short_key, generation;`
+	AssignLeasedKeyQuery = `UPDATE urls SET url = ?, url_hash = ?, owner_id = ?, expires_at = ?, updated_at = ?, leased_until = NULL, generation = generation + 1
+		WHERE short_key = ? AND url IS NULL AND leased_until = ? AND generation = ?;`
+	ReleaseLeaseQuery = `UPDATE urls SET leased_until = NULL WHERE short_key = ? AND url IS NULL AND leased_until = ?;`
+)
+
+// LeaseKeys sets aside upto n free keys of the shard till until. The
+// keys whose lease has expired are free again, and can be leased.
+func LeaseKeys(ctx context.Context, conn *sql.DB, n int, until time.Time) ([]*KeyLease, error) {
+	now := time.Now()
+
+	rows, err := conn.QueryContext(ctx, LeaseKeysQuery, until.UnixMilli(), now.UnixMilli(), n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	leases := []*KeyLease{}
+
+	for rows.Next() {
+		lease := &KeyLease{Until: until.UnixMilli()}
+
+		if err := rows.Scan(&lease.ShortKey, &lease.Generation); err != nil {
+			return nil, err
+		}
+
+		leases = append(leases, lease)
+	}
+
+	return leases, rows.Err()
+}
+
+// AssignLeasedKey maps urlStr to the leased key. ErrKeyTaken is
+// returned if the lease was lost, it expired and was leased again,
+// or the key was claimed as an alias, or recycled.
+func (repo *URLRepo) AssignLeasedKey(ctx context.Context, lease *KeyLease, urlStr string, opts ...WithAssignOpts) (*URL, error) {
+	assignOpts := buildAssignOpts(opts)
+
+	db, err := repo.sharder.GetShard(lease.ShortKey)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	res, err := db.Conn().ExecContext(
+		ctx,
+		AssignLeasedKeyQuery,
+		url.QueryEscape(urlStr),
+		HashURL(urlStr),
+		assignOpts.OwnerID,
+		assignOpts.ExpiresAt,
+		now,
+		lease.ShortKey,
+		lease.Until,
+		lease.Generation,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return nil, ErrKeyTaken
+	}
+
+	return &URL{
+		Link:       &urlStr,
+		UpdatedAt:  now,
+		ShortKey:   lease.ShortKey,
+		ExpiresAt:  assignOpts.ExpiresAt,
+		OwnerID:    assignOpts.OwnerID,
+		Generation: lease.Generation + 1,
+	}, nil
+}
+
+// ReleaseLeases frees the leased keys which weren't
+// assigned, in one transaction per shard.
+func (repo *URLRepo) ReleaseLeases(ctx context.Context, leases []*KeyLease) (int, error) {
+	byShard := map[string][]*KeyLease{}
+	conns := map[string]*sql.DB{}
+
+	for _, lease := range leases {
+		db, err := repo.sharder.GetShard(lease.ShortKey)
+		if err != nil {
+			return 0, err
+		}
+
+		byShard[db.ID()] = append(byShard[db.ID()], lease)
+		conns[db.ID()] = db.Conn()
+	}
+
+	released := 0
+
+	for id, shardLeases := range byShard {
+		n, err := releaseLeases(ctx, conns[id], shardLeases)
+		if err != nil {
+			return released, err
+		}
+
+		released += n
+	}
+
+	return released, nil
+}
+
+func releaseLeases(ctx context.Context, conn *sql.DB, leases []*KeyLease) (int, error) {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	stmt, err := tx.PrepareContext(ctx, ReleaseLeaseQuery)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	defer stmt.Close()
+
+	released := 0
+
+	for _, lease := range leases {
+		res, err := stmt.ExecContext(ctx, lease.ShortKey, lease.Until)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+
+		n, err := res.RowsAffected()
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+
+		released += int(n)
+	}
+
+	return released, tx.Commit()
+}
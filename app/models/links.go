@@ -0,0 +1,320 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/go-batteries/shortner/app/db"
+)
+
+const (
+	DefaultListLimit = 50
+	MaxListLimit     = 500
+)
+
+const RetargetURLQuery = `UPDATE urls SET url = ?1, url_hash = ?2, updated_at = ?3, generation = generation + 1,
+	scanned_at = NULL, scan_score = NULL
+	WHERE short_key = ?4 AND owner_id = ?5 AND url IS NOT NULL AND deleted_at IS NULL AND (?6 = 0 OR generation = ?6)
+	AND (expires_at IS NULL OR expires_at > ?3)
+	RETURNING generation`
+
+const SetMaliciousQuery = `UPDATE urls SET malicious = ?1, updated_at = ?2, generation = generation + 1
+	WHERE short_key = ?3 AND url IS NOT NULL AND (?4 = 0 OR generation = ?4)
+	RETURNING generation`
+
+// LinkGenerationQuery is CurrentGenerationQuery, for
+// the writes which aren't limited to the owner.
+const LinkGenerationQuery = `SELECT generation FROM urls WHERE short_key = ? AND url IS NOT NULL`
+
+// ReassignOwnerQuery moves the deleted links too, so
+// that the old owner id doesn't own anything anymore.
+const ReassignOwnerQuery = `UPDATE urls SET owner_id = ?1, updated_at = ?2, generation = generation + 1
+	WHERE owner_id = ?3 AND url IS NOT NULL`
+
+// FindOwnedURLQuery doesn't care about expires_at or malicious,
+// the owner still gets to see the link.
+const FindOwnedURLQuery = `
+	SELECT url
+		,short_key
+		,vanity
+		,created_at
+		,updated_at
+		,expires_at
+		,malicious
+		,generation
+	FROM urls
+	WHERE short_key = ?
+	AND owner_id = ?
+	AND url IS NOT NULL
+	AND deleted_at IS NULL
+`
+
+// ListURLsByOwnerQuery is paginated on the short_key,
+// which is unique and sorts the same on every shard.
+const ListURLsByOwnerQuery = `
+	SELECT url
+		,short_key
+		,vanity
+		,created_at
+		,updated_at
+		,expires_at
+		,generation
+	FROM urls
+	WHERE owner_id = ?
+	AND short_key > ?
+	AND deleted_at IS NULL
+	ORDER BY short_key
+	LIMIT ?
+`
+
+// FindOwned returns the link of the owner, ErrLinkNotFound if the
+// owner has no such link. It's read from the primary, like the writes.
+func (repo *URLRepo) FindOwned(ctx context.Context, ownerID string, shortKey string) (*URL, error) {
+	shard, err := repo.sharder.GetShard(shortKey)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &URL{OwnerID: &ownerID}
+
+	err = shard.Conn().QueryRowContext(ctx, FindOwnedURLQuery, shortKey, ownerID).Scan(
+		&u.Link,
+		&u.ShortKey,
+		&u.Vanity,
+		&u.CreatedAt,
+		&u.UpdatedAt,
+		&u.ExpiresAt,
+		&u.Malicious,
+		&u.Generation,
+	)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrLinkNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// Retarget points an existing link of the owner to a new url.
+// ErrLinkNotFound is returned if the owner has no such link,
+// ErrLinkExpired if it expired, and a GenerationConflict if the
+// link isn't at generation. An expired link stays expired, it
+// isn't brought back by pointing it elsewhere.
+func (repo *URLRepo) Retarget(ctx context.Context, ownerID string, shortKey string, urlStr string, generation int64) (*URL, error) {
+	shard, err := repo.sharder.GetShard(shortKey)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	err = shard.Conn().QueryRowContext(
+		ctx,
+		RetargetURLQuery,
+		url.QueryEscape(urlStr),
+		HashURL(urlStr),
+		now,
+		shortKey,
+		ownerID,
+		generation,
+	).Scan(&generation)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, retargetError(ctx, repo, ownerID, shortKey, now)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &URL{
+		Link:       &urlStr,
+		ShortKey:   shortKey,
+		UpdatedAt:  now,
+		OwnerID:    &ownerID,
+		Generation: generation,
+	}, nil
+}
+
+// ReassignOwner moves all the links of an owner to another, on every
+// shard, it returns how many were moved. It's for the legacy owners,
+// see LegacyOwnerID. A shard which fails, leaves the ones after it
+// as they were, running it again moves the rest.
+func (repo *URLRepo) ReassignOwner(ctx context.Context, from string, to string) (int64, error) {
+	shards, ok := repo.sharder.GetShards()
+	if !ok {
+		return 0, fmt.Errorf("no shards to reassign on")
+	}
+
+	now := time.Now().UTC()
+	var moved int64
+
+	for _, shard := range shards {
+		res, err := shard.Conn().ExecContext(ctx, ReassignOwnerQuery, to, now, from)
+		if err != nil {
+			return moved, fmt.Errorf("failed to reassign owner on %s. %w", shard.ID(), err)
+		}
+
+		n, _ := res.RowsAffected()
+		moved += n
+	}
+
+	return moved, nil
+}
+
+// retargetError is the error of a retarget which matched no row.
+// The link is looked up on the primary, like the write was.
+func retargetError(ctx context.Context, store Store, ownerID string, shortKey string, now time.Time) error {
+	u, err := store.FindOwned(ctx, ownerID, shortKey)
+	if err != nil {
+		return err
+	}
+
+	if u.ExpiresAt != nil && !u.ExpiresAt.After(now) {
+		return ErrLinkExpired
+	}
+
+	return &GenerationConflict{ShortKey: shortKey, Current: u.Generation}
+}
+
+// SetMalicious marks the link as malicious, or clears the mark. A
+// malicious link stops resolving, and its key is never recycled, even
+// once deleted. It's a write of the reviewers, not of the owner, so
+// deleted links can be marked too.
+func (repo *URLRepo) SetMalicious(ctx context.Context, shortKey string, malicious bool, generation int64) (*URL, error) {
+	shard, err := repo.sharder.GetShard(shortKey)
+	if err != nil {
+		return nil, err
+	}
+
+	flag := 0
+	if malicious {
+		flag = 1
+	}
+
+	now := time.Now().UTC()
+
+	err = shard.Conn().QueryRowContext(ctx, SetMaliciousQuery, flag, now, shortKey, generation).Scan(&generation)
+	if errors.Is(err, sql.ErrNoRows) {
+		var current int64
+
+		err := shard.Conn().QueryRowContext(ctx, LinkGenerationQuery, shortKey).Scan(&current)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrLinkNotFound
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, &GenerationConflict{ShortKey: shortKey, Current: current}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &URL{
+		ShortKey:   shortKey,
+		Malicious:  &flag,
+		UpdatedAt:  now,
+		Generation: generation,
+	}, nil
+}
+
+// ListByOwner returns upto limit links of the owner, with short keys
+// after the given key. Each shard is asked for a page, and the pages are
+// merged, so the order is stable across shards. The returned cursor is
+// empty when there are no more links.
+func (repo *URLRepo) ListByOwner(ctx context.Context, ownerID string, after string, limit int) ([]*URL, string, error) {
+	if limit < 1 || limit > MaxListLimit {
+		limit = DefaultListLimit
+	}
+
+	shards, ok := repo.sharder.GetShards()
+	if !ok {
+		return nil, "", fmt.Errorf("no shards to list from")
+	}
+
+	type page struct {
+		urls []*URL
+		err  error
+	}
+
+	pages := make(chan page, len(shards))
+
+	for _, shard := range shards {
+		go func(shard db.Shard[string]) {
+			urls, err := listShardByOwner(ctx, shard, ownerID, after, limit)
+			pages <- page{urls: urls, err: err}
+		}(shard)
+	}
+
+	urls := []*URL{}
+
+	for i := 0; i < len(shards); i++ {
+		p := <-pages
+		if p.err != nil {
+			return nil, "", p.err
+		}
+
+		urls = append(urls, p.urls...)
+	}
+
+	sort.Slice(urls, func(i, j int) bool {
+		return urls[i].ShortKey < urls[j].ShortKey
+	})
+
+	if len(urls) <= limit {
+		return urls, "", nil
+	}
+
+	urls = urls[:limit]
+	return urls, urls[limit-1].ShortKey, nil
+}
+
+func listShardByOwner(ctx context.Context, shard db.Shard[string], ownerID string, after string, limit int) ([]*URL, error) {
+	var urls []*URL
+
+	err := db.ReadFrom(shard, func(conn *sql.DB) error {
+		// one extra, to know if there is a next page
+		rows, err := conn.QueryContext(ctx, ListURLsByOwnerQuery, ownerID, after, limit+1)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		urls = []*URL{}
+
+		for rows.Next() {
+			u := &URL{OwnerID: &ownerID}
+
+			if err := rows.Scan(
+				&u.Link,
+				&u.ShortKey,
+				&u.Vanity,
+				&u.CreatedAt,
+				&u.UpdatedAt,
+				&u.ExpiresAt,
+				&u.Generation,
+			); err != nil {
+				return err
+			}
+
+			urls = append(urls, u)
+		}
+
+		return rows.Err()
+	})
+
+	return urls, err
+}
@@ -0,0 +1,119 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-batteries/shortner/app/models"
+)
+
+func Test_ListByOwnerShards(t *testing.T) {
+	ctx := context.Background()
+	repo := models.NewURLRepo(rangeShards(t, 5, "a-m", "n-z"))
+
+	owned := []string{}
+
+	for i := 0; i < 5; i++ {
+		u, err := repo.AssignURL(ctx, fmt.Sprintf("https://example.com/%d", i), models.WithOwner("acc_1"))
+		if err != nil {
+			t.Fatalf("failed to assign url %v", err)
+		}
+
+		owned = append(owned, u.ShortKey)
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, err := repo.AssignURL(ctx, fmt.Sprintf("https://example.org/%d", i), models.WithOwner("acc_2")); err != nil {
+			t.Fatalf("failed to assign url %v", err)
+		}
+	}
+
+	sort.Strings(owned)
+
+	listed := []string{}
+	after := ""
+
+	for pages := 0; ; pages++ {
+		if pages > 3 {
+			t.Fatalf("expected 3 pages of 2, got more")
+		}
+
+		urls, next, err := repo.ListByOwner(ctx, "acc_1", after, 2)
+		if err != nil {
+			t.Fatalf("failed to list %v", err)
+		}
+
+		for _, u := range urls {
+			listed = append(listed, u.ShortKey)
+		}
+
+		if next == "" {
+			break
+		}
+
+		after = next
+	}
+
+	if fmt.Sprint(listed) != fmt.Sprint(owned) {
+		t.Fatalf("expected the pages of both shards in order %v, got %v", owned, listed)
+	}
+
+	if owned[0][0] == owned[len(owned)-1][0] {
+		t.Fatalf("expected the links to be on both shards, got %v", owned)
+	}
+
+	if _, err := repo.Retarget(ctx, "acc_2", owned[0], "https://gitlab.com", models.AnyGeneration); !errors.Is(err, models.ErrLinkNotFound) {
+		t.Fatalf("only the owner should retarget, got %v", err)
+	}
+
+	if err := repo.Delete(ctx, "acc_2", owned[1], models.AnyGeneration); !errors.Is(err, models.ErrLinkNotFound) {
+		t.Fatalf("only the owner should delete, got %v", err)
+	}
+
+	if _, err := repo.Retarget(ctx, "acc_1", owned[0], "https://gitlab.com", models.AnyGeneration); err != nil {
+		t.Fatalf("failed to retarget %v", err)
+	}
+
+	if err := repo.Delete(ctx, "acc_1", owned[1], models.AnyGeneration); err != nil {
+		t.Fatalf("failed to delete %v", err)
+	}
+
+	if urls, _, _ := repo.ListByOwner(ctx, "acc_1", "", 10); len(urls) != 4 {
+		t.Fatalf("expected the deleted link to not be listed, got %d", len(urls))
+	}
+}
+
+func Test_RetargetExpired(t *testing.T) {
+	ctx := context.Background()
+	past := time.Now().UTC().Add(-time.Minute)
+
+	for name, store := range map[string]models.Store{
+		"sqlite": models.NewURLRepo(rangeShards(t, 2, "a-z")),
+		"memory": models.NewMemoryStore(),
+	} {
+		u, err := store.AssignURL(ctx, "https://sale.com", models.WithOwner("acc_1"), models.WithExpiry(&past))
+		if err != nil {
+			t.Fatalf("%s: failed to assign url %v", name, err)
+		}
+
+		if _, err := store.Retarget(ctx, "acc_1", u.ShortKey, "https://gitlab.com", models.AnyGeneration); !errors.Is(err, models.ErrLinkExpired) {
+			t.Fatalf("%s: expected an expired link to not be retargeted, got %v", name, err)
+		}
+
+		if _, err := store.Retarget(ctx, "acc_1", u.ShortKey, "https://gitlab.com", u.Generation); !errors.Is(err, models.ErrLinkExpired) {
+			t.Fatalf("%s: expected link_expired at the current generation, got %v", name, err)
+		}
+
+		if _, err := store.Retarget(ctx, "acc_2", u.ShortKey, "https://gitlab.com", models.AnyGeneration); !errors.Is(err, models.ErrLinkNotFound) {
+			t.Fatalf("%s: expected link_not_found for another owner, got %v", name, err)
+		}
+
+		if _, err := store.Find(ctx, u.ShortKey); !errors.Is(err, models.ErrLinkExpired) {
+			t.Fatalf("%s: expected the link to stay expired, got %v", name, err)
+		}
+	}
+}
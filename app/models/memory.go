@@ -0,0 +1,393 @@
+package models
+
+import (
+	"context"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+type memoryRow struct {
+	URL
+	hash string
+
+	scannedAt *time.Time
+}
+
+// MemoryStore is a Store in a map, for tests and local runs.
+// Nothing survives a restart.
+type MemoryStore struct {
+	mu   sync.RWMutex
+	rows map[string]*memoryRow
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{rows: map[string]*memoryRow{}}
+}
+
+// snapshot copies the row, so callers can't mutate the store
+func (row *memoryRow) snapshot() *URL {
+	u := row.URL
+	return &u
+}
+
+func (row *memoryRow) active(now time.Time) bool {
+	return row.Link != nil &&
+		row.DeletedAt == nil &&
+		(row.Malicious == nil || *row.Malicious == 0) &&
+		(row.ExpiresAt == nil || row.ExpiresAt.After(now))
+}
+
+func sameOwner(a *string, b string) bool {
+	if a == nil {
+		return b == ""
+	}
+
+	return *a == b
+}
+
+func (store *MemoryStore) Find(ctx context.Context, shortKey string) (*URL, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	row, ok := store.rows[shortKey]
+	if !ok {
+		return nil, ErrLinkNotFound
+	}
+
+	now := time.Now().UTC()
+
+	if row.active(now) {
+		return row.snapshot(), nil
+	}
+
+	if row.Link != nil && row.Malicious != nil && *row.Malicious == 1 {
+		return nil, ErrLinkMalicious
+	}
+
+	if row.Link != nil && row.ExpiresAt != nil && !row.ExpiresAt.After(now) {
+		return nil, ErrLinkExpired
+	}
+
+	return nil, ErrLinkNotFound
+}
+
+func (store *MemoryStore) FindByHash(ctx context.Context, ownerID string, urlStr string) (*URL, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	hash := HashURL(urlStr)
+	now := time.Now().UTC()
+
+	for _, row := range store.rows {
+		if row.hash == hash && sameOwner(row.OwnerID, ownerID) &&
+			row.ExpiresAt == nil && !row.Vanity && row.active(now) {
+			return row.snapshot(), nil
+		}
+	}
+
+	return nil, nil
+}
+
+// insert is called with the lock held
+func (store *MemoryStore) insert(shortKey string, urlStr string, vanity bool, assignOpts *AssignOpts, now time.Time) *URL {
+	link := url.QueryEscape(urlStr)
+
+	store.rows[shortKey] = &memoryRow{
+		URL: URL{
+			ShortKey:   shortKey,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+			Link:       &link,
+			Vanity:     vanity,
+			ExpiresAt:  assignOpts.ExpiresAt,
+			OwnerID:    assignOpts.OwnerID,
+			Generation: 1,
+		},
+		hash: HashURL(urlStr),
+	}
+
+	return &URL{
+		Link:       &urlStr,
+		ShortKey:   shortKey,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		Vanity:     vanity,
+		ExpiresAt:  assignOpts.ExpiresAt,
+		OwnerID:    assignOpts.OwnerID,
+		Generation: 1,
+	}
+}
+
+// mint is called with the lock held
+func (store *MemoryStore) mint() (string, error) {
+	for i := 0; i < mintAttempts; i++ {
+		shortKey := MintShortKey()
+
+		if _, ok := store.rows[shortKey]; !ok {
+			return shortKey, nil
+		}
+	}
+
+	return "", ErrKeyTaken
+}
+
+func (store *MemoryStore) AssignURL(ctx context.Context, urlStr string, opts ...WithAssignOpts) (*URL, error) {
+	urls, err := store.AssignURLs(ctx, []string{urlStr}, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return urls[0], nil
+}
+
+func (store *MemoryStore) AssignURLs(ctx context.Context, urlStrs []string, opts ...WithAssignOpts) ([]*URL, error) {
+	assignOpts := buildAssignOpts(opts)
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	shortKeys := make([]string, 0, len(urlStrs))
+	minted := map[string]bool{}
+
+	for range urlStrs {
+		shortKey, err := store.mint()
+		if err != nil || minted[shortKey] {
+			return nil, ErrKeyTaken
+		}
+
+		minted[shortKey] = true
+		shortKeys = append(shortKeys, shortKey)
+	}
+
+	now := time.Now().UTC()
+	urls := make([]*URL, 0, len(urlStrs))
+
+	for i, urlStr := range urlStrs {
+		urls = append(urls, store.insert(shortKeys[i], urlStr, false, assignOpts, now))
+	}
+
+	return urls, nil
+}
+
+func (store *MemoryStore) AssignAlias(ctx context.Context, alias string, urlStr string, opts ...WithAssignOpts) (*URL, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.rows[alias]; ok {
+		return nil, ErrAliasTaken
+	}
+
+	return store.insert(alias, urlStr, true, buildAssignOpts(opts), time.Now().UTC()), nil
+}
+
+// owned is called with the lock held. It returns the link of the
+// owner, if it's at generation.
+func (store *MemoryStore) owned(ownerID string, shortKey string, generation int64) (*memoryRow, error) {
+	row, ok := store.rows[shortKey]
+	if !ok || row.Link == nil || row.DeletedAt != nil || row.OwnerID == nil || *row.OwnerID != ownerID {
+		return nil, ErrLinkNotFound
+	}
+
+	if generation != AnyGeneration && generation != row.Generation {
+		return nil, &GenerationConflict{ShortKey: shortKey, Current: row.Generation}
+	}
+
+	return row, nil
+}
+
+func (store *MemoryStore) FindOwned(ctx context.Context, ownerID string, shortKey string) (*URL, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	row, err := store.owned(ownerID, shortKey, AnyGeneration)
+	if err != nil {
+		return nil, err
+	}
+
+	return row.snapshot(), nil
+}
+
+func (store *MemoryStore) ReassignOwner(ctx context.Context, from string, to string) (int64, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now().UTC()
+	var moved int64
+
+	for _, row := range store.rows {
+		if row.Link != nil && row.OwnerID != nil && *row.OwnerID == from {
+			owner := to
+			row.OwnerID = &owner
+			row.UpdatedAt = now
+			row.Generation++
+			moved++
+		}
+	}
+
+	return moved, nil
+}
+
+func (store *MemoryStore) Retarget(ctx context.Context, ownerID string, shortKey string, urlStr string, generation int64) (*URL, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now().UTC()
+
+	row, err := store.owned(ownerID, shortKey, AnyGeneration)
+	if err != nil {
+		return nil, err
+	}
+
+	if row.ExpiresAt != nil && !row.ExpiresAt.After(now) {
+		return nil, ErrLinkExpired
+	}
+
+	if generation != AnyGeneration && generation != row.Generation {
+		return nil, &GenerationConflict{ShortKey: shortKey, Current: row.Generation}
+	}
+
+	link := url.QueryEscape(urlStr)
+
+	row.Link = &link
+	row.hash = HashURL(urlStr)
+	row.UpdatedAt = now
+	row.Generation++
+	row.scannedAt = nil
+
+	return &URL{
+		Link:       &urlStr,
+		ShortKey:   shortKey,
+		UpdatedAt:  now,
+		OwnerID:    &ownerID,
+		Generation: row.Generation,
+	}, nil
+}
+
+func (store *MemoryStore) Delete(ctx context.Context, ownerID string, shortKey string, generation int64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	row, err := store.owned(ownerID, shortKey, generation)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	row.DeletedAt = &now
+	row.UpdatedAt = now
+	row.Generation++
+
+	return nil
+}
+
+func (store *MemoryStore) SetMalicious(ctx context.Context, shortKey string, malicious bool, generation int64) (*URL, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	row, ok := store.rows[shortKey]
+	if !ok || row.Link == nil {
+		return nil, ErrLinkNotFound
+	}
+
+	if generation != AnyGeneration && generation != row.Generation {
+		return nil, &GenerationConflict{ShortKey: shortKey, Current: row.Generation}
+	}
+
+	flag := 0
+	if malicious {
+		flag = 1
+	}
+
+	now := time.Now().UTC()
+
+	row.Malicious = &flag
+	row.UpdatedAt = now
+	row.Generation++
+
+	return &URL{
+		ShortKey:   shortKey,
+		Malicious:  &flag,
+		UpdatedAt:  now,
+		Generation: row.Generation,
+	}, nil
+}
+
+func (store *MemoryStore) ListByOwner(ctx context.Context, ownerID string, after string, limit int) ([]*URL, string, error) {
+	if limit < 1 || limit > MaxListLimit {
+		limit = DefaultListLimit
+	}
+
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	urls := []*URL{}
+
+	for shortKey, row := range store.rows {
+		if shortKey > after && row.DeletedAt == nil && row.OwnerID != nil && *row.OwnerID == ownerID {
+			urls = append(urls, row.snapshot())
+		}
+	}
+
+	sort.Slice(urls, func(i, j int) bool {
+		return urls[i].ShortKey < urls[j].ShortKey
+	})
+
+	if len(urls) <= limit {
+		return urls, "", nil
+	}
+
+	urls = urls[:limit]
+	return urls, urls[limit-1].ShortKey, nil
+}
+
+func (store *MemoryStore) ScanDue(ctx context.Context, before time.Time, limit int) ([]*URL, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	now := time.Now().UTC()
+	rows := []*memoryRow{}
+
+	for _, row := range store.rows {
+		if row.active(now) && (row.scannedAt == nil || row.scannedAt.Before(before)) {
+			rows = append(rows, row)
+		}
+	}
+
+	// never scanned first, like the sql stores
+	sort.Slice(rows, func(i, j int) bool {
+		if rows[i].scannedAt == nil || rows[j].scannedAt == nil {
+			return rows[i].scannedAt == nil && rows[j].scannedAt != nil
+		}
+
+		return rows[i].scannedAt.Before(*rows[j].scannedAt)
+	})
+
+	urls := []*URL{}
+
+	for _, row := range rows {
+		if len(urls) >= limit {
+			break
+		}
+
+		urls = append(urls, row.snapshot())
+	}
+
+	return urls, nil
+}
+
+func (store *MemoryStore) MarkScanned(ctx context.Context, shortKey string, score int, generation int64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	row, ok := store.rows[shortKey]
+	if !ok || (generation != AnyGeneration && generation != row.Generation) {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	row.scannedAt = &now
+
+	return nil
+}
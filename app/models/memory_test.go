@@ -0,0 +1,113 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-batteries/shortner/app/models"
+)
+
+func Test_MemoryStore(t *testing.T) {
+	ctx := context.Background()
+	store := models.NewMemoryStore()
+
+	u, err := store.AssignURL(ctx, "https://github.com", models.WithOwner("acc_1"))
+	if err != nil {
+		t.Fatalf("failed to assign url %v", err)
+	}
+
+	found, err := store.Find(ctx, u.ShortKey)
+	if err != nil || *found.Link != "https%3A%2F%2Fgithub.com" {
+		t.Fatalf("expected escaped link for %s, got %v", u.ShortKey, err)
+	}
+
+	existing, err := store.FindByHash(ctx, "acc_1", "https://github.com")
+	if err != nil || existing == nil || existing.ShortKey != u.ShortKey {
+		t.Fatalf("expected to find %s by hash", u.ShortKey)
+	}
+
+	if existing, _ := store.FindByHash(ctx, "", "https://github.com"); existing != nil {
+		t.Fatalf("links should not be shared across owners")
+	}
+
+	if _, err := store.AssignAlias(ctx, "gh-home", "https://github.com"); err != nil {
+		t.Fatalf("failed to assign alias %v", err)
+	}
+
+	if _, err := store.AssignAlias(ctx, "gh-home", "https://gitlab.com"); !errors.Is(err, models.ErrAliasTaken) {
+		t.Fatalf("expected alias_taken, got %v", err)
+	}
+
+	past := time.Now().UTC().Add(-time.Minute)
+
+	expired, err := store.AssignURL(ctx, "https://golang.org", models.WithExpiry(&past))
+	if err != nil {
+		t.Fatalf("failed to assign url %v", err)
+	}
+
+	if _, err := store.Find(ctx, expired.ShortKey); !errors.Is(err, models.ErrLinkExpired) {
+		t.Fatalf("expected link_expired, got %v", err)
+	}
+
+	if _, err := store.Retarget(ctx, "acc_2", u.ShortKey, "https://gitlab.com", models.AnyGeneration); !errors.Is(err, models.ErrLinkNotFound) {
+		t.Fatalf("only the owner should retarget, got %v", err)
+	}
+
+	if _, err := store.Retarget(ctx, "acc_1", u.ShortKey, "https://gitlab.com", models.AnyGeneration); err != nil {
+		t.Fatalf("failed to retarget %v", err)
+	}
+
+	if _, err := store.SetMalicious(ctx, u.ShortKey, true, u.Generation); !errors.Is(err, models.ErrGenerationConflict) {
+		t.Fatalf("expected the retarget to have moved the generation, got %v", err)
+	}
+
+	if _, err := store.SetMalicious(ctx, u.ShortKey, true, models.AnyGeneration); err != nil {
+		t.Fatalf("failed to mark malicious %v", err)
+	}
+
+	if _, err := store.Find(ctx, u.ShortKey); !errors.Is(err, models.ErrLinkMalicious) {
+		t.Fatalf("expected link_malicious, got %v", err)
+	}
+
+	if _, err := store.SetMalicious(ctx, u.ShortKey, false, models.AnyGeneration); err != nil {
+		t.Fatalf("failed to clear %v", err)
+	}
+
+	urls, err := store.AssignURLs(ctx, []string{"https://a.com", "https://b.com"}, models.WithOwner("acc_1"))
+	if err != nil || len(urls) != 2 {
+		t.Fatalf("failed to assign urls %v", err)
+	}
+
+	due, err := store.ScanDue(ctx, time.Time{}, 10)
+	if err != nil || len(due) != 4 {
+		t.Fatalf("expected the 4 live links to be due a scan, got %d %v", len(due), err)
+	}
+
+	if err := store.MarkScanned(ctx, u.ShortKey, 0, models.AnyGeneration); err != nil {
+		t.Fatalf("failed to mark scanned %v", err)
+	}
+
+	if due, _ := store.ScanDue(ctx, time.Time{}, 10); len(due) != 3 {
+		t.Fatalf("expected the scanned link to not be due, got %d", len(due))
+	}
+
+	links, next, err := store.ListByOwner(ctx, "acc_1", "", 2)
+	if err != nil || len(links) != 2 || next == "" {
+		t.Fatalf("expected a page of 2 with a cursor, got %d %q %v", len(links), next, err)
+	}
+
+	rest, next, err := store.ListByOwner(ctx, "acc_1", next, 2)
+	if err != nil || len(rest) != 1 || next != "" {
+		t.Fatalf("expected the last link, got %d %q %v", len(rest), next, err)
+	}
+
+	if err := store.Delete(ctx, "acc_1", u.ShortKey, models.AnyGeneration); err != nil {
+		t.Fatalf("failed to delete %v", err)
+	}
+
+	if _, err := store.Find(ctx, u.ShortKey); !errors.Is(err, models.ErrLinkNotFound) {
+		t.Fatalf("expected link_not_found after delete, got %v", err)
+	}
+}
@@ -0,0 +1,564 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/url"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// Postgres doesn't need sharding on the key range, so all the
+// links live in one table, and keys are minted on assignment
+// instead of being seeded.
+const MigratePostgresQuery = `
+CREATE TABLE IF NOT EXISTS urls (
+	short_key TEXT COLLATE "C" PRIMARY KEY,
+	url TEXT,
+	url_hash TEXT,
+	owner_id TEXT,
+	malicious INTEGER,
+	vanity INTEGER NOT NULL DEFAULT 0,
+	generation INTEGER NOT NULL DEFAULT 1,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	deleted_at TIMESTAMPTZ,
+	expires_at TIMESTAMPTZ,
+	scanned_at TIMESTAMPTZ,
+	scan_score INTEGER
+);
+
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS scanned_at TIMESTAMPTZ;
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS scan_score INTEGER;
+
+CREATE INDEX IF NOT EXISTS idx_url_hash ON urls(url_hash) WHERE url_hash IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_owner_short_key ON urls(owner_id, short_key) WHERE owner_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_expires_at ON urls(expires_at) WHERE expires_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_scanned_at ON urls(scanned_at) WHERE url IS NOT NULL;
+`
+
+const (
+	PgFindURLByShortKey = `
+	SELECT url
+		,short_key
+		,updated_at
+		,expires_at
+	FROM urls
+	WHERE short_key = $1
+	AND (malicious IS NULL or malicious = 0)
+	AND deleted_at IS NULL
+	AND (expires_at IS NULL OR expires_at > $2)
+	`
+
+	PgFindExpiredByShortKey = `
+	SELECT expires_at
+	FROM urls
+	WHERE short_key = $1
+	AND url IS NOT NULL
+	AND expires_at IS NOT NULL
+	AND expires_at <= $2
+	`
+
+	PgFindMaliciousByShortKey = `
+	SELECT 1
+	FROM urls
+	WHERE short_key = $1
+	AND url IS NOT NULL
+	AND malicious = 1
+	`
+
+	PgFindURLByHash = `
+	SELECT url
+		,short_key
+		,updated_at
+	FROM urls
+	WHERE url_hash = $1
+	AND owner_id IS NOT DISTINCT FROM $2
+	AND (malicious IS NULL or malicious = 0)
+	AND deleted_at IS NULL
+	AND expires_at IS NULL
+	AND vanity = 0
+	LIMIT 1
+	`
+
+	PgInsertURLQuery = `INSERT INTO urls (short_key, url, url_hash, owner_id, vanity, expires_at, created_at, updated_at)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $7)
+	ON CONFLICT (short_key) DO NOTHING`
+
+	PgRetargetURLQuery = `UPDATE urls SET url = $1, url_hash = $2, updated_at = $3, generation = generation + 1,
+	scanned_at = NULL, scan_score = NULL
+	WHERE short_key = $4 AND owner_id = $5 AND url IS NOT NULL AND deleted_at IS NULL AND ($6 = 0 OR generation = $6)
+	AND (expires_at IS NULL OR expires_at > $3)
+	RETURNING generation`
+
+	PgDeleteEntryQuery = `UPDATE urls SET deleted_at = $1, updated_at = $1, generation = generation + 1
+	WHERE short_key = $2 AND owner_id = $3 AND deleted_at IS NULL AND ($4 = 0 OR generation = $4)`
+
+	PgSetMaliciousQuery = `UPDATE urls SET malicious = $1, updated_at = $2, generation = generation + 1
+	WHERE short_key = $3 AND url IS NOT NULL AND ($4 = 0 OR generation = $4)
+	RETURNING generation`
+
+	PgLinkGenerationQuery = `SELECT generation FROM urls WHERE short_key = $1 AND url IS NOT NULL`
+
+	PgCurrentGenerationQuery = `SELECT generation FROM urls WHERE short_key = $1 AND owner_id = $2 AND url IS NOT NULL AND deleted_at IS NULL`
+
+	PgReassignOwnerQuery = `UPDATE urls SET owner_id = $1, updated_at = $2, generation = generation + 1
+	WHERE owner_id = $3 AND url IS NOT NULL`
+
+	PgFindOwnedURLQuery = `
+	SELECT url
+		,short_key
+		,vanity
+		,created_at
+		,updated_at
+		,expires_at
+		,malicious
+		,generation
+	FROM urls
+	WHERE short_key = $1
+	AND owner_id = $2
+	AND url IS NOT NULL
+	AND deleted_at IS NULL
+	`
+
+	PgListURLsByOwnerQuery = `
+	SELECT url
+		,short_key
+		,vanity
+		,created_at
+		,updated_at
+		,expires_at
+		,generation
+	FROM urls
+	WHERE owner_id = $1
+	AND short_key > $2
+	AND deleted_at IS NULL
+	ORDER BY short_key
+	LIMIT $3
+	`
+
+	PgScanDueQuery = `
+	SELECT url
+		,short_key
+		,generation
+	FROM urls
+	WHERE url IS NOT NULL
+	AND deleted_at IS NULL
+	AND (malicious IS NULL OR malicious = 0)
+	AND (expires_at IS NULL OR expires_at > $1)
+	AND (scanned_at IS NULL OR scanned_at < $2)
+	ORDER BY scanned_at NULLS FIRST
+	LIMIT $3
+	`
+
+	PgMarkScannedQuery = `UPDATE urls SET scanned_at = $1, scan_score = $2
+	WHERE short_key = $3 AND ($4 = 0 OR generation = $4)`
+)
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+// ConnectPostgresStore opens the database at dsn,
+// and creates the tables if they are missing.
+func ConnectPostgresStore(ctx context.Context, dsn string) (*PostgresStore, error) {
+	conn, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.PingContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if _, err := conn.ExecContext(ctx, MigratePostgresQuery); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return NewPostgresStore(conn), nil
+}
+
+func (store *PostgresStore) Close() error {
+	return store.db.Close()
+}
+
+func (store *PostgresStore) Find(ctx context.Context, shortKey string) (*URL, error) {
+	now := time.Now().UTC()
+	data := &URL{}
+
+	err := store.db.QueryRowContext(ctx, PgFindURLByShortKey, shortKey, now).Scan(
+		&data.Link,
+		&data.ShortKey,
+		&data.UpdatedAt,
+		&data.ExpiresAt,
+	)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		var flagged int
+
+		malicious := store.db.QueryRowContext(ctx, PgFindMaliciousByShortKey, shortKey)
+		if malicious.Scan(&flagged) == nil {
+			return nil, ErrLinkMalicious
+		}
+
+		var expiresAt time.Time
+
+		expired := store.db.QueryRowContext(ctx, PgFindExpiredByShortKey, shortKey, now)
+		if expired.Scan(&expiresAt) == nil {
+			return nil, ErrLinkExpired
+		}
+
+		return nil, ErrLinkNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (store *PostgresStore) FindByHash(ctx context.Context, ownerID string, urlStr string) (*URL, error) {
+	var owner *string
+	if ownerID != "" {
+		owner = &ownerID
+	}
+
+	u := &URL{}
+
+	err := store.db.QueryRowContext(ctx, PgFindURLByHash, HashURL(urlStr), owner).Scan(
+		&u.Link,
+		&u.ShortKey,
+		&u.UpdatedAt,
+	)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// execer is either the db or a transaction
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+// insert returns false if the short key is already taken
+func (store *PostgresStore) insert(ctx context.Context, conn execer, shortKey string, urlStr string, vanity bool, assignOpts *AssignOpts, now time.Time) (bool, error) {
+	var vanityFlag int
+	if vanity {
+		vanityFlag = 1
+	}
+
+	res, err := conn.ExecContext(
+		ctx,
+		PgInsertURLQuery,
+		shortKey,
+		url.QueryEscape(urlStr),
+		HashURL(urlStr),
+		assignOpts.OwnerID,
+		vanityFlag,
+		assignOpts.ExpiresAt,
+		now,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// mint inserts the url with a fresh key, retrying on collisions
+func (store *PostgresStore) mint(ctx context.Context, conn execer, urlStr string, assignOpts *AssignOpts, now time.Time) (*URL, error) {
+	for i := 0; i < mintAttempts; i++ {
+		shortKey := MintShortKey()
+
+		ok, err := store.insert(ctx, conn, shortKey, urlStr, false, assignOpts, now)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			link := urlStr
+
+			return &URL{
+				Link:       &link,
+				ShortKey:   shortKey,
+				CreatedAt:  now,
+				UpdatedAt:  now,
+				ExpiresAt:  assignOpts.ExpiresAt,
+				OwnerID:    assignOpts.OwnerID,
+				Generation: 1,
+			}, nil
+		}
+	}
+
+	return nil, ErrKeyTaken
+}
+
+func (store *PostgresStore) AssignURL(ctx context.Context, urlStr string, opts ...WithAssignOpts) (*URL, error) {
+	return store.mint(ctx, store.db, urlStr, buildAssignOpts(opts), time.Now().UTC())
+}
+
+// AssignURLs inserts all the urls in one transaction.
+// Either all the urls get a key, or none do.
+func (store *PostgresStore) AssignURLs(ctx context.Context, urlStrs []string, opts ...WithAssignOpts) ([]*URL, error) {
+	assignOpts := buildAssignOpts(opts)
+
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	urls := make([]*URL, 0, len(urlStrs))
+
+	for _, urlStr := range urlStrs {
+		u, err := store.mint(ctx, tx, urlStr, assignOpts, now)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+
+		urls = append(urls, u)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return urls, nil
+}
+
+func (store *PostgresStore) AssignAlias(ctx context.Context, alias string, urlStr string, opts ...WithAssignOpts) (*URL, error) {
+	assignOpts := buildAssignOpts(opts)
+	now := time.Now().UTC()
+
+	ok, err := store.insert(ctx, store.db, alias, urlStr, true, assignOpts, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, ErrAliasTaken
+	}
+
+	return &URL{
+		Link:       &urlStr,
+		ShortKey:   alias,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		Vanity:     true,
+		ExpiresAt:  assignOpts.ExpiresAt,
+		OwnerID:    assignOpts.OwnerID,
+		Generation: 1,
+	}, nil
+}
+
+func (store *PostgresStore) FindOwned(ctx context.Context, ownerID string, shortKey string) (*URL, error) {
+	u := &URL{OwnerID: &ownerID}
+	var vanity int
+
+	err := store.db.QueryRowContext(ctx, PgFindOwnedURLQuery, shortKey, ownerID).Scan(
+		&u.Link,
+		&u.ShortKey,
+		&vanity,
+		&u.CreatedAt,
+		&u.UpdatedAt,
+		&u.ExpiresAt,
+		&u.Malicious,
+		&u.Generation,
+	)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrLinkNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	u.Vanity = vanity == 1
+	return u, nil
+}
+
+func (store *PostgresStore) ReassignOwner(ctx context.Context, from string, to string) (int64, error) {
+	res, err := store.db.ExecContext(ctx, PgReassignOwnerQuery, to, time.Now().UTC(), from)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+func (store *PostgresStore) Retarget(ctx context.Context, ownerID string, shortKey string, urlStr string, generation int64) (*URL, error) {
+	now := time.Now().UTC()
+
+	err := store.db.QueryRowContext(ctx, PgRetargetURLQuery, url.QueryEscape(urlStr), HashURL(urlStr), now, shortKey, ownerID, generation).Scan(&generation)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, retargetError(ctx, store, ownerID, shortKey, now)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &URL{
+		Link:       &urlStr,
+		ShortKey:   shortKey,
+		UpdatedAt:  now,
+		OwnerID:    &ownerID,
+		Generation: generation,
+	}, nil
+}
+
+func (store *PostgresStore) Delete(ctx context.Context, ownerID string, shortKey string, generation int64) error {
+	res, err := store.db.ExecContext(ctx, PgDeleteEntryQuery, time.Now().UTC(), shortKey, ownerID, generation)
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return store.conflictOrNotFound(ctx, ownerID, shortKey)
+	}
+
+	return nil
+}
+
+func (store *PostgresStore) SetMalicious(ctx context.Context, shortKey string, malicious bool, generation int64) (*URL, error) {
+	flag := 0
+	if malicious {
+		flag = 1
+	}
+
+	now := time.Now().UTC()
+
+	err := store.db.QueryRowContext(ctx, PgSetMaliciousQuery, flag, now, shortKey, generation).Scan(&generation)
+	if errors.Is(err, sql.ErrNoRows) {
+		var current int64
+
+		err := store.db.QueryRowContext(ctx, PgLinkGenerationQuery, shortKey).Scan(&current)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrLinkNotFound
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return nil, &GenerationConflict{ShortKey: shortKey, Current: current}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &URL{
+		ShortKey:   shortKey,
+		Malicious:  &flag,
+		UpdatedAt:  now,
+		Generation: generation,
+	}, nil
+}
+
+func (store *PostgresStore) conflictOrNotFound(ctx context.Context, ownerID string, shortKey string) error {
+	var current int64
+
+	err := store.db.QueryRowContext(ctx, PgCurrentGenerationQuery, shortKey, ownerID).Scan(&current)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrLinkNotFound
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return &GenerationConflict{ShortKey: shortKey, Current: current}
+}
+
+func (store *PostgresStore) ListByOwner(ctx context.Context, ownerID string, after string, limit int) ([]*URL, string, error) {
+	if limit < 1 || limit > MaxListLimit {
+		limit = DefaultListLimit
+	}
+
+	// one extra, to know if there is a next page
+	rows, err := store.db.QueryContext(ctx, PgListURLsByOwnerQuery, ownerID, after, limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	urls := []*URL{}
+
+	for rows.Next() {
+		u := &URL{OwnerID: &ownerID}
+		var vanity int
+
+		if err := rows.Scan(
+			&u.Link,
+			&u.ShortKey,
+			&vanity,
+			&u.CreatedAt,
+			&u.UpdatedAt,
+			&u.ExpiresAt,
+			&u.Generation,
+		); err != nil {
+			return nil, "", err
+		}
+
+		u.Vanity = vanity == 1
+		urls = append(urls, u)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	if len(urls) <= limit {
+		return urls, "", nil
+	}
+
+	urls = urls[:limit]
+	return urls, urls[limit-1].ShortKey, nil
+}
+
+func (store *PostgresStore) ScanDue(ctx context.Context, before time.Time, limit int) ([]*URL, error) {
+	rows, err := store.db.QueryContext(ctx, PgScanDueQuery, time.Now().UTC(), before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	urls := []*URL{}
+
+	for rows.Next() {
+		u := &URL{}
+
+		if err := rows.Scan(&u.Link, &u.ShortKey, &u.Generation); err != nil {
+			return nil, err
+		}
+
+		urls = append(urls, u)
+	}
+
+	return urls, rows.Err()
+}
+
+func (store *PostgresStore) MarkScanned(ctx context.Context, shortKey string, score int, generation int64) error {
+	_, err := store.db.ExecContext(ctx, PgMarkScannedQuery, time.Now().UTC(), score, shortKey, generation)
+	return err
+}
@@ -122,7 +122,7 @@ func (p *ShardProber) GetStatsForKeyRange(ctx context.Context, keyRange string)
 		return nil, fmt.Errorf("invalid key range. expected format start-end. keyRange: %s", keyRange)
 	}
 
-	keyRanges := p.seeder.Shards(5)
+	keyRanges := p.seeder.Shards()
 
 	// this is an interval problem
 	// given keyranges, a-e, f-p, q-s
@@ -146,7 +146,7 @@ func (p *ShardProber) GetStatsForKeyRange(ctx context.Context, keyRange string)
 
 	err := database.ConnectShards(ctx, db.DBReadOnlyMode)
 	if err != nil {
-		fmt.Errorf("failed to create databases")
+		return nil, fmt.Errorf("failed to create databases")
 	}
 
 	shards, ok := database.GetShards()
@@ -0,0 +1,467 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	ReportReasonPhishing = "phishing"
+	ReportReasonMalware  = "malware"
+	ReportReasonSpam     = "spam"
+	ReportReasonOther    = "other"
+)
+
+var ReportReasons = []string{ReportReasonPhishing, ReportReasonMalware, ReportReasonSpam, ReportReasonOther}
+
+const (
+	ReportStatusPending  = "pending"
+	ReportStatusResolved = "resolved"
+	// ReportStatusRecycled is a pending report of a link, whose key
+	// was recycled before a review. The key is another link now.
+	ReportStatusRecycled = "recycled"
+)
+
+// The actions of a review. Malicious stops the link from redirecting,
+// clear lifts it again, and dismiss resolves the reports as unfounded.
+const (
+	ActionMalicious = "malicious"
+	ActionClear     = "clear"
+	ActionDismiss   = "dismiss"
+)
+
+var ReviewActions = []string{ActionMalicious, ActionClear, ActionDismiss}
+
+// MaxReportDetails bounds the free text of a report
+const MaxReportDetails = 1000
+
+var (
+	ErrInvalidReason     = errors.New("invalid_reason")
+	ErrInvalidAction     = errors.New("invalid_action")
+	ErrNoPendingReports  = errors.New("no_pending_reports")
+	ErrDuplicateReport   = errors.New("duplicate_report")
+	ErrReportTooDetailed = errors.New("report_too_detailed")
+)
+
+// LinkReport is a link reported by an end user. Reporter is the
+// account of the user, or their ip for anonymous reports.
+type LinkReport struct {
+	ID         int64     `db:"id" json:"id"`
+	ShortKey   string    `db:"short_key" json:"short_key"`
+	Reason     string    `db:"reason" json:"reason"`
+	Details    string    `db:"details" json:"details,omitempty"`
+	Reporter   string    `db:"reporter" json:"-"`
+	Status     string    `db:"status" json:"status"`
+	DecisionID *int64    `db:"decision_id" json:"decision_id,omitempty"`
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`
+}
+
+func (r *LinkReport) Validate() error {
+	if !slices.Contains(ReportReasons, r.Reason) {
+		return fmt.Errorf("%w. expected one of %s", ErrInvalidReason, strings.Join(ReportReasons, ", "))
+	}
+
+	if len(r.Details) > MaxReportDetails {
+		return ErrReportTooDetailed
+	}
+
+	return nil
+}
+
+// LinkDecision is the outcome of a review of a link, Reports are
+// the pending reports it resolved. Generation is of the link, once
+// the decision was applied, it's 0 for the older decisions, or when
+// the link was left as it was.
+type LinkDecision struct {
+	ID         int64     `db:"id" json:"id"`
+	ShortKey   string    `db:"short_key" json:"short_key"`
+	Action     string    `db:"action" json:"action"`
+	Note       string    `db:"note" json:"note,omitempty"`
+	DecidedBy  string    `db:"decided_by" json:"decided_by"`
+	Reports    int64     `db:"reports" json:"reports"`
+	Generation int64     `db:"generation" json:"generation,omitempty"`
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`
+}
+
+// ReviewItem is a link in the review queue, with its pending reports
+type ReviewItem struct {
+	ShortKey  string    `json:"short_key"`
+	Reports   int64     `json:"reports"`
+	Reasons   []string  `json:"reasons"`
+	FirstAt   time.Time `json:"first_reported_at"`
+	LastAt    time.Time `json:"last_reported_at"`
+	Decisions int64     `json:"decisions"`
+}
+
+// LinkHistory is every report of a link, and every decision on it,
+// oldest first.
+type LinkHistory struct {
+	ShortKey  string          `json:"short_key"`
+	Reports   []*LinkReport   `json:"reports"`
+	Decisions []*LinkDecision `json:"decisions"`
+}
+
+const (
+	// a reporter has one pending report per link, at most
+	ReportInsertQuery = `INSERT INTO link_reports (short_key, reason, details, reporter, status, created_at)
+		SELECT ?1, ?2, ?3, ?4, 'pending', ?5
+		WHERE NOT EXISTS (SELECT 1 FROM link_reports WHERE short_key = ?1 AND reporter = ?4 AND status = 'pending')`
+	// the links with the most reports first, then the ones waiting longest
+	ReviewQueueQuery = `
+		SELECT r.short_key
+			,COUNT(1)
+			,GROUP_CONCAT(DISTINCT r.reason)
+			,MIN(r.created_at)
+			,MAX(r.created_at)
+			,(SELECT COUNT(1) FROM link_decisions d WHERE d.short_key = r.short_key)
+		FROM link_reports r
+		WHERE r.status = 'pending'
+		GROUP BY r.short_key
+		ORDER BY COUNT(1) DESC, MIN(r.created_at)
+		LIMIT ?
+	`
+	ReportsByShortKeyQuery = `SELECT id, short_key, reason, COALESCE(details, ''), reporter, status, decision_id, created_at
+		FROM link_reports WHERE short_key = ? ORDER BY id`
+	DecisionsByShortKeyQuery = `SELECT id, short_key, action, COALESCE(note, ''), decided_by, reports, created_at, COALESCE(generation, 0)
+		FROM link_decisions WHERE short_key = ? ORDER BY id`
+	LatestDecisionQuery = `SELECT id, short_key, action, COALESCE(note, ''), decided_by, reports, created_at, COALESCE(generation, 0)
+		FROM link_decisions WHERE short_key = ? ORDER BY id DESC LIMIT 1`
+	DecisionsAfterQuery = `SELECT id, short_key, action, COALESCE(note, ''), decided_by, reports, created_at, COALESCE(generation, 0)
+		FROM link_decisions WHERE id > ? ORDER BY id LIMIT ?`
+	LastDecisionIDQuery = `SELECT COALESCE(MAX(id), 0) FROM link_decisions`
+	DecisionInsertQuery = `INSERT INTO link_decisions (short_key, action, note, decided_by, reports, created_at, generation)
+		VALUES (?, ?, ?, ?, 0, ?, ?) RETURNING id`
+	ResolveReportsQuery  = `UPDATE link_reports SET status = 'resolved', decision_id = ? WHERE short_key = ? AND status = 'pending'`
+	DecisionReportsQuery = `UPDATE link_decisions SET reports = ? WHERE id = ?`
+	RecycleReportsQuery  = `UPDATE link_reports SET status = 'recycled' WHERE short_key = ? AND status = 'pending' AND created_at <= ?`
+)
+
+// ReportRepo keeps the reports of links and the review decisions
+// on them. It lives in the coordinator db, so that the review queue
+// doesn't have to be gathered from the shards.
+type ReportRepo struct {
+	db *sql.DB
+}
+
+func NewReportRepo(db *sql.DB) *ReportRepo {
+	return &ReportRepo{db: db}
+}
+
+// Create records the report as pending. ErrDuplicateReport is returned
+// if the reporter already has a pending report on the link.
+func (repo *ReportRepo) Create(ctx context.Context, report *LinkReport) error {
+	if err := report.Validate(); err != nil {
+		return err
+	}
+
+	report.Status = ReportStatusPending
+	report.CreatedAt = time.Now().UTC()
+
+	var details *string
+	if report.Details != "" {
+		details = &report.Details
+	}
+
+	res, err := repo.db.ExecContext(
+		ctx,
+		ReportInsertQuery,
+		report.ShortKey,
+		report.Reason,
+		details,
+		report.Reporter,
+		report.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return ErrDuplicateReport
+	}
+
+	report.ID, err = res.LastInsertId()
+	return err
+}
+
+// Queue lists upto limit links with pending reports
+func (repo *ReportRepo) Queue(ctx context.Context, limit int) ([]*ReviewItem, error) {
+	if limit < 1 || limit > MaxListLimit {
+		limit = DefaultListLimit
+	}
+
+	rows, err := repo.db.QueryContext(ctx, ReviewQueueQuery, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	items := []*ReviewItem{}
+
+	for rows.Next() {
+		item := &ReviewItem{}
+
+		var reasons string
+		// aggregates of timestamps come back as text
+		var firstAt, lastAt string
+
+		if err := rows.Scan(
+			&item.ShortKey,
+			&item.Reports,
+			&reasons,
+			&firstAt,
+			&lastAt,
+			&item.Decisions,
+		); err != nil {
+			return nil, err
+		}
+
+		item.Reasons = strings.Split(reasons, ",")
+		item.FirstAt = parseSqliteTime(firstAt)
+		item.LastAt = parseSqliteTime(lastAt)
+
+		items = append(items, item)
+	}
+
+	return items, rows.Err()
+}
+
+// parseSqliteTime parses a time the way the sqlite driver stores it,
+// a zero time is returned for anything else.
+func parseSqliteTime(value string) time.Time {
+	for _, layout := range []string{"2006-01-02 15:04:05.999999999-07:00", time.RFC3339Nano} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC()
+		}
+	}
+
+	return time.Time{}
+}
+
+// History returns the reports and the decisions of the link
+func (repo *ReportRepo) History(ctx context.Context, shortKey string) (*LinkHistory, error) {
+	history := &LinkHistory{ShortKey: shortKey, Reports: []*LinkReport{}, Decisions: []*LinkDecision{}}
+
+	rows, err := repo.db.QueryContext(ctx, ReportsByShortKeyQuery, shortKey)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		report := &LinkReport{}
+
+		if err := rows.Scan(
+			&report.ID,
+			&report.ShortKey,
+			&report.Reason,
+			&report.Details,
+			&report.Reporter,
+			&report.Status,
+			&report.DecisionID,
+			&report.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+
+		history.Reports = append(history.Reports, report)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	decisions, err := repo.db.QueryContext(ctx, DecisionsByShortKeyQuery, shortKey)
+	if err != nil {
+		return nil, err
+	}
+	defer decisions.Close()
+
+	for decisions.Next() {
+		decision := &LinkDecision{}
+
+		if err := decisions.Scan(
+			&decision.ID,
+			&decision.ShortKey,
+			&decision.Action,
+			&decision.Note,
+			&decision.DecidedBy,
+			&decision.Reports,
+			&decision.CreatedAt,
+			&decision.Generation,
+		); err != nil {
+			return nil, err
+		}
+
+		history.Decisions = append(history.Decisions, decision)
+	}
+
+	return history, decisions.Err()
+}
+
+// LatestDecision returns the last decision on the link,
+// or nil if it was never reviewed.
+func (repo *ReportRepo) LatestDecision(ctx context.Context, shortKey string) (*LinkDecision, error) {
+	decision := &LinkDecision{}
+
+	err := repo.db.QueryRowContext(ctx, LatestDecisionQuery, shortKey).Scan(
+		&decision.ID,
+		&decision.ShortKey,
+		&decision.Action,
+		&decision.Note,
+		&decision.DecidedBy,
+		&decision.Reports,
+		&decision.CreatedAt,
+		&decision.Generation,
+	)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return decision, nil
+}
+
+// DecisionsAfter lists upto limit decisions, recorded after the one
+// with afterID, oldest first. It's how the servers learn of the
+// decisions taken elsewhere, see LastDecisionID.
+func (repo *ReportRepo) DecisionsAfter(ctx context.Context, afterID int64, limit int) ([]*LinkDecision, error) {
+	rows, err := repo.db.QueryContext(ctx, DecisionsAfterQuery, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	decisions := []*LinkDecision{}
+
+	for rows.Next() {
+		decision := &LinkDecision{}
+
+		err := rows.Scan(
+			&decision.ID,
+			&decision.ShortKey,
+			&decision.Action,
+			&decision.Note,
+			&decision.DecidedBy,
+			&decision.Reports,
+			&decision.CreatedAt,
+			&decision.Generation,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		decisions = append(decisions, decision)
+	}
+
+	return decisions, rows.Err()
+}
+
+// LastDecisionID is the id of the last decision, 0 if there is none
+func (repo *ReportRepo) LastDecisionID(ctx context.Context) (int64, error) {
+	var id int64
+	err := repo.db.QueryRowContext(ctx, LastDecisionIDQuery).Scan(&id)
+
+	return id, err
+}
+
+// Recycled closes the pending reports of the recycled keys, made before
+// recycledAt, so they don't land on the links the keys are given next.
+func (repo *ReportRepo) Recycled(ctx context.Context, shortKeys []string, recycledAt time.Time) (int64, error) {
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var closed int64
+
+	for _, shortKey := range shortKeys {
+		res, err := tx.ExecContext(ctx, RecycleReportsQuery, shortKey, recycledAt)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+
+		n, _ := res.RowsAffected()
+		closed += n
+	}
+
+	return closed, tx.Commit()
+}
+
+// Decide records the decision, and resolves the pending reports of
+// the link with it. A dismissal needs pending reports, otherwise
+// ErrNoPendingReports is returned.
+func (repo *ReportRepo) Decide(ctx context.Context, decision *LinkDecision) error {
+	if !slices.Contains(ReviewActions, decision.Action) {
+		return fmt.Errorf("%w. expected one of %s", ErrInvalidAction, strings.Join(ReviewActions, ", "))
+	}
+
+	decision.CreatedAt = time.Now().UTC()
+
+	var note *string
+	if decision.Note != "" {
+		note = &decision.Note
+	}
+
+	var generation *int64
+	if decision.Generation != AnyGeneration {
+		generation = &decision.Generation
+	}
+
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	err = tx.QueryRowContext(
+		ctx,
+		DecisionInsertQuery,
+		decision.ShortKey,
+		decision.Action,
+		note,
+		decision.DecidedBy,
+		decision.CreatedAt,
+		generation,
+	).Scan(&decision.ID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	res, err := tx.ExecContext(ctx, ResolveReportsQuery, decision.ID, decision.ShortKey)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if decision.Reports, err = res.RowsAffected(); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if decision.Reports == 0 && decision.Action == ActionDismiss {
+		tx.Rollback()
+		return ErrNoPendingReports
+	}
+
+	if _, err := tx.ExecContext(ctx, DecisionReportsQuery, decision.Reports, decision.ID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,136 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-batteries/shortner/app/models"
+)
+
+func Test_ReportReview(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	database, _ := changelogShard(t, filepath.Join(dir, "db_a_z"), false)
+	database.CoordinatorPath = filepath.Join(dir, "coordinator.db")
+
+	cdb, err := database.ConnectCoordinatorDB(ctx)
+	if err != nil {
+		t.Fatalf("failed to open coordinator %v", err)
+	}
+	defer cdb.Close()
+
+	if err := database.MigrateCoordinator(ctx); err != nil {
+		t.Fatalf("failed to migrate coordinator %v", err)
+	}
+
+	repo := models.NewURLRepo(database)
+	reports := models.NewReportRepo(cdb)
+
+	u, err := repo.AssignAlias(ctx, "phish", "https://phish.example.com", models.WithOwner("acc_1"))
+	if err != nil {
+		t.Fatalf("failed to assign alias %v", err)
+	}
+
+	for _, report := range []*models.LinkReport{
+		{ShortKey: "phish", Reason: models.ReportReasonPhishing, Reporter: "ip:10.0.0.1"},
+		{ShortKey: "phish", Reason: models.ReportReasonMalware, Reporter: "ip:10.0.0.2", Details: "asks for a password"},
+		{ShortKey: "other", Reason: models.ReportReasonSpam, Reporter: "ip:10.0.0.1"},
+	} {
+		if err := reports.Create(ctx, report); err != nil {
+			t.Fatalf("failed to report %v", err)
+		}
+	}
+
+	if err := reports.Create(ctx, &models.LinkReport{ShortKey: "phish", Reason: models.ReportReasonSpam, Reporter: "ip:10.0.0.1"}); !errors.Is(err, models.ErrDuplicateReport) {
+		t.Fatalf("expected a pending report of the same reporter to be a duplicate, got %v", err)
+	}
+
+	if err := reports.Create(ctx, &models.LinkReport{ShortKey: "phish", Reason: "boring", Reporter: "ip:10.0.0.3"}); !errors.Is(err, models.ErrInvalidReason) {
+		t.Fatalf("expected invalid_reason, got %v", err)
+	}
+
+	queue, err := reports.Queue(ctx, 10)
+	if err != nil || len(queue) != 2 || queue[0].ShortKey != "phish" || queue[0].Reports != 2 || len(queue[0].Reasons) != 2 {
+		t.Fatalf("expected the most reported link first, got %+v. %v", queue, err)
+	}
+
+	if queue[0].FirstAt.IsZero() || time.Since(queue[0].LastAt) > time.Minute {
+		t.Fatalf("expected the report times, got %+v", queue[0])
+	}
+
+	marked, err := repo.SetMalicious(ctx, "phish", true, u.Generation)
+	if err != nil || marked.Generation != u.Generation+1 {
+		t.Fatalf("failed to mark malicious %+v. %v", marked, err)
+	}
+
+	if _, err := repo.SetMalicious(ctx, "phish", false, u.Generation); !errors.Is(err, models.ErrGenerationConflict) {
+		t.Fatalf("expected a stale mark to conflict, got %v", err)
+	}
+
+	if _, err := repo.SetMalicious(ctx, "nope", true, models.AnyGeneration); !errors.Is(err, models.ErrLinkNotFound) {
+		t.Fatalf("expected link_not_found, got %v", err)
+	}
+
+	if _, err := repo.Find(ctx, "phish"); !errors.Is(err, models.ErrLinkMalicious) {
+		t.Fatalf("expected the marked link to stop resolving, got %v", err)
+	}
+
+	decision := &models.LinkDecision{ShortKey: "phish", Action: models.ActionMalicious, DecidedBy: "admin", Note: "confirmed"}
+	if err := reports.Decide(ctx, decision); err != nil || decision.Reports != 2 {
+		t.Fatalf("expected the decision to resolve 2 reports, got %+v. %v", decision, err)
+	}
+
+	if err := reports.Decide(ctx, &models.LinkDecision{ShortKey: "phish", Action: models.ActionDismiss, DecidedBy: "admin"}); !errors.Is(err, models.ErrNoPendingReports) {
+		t.Fatalf("expected a dismissal without reports to fail, got %v", err)
+	}
+
+	if err := reports.Decide(ctx, &models.LinkDecision{ShortKey: "phish", Action: "delete", DecidedBy: "admin"}); !errors.Is(err, models.ErrInvalidAction) {
+		t.Fatalf("expected invalid_action, got %v", err)
+	}
+
+	queue, err = reports.Queue(ctx, 10)
+	if err != nil || len(queue) != 1 || queue[0].ShortKey != "other" {
+		t.Fatalf("expected only the other link left in the queue, got %+v. %v", queue, err)
+	}
+
+	// a new report after the decision is pending again
+	if err := reports.Create(ctx, &models.LinkReport{ShortKey: "phish", Reason: models.ReportReasonPhishing, Reporter: "ip:10.0.0.1"}); err != nil {
+		t.Fatalf("failed to report again %v", err)
+	}
+
+	history, err := reports.History(ctx, "phish")
+	if err != nil || len(history.Reports) != 3 || len(history.Decisions) != 1 {
+		t.Fatalf("expected 3 reports and a decision, got %+v. %v", history, err)
+	}
+
+	if history.Reports[0].Status != models.ReportStatusResolved || *history.Reports[0].DecisionID != decision.ID ||
+		history.Reports[2].Status != models.ReportStatusPending || history.Decisions[0].Note != "confirmed" {
+		t.Fatalf("expected the decided reports resolved, got %+v", history.Reports[0])
+	}
+
+	if _, err := repo.SetMalicious(ctx, "phish", false, models.AnyGeneration); err != nil {
+		t.Fatalf("failed to clear %v", err)
+	}
+
+	if _, err := repo.Find(ctx, "phish"); err != nil {
+		t.Fatalf("expected the cleared link to resolve again, got %v", err)
+	}
+
+	// the key of other is recycled, before it was reviewed
+	closed, err := reports.Recycled(ctx, []string{"other", "unreported"}, time.Now().UTC())
+	if err != nil || closed != 1 {
+		t.Fatalf("expected the pending report of the recycled key closed, got %d. %v", closed, err)
+	}
+
+	if history, _ := reports.History(ctx, "other"); history.Reports[0].Status != models.ReportStatusRecycled {
+		t.Fatalf("expected the report to be recycled, got %+v", history.Reports[0])
+	}
+
+	if queue, _ := reports.Queue(ctx, 10); len(queue) != 1 || queue[0].ShortKey != "phish" {
+		t.Fatalf("expected the recycled key out of the queue, got %+v", queue)
+	}
+}
@@ -0,0 +1,263 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// The mover runs these on a source shard connection, with the new shard
+// attached as target. %[1]s is the column list of urls, and %[2]s
+// matches the short keys of the prefixes being moved.
+const (
+	AttachTargetQuery = `ATTACH DATABASE ? AS target`
+	DetachTargetQuery = `DETACH DATABASE target`
+	URLColumnsQuery   = `SELECT name FROM pragma_table_info('urls')`
+	MaxURLRowIDQuery  = `SELECT COALESCE(MAX(rowid), 0) FROM main.urls`
+
+	MoveFreeKeysQuery   = `INSERT INTO target.urls (%[1]s) SELECT %[1]s FROM main.urls WHERE url IS NULL AND %[2]s`
+	DeleteFreeKeysQuery = `DELETE FROM main.urls WHERE url IS NULL AND %[2]s`
+
+	CopyLinksQuery  = `INSERT INTO target.urls (%[1]s) SELECT %[1]s FROM main.urls WHERE rowid > ? AND rowid <= ? AND %[2]s`
+	CopyClicksQuery = `INSERT INTO target.clicks (short_key, clicked_at, referrer, user_agent, country)
+		SELECT short_key, clicked_at, referrer, user_agent, country FROM main.clicks WHERE clicked_at < ? AND %[2]s`
+
+	// The links written to both, by the servers on either side of the
+	// switch, like an alias claimed twice. Only the later write is kept.
+	ConflictingLinksQuery = `SELECT s.short_key FROM main.urls s WHERE s.updated_at >= ?1 AND %[2]s
+		AND EXISTS (SELECT 1 FROM target.urls t WHERE t.short_key = s.short_key AND t.updated_at >= ?1
+			AND (t.url IS NOT s.url OR t.owner_id IS NOT s.owner_id))
+		ORDER BY s.short_key`
+
+	// The writes which landed on the source after the copy started, win
+	// over the copy. Unless the target changed them later, after the switch.
+	DropStaleLinksQuery = `DELETE FROM target.urls WHERE short_key IN (
+		SELECT s.short_key FROM main.urls s WHERE s.updated_at >= ? AND %[2]s
+		AND s.updated_at > (SELECT MAX(t.updated_at) FROM target.urls t WHERE t.short_key = s.short_key))`
+	CatchUpLinksQuery = `INSERT INTO target.urls (%[1]s) SELECT %[1]s FROM main.urls s WHERE %[2]s
+		AND NOT EXISTS (SELECT 1 FROM target.urls t WHERE t.short_key = s.short_key)`
+	CatchUpClicksQuery = `INSERT INTO target.clicks (short_key, clicked_at, referrer, user_agent, country)
+		SELECT short_key, clicked_at, referrer, user_agent, country FROM main.clicks WHERE clicked_at >= ? AND %[2]s`
+
+	PurgeLinksQuery  = `DELETE FROM main.urls WHERE %[2]s`
+	PurgeClicksQuery = `DELETE FROM main.clicks WHERE %[2]s`
+)
+
+type MoveStats struct {
+	KeyRange string
+	FreeKeys int64
+	Links    int64
+	Clicks   int64
+	CaughtUp int64
+	Purged   int64
+
+	// Conflicts are the short keys written on both the
+	// source and the target, since the copy started.
+	Conflicts []string
+}
+
+// ShardMover moves the rows of a key range, out of a shard
+// file into a new one. It holds on to a single connection
+// of the source, since the target is attached to it.
+type ShardMover struct {
+	conn    *sql.Conn
+	columns string
+	start   string
+	end     string
+
+	Stats *MoveStats
+}
+
+func NewShardMover(ctx context.Context, source *sql.DB, targetPath string, keyRange string) (*ShardMover, error) {
+	start, end, ok := ExplodeKeyRange(keyRange)
+	if !ok {
+		return nil, fmt.Errorf("invalid key range %s", keyRange)
+	}
+
+	conn, err := source.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.ExecContext(ctx, AttachTargetQuery, targetPath); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to attach %s. %v", targetPath, err)
+	}
+
+	mover := &ShardMover{
+		conn:  conn,
+		start: string(start),
+		end:   string(end),
+		Stats: &MoveStats{KeyRange: keyRange},
+	}
+
+	if mover.columns, err = mover.urlColumns(ctx); err != nil {
+		mover.Close()
+		return nil, err
+	}
+
+	return mover, nil
+}
+
+func (m *ShardMover) urlColumns(ctx context.Context) (string, error) {
+	rows, err := m.conn.QueryContext(ctx, URLColumnsQuery)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	columns := []string{}
+
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return "", err
+		}
+
+		columns = append(columns, column)
+	}
+
+	return strings.Join(columns, ", "), rows.Err()
+}
+
+func (m *ShardMover) Close() error {
+	m.conn.ExecContext(context.Background(), DetachTargetQuery)
+	return m.conn.Close()
+}
+
+func (m *ShardMover) query(query string) string {
+	inRange := fmt.Sprintf("lower(substr(short_key, 1, 1)) BETWEEN '%s' AND '%s'", m.start, m.end)
+	return fmt.Sprintf(query, m.columns, inRange)
+}
+
+// MoveFreeKeys hands the unassigned keys over to the target, first.
+// So the source can't assign them anymore, while the links are copied.
+func (m *ShardMover) MoveFreeKeys(ctx context.Context) error {
+	tx, err := m.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.ExecContext(ctx, m.query(MoveFreeKeysQuery))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	m.Stats.FreeKeys, _ = res.RowsAffected()
+
+	if _, err := tx.ExecContext(ctx, m.query(DeleteFreeKeysQuery)); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// CopyLinks copies the links, batchSize rowids at a time,
+// and the clicks recorded before until.
+func (m *ShardMover) CopyLinks(ctx context.Context, until time.Time, batchSize int) error {
+	var maxRowID int64
+	if err := m.conn.QueryRowContext(ctx, MaxURLRowIDQuery).Scan(&maxRowID); err != nil {
+		return err
+	}
+
+	for from := int64(0); from < maxRowID; from += int64(batchSize) {
+		res, err := m.conn.ExecContext(ctx, m.query(CopyLinksQuery), from, from+int64(batchSize))
+		if err != nil {
+			return err
+		}
+
+		copied, _ := res.RowsAffected()
+		m.Stats.Links += copied
+	}
+
+	res, err := m.conn.ExecContext(ctx, m.query(CopyClicksQuery), until)
+	if err != nil {
+		return err
+	}
+
+	m.Stats.Clicks, _ = res.RowsAffected()
+	return nil
+}
+
+// CatchUp brings over what the source received since the copy started.
+// It should run once the servers have switched to the target.
+func (m *ShardMover) CatchUp(ctx context.Context, since time.Time) error {
+	tx, err := m.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if m.Stats.Conflicts, err = m.conflicts(ctx, tx, since); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, m.query(DropStaleLinksQuery), since); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	res, err := tx.ExecContext(ctx, m.query(CatchUpLinksQuery))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	m.Stats.CaughtUp, _ = res.RowsAffected()
+
+	res, err = tx.ExecContext(ctx, m.query(CatchUpClicksQuery), since)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	clicks, _ := res.RowsAffected()
+	m.Stats.Clicks += clicks
+
+	return tx.Commit()
+}
+
+func (m *ShardMover) conflicts(ctx context.Context, tx *sql.Tx, since time.Time) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, m.query(ConflictingLinksQuery), since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	shortKeys := []string{}
+
+	for rows.Next() {
+		var shortKey string
+		if err := rows.Scan(&shortKey); err != nil {
+			return nil, err
+		}
+
+		shortKeys = append(shortKeys, shortKey)
+	}
+
+	return shortKeys, rows.Err()
+}
+
+// Purge removes the moved rows from the source
+func (m *ShardMover) Purge(ctx context.Context) error {
+	tx, err := m.conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.ExecContext(ctx, m.query(PurgeLinksQuery))
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	m.Stats.Purged, _ = res.RowsAffected()
+
+	if _, err := tx.ExecContext(ctx, m.query(PurgeClicksQuery)); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
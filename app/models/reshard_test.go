@@ -0,0 +1,113 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-batteries/shortner/app/models"
+)
+
+func Test_ShardMover(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	sourceDB, source := changelogShard(t, filepath.Join(dir, "db_a_z"), false)
+	targetDB, _ := changelogShard(t, filepath.Join(dir, "db_n_z"), false)
+
+	sourceRepo := models.NewURLRepo(sourceDB)
+	targetRepo := models.NewURLRepo(targetDB)
+
+	now := time.Now().UTC()
+	err := sourceRepo.CreateBatches(ctx, []*models.URL{
+		{ShortKey: "b001", CreatedAt: now, UpdatedAt: now},
+		{ShortKey: "p001", CreatedAt: now, UpdatedAt: now},
+		{ShortKey: "p002", CreatedAt: now, UpdatedAt: now},
+	})
+	if err != nil {
+		t.Fatalf("failed to seed keys %v", err)
+	}
+
+	for _, alias := range []string{"apple", "nebula", "nova", "quasar"} {
+		if _, err := sourceRepo.AssignAlias(ctx, alias, "https://example.com/"+alias, models.WithOwner("acc_1")); err != nil {
+			t.Fatalf("failed to assign alias %v", err)
+		}
+	}
+
+	mover, err := models.NewShardMover(ctx, source.Conn(), filepath.Join(dir, "db_n_z.db"), "n-z")
+	if err != nil {
+		t.Fatalf("failed to create mover %v", err)
+	}
+	defer mover.Close()
+
+	if err := mover.MoveFreeKeys(ctx); err != nil || mover.Stats.FreeKeys != 2 {
+		t.Fatalf("expected the 2 free keys of n-z to move, got %d. %v", mover.Stats.FreeKeys, err)
+	}
+
+	copyStart := time.Now().UTC()
+
+	// during the copy, the source still takes the writes
+	if _, err := sourceRepo.Retarget(ctx, "acc_1", "nebula", "https://example.com/copying", models.AnyGeneration); err != nil {
+		t.Fatalf("failed to retarget %v", err)
+	}
+
+	if err := mover.CopyLinks(ctx, copyStart, 1); err != nil || mover.Stats.Links != 3 {
+		t.Fatalf("expected the 3 links of n-z to be copied, got %d. %v", mover.Stats.Links, err)
+	}
+
+	// the grace window, the servers which haven't switched
+	// write to the source, the rest to the target
+	if err := sourceRepo.Delete(ctx, "acc_1", "nova", models.AnyGeneration); err != nil {
+		t.Fatalf("failed to delete %v", err)
+	}
+
+	if _, err := sourceRepo.AssignAlias(ctx, "orbit", "https://example.com/orbit", models.WithOwner("acc_1")); err != nil {
+		t.Fatalf("failed to assign alias %v", err)
+	}
+
+	if _, err := sourceRepo.AssignAlias(ctx, "omega", "https://example.com/source", models.WithOwner("acc_1")); err != nil {
+		t.Fatalf("failed to assign alias %v", err)
+	}
+
+	if _, err := targetRepo.AssignAlias(ctx, "omega", "https://example.com/target", models.WithOwner("acc_2")); err != nil {
+		t.Fatalf("failed to assign alias %v", err)
+	}
+
+	if _, err := targetRepo.Retarget(ctx, "acc_1", "quasar", "https://example.com/switched", models.AnyGeneration); err != nil {
+		t.Fatalf("failed to retarget %v", err)
+	}
+
+	if err := mover.CatchUp(ctx, copyStart); err != nil {
+		t.Fatalf("failed to catch up %v", err)
+	}
+
+	if len(mover.Stats.Conflicts) != 1 || mover.Stats.Conflicts[0] != "omega" {
+		t.Fatalf("expected the alias claimed on both sides to be a conflict, got %v", mover.Stats.Conflicts)
+	}
+
+	if err := mover.Purge(ctx); err != nil || mover.Stats.Purged != 5 {
+		t.Fatalf("expected the 5 links of n-z to be purged from the source, got %d. %v", mover.Stats.Purged, err)
+	}
+
+	for shortKey, link := range map[string]string{
+		"nebula": "https%3A%2F%2Fexample.com%2Fcopying",
+		"orbit":  "https%3A%2F%2Fexample.com%2Forbit",
+		"omega":  "https%3A%2F%2Fexample.com%2Ftarget",
+		"quasar": "https%3A%2F%2Fexample.com%2Fswitched",
+	} {
+		u, err := targetRepo.Find(ctx, shortKey)
+		if err != nil || *u.Link != link {
+			t.Fatalf("expected %s to point to %s on the target, got %v", shortKey, link, err)
+		}
+	}
+
+	if _, err := targetRepo.Find(ctx, "nova"); !errors.Is(err, models.ErrLinkNotFound) {
+		t.Fatalf("expected the delete on the source to be caught up, got %v", err)
+	}
+
+	if _, err := sourceRepo.Find(ctx, "apple"); err != nil {
+		t.Fatalf("expected the links out of n-z to stay on the source, got %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/go-batteries/shortner/app/db"
+)
+
+// ScanDueQuery is ordered on scanned_at, so the links never
+// scanned come first, then the ones scanned the longest ago.
+const ScanDueQuery = `
+	SELECT url
+		,short_key
+		,generation
+	FROM urls
+	WHERE url IS NOT NULL
+	AND deleted_at IS NULL
+	AND (malicious IS NULL OR malicious = 0)
+	AND (expires_at IS NULL OR expires_at > ?1)
+	AND (scanned_at IS NULL OR scanned_at < ?2)
+	ORDER BY scanned_at
+	LIMIT ?3
+`
+
+// MarkScannedQuery doesn't bump the generation, the scan isn't a write
+// to the link. It's skipped if the link moved on, since the scan was of
+// what it pointed to before.
+const MarkScannedQuery = `UPDATE urls SET scanned_at = ?1, scan_score = ?2
+	WHERE short_key = ?3 AND (?4 = 0 OR generation = ?4)`
+
+// ScanDue returns upto limit live links, which haven't been scanned
+// since before. The shards are gone through in order, till the limit
+// is reached.
+func (repo *URLRepo) ScanDue(ctx context.Context, before time.Time, limit int) ([]*URL, error) {
+	shards, ok := repo.sharder.GetShards()
+	if !ok {
+		return nil, fmt.Errorf("no shards to scan")
+	}
+
+	now := time.Now().UTC()
+	urls := []*URL{}
+
+	for _, shard := range shards {
+		if len(urls) >= limit {
+			break
+		}
+
+		err := db.ReadFrom(shard, func(conn *sql.DB) error {
+			rows, err := conn.QueryContext(ctx, ScanDueQuery, now, before, limit-len(urls))
+			if err != nil {
+				return err
+			}
+			defer rows.Close()
+
+			for rows.Next() {
+				u := &URL{}
+
+				if err := rows.Scan(&u.Link, &u.ShortKey, &u.Generation); err != nil {
+					return err
+				}
+
+				urls = append(urls, u)
+			}
+
+			return rows.Err()
+		})
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to find the links due on %s. %w", shard.ShardKey(), err)
+		}
+	}
+
+	return urls, nil
+}
+
+// MarkScanned records the score of the scan of the link, at generation.
+func (repo *URLRepo) MarkScanned(ctx context.Context, shortKey string, score int, generation int64) error {
+	shard, err := repo.sharder.GetShard(shortKey)
+	if err != nil {
+		return err
+	}
+
+	_, err = shard.Conn().ExecContext(ctx, MarkScannedQuery, time.Now().UTC(), score, shortKey, generation)
+	return err
+}
@@ -0,0 +1,89 @@
+package models_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-batteries/shortner/app/models"
+)
+
+func Test_ScanDue(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	database, shard := changelogShard(t, filepath.Join(dir, "db_a_z"), true)
+	repo := models.NewURLRepo(database)
+
+	a, err := repo.AssignAlias(ctx, "scan-a", "https://a.example.com", models.WithOwner("acc_1"))
+	if err != nil {
+		t.Fatalf("failed to assign alias %v", err)
+	}
+
+	b, err := repo.AssignAlias(ctx, "scan-b", "https://b.example.com", models.WithOwner("acc_1"))
+	if err != nil {
+		t.Fatalf("failed to assign alias %v", err)
+	}
+
+	due := func(before time.Time) []string {
+		t.Helper()
+
+		urls, err := repo.ScanDue(ctx, before, 10)
+		if err != nil {
+			t.Fatalf("failed to find the links due %v", err)
+		}
+
+		keys := []string{}
+		for _, u := range urls {
+			keys = append(keys, u.ShortKey)
+		}
+
+		return keys
+	}
+
+	if keys := due(time.Time{}); len(keys) != 2 {
+		t.Fatalf("expected both links never scanned, got %v", keys)
+	}
+
+	var changes int
+	shard.Conn().QueryRow(`SELECT COUNT(1) FROM changelog`).Scan(&changes)
+
+	if err := repo.MarkScanned(ctx, a.ShortKey, 1, a.Generation); err != nil {
+		t.Fatalf("failed to mark scanned %v", err)
+	}
+
+	// a stale scan isn't recorded
+	if err := repo.MarkScanned(ctx, b.ShortKey, 1, b.Generation+1); err != nil {
+		t.Fatalf("failed to mark scanned %v", err)
+	}
+
+	if keys := due(time.Time{}); len(keys) != 1 || keys[0] != b.ShortKey {
+		t.Fatalf("expected only %s left unscanned, got %v", b.ShortKey, keys)
+	}
+
+	var after int
+	shard.Conn().QueryRow(`SELECT COUNT(1) FROM changelog`).Scan(&after)
+
+	if after != changes {
+		t.Fatalf("expected the scans to be left out of the changelog, got %d changes", after-changes)
+	}
+
+	// the never scanned come before the ones due a rescan
+	if keys := due(time.Now().UTC().Add(time.Minute)); len(keys) != 2 || keys[0] != b.ShortKey {
+		t.Fatalf("expected both links due a rescan, unscanned first, got %v", keys)
+	}
+
+	if _, err := repo.Retarget(ctx, "acc_1", a.ShortKey, "https://c.example.com", models.AnyGeneration); err != nil {
+		t.Fatalf("failed to retarget %v", err)
+	}
+
+	if _, err := repo.SetMalicious(ctx, b.ShortKey, true, models.AnyGeneration); err != nil {
+		t.Fatalf("failed to mark malicious %v", err)
+	}
+
+	keys := due(time.Time{})
+	if len(keys) != 1 || keys[0] != a.ShortKey {
+		t.Fatalf("expected the retargeted link to be scanned again, and the malicious one skipped, got %v", keys)
+	}
+}
@@ -0,0 +1,72 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"math/rand"
+	"time"
+
+	"github.com/go-batteries/shortner/app/seed"
+	"github.com/mr-tron/base58"
+)
+
+const (
+	StoreDriverSqlite   = "sqlite"
+	StoreDriverPostgres = "postgres"
+	StoreDriverMemory   = "memory"
+)
+
+// Store keeps the short key to url mappings. The controllers only
+// talk to a Store, so the backing database can be swapped.
+// URLRepo is the sharded sqlite Store.
+//
+// Links returned by the finders are query escaped, the way they are
+// stored, the ones returned by the writes are as given.
+//
+// The writes of the owner compare and swap on the generation of the
+// link, AnyGeneration skips the check. A GenerationConflict, with the
+// current generation, is returned if it doesn't match.
+//
+// FindOwned finds a link of the owner, even an expired or a malicious
+// one, for the owner to look at. It's read from the primary.
+//
+// The links are scanned in the background, ScanDue finds the ones to
+// scan, and MarkScanned records the score. A retarget resets the scan.
+type Store interface {
+	Find(ctx context.Context, shortKey string) (*URL, error)
+	FindByHash(ctx context.Context, ownerID string, urlStr string) (*URL, error)
+	FindOwned(ctx context.Context, ownerID string, shortKey string) (*URL, error)
+	AssignURL(ctx context.Context, urlStr string, opts ...WithAssignOpts) (*URL, error)
+	AssignURLs(ctx context.Context, urlStrs []string, opts ...WithAssignOpts) ([]*URL, error)
+	AssignAlias(ctx context.Context, alias string, urlStr string, opts ...WithAssignOpts) (*URL, error)
+	Retarget(ctx context.Context, ownerID string, shortKey string, urlStr string, generation int64) (*URL, error)
+	Delete(ctx context.Context, ownerID string, shortKey string, generation int64) error
+	SetMalicious(ctx context.Context, shortKey string, malicious bool, generation int64) (*URL, error)
+	ListByOwner(ctx context.Context, ownerID string, after string, limit int) ([]*URL, string, error)
+	ScanDue(ctx context.Context, before time.Time, limit int) ([]*URL, error)
+	MarkScanned(ctx context.Context, shortKey string, score int, generation int64) error
+}
+
+var (
+	_ Store = (*URLRepo)(nil)
+	_ Store = (*PostgresStore)(nil)
+	_ Store = (*MemoryStore)(nil)
+)
+
+// mintAttempts is how many fresh keys are tried,
+// before giving up on a key collision.
+const mintAttempts = 5
+
+var mintPrefixes = seed.RegisterUrlSeeder().Lowers()
+
+// MintShortKey makes a key the way the seeder does, a lowercase prefix
+// and the base58 of a number. The sqlite shards are seeded with keys
+// upfront, the other stores mint them on assignment, and rely on the
+// short_key being unique to catch collisions.
+func MintShortKey() string {
+	prefix := mintPrefixes[rand.Intn(len(mintPrefixes))]
+	n := DefaultSeedStart + uint64(rand.Int63n(int64(DefaultSeedStart)*100))
+
+	return fmt.Sprintf("%s%s", prefix, base58.Encode(big.NewInt(0).SetUint64(n).Bytes()))
+}
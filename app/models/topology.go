@@ -0,0 +1,440 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrTopologyMismatch = errors.New("topology_mismatch")
+	ErrInvalidSplit     = errors.New("invalid_split")
+)
+
+// ShardSpec is one shard of the topology, the db file of
+// a key range, and where the keys of each prefix start from.
+type ShardSpec struct {
+	KeyRange string
+	Path     string
+	Starts   map[string]uint64
+
+	// Replicas are local to each server, they
+	// aren't recorded, or compared, like Path.
+	Replicas []string
+}
+
+// Topology is the layout of the shards. It is recorded in the
+// coordinator db by the first component to run, after which,
+// everything has to agree with it.
+type Topology struct {
+	Shards []*ShardSpec
+
+	// CoordinatorPath isn't part of the recorded
+	// topology, it is where it's recorded.
+	CoordinatorPath string
+
+	// Changelog isn't recorded either, it's whether
+	// the writes to the shards are captured.
+	Changelog bool
+}
+
+func (t *Topology) KeyRanges() []string {
+	keyRanges := make([]string, 0, len(t.Shards))
+	for _, spec := range t.Shards {
+		keyRanges = append(keyRanges, spec.KeyRange)
+	}
+
+	return keyRanges
+}
+
+func (t *Topology) Paths() []string {
+	paths := make([]string, 0, len(t.Shards))
+	for _, spec := range t.Shards {
+		paths = append(paths, spec.Path)
+	}
+
+	return paths
+}
+
+func (t *Topology) spec(keyRange string) *ShardSpec {
+	for _, spec := range t.Shards {
+		if spec.KeyRange == keyRange {
+			return spec
+		}
+	}
+
+	return nil
+}
+
+// DBName is the shard file, without the .db
+// the way SqliteCoordinator.ToDbName expects.
+func (t *Topology) DBName(keyRange string) string {
+	spec := t.spec(keyRange)
+	if spec == nil {
+		return strings.TrimSuffix(defaultShardPath(keyRange), ".db")
+	}
+
+	return strings.TrimSuffix(spec.Path, ".db")
+}
+
+func defaultShardPath(keyRange string) string {
+	return fmt.Sprintf("db_%s.db", strings.ReplaceAll(keyRange, "-", "_"))
+}
+
+// Split returns the topology with the key range from, split into the
+// contiguous key ranges of into. The first of them keeps the db file,
+// the rest get the file from paths, or a new one named after the range.
+func (t *Topology) Split(from string, into []string, paths map[string]string) (*Topology, error) {
+	source := t.spec(from)
+	if source == nil {
+		return nil, fmt.Errorf("%w. unknown key range %s", ErrInvalidSplit, from)
+	}
+
+	if len(into) < 2 {
+		return nil, fmt.Errorf("%w. %s should be split into at least two key ranges", ErrInvalidSplit, from)
+	}
+
+	fromStart, fromEnd, _ := ExplodeKeyRange(from)
+	next := fromStart
+
+	for _, keyRange := range into {
+		start, end, ok := ExplodeKeyRange(keyRange)
+		if !ok || start > end {
+			return nil, fmt.Errorf("%w. invalid key range %s", ErrInvalidSplit, keyRange)
+		}
+
+		if start != next {
+			return nil, fmt.Errorf("%w. %s doesn't continue from %c", ErrInvalidSplit, keyRange, next)
+		}
+
+		next = end + 1
+	}
+
+	if next != fromEnd+1 {
+		return nil, fmt.Errorf("%w. %s doesn't cover all of %s", ErrInvalidSplit, strings.Join(into, ","), from)
+	}
+
+	split := &Topology{CoordinatorPath: t.CoordinatorPath}
+	usedPaths := map[string]bool{}
+
+	for _, spec := range t.Shards {
+		if spec.KeyRange == from {
+			continue
+		}
+
+		usedPaths[spec.Path] = true
+	}
+
+	for _, spec := range t.Shards {
+		if spec.KeyRange != from {
+			split.Shards = append(split.Shards, spec)
+			continue
+		}
+
+		for i, keyRange := range into {
+			path := source.Path
+			if i > 0 {
+				path = paths[keyRange]
+				if path == "" {
+					path = defaultShardPath(keyRange)
+				}
+			}
+
+			if usedPaths[path] {
+				return nil, fmt.Errorf("%w. %s is already used by another shard", ErrInvalidSplit, path)
+			}
+			usedPaths[path] = true
+
+			start, end, _ := ExplodeKeyRange(keyRange)
+			starts := map[string]uint64{}
+
+			for prefix, value := range source.Starts {
+				if prefix[0] >= start && prefix[0] <= end {
+					starts[prefix] = value
+				}
+			}
+
+			spec := &ShardSpec{KeyRange: keyRange, Path: path, Starts: starts}
+			if i == 0 {
+				spec.Replicas = source.Replicas
+			}
+
+			split.Shards = append(split.Shards, spec)
+		}
+	}
+
+	return split, nil
+}
+
+// ReplicaPaths are the replica files of the key range,
+// the way SqliteCoordinator.ReplicaPaths expects.
+func (t *Topology) ReplicaPaths(keyRange string) []string {
+	if spec := t.spec(keyRange); spec != nil {
+		return spec.Replicas
+	}
+
+	return nil
+}
+
+// KeepLocal copies what isn't recorded from current, to a topology
+// loaded from the coordinator db. Replicas are kept for the shards
+// whose file didn't change.
+func (t *Topology) KeepLocal(current *Topology) {
+	t.CoordinatorPath = current.CoordinatorPath
+	t.Changelog = current.Changelog
+
+	for _, spec := range t.Shards {
+		for _, theirs := range current.Shards {
+			if spec.Path == theirs.Path && len(spec.Replicas) == 0 {
+				spec.Replicas = theirs.Replicas
+			}
+		}
+	}
+}
+
+// Start is the number the keys of the prefix are generated from
+func (t *Topology) Start(prefix byte) uint64 {
+	for _, spec := range t.Shards {
+		if start, ok := spec.Starts[string(prefix)]; ok {
+			return start
+		}
+	}
+
+	return DefaultSeedStart
+}
+
+// MissingFiles are the shard files which don't exist yet
+func (t *Topology) MissingFiles() []string {
+	missing := []string{}
+
+	for _, path := range t.Paths() {
+		if _, err := os.Stat(path); err != nil {
+			missing = append(missing, path)
+		}
+	}
+
+	return missing
+}
+
+// Diff lists how other differs from t, empty if they agree
+func (t *Topology) Diff(other *Topology) []string {
+	diffs := []string{}
+
+	for _, spec := range t.Shards {
+		theirs := other.spec(spec.KeyRange)
+		if theirs == nil {
+			diffs = append(diffs, fmt.Sprintf("key range %s is missing", spec.KeyRange))
+			continue
+		}
+
+		if spec.Path != theirs.Path {
+			diffs = append(diffs, fmt.Sprintf("key range %s is at %s, not %s", spec.KeyRange, theirs.Path, spec.Path))
+		}
+
+		if encodeStarts(spec.Starts) != encodeStarts(theirs.Starts) {
+			diffs = append(diffs, fmt.Sprintf("key range %s starts at %s, not %s",
+				spec.KeyRange, encodeStarts(theirs.Starts), encodeStarts(spec.Starts)))
+		}
+	}
+
+	for _, spec := range other.Shards {
+		if t.spec(spec.KeyRange) == nil {
+			diffs = append(diffs, fmt.Sprintf("key range %s is unexpected", spec.KeyRange))
+		}
+	}
+
+	return diffs
+}
+
+// StatusDiff lists the shard_status rows which don't fit t, the ones
+// of a key range it doesn't have, or of a prefix out of their range.
+func (t *Topology) StatusDiff(statuses []*ShardStatus) []string {
+	diffs := []string{}
+
+	for _, status := range statuses {
+		if t.spec(status.ShardID) == nil {
+			diffs = append(diffs, fmt.Sprintf("shard_status has key range %s, which isn't a shard", status.ShardID))
+			continue
+		}
+
+		start, end, ok := ExplodeKeyRange(status.ShardID)
+		if !ok || len(status.ShardChar) != 1 || status.ShardChar[0] < start || status.ShardChar[0] > end {
+			diffs = append(diffs, fmt.Sprintf("shard_status has prefix %s in key range %s", status.ShardChar, status.ShardID))
+		}
+	}
+
+	return diffs
+}
+
+// LockPath is the file the servers lock, while they have the shards open
+func (t *Topology) LockPath() string {
+	return t.CoordinatorPath + ".lock"
+}
+
+// encodeStarts is the sorted prefix=start list stored in the db
+func encodeStarts(starts map[string]uint64) string {
+	pairs := make([]string, 0, len(starts))
+	for prefix, start := range starts {
+		pairs = append(pairs, fmt.Sprintf("%s=%d", prefix, start))
+	}
+
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func decodeStarts(encoded string) (map[string]uint64, error) {
+	starts := map[string]uint64{}
+
+	for _, pair := range strings.Split(encoded, ",") {
+		if pair == "" {
+			continue
+		}
+
+		prefix, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid start %q", pair)
+		}
+
+		start, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid start %q", pair)
+		}
+
+		starts[prefix] = start
+	}
+
+	return starts, nil
+}
+
+const (
+	SelectTopologyQuery = `SELECT key_range, db_path, starts FROM shard_topology ORDER BY key_range`
+	DeleteTopologyQuery = `DELETE FROM shard_topology`
+	InsertTopologyQuery = `INSERT INTO shard_topology (key_range, db_path, starts, created_at) VALUES (?, ?, ?, ?)`
+
+	// ReassignShardStatusQuery moves the seeding state of the
+	// prefixes in a key range, to the shard they were split into.
+	ReassignShardStatusQuery = `UPDATE shard_status SET shard_id = ?, updated_at = ?, generation = generation + 1
+		WHERE shard_id = ? AND shard_char >= ? AND shard_char <= ?`
+)
+
+type TopologyRepo struct {
+	db *sql.DB
+}
+
+func NewTopologyRepo(db *sql.DB) *TopologyRepo {
+	return &TopologyRepo{db: db}
+}
+
+// Load returns the recorded topology, with no shards if none was recorded
+func (repo *TopologyRepo) Load(ctx context.Context) (*Topology, error) {
+	rows, err := repo.db.QueryContext(ctx, SelectTopologyQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	topology := &Topology{}
+
+	for rows.Next() {
+		spec := &ShardSpec{}
+		var starts string
+
+		if err := rows.Scan(&spec.KeyRange, &spec.Path, &starts); err != nil {
+			return nil, err
+		}
+
+		if spec.Starts, err = decodeStarts(starts); err != nil {
+			return nil, fmt.Errorf("key range %s. %v", spec.KeyRange, err)
+		}
+
+		topology.Shards = append(topology.Shards, spec)
+	}
+
+	return topology, rows.Err()
+}
+
+// Save replaces the recorded topology
+func (repo *TopologyRepo) Save(ctx context.Context, topology *Topology) error {
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := saveTopology(ctx, tx, topology); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Split records the split topology, and moves the shard_status
+// rows of the key range from, to the key ranges it was split into.
+// Running servers pick up the new routing from here.
+func (repo *TopologyRepo) Split(ctx context.Context, split *Topology, from string, into []string) error {
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := saveTopology(ctx, tx, split); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	now := time.Now().UTC()
+
+	for _, keyRange := range into {
+		start, end, _ := ExplodeKeyRange(keyRange)
+
+		_, err := tx.ExecContext(ctx, ReassignShardStatusQuery, keyRange, now, from, string(start), string(end))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func saveTopology(ctx context.Context, tx *sql.Tx, topology *Topology) error {
+	if _, err := tx.ExecContext(ctx, DeleteTopologyQuery); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+
+	for _, spec := range topology.Shards {
+		_, err := tx.ExecContext(ctx, InsertTopologyQuery, spec.KeyRange, spec.Path, encodeStarts(spec.Starts), now)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Verify records the topology if there is none, otherwise
+// returns ErrTopologyMismatch, if it differs from the recorded one.
+func (repo *TopologyRepo) Verify(ctx context.Context, topology *Topology) error {
+	recorded, err := repo.Load(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(recorded.Shards) == 0 {
+		return repo.Save(ctx, topology)
+	}
+
+	if diffs := topology.Diff(recorded); len(diffs) > 0 {
+		return fmt.Errorf("%w. %s", ErrTopologyMismatch, strings.Join(diffs, "; "))
+	}
+
+	return nil
+}
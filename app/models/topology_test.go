@@ -0,0 +1,109 @@
+package models_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/go-batteries/shortner/app/models"
+)
+
+func Test_TopologyDiff(t *testing.T) {
+	recorded := &models.Topology{Shards: []*models.ShardSpec{
+		{KeyRange: "a-m", Path: "db_a_m.db", Starts: map[string]uint64{"a": 1, "b": 1}},
+		{KeyRange: "n-z", Path: "db_n_z.db", Starts: map[string]uint64{"n": 2}},
+	}}
+
+	same := &models.Topology{Shards: []*models.ShardSpec{
+		{KeyRange: "n-z", Path: "db_n_z.db", Starts: map[string]uint64{"n": 2}},
+		{KeyRange: "a-m", Path: "db_a_m.db", Starts: map[string]uint64{"b": 1, "a": 1}},
+	}}
+
+	if diffs := same.Diff(recorded); len(diffs) != 0 {
+		t.Fatalf("expected no diff regardless of order, got %v", diffs)
+	}
+
+	changed := &models.Topology{Shards: []*models.ShardSpec{
+		{KeyRange: "a-m", Path: "shards/a_m.db", Starts: map[string]uint64{"a": 1, "b": 3}},
+		{KeyRange: "n-r", Path: "db_n_r.db", Starts: map[string]uint64{"n": 2}},
+	}}
+
+	diffs := changed.Diff(recorded)
+	if len(diffs) != 4 {
+		t.Fatalf("expected path, starts, missing and unexpected diffs, got %v", diffs)
+	}
+
+	for i, want := range []string{"is at db_a_m.db", "starts at a=1,b=1", "n-r is missing", "n-z is unexpected"} {
+		if !strings.Contains(diffs[i], want) {
+			t.Errorf("expected %q in %q", want, diffs[i])
+		}
+	}
+
+	if got := recorded.DBName("a-m"); got != "db_a_m" {
+		t.Errorf("expected db name db_a_m, got %s", got)
+	}
+
+	if got := recorded.Start('n'); got != 2 {
+		t.Errorf("expected start 2 for n, got %d", got)
+	}
+}
+
+func Test_TopologySplit(t *testing.T) {
+	topology := &models.Topology{Shards: []*models.ShardSpec{
+		{KeyRange: "a-e", Path: "db_a_e.db", Starts: map[string]uint64{"a": 1, "d": 2, "e": 3}},
+		{KeyRange: "f-z", Path: "db_f_z.db", Starts: map[string]uint64{"f": 4}},
+	}}
+
+	split, err := topology.Split("a-e", []string{"a-c", "d-e"}, nil)
+	if err != nil {
+		t.Fatalf("failed to split %v", err)
+	}
+
+	if got := strings.Join(split.KeyRanges(), ","); got != "a-c,d-e,f-z" {
+		t.Fatalf("expected the split key ranges in place, got %s", got)
+	}
+
+	if split.DBName("a-c") != "db_a_e" || split.DBName("d-e") != "db_d_e" {
+		t.Fatalf("expected a-c to keep the file, got %v", split.Paths())
+	}
+
+	if split.Start('a') != 1 || split.Start('e') != 3 {
+		t.Fatalf("expected the starts to follow their prefixes")
+	}
+
+	for _, into := range [][]string{{"a-c", "e-e"}, {"a-b", "c-f"}, {"a-e"}} {
+		if _, err := topology.Split("a-e", into, nil); !errors.Is(err, models.ErrInvalidSplit) {
+			t.Errorf("expected %v to be an invalid split, got %v", into, err)
+		}
+	}
+
+	if _, err := topology.Split("a-e", []string{"a-c", "d-e"}, map[string]string{"d-e": "db_f_z.db"}); !errors.Is(err, models.ErrInvalidSplit) {
+		t.Errorf("expected a path in use to be an invalid split, got %v", err)
+	}
+}
+
+func Test_TopologyStatusDiff(t *testing.T) {
+	topology := &models.Topology{Shards: []*models.ShardSpec{
+		{KeyRange: "a-e", Path: "db_a_e.db"},
+		{KeyRange: "f-z", Path: "db_f_z.db"},
+	}}
+
+	statuses := []*models.ShardStatus{
+		{ShardID: "a-e", ShardChar: "a"},
+		{ShardID: "a-e", ShardChar: "e"},
+		{ShardID: "f-z", ShardChar: "q"},
+	}
+
+	if diffs := topology.StatusDiff(statuses); len(diffs) != 0 {
+		t.Fatalf("expected shard_status to agree, got %v", diffs)
+	}
+
+	statuses = append(statuses,
+		&models.ShardStatus{ShardID: "a-e", ShardChar: "g"},
+		&models.ShardStatus{ShardID: "a-c", ShardChar: "b"},
+	)
+
+	if diffs := topology.StatusDiff(statuses); len(diffs) != 2 {
+		t.Fatalf("expected a prefix out of range and an unknown key range, got %v", diffs)
+	}
+}
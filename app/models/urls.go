@@ -3,7 +3,9 @@ package models
 import (
 	"context"
 	"crypto/sha1"
+	"database/sql"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"net/url"
@@ -13,6 +15,38 @@ import (
 	"github.com/go-batteries/shortner/app/db"
 )
 
+var (
+	ErrAliasTaken    = errors.New("alias_taken")
+	ErrLinkExpired   = errors.New("link_expired")
+	ErrLinkNotFound  = errors.New("link_not_found")
+	ErrLinkMalicious = errors.New("link_malicious")
+	ErrNoFreeKeys    = errors.New("no_free_keys")
+	ErrKeyTaken      = errors.New("key_taken")
+
+	ErrGenerationConflict = errors.New("generation_conflict")
+)
+
+// AnyGeneration skips the generation check of a write. It's for the
+// writes of the server itself, like the sweep or a reshard, the api
+// requires clients to send the generation they read.
+const AnyGeneration int64 = 0
+
+// GenerationConflict is returned when a write expected a generation of
+// the link, which has changed since. Current is the generation it has
+// now, the write can be retried with it, after a fresh read.
+type GenerationConflict struct {
+	ShortKey string
+	Current  int64
+}
+
+func (e *GenerationConflict) Error() string {
+	return fmt.Sprintf("%s. %s is at generation %d", ErrGenerationConflict, e.ShortKey, e.Current)
+}
+
+func (e *GenerationConflict) Unwrap() error {
+	return ErrGenerationConflict
+}
+
 type URL struct {
 	ShortKey  string     `db:"short_key"`
 	CreatedAt time.Time  `db:"created_at"`
@@ -20,11 +54,24 @@ type URL struct {
 	DeletedAt *time.Time `db:"deleted_at"`
 	Link      *string    `db:"url"`
 	Malicious *int       `db:"malicious"`
+	Vanity    bool       `db:"vanity"`
+	ExpiresAt *time.Time `db:"expires_at"`
+	OwnerID   *string    `db:"owner_id"`
+
+	// Generation is bumped by every write to the row,
+	// the writes compare and swap on it.
+	Generation int64 `db:"generation"`
 }
 
 func (u *URL) Hash() string {
+	return HashURL(*u.Link)
+}
+
+// HashURL is the sha1 of the url, as submitted.
+// Used to find an existing short key for the same url.
+func HashURL(urlStr string) string {
 	h := sha1.New()
-	h.Write([]byte(*u.Link))
+	h.Write([]byte(urlStr))
 	return hex.EncodeToString(h.Sum(nil))
 }
 
@@ -50,7 +97,46 @@ func NewURLRepo(sharder db.Coordinator[string]) *URLRepo {
 	return &URLRepo{sharder: sharder}
 }
 
-const CreateBatchesQuery = `INSERT INTO urls (
+// AssignOpts are the optional attributes set
+// when a key is assigned to an url
+type AssignOpts struct {
+	ExpiresAt *time.Time
+	OwnerID   *string
+}
+
+type WithAssignOpts func(opts *AssignOpts)
+
+// WithExpiry, the link stops resolving after expiresAt.
+// A nil expiresAt means the link never expires.
+func WithExpiry(expiresAt *time.Time) WithAssignOpts {
+	return func(opts *AssignOpts) {
+		opts.ExpiresAt = expiresAt
+	}
+}
+
+// WithOwner, the link can be managed by the owner.
+// An empty ownerID means an anonymous link.
+func WithOwner(ownerID string) WithAssignOpts {
+	return func(opts *AssignOpts) {
+		if ownerID != "" {
+			opts.OwnerID = &ownerID
+		}
+	}
+}
+
+func buildAssignOpts(opts []WithAssignOpts) *AssignOpts {
+	assignOpts := &AssignOpts{}
+
+	for _, opt := range opts {
+		opt(assignOpts)
+	}
+
+	return assignOpts
+}
+
+// CreateBatchesQuery skips the keys already in the shard,
+// like an alias which was claimed before the key was seeded.
+const CreateBatchesQuery = `INSERT OR IGNORE INTO urls (
 	url
 	,short_key
 	,malicious
@@ -63,23 +149,107 @@ const FindURLByShortKey = `
 	SELECT url
 		,short_key
 		,updated_at
+		,expires_at
 	FROM urls
 	WHERE short_key = ?
 	AND (malicious IS NULL or malicious = 0)
 	AND deleted_at IS NULL
+	AND (expires_at IS NULL OR expires_at > ?)
+	LIMIT 1
+`
+
+// FindExpiredByShortKey doesn't care about deleted_at,
+// expired keys are tombstoned by the sweeper.
+const FindExpiredByShortKey = `
+	SELECT expires_at
+	FROM urls
+	WHERE short_key = ?
+	AND url IS NOT NULL
+	AND expires_at IS NOT NULL
+	AND expires_at <= ?
+	LIMIT 1
+`
+
+// FindMaliciousByShortKey doesn't care about deleted_at either,
+// a link marked malicious keeps warning, even once deleted.
+const FindMaliciousByShortKey = `
+	SELECT 1
+	FROM urls
+	WHERE short_key = ?
+	AND url IS NOT NULL
+	AND malicious = 1
 	LIMIT 1
 `
 
-const DeleteEntryQuery = `UPDATE urls SET deleted_at = ? WHERE short_key = ?`
+const DeleteEntryQuery = `UPDATE urls SET deleted_at = ?1, updated_at = ?1, generation = generation + 1
+	WHERE short_key = ?2 AND owner_id = ?3 AND deleted_at IS NULL AND (?4 = 0 OR generation = ?4)`
+
+// CurrentGenerationQuery tells a write which lost the
+// compare and swap, from one for a missing link.
+const CurrentGenerationQuery = `SELECT generation FROM urls WHERE short_key = ? AND owner_id = ? AND url IS NOT NULL AND deleted_at IS NULL`
+
+const SelectAssignedKeysQuery = `SELECT short_key FROM urls WHERE url IS NOT NULL`
+
+// EachAssignedKey calls fn with every assigned key in the shard
+func EachAssignedKey(ctx context.Context, conn *sql.DB, fn func(shortKey string)) error {
+	rows, err := conn.QueryContext(ctx, SelectAssignedKeysQuery)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var shortKey string
+		if err := rows.Scan(&shortKey); err != nil {
+			return err
+		}
 
-// const AssignKeyToURLQuery = `
-// UPDATE urls SET url = ?, updated_at = ? WHERE short_key = (SELECT short_key FROM urls WHERE url IS NULL LIMIT 1);
-// `
-const SelectEmptyShortKey = `SELECT short_key FROM urls WHERE url IS NULL LIMIT 1;`
-const AssignURLQuery = `UPDATE urls SET url = ?, updated_at = ? WHERE short_key = ? AND url IS NULL;`
+		fn(shortKey)
+	}
 
-// DeleteEntry, marks the entry as deleted by setting deleted_at
-func (repo *URLRepo) Delete(ctx context.Context, shortKey string) error {
+	return rows.Err()
+}
+
+// ReserveKeyQuery picks a free key and assigns it, in one statement.
+// sqlite holds the write lock from before the key is picked, so two
+// writers can't get the same one, and the key is only returned if
+// the update took effect. Keys leased to a key pool are skipped.
+const ReserveKeyQuery = `UPDATE urls SET url = ?, url_hash = ?, owner_id = ?, expires_at = ?, updated_at = ?, generation = generation + 1
+	WHERE (short_key, generation) = (SELECT short_key, generation FROM urls WHERE url IS NULL AND (leased_until IS NULL OR leased_until < ?) LIMIT 1) AND url IS NULL
+	RETURNING short_key, generation;`
+
+// FindURLByHash only matches links without an expiry,
+// handing out a link which dies earlier, or later, than
+// asked for, is worse than using up a new key.
+// Vanity keys are not shared either. And neither are links
+// across owners, the owner wouldn't be able to manage them.
+const FindURLByHash = `
+	SELECT url
+		,short_key
+		,updated_at
+	FROM urls
+	WHERE url_hash = ?
+	AND owner_id IS ?
+	AND (malicious IS NULL or malicious = 0)
+	AND deleted_at IS NULL
+	AND expires_at IS NULL
+	AND vanity = 0
+	LIMIT 1
+`
+
+// An alias can be one of the pre-seeded keys which hasn't been
+// handed out yet. In which case, we just claim it.
+const ClaimAliasQuery = `UPDATE urls SET url = ?, url_hash = ?, owner_id = ?, vanity = 1, expires_at = ?, updated_at = ?, generation = generation + 1
+	WHERE short_key = ? AND url IS NULL AND deleted_at IS NULL
+	RETURNING generation;`
+const InsertAliasQuery = `INSERT INTO urls (url, url_hash, owner_id, short_key, vanity, expires_at, created_at, updated_at)
+	SELECT ?, ?, ?, ?, 1, ?, ?, ? WHERE NOT EXISTS (SELECT 1 FROM urls WHERE short_key = ?);
+`
+
+// Delete, marks the entry as deleted by setting deleted_at.
+// Only the owner can delete a link, otherwise ErrLinkNotFound is returned.
+// A GenerationConflict is returned if the link isn't at generation.
+func (repo *URLRepo) Delete(ctx context.Context, ownerID string, shortKey string, generation int64) error {
 	db, err := repo.sharder.GetShard(shortKey)
 	if err != nil {
 		return err
@@ -89,79 +259,294 @@ func (repo *URLRepo) Delete(ctx context.Context, shortKey string) error {
 
 	tx, err := db.Conn().BeginTx(ctx, nil)
 	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+
+	res, err := tx.ExecContext(ctx, DeleteEntryQuery, now, shortKey, ownerID, generation)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		err := conflictOrNotFound(ctx, tx, ownerID, shortKey)
 		tx.Rollback()
 		return err
 	}
 
-	_, err = tx.ExecContext(ctx, DeleteEntryQuery, time.Now().UTC(), shortKey)
-	return err
+	return tx.Commit()
 }
 
-func (repo *URLRepo) AssignURL(ctx context.Context, urlStr string) (*URL, error) {
-	db, err := repo.sharder.GetShard("")
+// conflictOrNotFound is the error of a write of the owner,
+// which matched no row, a GenerationConflict if the link
+// exists, ErrLinkNotFound otherwise.
+func conflictOrNotFound(ctx context.Context, conn queryRower, ownerID string, shortKey string) error {
+	var current int64
+
+	err := conn.QueryRowContext(ctx, CurrentGenerationQuery, shortKey, ownerID).Scan(&current)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrLinkNotFound
+	}
+
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	tx, err := db.Conn().BeginTx(ctx, nil)
+	return &GenerationConflict{ShortKey: shortKey, Current: current}
+}
+
+// AssignURL reserves a free key on the next shard of the round
+// robin, or on the ones after it, if that one has none left.
+func (repo *URLRepo) AssignURL(ctx context.Context, urlStr string, opts ...WithAssignOpts) (*URL, error) {
+	assignOpts := buildAssignOpts(opts)
+
+	shards, err := repo.assignShards()
 	if err != nil {
 		return nil, err
 	}
 
-	rows := tx.QueryRowContext(ctx, SelectEmptyShortKey)
-	if rows.Err() != nil {
-		tx.Rollback()
+	now := time.Now().UTC()
+
+	var shortKey string
+	var generation int64
+
+	for _, shard := range shards {
+		shortKey, generation, err = reserveKey(ctx, shard.Conn(), urlStr, assignOpts, now)
+		if !errors.Is(err, ErrNoFreeKeys) {
+			break
+		}
+	}
+
+	if err != nil {
 		return nil, err
 	}
 
+	return &URL{
+		Link:       &urlStr,
+		UpdatedAt:  now,
+		ShortKey:   shortKey,
+		ExpiresAt:  assignOpts.ExpiresAt,
+		OwnerID:    assignOpts.OwnerID,
+		Generation: generation,
+	}, nil
+}
+
+// queryRower is either the db or a transaction
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// reserveKey assigns urlStr to a free key, and returns the key, with
+// its new generation. ErrNoFreeKeys is returned if the shard has none
+// left.
+func reserveKey(ctx context.Context, conn queryRower, urlStr string, assignOpts *AssignOpts, now time.Time) (string, int64, error) {
 	var shortKey string
+	var generation int64
+
+	err := conn.QueryRowContext(
+		ctx,
+		ReserveKeyQuery,
+		url.QueryEscape(urlStr),
+		HashURL(urlStr),
+		assignOpts.OwnerID,
+		assignOpts.ExpiresAt,
+		now,
+		now.UnixMilli(),
+	).Scan(&shortKey, &generation)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", 0, ErrNoFreeKeys
+	}
 
-	if err := rows.Scan(&shortKey); err != nil {
-		tx.Rollback()
+	return shortKey, generation, err
+}
+
+// AssignAlias maps urlStr to a vanity short key, on the shard owning
+// the key range of the alias. ErrAliasTaken is returned if the alias
+// is already in use, or was used and deleted.
+func (repo *URLRepo) AssignAlias(ctx context.Context, alias string, urlStr string, opts ...WithAssignOpts) (*URL, error) {
+	assignOpts := buildAssignOpts(opts)
+
+	db, err := repo.sharder.GetShard(alias)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Conn().BeginTx(ctx, nil)
+	if err != nil {
 		return nil, err
 	}
 
 	now := time.Now().UTC()
+	link, hash := url.QueryEscape(urlStr), HashURL(urlStr)
 
-	_, err = tx.ExecContext(ctx, AssignURLQuery, url.QueryEscape(urlStr), now, shortKey)
-	if err != nil {
+	// a new row starts at the first generation
+	generation := int64(1)
+
+	err = tx.QueryRowContext(ctx, ClaimAliasQuery, link, hash, assignOpts.OwnerID, assignOpts.ExpiresAt, now, alias).Scan(&generation)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		tx.Rollback()
 		return nil, err
 	}
 
-	err = tx.Commit()
-	if err != nil {
+	if errors.Is(err, sql.ErrNoRows) {
+		res, err := tx.ExecContext(ctx, InsertAliasQuery, link, hash, assignOpts.OwnerID, alias, assignOpts.ExpiresAt, now, now, alias)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+
+		inserted, err := res.RowsAffected()
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+
+		if inserted == 0 {
+			tx.Rollback()
+			return nil, ErrAliasTaken
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
 		return nil, err
 	}
 
 	return &URL{
-		Link:      &urlStr,
-		UpdatedAt: now,
-		ShortKey:  shortKey,
+		Link:       &urlStr,
+		UpdatedAt:  now,
+		ShortKey:   alias,
+		Vanity:     true,
+		ExpiresAt:  assignOpts.ExpiresAt,
+		OwnerID:    assignOpts.OwnerID,
+		Generation: generation,
 	}, nil
 }
 
-// Find find an URL by shortKey
+// Find find an URL by shortKey.
+// ErrLinkMalicious is returned if the link was marked malicious,
+// ErrLinkExpired if the link existed, but has expired, and
+// ErrLinkNotFound if there is no such link.
 func (repo *URLRepo) Find(ctx context.Context, shortKey string) (*URL, error) {
-	db, err := repo.sharder.GetShard(shortKey)
+	shard, err := repo.sharder.GetShard(shortKey)
 	if err != nil {
 		return nil, err
 	}
 
-	rows := db.Conn().QueryRowContext(ctx, FindURLByShortKey, shortKey)
-	if err := rows.Err(); err != nil {
+	now := time.Now().UTC()
+	data := &URL{}
+
+	// a link which was just created, might not be on the replica yet
+	err = db.ReadFrom(shard, func(conn *sql.DB) error {
+		err := conn.QueryRowContext(ctx, FindURLByShortKey, shortKey, now).Scan(
+			&data.Link,
+			&data.ShortKey,
+			&data.UpdatedAt,
+			&data.ExpiresAt,
+		)
+
+		// a replica may not have the mark yet, it has to stop redirecting at once
+		if err == nil && conn != shard.Conn() {
+			var flagged int
+
+			if shard.Conn().QueryRowContext(ctx, FindMaliciousByShortKey, shortKey).Scan(&flagged) == nil {
+				return ErrLinkMalicious
+			}
+		}
+
+		if errors.Is(err, sql.ErrNoRows) {
+			var flagged int
+
+			malicious := conn.QueryRowContext(ctx, FindMaliciousByShortKey, shortKey)
+			if malicious.Scan(&flagged) == nil {
+				return ErrLinkMalicious
+			}
+
+			var expiresAt time.Time
+
+			expired := conn.QueryRowContext(ctx, FindExpiredByShortKey, shortKey, now)
+			if expired.Scan(&expiresAt) == nil {
+				return ErrLinkExpired
+			}
+
+			return ErrLinkNotFound
+		}
+
+		return err
+	}, ErrLinkNotFound, ErrLinkExpired, ErrLinkMalicious)
+
+	if err != nil {
 		return nil, err
 	}
 
-	data := &URL{}
+	return data, nil
+}
+
+// FindByHash looks for an existing short key for the url, of the
+// same owner, on all the shards, since the key could have been
+// assigned on any of them. It returns nil, if none was found.
+func (repo *URLRepo) FindByHash(ctx context.Context, ownerID string, urlStr string) (*URL, error) {
+	shards, ok := repo.sharder.GetShards()
+	if !ok {
+		return nil, fmt.Errorf("no shards to search")
+	}
+
+	hash := HashURL(urlStr)
+
+	var owner *string
+	if ownerID != "" {
+		owner = &ownerID
+	}
+
+	type found struct {
+		u   *URL
+		err error
+	}
+
+	results := make(chan found, len(shards))
+
+	for _, shard := range shards {
+		go func(shard db.Shard[string]) {
+			u := &URL{}
+
+			err := shard.Conn().QueryRowContext(ctx, FindURLByHash, hash, owner).Scan(
+				&u.Link,
+				&u.ShortKey,
+				&u.UpdatedAt,
+			)
+
+			if errors.Is(err, sql.ErrNoRows) {
+				results <- found{}
+				return
+			}
+
+			results <- found{u: u, err: err}
+		}(shard)
+	}
+
+	var match *URL
+	var errr error
+
+	for i := 0; i < len(shards); i++ {
+		res := <-results
+
+		if res.err != nil {
+			errr = res.err
+			continue
+		}
 
-	err = rows.Scan(
-		&data.Link,
-		&data.ShortKey,
-		&data.UpdatedAt,
-	)
+		if res.u != nil && match == nil {
+			match = res.u
+		}
+	}
+
+	if match != nil {
+		return match, nil
+	}
 
-	return data, err
+	return nil, errr
 }
 
 // CreateBatches creates a batch of records
@@ -0,0 +1,406 @@
+package models_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-batteries/shortner/app/db"
+	"github.com/go-batteries/shortner/app/models"
+)
+
+func Test_AssignURLConcurrent(t *testing.T) {
+	ctx := context.Background()
+
+	database, _ := changelogShard(t, filepath.Join(t.TempDir(), "db_a_z"), false)
+	repo := models.NewURLRepo(database)
+
+	now := time.Now().UTC()
+	free := []*models.URL{}
+
+	for i := 0; i < 40; i++ {
+		free = append(free, &models.URL{ShortKey: fmt.Sprintf("a%03d", i), CreatedAt: now, UpdatedAt: now})
+	}
+
+	if err := repo.CreateBatches(ctx, free); err != nil {
+		t.Fatalf("failed to seed keys %v", err)
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	assigned := map[string]string{}
+	errs := []error{}
+
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			link := fmt.Sprintf("https://example.com/%d", i)
+			u, err := repo.AssignURL(ctx, link)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil {
+				errs = append(errs, err)
+				return
+			}
+
+			if other, ok := assigned[u.ShortKey]; ok {
+				errs = append(errs, fmt.Errorf("%s handed to %s and %s", u.ShortKey, other, link))
+			}
+			assigned[u.ShortKey] = link
+		}(i)
+	}
+
+	wg.Wait()
+
+	if len(errs) > 0 {
+		t.Fatalf("expected every assign to get its own key, got %v", errs)
+	}
+
+	for shortKey, link := range assigned {
+		u, err := repo.Find(ctx, shortKey)
+		if err != nil || u.Link == nil {
+			t.Fatalf("expected %s to be assigned, got %v", shortKey, err)
+		}
+
+		if *u.Link != url.QueryEscape(link) {
+			t.Fatalf("expected %s to point to %s, got %s", shortKey, link, *u.Link)
+		}
+	}
+
+	if _, err := repo.AssignURLs(ctx, []string{"https://a.com", "https://b.com", "https://c.com"}); err != nil {
+		t.Fatalf("failed to assign in bulk %v", err)
+	}
+
+	// 7 left, all or none
+	if _, err := repo.AssignURLs(ctx, make([]string, 8)); !errors.Is(err, models.ErrNoFreeKeys) {
+		t.Fatalf("expected no free keys, got %v", err)
+	}
+
+	if _, err := repo.AssignURLs(ctx, make([]string, 7)); err != nil {
+		t.Fatalf("expected the rolled back keys to be free, got %v", err)
+	}
+
+	if _, err := repo.AssignURL(ctx, "https://d.com"); !errors.Is(err, models.ErrNoFreeKeys) {
+		t.Fatalf("expected no free keys, got %v", err)
+	}
+}
+
+func Test_KeyLeases(t *testing.T) {
+	ctx := context.Background()
+
+	database, shard := changelogShard(t, filepath.Join(t.TempDir(), "db_a_z"), true)
+	repo := models.NewURLRepo(database)
+
+	now := time.Now().UTC()
+	free := []*models.URL{}
+
+	for i := 0; i < 5; i++ {
+		free = append(free, &models.URL{ShortKey: fmt.Sprintf("a%03d", i), CreatedAt: now, UpdatedAt: now})
+	}
+
+	if err := repo.CreateBatches(ctx, free); err != nil {
+		t.Fatalf("failed to seed keys %v", err)
+	}
+
+	changelog := models.NewChangelogRepo("db_a_z", shard.Conn())
+	before, _ := changelog.State(ctx)
+
+	leases, err := models.LeaseKeys(ctx, shard.Conn(), 3, now.Add(time.Minute))
+	if err != nil || len(leases) != 3 {
+		t.Fatalf("expected 3 leases, got %d. %v", len(leases), err)
+	}
+
+	if after, _ := changelog.State(ctx); after.Position != before.Position {
+		t.Fatalf("expected the leases to stay out of the changelog, got %d changes", after.Position-before.Position)
+	}
+
+	// the 2 keys which aren't leased
+	if _, err := repo.AssignURLs(ctx, []string{"https://a.com", "https://b.com", "https://c.com"}); !errors.Is(err, models.ErrNoFreeKeys) {
+		t.Fatalf("expected the leased keys to be skipped, got %v", err)
+	}
+
+	u, err := repo.AssignLeasedKey(ctx, leases[0], "https://github.com")
+	if err != nil || u.ShortKey != leases[0].ShortKey {
+		t.Fatalf("failed to assign the leased key %v", err)
+	}
+
+	if _, err := repo.AssignLeasedKey(ctx, leases[0], "https://gitlab.com"); !errors.Is(err, models.ErrKeyTaken) {
+		t.Fatalf("expected an assigned key to be taken, got %v", err)
+	}
+
+	stolen := &models.KeyLease{ShortKey: leases[1].ShortKey, Until: leases[1].Until + 1}
+	if _, err := repo.AssignLeasedKey(ctx, stolen, "https://gitlab.com"); !errors.Is(err, models.ErrKeyTaken) {
+		t.Fatalf("expected a key of another lease to be taken, got %v", err)
+	}
+
+	released, err := repo.ReleaseLeases(ctx, leases)
+	if err != nil || released != 2 {
+		t.Fatalf("expected the 2 unassigned keys to be released, got %d. %v", released, err)
+	}
+
+	if _, err := repo.AssignURLs(ctx, []string{"https://a.com", "https://b.com", "https://c.com", "https://d.com"}); err != nil {
+		t.Fatalf("expected the released keys to be free, got %v", err)
+	}
+
+	if err := repo.CreateBatches(ctx, []*models.URL{{ShortKey: "b000", CreatedAt: now, UpdatedAt: now}}); err != nil {
+		t.Fatalf("failed to seed key %v", err)
+	}
+
+	expired, err := models.LeaseKeys(ctx, shard.Conn(), 1, now.Add(-time.Second))
+	if err != nil || len(expired) != 1 || !expired[0].Expired(now) {
+		t.Fatalf("expected an expired lease, got %v", err)
+	}
+
+	again, err := models.LeaseKeys(ctx, shard.Conn(), 1, now.Add(time.Minute))
+	if err != nil || len(again) != 1 || again[0].ShortKey != "b000" {
+		t.Fatalf("expected the expired lease to be leased again, got %v", err)
+	}
+
+	if _, err := repo.AssignLeasedKey(ctx, expired[0], "https://gitlab.com"); !errors.Is(err, models.ErrKeyTaken) {
+		t.Fatalf("expected the expired lease to be lost, got %v", err)
+	}
+}
+
+func Test_GenerationConflict(t *testing.T) {
+	ctx := context.Background()
+
+	database, _ := changelogShard(t, filepath.Join(t.TempDir(), "db_a_z"), false)
+	repo := models.NewURLRepo(database)
+
+	now := time.Now().UTC()
+
+	if err := repo.CreateBatches(ctx, []*models.URL{{ShortKey: "a000", CreatedAt: now, UpdatedAt: now}}); err != nil {
+		t.Fatalf("failed to seed keys %v", err)
+	}
+
+	u, err := repo.AssignURL(ctx, "https://github.com", models.WithOwner("acc_1"))
+	if err != nil || u.Generation != 2 {
+		t.Fatalf("expected the seeded key to move to generation 2, got %+v. %v", u, err)
+	}
+
+	retargeted, err := repo.Retarget(ctx, "acc_1", u.ShortKey, "https://gitlab.com", u.Generation)
+	if err != nil || retargeted.Generation != u.Generation+1 {
+		t.Fatalf("expected the retarget to bump the generation, got %+v. %v", retargeted, err)
+	}
+
+	// a write of a client which read the link before the retarget
+	_, err = repo.Retarget(ctx, "acc_1", u.ShortKey, "https://bitbucket.org", u.Generation)
+
+	var conflict *models.GenerationConflict
+	if !errors.As(err, &conflict) || !errors.Is(err, models.ErrGenerationConflict) || conflict.Current != retargeted.Generation {
+		t.Fatalf("expected a conflict at generation %d, got %v", retargeted.Generation, err)
+	}
+
+	if err := repo.Delete(ctx, "acc_1", u.ShortKey, u.Generation); !errors.As(err, &conflict) {
+		t.Fatalf("expected the stale delete to conflict, got %v", err)
+	}
+
+	if _, err := repo.Retarget(ctx, "acc_2", u.ShortKey, "https://bitbucket.org", conflict.Current); !errors.Is(err, models.ErrLinkNotFound) {
+		t.Fatalf("expected link_not_found for another owner, got %v", err)
+	}
+
+	if err := repo.Delete(ctx, "acc_1", u.ShortKey, conflict.Current); err != nil {
+		t.Fatalf("expected the delete at the current generation to pass, got %v", err)
+	}
+
+	if err := repo.Delete(ctx, "acc_1", u.ShortKey, models.AnyGeneration); !errors.Is(err, models.ErrLinkNotFound) {
+		t.Fatalf("expected link_not_found once deleted, got %v", err)
+	}
+}
+
+// rangeShards is a coordinator of a shard per key range, each
+// seeded with keys starting with the first letter of its range.
+func rangeShards(t *testing.T, seeds int, keyRanges ...string) *db.SqliteCoordinator[string] {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	database := db.NewSqliteCoordinator(keyRanges)
+	database.ToDbName = func(keyRange string) string {
+		return filepath.Join(dir, "db_"+strings.ReplaceAll(keyRange, "-", "_"))
+	}
+
+	if err := database.RegisterShards(context.Background()); err != nil {
+		t.Fatalf("failed to create shards %v", err)
+	}
+	t.Cleanup(database.DeInit)
+
+	shards, _ := database.GetShards()
+	database.SetPolicy(&db.KeyOrRoundRobinPolicy[string]{
+		Keyed: &db.KeyBasedPolicy[string]{Shards: db.ShardsByKeyRange(keyRanges, shards)},
+		Robin: &db.RoundRobinPolicy[string]{Shards: shards},
+	})
+
+	now := time.Now().UTC()
+	free := []*models.URL{}
+
+	for _, keyRange := range keyRanges {
+		for i := 0; i < seeds; i++ {
+			free = append(free, &models.URL{ShortKey: fmt.Sprintf("%c%03d", keyRange[0], i), CreatedAt: now, UpdatedAt: now})
+		}
+	}
+
+	if err := models.NewURLRepo(database).CreateBatches(context.Background(), free); err != nil {
+		t.Fatalf("failed to seed keys %v", err)
+	}
+
+	return database
+}
+
+func Test_SeedOverAlias(t *testing.T) {
+	ctx := context.Background()
+
+	database := rangeShards(t, 0, "a-z")
+	repo := models.NewURLRepo(database)
+
+	// an alias shaped like a seeded key, claimed before it's seeded
+	if _, err := repo.AssignAlias(ctx, "a001", "https://github.com"); err != nil {
+		t.Fatalf("failed to assign alias %v", err)
+	}
+
+	now := time.Now().UTC()
+	free := []*models.URL{}
+
+	for i := 0; i < 3; i++ {
+		free = append(free, &models.URL{ShortKey: fmt.Sprintf("a%03d", i), CreatedAt: now, UpdatedAt: now})
+	}
+
+	if err := repo.CreateBatches(ctx, free); err != nil {
+		t.Fatalf("failed to seed keys %v", err)
+	}
+
+	shards, _ := database.GetShards()
+
+	var rows int
+	if err := shards[0].Conn().QueryRow(`SELECT COUNT(1) FROM urls WHERE short_key = 'a001'`).Scan(&rows); err != nil || rows != 1 {
+		t.Fatalf("expected the alias to be the only row of its key, got %d. %v", rows, err)
+	}
+
+	u, err := repo.Find(ctx, "a001")
+	if err != nil || *u.Link != url.QueryEscape("https://github.com") {
+		t.Fatalf("expected the alias to still resolve, got %v", err)
+	}
+
+	// only the keys which weren't taken are free
+	if _, err := repo.AssignURLs(ctx, []string{"https://a.com", "https://b.com"}); err != nil {
+		t.Fatalf("failed to assign the seeded keys %v", err)
+	}
+
+	if _, err := repo.AssignURL(ctx, "https://c.com"); !errors.Is(err, models.ErrNoFreeKeys) {
+		t.Fatalf("expected no free keys, got %v", err)
+	}
+}
+
+func Test_FindByHashShards(t *testing.T) {
+	ctx := context.Background()
+	repo := models.NewURLRepo(rangeShards(t, 5, "a-m", "n-z"))
+
+	first, err := repo.AssignURL(ctx, "https://github.com", models.WithOwner("acc_1"))
+	if err != nil {
+		t.Fatalf("failed to assign url %v", err)
+	}
+
+	second, err := repo.AssignURL(ctx, "https://gitlab.com", models.WithOwner("acc_1"))
+	if err != nil {
+		t.Fatalf("failed to assign url %v", err)
+	}
+
+	if first.ShortKey[0] == second.ShortKey[0] {
+		t.Fatalf("expected the round robin to use both shards, got %s and %s", first.ShortKey, second.ShortKey)
+	}
+
+	for _, u := range []*models.URL{first, second} {
+		existing, err := repo.FindByHash(ctx, "acc_1", *u.Link)
+		if err != nil || existing == nil || existing.ShortKey != u.ShortKey {
+			t.Fatalf("expected %s to be found on its shard, got %+v. %v", u.ShortKey, existing, err)
+		}
+
+		if existing, _ := repo.FindByHash(ctx, "acc_2", *u.Link); existing != nil {
+			t.Fatalf("expected %s to not be shared with another owner", u.ShortKey)
+		}
+	}
+
+	future := time.Now().UTC().Add(time.Hour)
+
+	if _, err := repo.AssignURL(ctx, "https://golang.org", models.WithOwner("acc_1"), models.WithExpiry(&future)); err != nil {
+		t.Fatalf("failed to assign url %v", err)
+	}
+
+	if existing, _ := repo.FindByHash(ctx, "acc_1", "https://golang.org"); existing != nil {
+		t.Fatalf("expected a link with an expiry to not be reused, got %s", existing.ShortKey)
+	}
+
+	if _, err := repo.AssignAlias(ctx, "go-home", "https://go.dev", models.WithOwner("acc_1")); err != nil {
+		t.Fatalf("failed to assign alias %v", err)
+	}
+
+	if existing, _ := repo.FindByHash(ctx, "acc_1", "https://go.dev"); existing != nil {
+		t.Fatalf("expected an alias to not be reused, got %s", existing.ShortKey)
+	}
+}
+
+func Test_FindMaliciousOnReplica(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	primary, shard := changelogShard(t, filepath.Join(dir, "db_a_z"), false)
+	repo := models.NewURLRepo(primary)
+
+	for _, alias := range []string{"phish", "safe"} {
+		if _, err := repo.AssignAlias(ctx, alias, "https://"+alias+".example.com"); err != nil {
+			t.Fatalf("failed to assign alias %v", err)
+		}
+	}
+
+	if err := primary.Heartbeat(ctx); err != nil {
+		t.Fatalf("failed to beat %v", err)
+	}
+
+	replicaPath := filepath.Join(dir, "replica_a_z.db")
+	if _, err := shard.Conn().ExecContext(ctx, "VACUUM INTO ?", replicaPath); err != nil {
+		t.Fatalf("failed to copy the replica %v", err)
+	}
+
+	readers := db.NewSqliteCoordinator([]string{"a-z"})
+	readers.ToDbName = func(string) string { return filepath.Join(dir, "db_a_z") }
+	readers.ReplicaPaths = func(string) []string { return []string{replicaPath} }
+
+	if err := readers.ConnectShards(ctx, db.DBReadOnlyMode); err != nil {
+		t.Fatalf("failed to connect %v", err)
+	}
+	defer readers.DeInit()
+
+	if statuses := readers.CheckReplicas(ctx, time.Hour); !statuses[0].Healthy {
+		t.Fatalf("expected the copied replica to be healthy, got %+v", statuses[0])
+	}
+
+	shards, _ := readers.GetShards()
+	readers.SetPolicy(&db.KeyBasedPolicy[string]{Shards: db.ShardsByKeyRange([]string{"a-z"}, shards)})
+
+	// the replica hasn't caught up with the mark
+	if _, err := repo.SetMalicious(ctx, "phish", true, models.AnyGeneration); err != nil {
+		t.Fatalf("failed to mark malicious %v", err)
+	}
+
+	replicaRepo := models.NewURLRepo(readers)
+
+	if _, err := replicaRepo.Find(ctx, "phish"); !errors.Is(err, models.ErrLinkMalicious) {
+		t.Fatalf("expected the mark on the primary to stop the redirect, got %v", err)
+	}
+
+	if _, err := replicaRepo.Find(ctx, "safe"); err != nil || shards[0].ReadConn() == shards[0].Conn() {
+		t.Fatalf("expected the other links to be read from the replica, got %v", err)
+	}
+}
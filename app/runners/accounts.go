@@ -0,0 +1,38 @@
+package runners
+
+import (
+	"context"
+
+	"github.com/go-batteries/shortner/app/models"
+)
+
+// OwnerReassigner moves the links of an owner to another.
+// models.URLRepo and models.PostgresStore are ones.
+type OwnerReassigner interface {
+	ReassignOwner(ctx context.Context, from string, to string) (int64, error)
+}
+
+// AdoptLegacyLinks moves the links of a legacy owner, see
+// models.LegacyOwnerID, to the account. The links are moved in store,
+// or in the shards of the topology, if store is nil. It returns how
+// many links were moved, it's safe to run again.
+func AdoptLegacyLinks(ctx context.Context, topology *models.Topology, store OwnerReassigner, legacyOwnerID string, accountID string) (int64, error) {
+	if store != nil {
+		return store.ReassignOwner(ctx, legacyOwnerID, accountID)
+	}
+
+	database := NewTopologyCoordinator(topology)
+
+	if err := VerifyTopology(ctx, database, topology, false); err != nil {
+		return 0, err
+	}
+	defer database.CoordinatorDB.Close()
+	defer database.DeInit()
+
+	repo, err := connectLinkShards(ctx, database, topology)
+	if err != nil {
+		return 0, err
+	}
+
+	return repo.ReassignOwner(ctx, legacyOwnerID, accountID)
+}
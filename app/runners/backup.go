@@ -0,0 +1,212 @@
+package runners
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-batteries/shortner/app/db"
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/go-batteries/shortner/app/watchers"
+	"github.com/rs/zerolog/log"
+)
+
+type BackupOpts struct {
+	// Compress gzips the snapshots
+	Compress bool
+
+	// Keep and MaxAge are the retention of the runs,
+	// see models.ExpiredBackupRuns. 0 turns either off.
+	Keep   int
+	MaxAge time.Duration
+}
+
+// BackupShards snapshots the shards of the topology and the coordinator
+// to a new run on the target. The snapshots are taken with VACUUM INTO,
+// so the servers can keep writing. The manifest is put last, followed
+// by deleting the runs past the retention. The expired runs are
+// returned, with the manifest of this one.
+func BackupShards(ctx context.Context, topology *models.Topology, target watchers.BackupTarget, opts *BackupOpts) (*models.BackupManifest, []*models.BackupRun, error) {
+	manifest := models.NewBackupManifest(time.Now())
+
+	existing, err := target.List(ctx, manifest.Prefix())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(existing) > 0 {
+		return nil, nil, fmt.Errorf("backup run %s already exists", manifest.ID)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "backup-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, spec := range topology.Shards {
+		file, err := backupFile(ctx, target, manifest, tmpDir, spec.Path, spec.KeyRange, opts.Compress)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to back up %s. %v", spec.KeyRange, err)
+		}
+
+		manifest.Files = append(manifest.Files, file)
+	}
+
+	file, err := backupFile(ctx, target, manifest, tmpDir, topology.CoordinatorPath, "", opts.Compress)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to back up the coordinator. %v", err)
+	}
+
+	manifest.Files = append(manifest.Files, file)
+
+	var body bytes.Buffer
+	if err := models.WriteManifest(&body, manifest); err != nil {
+		return nil, nil, err
+	}
+
+	if err := target.Put(ctx, manifest.Key(), bytes.NewReader(body.Bytes())); err != nil {
+		return nil, nil, fmt.Errorf("failed to put manifest. %v", err)
+	}
+
+	expired, err := expireBackups(ctx, target, opts)
+	return manifest, expired, err
+}
+
+func backupFile(ctx context.Context, target watchers.BackupTarget, manifest *models.BackupManifest, tmpDir string, src string, keyRange string, compress bool) (*models.BackupFile, error) {
+	file := &models.BackupFile{
+		Name:       filepath.Base(src),
+		KeyRange:   keyRange,
+		Compressed: compress,
+	}
+
+	if _, err := os.Stat(src); err != nil {
+		return nil, err
+	}
+
+	snapshot := filepath.Join(tmpDir, file.Name)
+	if err := db.SnapshotInto(ctx, src, snapshot); err != nil {
+		return nil, err
+	}
+	defer os.Remove(snapshot)
+
+	// the coordinator has no changelog
+	if keyRange != "" {
+		state, err := snapshotChangelogState(ctx, snapshot)
+		if err != nil {
+			return nil, err
+		}
+
+		file.Timeline, file.Position = state.Timeline, state.Position
+	}
+
+	stored := snapshot
+	file.Key = manifest.Prefix() + file.Name
+
+	if compress {
+		stored = snapshot + ".gz"
+		file.Key += ".gz"
+	}
+
+	if err := hashInto(snapshot, stored, file); err != nil {
+		return nil, err
+	}
+	defer os.Remove(stored)
+
+	body, err := os.Open(stored)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	if err := target.Put(ctx, file.Key, body); err != nil {
+		return nil, err
+	}
+
+	log.Info().Str("file", file.Name).Str("key", file.Key).Int64("size", file.Size).Int64("stored_size", file.StoredSize).Msg("backed up")
+	return file, nil
+}
+
+// hashInto sets the checksum and sizes of the snapshot,
+// gzipping it into dst, if it's not the snapshot itself.
+func hashInto(snapshot string, dst string, file *models.BackupFile) error {
+	src, err := os.Open(snapshot)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	hash := sha256.New()
+
+	if dst == snapshot {
+		if file.Size, err = io.Copy(hash, src); err != nil {
+			return err
+		}
+
+		file.SHA256, file.StoredSize = hex.EncodeToString(hash.Sum(nil)), file.Size
+		return nil
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	zw := gzip.NewWriter(out)
+
+	if file.Size, err = io.Copy(zw, io.TeeReader(src, hash)); err != nil {
+		return err
+	}
+
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	info, err := out.Stat()
+	if err != nil {
+		return err
+	}
+
+	file.SHA256, file.StoredSize = hex.EncodeToString(hash.Sum(nil)), info.Size()
+	return nil
+}
+
+func snapshotChangelogState(ctx context.Context, path string) (*models.ChangelogState, error) {
+	conn, err := sql.Open("sqlite3", fmt.Sprintf("%s?mode=ro", path))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return models.NewChangelogRepo(path, conn).State(ctx)
+}
+
+func expireBackups(ctx context.Context, target watchers.BackupTarget, opts *BackupOpts) ([]*models.BackupRun, error) {
+	keys, err := target.List(ctx, models.SnapshotsPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	expired := models.ExpiredBackupRuns(models.BackupRuns(keys), opts.Keep, opts.MaxAge, time.Now())
+
+	for _, run := range expired {
+		for _, key := range run.Keys {
+			if err := target.Delete(ctx, key); err != nil {
+				return expired, fmt.Errorf("failed to delete %s. %v", key, err)
+			}
+		}
+
+		log.Info().Str("run", run.ID).Bool("complete", run.Complete).Msg("deleted expired backup")
+	}
+
+	return expired, nil
+}
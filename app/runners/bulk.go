@@ -0,0 +1,161 @@
+package runners
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/go-batteries/shortner/app/config"
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/go-batteries/shortner/app/seed"
+)
+
+var ErrSuspiciousURL = errors.New("url_seems_suspicious")
+
+const (
+	DefaultBulkBatchSize   = 500
+	DefaultBulkConcurrency = 16
+)
+
+type BulkItem struct {
+	URL   string `json:"url"`
+	Alias string `json:"alias,omitempty"`
+}
+
+type BulkResult struct {
+	Row      int            `json:"row"`
+	URL      string         `json:"url"`
+	ShortKey string         `json:"short_key,omitempty"`
+	Issues   []config.Issue `json:"issues,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+func (r *BulkResult) OK() bool {
+	return r.Error == ""
+}
+
+// BulkShortener validates the urls concurrently, and then reserves
+// keys for the valid ones in batches. Aliases can't be batched,
+// they are routed to the shard of the alias, one by one.
+type BulkShortener struct {
+	repo        models.Store
+	checker     *config.URLChecker
+	seeder      *seed.Seeder
+	batchSize   int
+	concurrency int
+}
+
+func NewBulkShortener(repo models.Store, checker *config.URLChecker, batchSize int) *BulkShortener {
+	if batchSize < 1 {
+		batchSize = DefaultBulkBatchSize
+	}
+
+	return &BulkShortener{
+		repo:        repo,
+		checker:     checker,
+		seeder:      seed.RegisterUrlSeeder(),
+		batchSize:   batchSize,
+		concurrency: DefaultBulkConcurrency,
+	}
+}
+
+// Shorten returns one result per item, in the same order.
+// Rows are numbered from 1.
+func (b *BulkShortener) Shorten(ctx context.Context, items []*BulkItem, opts ...models.WithAssignOpts) []*BulkResult {
+	results := make([]*BulkResult, len(items))
+
+	for i, item := range items {
+		results[i] = &BulkResult{Row: i + 1, URL: strings.TrimSpace(item.URL)}
+	}
+
+	b.validate(items, results)
+
+	pending := []*BulkResult{}
+
+	for i, res := range results {
+		if !res.OK() {
+			continue
+		}
+
+		alias := strings.TrimSpace(items[i].Alias)
+		if alias == "" {
+			pending = append(pending, res)
+			continue
+		}
+
+		u, err := b.repo.AssignAlias(ctx, alias, res.URL, opts...)
+		if err != nil {
+			res.Error = err.Error()
+			continue
+		}
+
+		res.ShortKey = u.ShortKey
+	}
+
+	for start := 0; start < len(pending); start += b.batchSize {
+		end := min(start+b.batchSize, len(pending))
+		batch := pending[start:end]
+
+		urlStrs := make([]string, len(batch))
+		for i, res := range batch {
+			urlStrs[i] = res.URL
+		}
+
+		urls, err := b.repo.AssignURLs(ctx, urlStrs, opts...)
+		for i, res := range batch {
+			if err != nil {
+				res.Error = err.Error()
+				continue
+			}
+
+			res.ShortKey = urls[i].ShortKey
+		}
+	}
+
+	return results
+}
+
+func (b *BulkShortener) validate(items []*BulkItem, results []*BulkResult) {
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+
+	for w := 0; w < b.concurrency; w++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for i := range jobs {
+				res := results[i]
+
+				if alias := strings.TrimSpace(items[i].Alias); alias != "" {
+					if err := b.seeder.ValidateAlias(alias); err != nil {
+						res.Error = err.Error()
+						continue
+					}
+				}
+
+				issues, err := b.checker.ValidateURL(res.URL)
+				res.Issues = issues
+
+				if err != nil {
+					res.Error = "invalid_url"
+					continue
+				}
+
+				if b.checker.Score(issues) > config.CutoffMaxIssues {
+					res.Error = ErrSuspiciousURL.Error()
+				}
+			}
+		}()
+	}
+
+	for i := range items {
+		jobs <- i
+	}
+
+	close(jobs)
+	wg.Wait()
+}
@@ -0,0 +1,80 @@
+package runners_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/go-batteries/shortner/app/config"
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/go-batteries/shortner/app/runners"
+)
+
+func Test_ReadBulkCSV(t *testing.T) {
+	items, err := runners.ReadBulkCSV(strings.NewReader("url,alias\nhttps://github.com\n\nhttps://go.dev, go-home\n"))
+	if err != nil || len(items) != 2 {
+		t.Fatalf("expected 2 rows without the header, got %d. %v", len(items), err)
+	}
+
+	if items[0].URL != "https://github.com" || items[0].Alias != "" || items[1].Alias != "go-home" {
+		t.Fatalf("expected the url and the trimmed alias, got %+v %+v", items[0], items[1])
+	}
+
+	if _, err := runners.ReadBulkCSV(strings.NewReader("https://github.com\n\"https://go.dev\n")); err == nil {
+		t.Fatalf("expected an unterminated quote to fail")
+	}
+}
+
+func Test_BulkShortener(t *testing.T) {
+	ctx := context.Background()
+	store := models.NewMemoryStore()
+
+	if _, err := store.AssignAlias(ctx, "taken", "https://example.com"); err != nil {
+		t.Fatalf("failed to assign alias %v", err)
+	}
+
+	shortener := runners.NewBulkShortener(store, config.NewURLChecker(config.DefaultOptions()), 2)
+
+	results := shortener.Shorten(ctx, []*runners.BulkItem{
+		{URL: " https://github.com "},
+		{URL: "https://go.dev", Alias: "go-home"},
+		{URL: "https://gitlab.com", Alias: "taken"},
+		{URL: "https://golang.org", Alias: "9lives"},
+		{URL: "https://pkg.go.dev"},
+		{URL: "https://bitbucket.org"},
+	}, models.WithOwner("acc_1"))
+
+	if len(results) != 6 {
+		t.Fatalf("expected a result per row, got %d", len(results))
+	}
+
+	for i, res := range results {
+		if res.Row != i+1 {
+			t.Fatalf("expected the rows in order, got row %d at %d", res.Row, i)
+		}
+	}
+
+	// the rows without an alias are assigned over 2 batches
+	for _, i := range []int{0, 4, 5} {
+		if !results[i].OK() || results[i].ShortKey == "" {
+			t.Fatalf("expected row %d to be shortened, got %+v", i+1, results[i])
+		}
+	}
+
+	if results[0].URL != "https://github.com" {
+		t.Fatalf("expected the url to be trimmed, got %q", results[0].URL)
+	}
+
+	if !results[1].OK() || results[1].ShortKey != "go-home" {
+		t.Fatalf("expected the alias to be assigned, got %+v", results[1])
+	}
+
+	if results[2].Error != models.ErrAliasTaken.Error() || results[3].OK() {
+		t.Fatalf("expected the taken and the invalid aliases to fail, got %+v %+v", results[2], results[3])
+	}
+
+	links, _, err := store.ListByOwner(ctx, "acc_1", "", 10)
+	if err != nil || len(links) != 4 {
+		t.Fatalf("expected the 4 shortened links to be owned, got %d. %v", len(links), err)
+	}
+}
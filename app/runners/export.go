@@ -0,0 +1,466 @@
+package runners
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-batteries/shortner/app/db"
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	ExportFormatCSV      = "csv"
+	ExportFormatJSONL    = "jsonl"
+	ExportFormatColumnar = "columnar"
+
+	DefaultExportPageSize = 1000
+)
+
+type ExportRow struct {
+	ShortKey  string     `json:"short_key"`
+	URL       string     `json:"url"`
+	OwnerID   string     `json:"owner_id,omitempty"`
+	Vanity    bool       `json:"vanity"`
+	Malicious bool       `json:"malicious"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+var exportColumns = []string{
+	"short_key", "url", "owner_id", "vanity", "malicious",
+	"created_at", "updated_at", "deleted_at", "expires_at",
+}
+
+func NewExportRow(u *models.URL) *ExportRow {
+	row := &ExportRow{
+		ShortKey:  u.ShortKey,
+		Vanity:    u.Vanity,
+		Malicious: u.Malicious != nil && *u.Malicious == 1,
+		CreatedAt: u.CreatedAt,
+		UpdatedAt: u.UpdatedAt,
+		DeletedAt: u.DeletedAt,
+		ExpiresAt: u.ExpiresAt,
+	}
+
+	if u.Link != nil {
+		link, err := url.QueryUnescape(*u.Link)
+		if err != nil {
+			link = *u.Link
+		}
+		row.URL = link
+	}
+
+	if u.OwnerID != nil {
+		row.OwnerID = *u.OwnerID
+	}
+
+	return row
+}
+
+func (r *ExportRow) values() []string {
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.UTC().Format(time.RFC3339Nano)
+	}
+
+	return []string{
+		r.ShortKey,
+		r.URL,
+		r.OwnerID,
+		fmt.Sprintf("%t", r.Vanity),
+		fmt.Sprintf("%t", r.Malicious),
+		formatTime(&r.CreatedAt),
+		formatTime(&r.UpdatedAt),
+		formatTime(r.DeletedAt),
+		formatTime(r.ExpiresAt),
+	}
+}
+
+// ExportWriter writes rows in one of the export formats.
+// Flush is called at checkpoints, rows written before a
+// Flush are expected to be durable.
+type ExportWriter interface {
+	WriteHeader() error
+	Write(row *ExportRow) error
+	Flush() error
+}
+
+type csvExportWriter struct {
+	w *csv.Writer
+}
+
+func (w *csvExportWriter) WriteHeader() error {
+	return w.w.Write(exportColumns)
+}
+
+func (w *csvExportWriter) Write(row *ExportRow) error {
+	return w.w.Write(row.values())
+}
+
+func (w *csvExportWriter) Flush() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+type jsonlExportWriter struct {
+	w   *bufio.Writer
+	enc *json.Encoder
+}
+
+func (w *jsonlExportWriter) WriteHeader() error {
+	return nil
+}
+
+func (w *jsonlExportWriter) Write(row *ExportRow) error {
+	return w.enc.Encode(row)
+}
+
+func (w *jsonlExportWriter) Flush() error {
+	return w.w.Flush()
+}
+
+// columnarExportWriter buffers rows into row groups, and writes
+// each group as one json line of column name to values.
+// Something like parquet, without needing a parquet library.
+type columnarExportWriter struct {
+	w        *bufio.Writer
+	enc      *json.Encoder
+	group    int
+	columns  map[string][]string
+	buffered int
+}
+
+type columnarRowGroup struct {
+	RowGroup int                 `json:"row_group"`
+	Rows     int                 `json:"rows"`
+	Columns  map[string][]string `json:"columns"`
+}
+
+func newColumnarExportWriter(w io.Writer) *columnarExportWriter {
+	bw := bufio.NewWriter(w)
+	cw := &columnarExportWriter{w: bw, enc: json.NewEncoder(bw)}
+	cw.reset()
+
+	return cw
+}
+
+func (w *columnarExportWriter) reset() {
+	w.columns = map[string][]string{}
+	w.buffered = 0
+
+	for _, col := range exportColumns {
+		w.columns[col] = []string{}
+	}
+}
+
+func (w *columnarExportWriter) WriteHeader() error {
+	return nil
+}
+
+func (w *columnarExportWriter) Write(row *ExportRow) error {
+	for i, value := range row.values() {
+		col := exportColumns[i]
+		w.columns[col] = append(w.columns[col], value)
+	}
+
+	w.buffered++
+	return nil
+}
+
+func (w *columnarExportWriter) Flush() error {
+	if w.buffered > 0 {
+		err := w.enc.Encode(&columnarRowGroup{
+			RowGroup: w.group,
+			Rows:     w.buffered,
+			Columns:  w.columns,
+		})
+		if err != nil {
+			return err
+		}
+
+		w.group++
+		w.reset()
+	}
+
+	return w.w.Flush()
+}
+
+func NewExportWriter(format string, w io.Writer) (ExportWriter, error) {
+	switch format {
+	case ExportFormatCSV:
+		return &csvExportWriter{w: csv.NewWriter(w)}, nil
+	case ExportFormatJSONL:
+		bw := bufio.NewWriter(w)
+		return &jsonlExportWriter{w: bw, enc: json.NewEncoder(bw)}, nil
+	case ExportFormatColumnar:
+		return newColumnarExportWriter(w), nil
+	}
+
+	return nil, fmt.Errorf("invalid export format %s. expected one of csv, jsonl, columnar", format)
+}
+
+type ExportOpts struct {
+	Format   string
+	OutPath  string
+	PageSize int
+	Filter   *models.ExportFilter
+
+	// Checkpoint is a file holding the last exported short key, and
+	// the size of OutPath once it was flushed. If it exists, the export
+	// resumes after that key, and OutPath is cut back to that size, so
+	// the rows written after the checkpoint aren't written twice.
+	Checkpoint string
+}
+
+type exportCheckpoint struct {
+	LastKey string
+	// Offset is -1 for the checkpoints of before
+	// it was recorded, which only had the key.
+	Offset int64
+}
+
+// readCheckpoint returns nil, if there is no checkpoint
+// to resume from. It's the key and the offset, on a line.
+func readCheckpoint(path string) (*exportCheckpoint, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(string(b))
+
+	switch len(fields) {
+	case 0:
+		return nil, nil
+	case 1:
+		return &exportCheckpoint{LastKey: fields[0], Offset: -1}, nil
+	}
+
+	offset, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || offset < 0 {
+		return nil, fmt.Errorf("invalid offset %s in checkpoint %s", fields[1], path)
+	}
+
+	return &exportCheckpoint{LastKey: fields[0], Offset: offset}, nil
+}
+
+// writeCheckpoint writes to a temp file and renames it,
+// so that a crash doesn't leave a half written key behind.
+func writeCheckpoint(path string, checkpoint *exportCheckpoint) error {
+	if path == "" || checkpoint.LastKey == "" {
+		return nil
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(fmt.Sprintf("%s %d\n", checkpoint.LastKey, checkpoint.Offset)), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// resumeAt cuts the file back to the offset of the checkpoint, and
+// returns it. The checkpoints without one, resume at the end.
+func resumeAt(file *os.File, offset int64) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	if offset < 0 {
+		log.Warn().Msg("the checkpoint has no offset, appending to the output as it is")
+		return file.Seek(0, io.SeekEnd)
+	}
+
+	if info.Size() < offset {
+		return 0, fmt.Errorf("output is %d bytes, shorter than the %d of the checkpoint", info.Size(), offset)
+	}
+
+	if err := file.Truncate(offset); err != nil {
+		return 0, err
+	}
+
+	return file.Seek(offset, io.SeekStart)
+}
+
+// countingWriter keeps track of the size of the output
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+
+	return n, err
+}
+
+// ExportLinks streams the assigned keys of all the shards, merged in the
+// order of the short keys. So two exports of the same data are identical,
+// and an interrupted export can be resumed from the checkpoint.
+func ExportLinks(ctx context.Context, topology *models.Topology, opts *ExportOpts) error {
+	if opts.PageSize < 1 {
+		opts.PageSize = DefaultExportPageSize
+	}
+
+	if opts.Filter == nil {
+		opts.Filter = &models.ExportFilter{}
+	}
+
+	checkpoint, err := readCheckpoint(opts.Checkpoint)
+	if err != nil {
+		return fmt.Errorf("failed to read checkpoint. %v", err)
+	}
+
+	resuming := checkpoint != nil
+
+	after := ""
+	if resuming {
+		after = checkpoint.LastKey
+	}
+
+	out := &countingWriter{w: os.Stdout}
+	var file *os.File
+
+	if opts.OutPath != "" {
+		flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if resuming {
+			flags = os.O_CREATE | os.O_WRONLY
+		}
+
+		file, err = os.OpenFile(opts.OutPath, flags, 0644)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		out.w = file
+
+		if resuming {
+			if out.n, err = resumeAt(file, checkpoint.Offset); err != nil {
+				return fmt.Errorf("failed to resume %s. %v", opts.OutPath, err)
+			}
+		}
+	}
+
+	writer, err := NewExportWriter(opts.Format, out)
+	if err != nil {
+		return err
+	}
+
+	// save flushes the rows written so far,
+	// and records them in the checkpoint
+	save := func(lastKey string) error {
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+
+		if file != nil {
+			if err := file.Sync(); err != nil {
+				return err
+			}
+		}
+
+		return writeCheckpoint(opts.Checkpoint, &exportCheckpoint{LastKey: lastKey, Offset: out.n})
+	}
+
+	database := NewTopologyCoordinator(topology)
+
+	if err := VerifyTopology(ctx, database, topology, false); err != nil {
+		return err
+	}
+	defer database.CoordinatorDB.Close()
+
+	if err := database.ConnectShards(ctx, db.DBReadOnlyMode); err != nil {
+		return err
+	}
+	defer database.DeInit()
+
+	shards, ok := database.GetShards()
+	if !ok {
+		return fmt.Errorf("should not have failed to create shards")
+	}
+
+	exporters := []*models.ShardExporter{}
+	for _, shard := range shards {
+		exporters = append(exporters, models.NewShardExporter(shard.ID(), shard.Conn(), opts.Filter, after, opts.PageSize))
+	}
+
+	if resuming {
+		log.Info().Str("after", after).Msg("resuming export")
+	} else if err := writer.WriteHeader(); err != nil {
+		return err
+	}
+
+	total, lastKey := 0, after
+
+	for {
+		// pick the smallest short key among the shards,
+		// there are only a handful of them.
+		var next *models.ShardExporter
+		var nextURL *models.URL
+
+		for _, exporter := range exporters {
+			u, err := exporter.Peek(ctx)
+			if err != nil {
+				return err
+			}
+
+			if u != nil && (nextURL == nil || u.ShortKey < nextURL.ShortKey) {
+				next, nextURL = exporter, u
+			}
+		}
+
+		if next == nil {
+			break
+		}
+
+		next.Next()
+
+		if err := writer.Write(NewExportRow(nextURL)); err != nil {
+			return err
+		}
+
+		total++
+		lastKey = nextURL.ShortKey
+
+		if total%opts.PageSize == 0 {
+			if err := save(lastKey); err != nil {
+				return err
+			}
+
+			log.Debug().Int("rows", total).Str("last", lastKey).Msg("export checkpoint")
+		}
+	}
+
+	if err := save(lastKey); err != nil {
+		return err
+	}
+
+	log.Info().Int("rows", total).Str("last", lastKey).Msg("export complete")
+	return nil
+}
@@ -0,0 +1,177 @@
+package runners_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-batteries/shortner/app/db"
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/go-batteries/shortner/app/runners"
+)
+
+// linkTopology creates the shard files of a topology over keyRanges, in
+// a temp dir, with seeds free keys in each, "<first letter>%03d".
+func linkTopology(t *testing.T, seeds int, keyRanges ...string) (*models.Topology, *db.SqliteCoordinator[string]) {
+	t.Helper()
+
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	topology := &models.Topology{CoordinatorPath: filepath.Join(dir, "coordinator.db")}
+	for _, keyRange := range keyRanges {
+		topology.Shards = append(topology.Shards, &models.ShardSpec{
+			KeyRange: keyRange,
+			Path:     filepath.Join(dir, "db_"+strings.ReplaceAll(keyRange, "-", "_")+".db"),
+		})
+	}
+
+	database := runners.NewTopologyCoordinator(topology)
+
+	if err := runners.VerifyTopology(ctx, database, topology, true); err != nil {
+		t.Fatalf("failed to record topology %v", err)
+	}
+	t.Cleanup(func() { database.CoordinatorDB.Close() })
+
+	if err := database.RegisterShards(ctx); err != nil {
+		t.Fatalf("failed to create shards %v", err)
+	}
+	t.Cleanup(database.DeInit)
+
+	shards, _ := database.GetShards()
+	database.SetPolicy(&db.KeyOrRoundRobinPolicy[string]{
+		Keyed: &db.KeyBasedPolicy[string]{Shards: db.ShardsByKeyRange(keyRanges, shards)},
+		Robin: &db.RoundRobinPolicy[string]{Shards: shards},
+	})
+
+	now := time.Now().UTC()
+	free := []*models.URL{}
+
+	for _, keyRange := range keyRanges {
+		for i := 0; i < seeds; i++ {
+			free = append(free, &models.URL{ShortKey: fmt.Sprintf("%c%03d", keyRange[0], i), CreatedAt: now, UpdatedAt: now})
+		}
+	}
+
+	if err := models.NewURLRepo(database).CreateBatches(ctx, free); err != nil {
+		t.Fatalf("failed to seed keys %v", err)
+	}
+
+	return topology, database
+}
+
+func Test_ExportLinks(t *testing.T) {
+	ctx := context.Background()
+	topology, database := linkTopology(t, 3, "a-m", "n-z")
+	repo := models.NewURLRepo(database)
+
+	aliases := []string{"zebra", "apple", "otter", "mango", "banana"}
+	for i, alias := range aliases {
+		if _, err := repo.AssignAlias(ctx, alias, fmt.Sprintf("https://example.com/%d", i)); err != nil {
+			t.Fatalf("failed to assign alias %v", err)
+		}
+	}
+
+	dir := t.TempDir()
+
+	export := func(format string, out string, checkpoint string) string {
+		t.Helper()
+
+		err := runners.ExportLinks(ctx, topology, &runners.ExportOpts{
+			Format:     format,
+			OutPath:    out,
+			PageSize:   2,
+			Checkpoint: checkpoint,
+		})
+		if err != nil {
+			t.Fatalf("failed to export %s %v", format, err)
+		}
+
+		b, _ := os.ReadFile(out)
+		return string(b)
+	}
+
+	// the shards are merged in the order of the keys, the free keys aren't exported
+	sorted := []string{"apple", "banana", "mango", "otter", "zebra"}
+
+	csv := export(runners.ExportFormatCSV, filepath.Join(dir, "links.csv"), "")
+	lines := strings.Split(strings.TrimSpace(csv), "\n")
+
+	if len(lines) != len(sorted)+1 || !strings.HasPrefix(lines[0], "short_key,url,") {
+		t.Fatalf("expected a header and a line per link, got %q", csv)
+	}
+
+	for i, alias := range sorted {
+		if !strings.HasPrefix(lines[i+1], alias+",https://example.com/") {
+			t.Fatalf("expected %s at line %d, got %q", alias, i+1, lines[i+1])
+		}
+	}
+
+	jsonl := export(runners.ExportFormatJSONL, filepath.Join(dir, "links.jsonl"), "")
+	for i, line := range strings.Split(strings.TrimSpace(jsonl), "\n") {
+		row := &runners.ExportRow{}
+		if err := json.Unmarshal([]byte(line), row); err != nil || row.ShortKey != sorted[i] || !row.Vanity {
+			t.Fatalf("expected %s at line %d, got %q. %v", sorted[i], i, line, err)
+		}
+	}
+
+	columnar := export(runners.ExportFormatColumnar, filepath.Join(dir, "links.columnar"), "")
+	keys := []string{}
+
+	for _, line := range strings.Split(strings.TrimSpace(columnar), "\n") {
+		group := struct {
+			Rows    int                 `json:"rows"`
+			Columns map[string][]string `json:"columns"`
+		}{}
+
+		if err := json.Unmarshal([]byte(line), &group); err != nil || group.Rows != len(group.Columns["short_key"]) {
+			t.Fatalf("expected a row group, got %q. %v", line, err)
+		}
+
+		keys = append(keys, group.Columns["short_key"]...)
+	}
+
+	if strings.Join(keys, ",") != strings.Join(sorted, ",") {
+		t.Fatalf("expected the keys in order over the row groups, got %v", keys)
+	}
+
+	// crash after a checkpoint, with half a row written past it
+	out := filepath.Join(dir, "resumed.csv")
+	checkpoint := filepath.Join(dir, "resumed.checkpoint")
+
+	if err := os.WriteFile(out, []byte(strings.Join(lines[:3], "\n")+"\nmango,https://exa"), 0644); err != nil {
+		t.Fatalf("failed to write output %v", err)
+	}
+
+	offset := len(strings.Join(lines[:3], "\n")) + 1
+	if err := os.WriteFile(checkpoint, []byte(fmt.Sprintf("banana %d\n", offset)), 0644); err != nil {
+		t.Fatalf("failed to write checkpoint %v", err)
+	}
+
+	if resumed := export(runners.ExportFormatCSV, out, checkpoint); resumed != csv {
+		t.Fatalf("expected the resumed export to match the full one, got %q", resumed)
+	}
+
+	if b, _ := os.ReadFile(checkpoint); string(b) != fmt.Sprintf("zebra %d\n", len(csv)) {
+		t.Fatalf("expected the checkpoint at the end of the output, got %q", b)
+	}
+
+	// the output was lost, or is from another export
+	if err := os.WriteFile(out, []byte("short_key"), 0644); err != nil {
+		t.Fatalf("failed to write output %v", err)
+	}
+
+	if err := os.WriteFile(checkpoint, []byte(fmt.Sprintf("banana %d\n", offset)), 0644); err != nil {
+		t.Fatalf("failed to write checkpoint %v", err)
+	}
+
+	err := runners.ExportLinks(ctx, topology, &runners.ExportOpts{Format: runners.ExportFormatCSV, OutPath: out, Checkpoint: checkpoint})
+	if err == nil {
+		t.Fatalf("expected an output shorter than the checkpoint to fail")
+	}
+}
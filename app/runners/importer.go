@@ -0,0 +1,142 @@
+package runners
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/go-batteries/shortner/app/config"
+	"github.com/go-batteries/shortner/app/db"
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/rs/zerolog/log"
+)
+
+// ReadBulkCSV reads rows of url[,alias].
+// A header row starting with "url" is skipped.
+func ReadBulkCSV(r io.Reader) ([]*BulkItem, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	items := []*BulkItem{}
+
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read line %d. %v", line, err)
+		}
+
+		if len(record) == 0 || strings.TrimSpace(record[0]) == "" {
+			continue
+		}
+
+		if line == 1 && strings.EqualFold(strings.TrimSpace(record[0]), "url") {
+			continue
+		}
+
+		item := &BulkItem{URL: record[0]}
+		if len(record) > 1 {
+			item.Alias = record[1]
+		}
+
+		items = append(items, item)
+	}
+
+	return items, nil
+}
+
+// ImportLinks shortens all the links in the csv file, and writes
+// the per row results as csv to out. With an account name,
+// the links are owned by that account.
+func ImportLinks(ctx context.Context, topology *models.Topology, checker *config.URLChecker, filePath string, accountName string, batchSize int, out io.Writer) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to open %s. %v", filePath, err)
+	}
+	defer file.Close()
+
+	items, err := ReadBulkCSV(file)
+	if err != nil {
+		return err
+	}
+
+	keyRanges := topology.KeyRanges()
+	database := NewTopologyCoordinator(topology)
+
+	if err := VerifyTopology(ctx, database, topology, false); err != nil {
+		return err
+	}
+	defer database.CoordinatorDB.Close()
+
+	if err := database.ConnectShards(ctx, db.DBReadWriteMode); err != nil {
+		return err
+	}
+	defer database.DeInit()
+
+	if err := database.MigrateShards(ctx); err != nil {
+		return err
+	}
+
+	shards, ok := database.GetShards()
+	if !ok {
+		return fmt.Errorf("should not have failed to create shards")
+	}
+
+	database.SetPolicy(&db.KeyOrRoundRobinPolicy[string]{
+		Keyed: &db.KeyBasedPolicy[string]{Shards: db.ShardsByKeyRange(keyRanges, shards)},
+		Robin: &db.RoundRobinPolicy[string]{Shards: shards},
+	})
+
+	opts := []models.WithAssignOpts{}
+
+	if accountName != "" {
+		account, err := models.NewAccountRepo(database.CoordinatorDB).FindByName(ctx, accountName)
+		if err != nil {
+			return fmt.Errorf("failed to find account %s. %v", accountName, err)
+		}
+
+		opts = append(opts, models.WithOwner(account.ID))
+	}
+
+	log.Info().Int("rows", len(items)).Msg("importing links")
+
+	shortener := NewBulkShortener(
+		models.NewURLRepo(database),
+		checker,
+		batchSize,
+	)
+
+	results := shortener.Shorten(ctx, items, opts...)
+
+	writer := csv.NewWriter(out)
+	writer.Write([]string{"row", "url", "short_key", "error", "issues"})
+
+	failed := 0
+
+	for _, res := range results {
+		if !res.OK() {
+			failed++
+		}
+
+		writer.Write([]string{
+			fmt.Sprintf("%d", res.Row),
+			res.URL,
+			res.ShortKey,
+			res.Error,
+			strings.Join(config.IssueStrings(res.Issues), "; "),
+		})
+	}
+
+	writer.Flush()
+
+	log.Info().Int("rows", len(results)).Int("failed", failed).Msg("import complete")
+	return writer.Error()
+}
@@ -0,0 +1,106 @@
+package runners
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-batteries/shortner/app/db"
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/rs/zerolog/log"
+)
+
+// Moderator applies the decisions of the reviewers of reported links,
+// for both the cli and the admin api. The link is marked, or cleared,
+// before the decision is recorded, so that a malicious link stops
+// redirecting as soon as possible.
+type Moderator struct {
+	store   models.Store
+	reports *models.ReportRepo
+}
+
+func NewModerator(store models.Store, reports *models.ReportRepo) *Moderator {
+	return &Moderator{store: store, reports: reports}
+}
+
+// Decide applies the decision to the link, which has to be at
+// generation, unless it's models.AnyGeneration. A dismissal leaves
+// the link as it is.
+func (m *Moderator) Decide(ctx context.Context, decision *models.LinkDecision, generation int64) error {
+	switch decision.Action {
+	case models.ActionMalicious, models.ActionClear:
+		u, err := m.store.SetMalicious(ctx, decision.ShortKey, decision.Action == models.ActionMalicious, generation)
+		if err != nil {
+			return err
+		}
+
+		// a clear only holds for the link, as it was cleared
+		decision.Generation = u.Generation
+
+		log.Info().
+			Str("shortKey", decision.ShortKey).
+			Str("action", decision.Action).
+			Int64("generation", u.Generation).
+			Msg("link moderated")
+	case models.ActionDismiss:
+	default:
+		return fmt.Errorf("%w. %s", models.ErrInvalidAction, decision.Action)
+	}
+
+	if err := m.reports.Decide(ctx, decision); err != nil {
+		return fmt.Errorf("failed to record the decision on %s. %w", decision.ShortKey, err)
+	}
+
+	return nil
+}
+
+// OpenModeration connects to the coordinator of the topology, which
+// has the reports, for the cli. The links are moderated in store, or in
+// the shards of the topology, if store is nil. done closes them.
+func OpenModeration(ctx context.Context, topology *models.Topology, store models.Store) (*Moderator, *models.ReportRepo, func(), error) {
+	database := NewTopologyCoordinator(topology)
+
+	if err := VerifyTopology(ctx, database, topology, false); err != nil {
+		return nil, nil, nil, err
+	}
+
+	done := func() {
+		database.DeInit()
+		database.CoordinatorDB.Close()
+	}
+
+	if store == nil {
+		repo, err := connectLinkShards(ctx, database, topology)
+		if err != nil {
+			done()
+			return nil, nil, nil, err
+		}
+
+		store = repo
+	}
+
+	reports := models.NewReportRepo(database.CoordinatorDB)
+
+	return NewModerator(store, reports), reports, done, nil
+}
+
+// connectLinkShards opens the shards of the topology for writing, for
+// the cli commands which change the links in place. The coordinator
+// has to be connected already, the caller closes the shards.
+func connectLinkShards(ctx context.Context, database *db.SqliteCoordinator[string], topology *models.Topology) (*models.URLRepo, error) {
+	if err := database.ConnectShards(ctx, db.DBReadWriteMode); err != nil {
+		return nil, err
+	}
+
+	if err := database.MigrateShards(ctx); err != nil {
+		return nil, err
+	}
+
+	shards, ok := database.GetShards()
+	if !ok {
+		return nil, fmt.Errorf("should not have failed to create shards")
+	}
+
+	database.SetPolicy(&db.KeyBasedPolicy[string]{Shards: db.ShardsByKeyRange(topology.KeyRanges(), shards)})
+
+	return models.NewURLRepo(database), nil
+}
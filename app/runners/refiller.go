@@ -12,13 +12,17 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-const FillThreshold = 10000
-
-func RefillKeys(ctx context.Context, seeder *seed.Seeder, batchSize int, seedSize uint64) error {
-	keyRanges := seeder.Shards(5)
+// RefillKeys seeds more keys in the shards with fewer than fillThreshold free keys
+func RefillKeys(ctx context.Context, seeder *seed.Seeder, topology *models.Topology, fillThreshold int, batchSize int, seedSize uint64) error {
+	keyRanges := topology.KeyRanges()
 	lowers := seeder.Lowers()
 
-	database := db.NewSqliteCoordinator(keyRanges)
+	database := NewTopologyCoordinator(topology)
+
+	if err := VerifyTopology(ctx, database, topology, false); err != nil {
+		return err
+	}
+	defer database.CoordinatorDB.Close()
 
 	err := database.ConnectShards(ctx, db.DBReadWriteMode)
 	if err != nil {
@@ -27,11 +31,9 @@ func RefillKeys(ctx context.Context, seeder *seed.Seeder, batchSize int, seedSiz
 
 	defer database.DeInit()
 
-	cdb, err := database.ConnectCoordinatorDB(ctx)
-	if err != nil {
-		log.Fatal().Err(err).Msg("failed to create coordinator db")
+	if err := database.MigrateShards(ctx); err != nil {
+		return err
 	}
-	defer cdb.Close()
 
 	shards, ok := database.GetShards()
 	if !ok {
@@ -54,12 +56,12 @@ func RefillKeys(ctx context.Context, seeder *seed.Seeder, batchSize int, seedSiz
 			prober := models.NewProber(keyRange, shard.Conn(), models.URLKeysProberQuery)
 			stats, err := prober.GetStats(ctx)
 			if err != nil {
-				res.err = fmt.Errorf("failed to get count error: %v", keyRange, err)
+				res.err = fmt.Errorf("failed to get count for %s. error: %v", keyRange, err)
 				resultsChan <- res
 				return
 			}
 
-			if stats.EmptyRecords < FillThreshold {
+			if stats.EmptyRecords < int64(fillThreshold) {
 				start, end, ok := models.ExplodeKeyRange(keyRange)
 				if !ok {
 					res.err = fmt.Errorf("invalid key range %s", keyRange)
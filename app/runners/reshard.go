@@ -0,0 +1,157 @@
+package runners
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/go-batteries/shortner/app/db"
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/rs/zerolog/log"
+)
+
+const DefaultReshardBatchSize = 5000
+
+type ReshardOpts struct {
+	From  string
+	Into  []string
+	Paths map[string]string
+
+	BatchSize int
+
+	// Grace is how long the running servers get to pick up
+	// the new routing, before the moved rows are removed
+	// from the source. It should be more than their
+	// shards.reload_interval.
+	Grace time.Duration
+}
+
+// Reshard splits the key range From of the topology into Into. The first
+// key range stays in the source file, the rest are moved into new ones.
+//
+// The free keys are moved first, so that the source stops handing them
+// out. Then the links are copied, and the split is recorded, which is
+// when the servers switch over. After the grace period, whatever the
+// source got in the meantime is caught up, and it's removed from there.
+func Reshard(ctx context.Context, topology *models.Topology, opts *ReshardOpts) (*models.Topology, []*models.MoveStats, error) {
+	split, err := topology.Split(opts.From, opts.Into, opts.Paths)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	database := NewTopologyCoordinator(topology)
+
+	if err := VerifyTopology(ctx, database, topology, false); err != nil {
+		return nil, nil, err
+	}
+	defer database.CoordinatorDB.Close()
+
+	moved := opts.Into[1:]
+
+	for _, keyRange := range moved {
+		path := split.DBName(keyRange) + ".db"
+
+		if _, err := os.Stat(path); err == nil {
+			return nil, nil, fmt.Errorf("%w. %s already exists", models.ErrInvalidSplit, path)
+		}
+	}
+
+	targets := db.NewSqliteCoordinator(moved)
+	targets.ToDbName = split.DBName
+	targets.Changelog = topology.Changelog
+
+	if err := targets.RegisterShards(ctx); err != nil {
+		return nil, nil, err
+	}
+	defer targets.DeInit()
+
+	source := db.NewSqliteCoordinator([]string{opts.From})
+	source.ToDbName = topology.DBName
+	source.Changelog = topology.Changelog
+
+	if err := source.ConnectShards(ctx, db.DBReadWriteMode); err != nil {
+		return nil, nil, err
+	}
+	defer source.DeInit()
+
+	if err := source.MigrateShards(ctx); err != nil {
+		return nil, nil, err
+	}
+
+	shards, ok := source.GetShards()
+	if !ok {
+		return nil, nil, fmt.Errorf("should not have failed to create shards")
+	}
+
+	sourceShard := shards[0]
+
+	movers := []*models.ShardMover{}
+	defer func() {
+		for _, mover := range movers {
+			mover.Close()
+		}
+	}()
+
+	for _, keyRange := range moved {
+		mover, err := models.NewShardMover(ctx, sourceShard.Conn(), split.DBName(keyRange)+".db", keyRange)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if err := mover.MoveFreeKeys(ctx); err != nil {
+			return nil, nil, fmt.Errorf("failed to move free keys of %s. %v", keyRange, err)
+		}
+
+		movers = append(movers, mover)
+	}
+
+	copyStart := time.Now().UTC()
+
+	for _, mover := range movers {
+		if err := mover.CopyLinks(ctx, copyStart, opts.BatchSize); err != nil {
+			return nil, nil, fmt.Errorf("failed to copy links of %s. %v", mover.Stats.KeyRange, err)
+		}
+
+		log.Info().
+			Str("key_range", mover.Stats.KeyRange).
+			Int64("free_keys", mover.Stats.FreeKeys).
+			Int64("links", mover.Stats.Links).
+			Msg("copied shard rows")
+	}
+
+	if err := models.NewTopologyRepo(database.CoordinatorDB).Split(ctx, split, opts.From, opts.Into); err != nil {
+		return nil, nil, fmt.Errorf("failed to record the split. %v", err)
+	}
+
+	log.Info().Dur("grace", opts.Grace).Msg("recorded the split, waiting for the servers to switch")
+
+	select {
+	case <-ctx.Done():
+		return split, nil, fmt.Errorf("split is recorded, but the rows weren't caught up. %v", ctx.Err())
+	case <-time.After(opts.Grace):
+	}
+
+	stats := []*models.MoveStats{}
+
+	for _, mover := range movers {
+		if err := mover.CatchUp(ctx, copyStart); err != nil {
+			return split, nil, fmt.Errorf("split is recorded, but failed to catch up %s. %v", mover.Stats.KeyRange, err)
+		}
+
+		if len(mover.Stats.Conflicts) > 0 {
+			log.Warn().
+				Str("key_range", mover.Stats.KeyRange).
+				Strs("short_keys", mover.Stats.Conflicts).
+				Msg("links written on both sides of the switch, the later write was kept")
+		}
+
+		if err := mover.Purge(ctx); err != nil {
+			return split, nil, fmt.Errorf("split is recorded, but failed to purge %s. %v", mover.Stats.KeyRange, err)
+		}
+
+		stats = append(stats, mover.Stats)
+	}
+
+	return split, stats, nil
+}
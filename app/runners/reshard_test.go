@@ -0,0 +1,119 @@
+package runners_test
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-batteries/shortner/app/db"
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/go-batteries/shortner/app/runners"
+)
+
+func Test_Reshard(t *testing.T) {
+	ctx := context.Background()
+	topology, database := linkTopology(t, 3, "a-z")
+	source := models.NewURLRepo(database)
+
+	for _, alias := range []string{"apple", "nebula", "quasar"} {
+		if _, err := source.AssignAlias(ctx, alias, "https://example.com/"+alias, models.WithOwner("acc_1")); err != nil {
+			t.Fatalf("failed to assign alias %v", err)
+		}
+	}
+
+	targetPath := filepath.Join(t.TempDir(), "db_n_z.db")
+	written := make(chan error, 1)
+
+	// the servers write to both sides, till they all switch
+	go func() {
+		written <- func() error {
+			for {
+				split, err := models.NewTopologyRepo(database.CoordinatorDB).Load(ctx)
+				if err != nil {
+					return err
+				}
+
+				if len(split.Shards) == 2 {
+					break
+				}
+
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			if _, err := source.AssignAlias(ctx, "orbit", "https://example.com/orbit", models.WithOwner("acc_1")); err != nil {
+				return err
+			}
+
+			if _, err := source.AssignAlias(ctx, "omega", "https://example.com/source", models.WithOwner("acc_1")); err != nil {
+				return err
+			}
+
+			target := db.NewSqliteCoordinator([]string{"n-z"})
+			target.ToDbName = func(string) string { return strings.TrimSuffix(targetPath, ".db") }
+
+			if err := target.ConnectShards(ctx, db.DBReadWriteMode); err != nil {
+				return err
+			}
+			defer target.DeInit()
+
+			shards, _ := target.GetShards()
+			target.SetPolicy(&db.KeyBasedPolicy[string]{Shards: db.ShardsByKeyRange([]string{"n-z"}, shards)})
+
+			_, err := models.NewURLRepo(target).AssignAlias(ctx, "omega", "https://example.com/target", models.WithOwner("acc_2"))
+			return err
+		}()
+	}()
+
+	split, stats, err := runners.Reshard(ctx, topology, &runners.ReshardOpts{
+		From:      "a-z",
+		Into:      []string{"a-m", "n-z"},
+		Paths:     map[string]string{"n-z": targetPath},
+		BatchSize: 2,
+		Grace:     2 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("failed to reshard %v", err)
+	}
+
+	if err := <-written; err != nil {
+		t.Fatalf("failed to write during the grace window %v", err)
+	}
+
+	if len(stats) != 1 || stats[0].FreeKeys != 0 || stats[0].Links != 2 {
+		t.Fatalf("expected the 2 links of n-z to be copied, got %+v", stats[0])
+	}
+
+	if stats[0].CaughtUp != 1 || len(stats[0].Conflicts) != 1 || stats[0].Conflicts[0] != "omega" {
+		t.Fatalf("expected orbit to be caught up, and omega to conflict, got %+v", stats[0])
+	}
+
+	if stats[0].Purged != 4 {
+		t.Fatalf("expected the 4 links of n-z to be purged from the source, got %d", stats[0].Purged)
+	}
+
+	// the servers restart on the split
+	reader := runners.NewTopologyCoordinator(split)
+	if err := reader.ConnectShards(ctx, db.DBReadOnlyMode); err != nil {
+		t.Fatalf("failed to open the split %v", err)
+	}
+	defer reader.DeInit()
+
+	shards, _ := reader.GetShards()
+	reader.SetPolicy(&db.KeyBasedPolicy[string]{Shards: db.ShardsByKeyRange(split.KeyRanges(), shards)})
+
+	repo := models.NewURLRepo(reader)
+
+	for shortKey, link := range map[string]string{
+		"apple":  "https%3A%2F%2Fexample.com%2Fapple",
+		"nebula": "https%3A%2F%2Fexample.com%2Fnebula",
+		"orbit":  "https%3A%2F%2Fexample.com%2Forbit",
+		"omega":  "https%3A%2F%2Fexample.com%2Ftarget",
+	} {
+		u, err := repo.Find(ctx, shortKey)
+		if err != nil || *u.Link != link {
+			t.Fatalf("expected %s to point to %s after the split, got %v", shortKey, link, err)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package runners
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-batteries/shortner/app/db"
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/go-batteries/shortner/app/watchers"
+	"github.com/rs/zerolog/log"
+)
+
+var ErrChangelogGap = errors.New("changelog_gap")
+
+type RestoreOpts struct {
+	// Until, the changes made after it aren't replayed
+	Until time.Time
+
+	// KeyRange restores only its shard, instead of all
+	KeyRange string
+
+	// BaseDir has the snapshots to replay the changelog on, named
+	// like the shard files. Shards without one are replayed from an
+	// empty shard, which needs the changelog from when it was seeded.
+	// The free keys aren't in the changelog, only the handed out ones
+	// are restored that way, the refill seeds the rest again.
+	BaseDir string
+
+	// OutDir is where the restored shard files are written
+	OutDir string
+
+	// Timeline to replay, defaults to the one of
+	// the snapshot, or of the shard file in use.
+	Timeline string
+}
+
+type RestoreStats struct {
+	KeyRange string
+	Path     string
+	Timeline string
+
+	// NewTimeline is where the restored shard
+	// ships its changelog, once it's in use.
+	NewTimeline string
+
+	From       int64
+	To         int64
+	Replayed   int64
+	LastChange time.Time
+}
+
+// RestoreShards rebuilds the shards of the topology as they were at
+// opts.Until, from a snapshot and the changelog shipped to the target.
+// The restored files are written to opts.OutDir, the ones in use
+// aren't touched. They are swapped in by hand, with the servers down.
+func RestoreShards(ctx context.Context, topology *models.Topology, target watchers.BackupTarget, opts *RestoreOpts) ([]*RestoreStats, error) {
+	if err := os.MkdirAll(opts.OutDir, 0755); err != nil {
+		return nil, err
+	}
+
+	stats := []*RestoreStats{}
+
+	for _, spec := range topology.Shards {
+		if opts.KeyRange != "" && spec.KeyRange != opts.KeyRange {
+			continue
+		}
+
+		stat, err := restoreShard(ctx, topology, spec, target, opts)
+		if err != nil {
+			return stats, fmt.Errorf("failed to restore %s. %v", spec.KeyRange, err)
+		}
+
+		stats = append(stats, stat)
+	}
+
+	if len(stats) == 0 {
+		return nil, fmt.Errorf("no shard for key range %s", opts.KeyRange)
+	}
+
+	return stats, nil
+}
+
+func restoreShard(ctx context.Context, topology *models.Topology, spec *models.ShardSpec, target watchers.BackupTarget, opts *RestoreOpts) (*RestoreStats, error) {
+	out := filepath.Join(opts.OutDir, filepath.Base(spec.Path))
+
+	if same, _ := sameFile(out, spec.Path); same {
+		return nil, fmt.Errorf("%s is the shard in use, restore somewhere else", out)
+	}
+
+	if _, err := os.Stat(out); err == nil {
+		return nil, fmt.Errorf("%s already exists", out)
+	}
+
+	stat := &RestoreStats{KeyRange: spec.KeyRange, Path: out, Timeline: opts.Timeline}
+
+	base := ""
+	if opts.BaseDir != "" {
+		base = filepath.Join(opts.BaseDir, filepath.Base(spec.Path))
+
+		if _, err := os.Stat(base); err != nil {
+			log.Warn().Str("key_range", spec.KeyRange).Msg("no snapshot, replaying from an empty shard")
+			base = ""
+		}
+	}
+
+	if base != "" {
+		if err := db.SnapshotInto(ctx, base, out); err != nil {
+			return nil, err
+		}
+	}
+
+	// the triggers are off, the changes are recorded by Replay
+	restored := db.NewSqliteCoordinator([]string{spec.KeyRange})
+	restored.ToDbName = func(string) string { return strings.TrimSuffix(out, ".db") }
+
+	if err := restored.RegisterShards(ctx); err != nil {
+		return nil, err
+	}
+	defer restored.DeInit()
+
+	shards, ok := restored.GetShards()
+	if !ok {
+		return nil, fmt.Errorf("should not have failed to create shards")
+	}
+
+	repo := models.NewChangelogRepo(out, shards[0].Conn())
+
+	state, err := repo.State(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if stat.Timeline == "" && base != "" {
+		stat.Timeline = state.Timeline
+	}
+
+	if stat.Timeline == "" {
+		if stat.Timeline, err = liveTimeline(ctx, spec.Path); err != nil {
+			return nil, fmt.Errorf("no timeline to replay, pass one. %v", err)
+		}
+	}
+
+	stat.From, stat.To = state.Position, state.Position
+
+	keys, err := target.List(ctx, models.SegmentPrefix(topology.DBName(spec.KeyRange), stat.Timeline))
+	if err != nil {
+		return nil, err
+	}
+
+	until := opts.Until.UnixMilli()
+
+	for _, key := range keys {
+		segment, err := models.ParseSegmentKey(key)
+		if err != nil {
+			return nil, err
+		}
+
+		if segment.Last <= stat.To {
+			continue
+		}
+
+		entries, err := readSegment(ctx, target, key)
+		if err != nil {
+			return nil, err
+		}
+
+		replay := []*models.ChangeEntry{}
+		reached := false
+
+		for _, entry := range entries {
+			if entry.Seq <= stat.To {
+				continue
+			}
+
+			if entry.ChangedAt > until {
+				reached = true
+				break
+			}
+
+			if entry.Seq != stat.To+1 {
+				return nil, fmt.Errorf("%w. changes %d to %d are missing", ErrChangelogGap, stat.To+1, entry.Seq-1)
+			}
+
+			replay = append(replay, entry)
+			stat.To = entry.Seq
+			stat.LastChange = entry.ChangedTime()
+		}
+
+		if err := repo.Replay(ctx, replay); err != nil {
+			return nil, err
+		}
+
+		stat.Replayed += int64(len(replay))
+
+		if reached {
+			break
+		}
+	}
+
+	next, err := repo.NewTimeline(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stat.NewTimeline = next.Timeline
+	return stat, nil
+}
+
+func readSegment(ctx context.Context, target watchers.BackupTarget, key string) ([]*models.ChangeEntry, error) {
+	body, err := target.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return models.ReadSegment(body)
+}
+
+func liveTimeline(ctx context.Context, path string) (string, error) {
+	if _, err := os.Stat(path); err != nil {
+		return "", err
+	}
+
+	conn, err := sql.Open("sqlite3", fmt.Sprintf("%s?mode=ro", path))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	state, err := models.NewChangelogRepo(path, conn).State(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	return state.Timeline, nil
+}
+
+func sameFile(a string, b string) (bool, error) {
+	absA, err := filepath.Abs(a)
+	if err != nil {
+		return false, err
+	}
+
+	absB, err := filepath.Abs(b)
+	if err != nil {
+		return false, err
+	}
+
+	return absA == absB, nil
+}
@@ -0,0 +1,62 @@
+package runners
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+
+	"github.com/go-batteries/shortner/app/db"
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/mr-tron/base58"
+)
+
+// ReportRingMoves places the assigned keys of the shards in the topology
+// on the current and the proposed hash rings, to see how many would move.
+// With a sample, that many random keys are used instead, for when the
+// shards aren't around, or are too big to go over.
+func ReportRingMoves(ctx context.Context, topology *models.Topology, current, proposed *db.HashRing, sample int) (*db.RingMoves, error) {
+	moves := db.NewRingMoves()
+
+	if sample > 0 {
+		// seeded, so the same proposal reports the same numbers
+		random := rand.New(rand.NewSource(int64(sample)))
+		buf := make([]byte, 8)
+
+		for i := 0; i < sample; i++ {
+			binary.BigEndian.PutUint64(buf, random.Uint64())
+			moves.Add(base58.Encode(buf[:5]), current, proposed)
+		}
+
+		return moves, nil
+	}
+
+	database := NewTopologyCoordinator(topology)
+
+	if err := VerifyTopology(ctx, database, topology, false); err != nil {
+		return nil, err
+	}
+	defer database.CoordinatorDB.Close()
+
+	if err := database.ConnectShards(ctx, db.DBReadOnlyMode); err != nil {
+		return nil, err
+	}
+	defer database.DeInit()
+
+	shards, ok := database.GetShards()
+	if !ok {
+		return nil, fmt.Errorf("should not have failed to create shards")
+	}
+
+	for _, shard := range shards {
+		err := models.EachAssignedKey(ctx, shard.Conn(), func(shortKey string) {
+			moves.Add(shortKey, current, proposed)
+		})
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read keys of %s. %v", shard.ShardKey(), err)
+		}
+	}
+
+	return moves, nil
+}
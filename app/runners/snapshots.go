@@ -0,0 +1,444 @@
+package runners
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-batteries/shortner/app/db"
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/go-batteries/shortner/app/watchers"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrBackupNotFound = errors.New("backup_not_found")
+	ErrBackupCorrupt  = errors.New("backup_corrupt")
+)
+
+// LatestBackup picks the latest complete run, in FetchBackup
+const LatestBackup = "latest"
+
+// ListBackups lists the backup runs on the target, oldest first,
+// with the manifest of the complete ones.
+func ListBackups(ctx context.Context, target watchers.BackupTarget) ([]*models.BackupRun, map[string]*models.BackupManifest, error) {
+	keys, err := target.List(ctx, models.SnapshotsPrefix)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	runs := models.BackupRuns(keys)
+	manifests := map[string]*models.BackupManifest{}
+
+	for _, run := range runs {
+		if !run.Complete {
+			continue
+		}
+
+		manifest, err := readManifest(ctx, target, run.Keys[0])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		manifests[run.ID] = manifest
+	}
+
+	return runs, manifests, nil
+}
+
+func readManifest(ctx context.Context, target watchers.BackupTarget, key string) (*models.BackupManifest, error) {
+	body, err := target.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return models.ReadManifest(body)
+}
+
+// FetchBackup downloads the run id, or the latest one, to dir. Every
+// shard of the topology and the coordinator have to be in the run,
+// and match the checksum in its manifest.
+func FetchBackup(ctx context.Context, target watchers.BackupTarget, topology *models.Topology, id string, dir string) (*models.BackupManifest, error) {
+	runs, _, err := ListBackups(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+
+	var run *models.BackupRun
+
+	for _, r := range runs {
+		if r.Complete && (r.ID == id || id == LatestBackup) {
+			run = r
+		}
+	}
+
+	if run == nil {
+		return nil, fmt.Errorf("%w. no complete run %s", ErrBackupNotFound, id)
+	}
+
+	manifest, err := readManifest(ctx, target, run.Keys[0])
+	if err != nil {
+		return nil, err
+	}
+
+	files := map[string]*models.BackupFile{}
+	for _, file := range manifest.Files {
+		files[file.Name] = file
+	}
+
+	for _, spec := range topology.Shards {
+		file, ok := files[filepath.Base(spec.Path)]
+		if !ok || file.KeyRange != spec.KeyRange {
+			return nil, fmt.Errorf("%w. run %s has no snapshot of %s", ErrBackupNotFound, manifest.ID, spec.KeyRange)
+		}
+	}
+
+	if _, ok := files[filepath.Base(topology.CoordinatorPath)]; !ok {
+		return nil, fmt.Errorf("%w. run %s has no snapshot of the coordinator", ErrBackupNotFound, manifest.ID)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	for _, file := range manifest.Files {
+		if err := fetchFile(ctx, target, file, dir); err != nil {
+			return nil, fmt.Errorf("failed to fetch %s. %w", file.Name, err)
+		}
+
+		log.Info().Str("file", file.Name).Str("key", file.Key).Int64("size", file.Size).Msg("fetched")
+	}
+
+	return manifest, nil
+}
+
+func fetchFile(ctx context.Context, target watchers.BackupTarget, file *models.BackupFile, dir string) error {
+	dst := filepath.Join(dir, file.Name)
+
+	if _, err := os.Stat(dst); err == nil {
+		return fmt.Errorf("%s already exists", dst)
+	}
+
+	body, err := target.Get(ctx, file.Key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	var src io.Reader = body
+
+	if file.Compressed {
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return fmt.Errorf("%w. %v", ErrBackupCorrupt, err)
+		}
+		defer zr.Close()
+
+		src = zr
+	}
+
+	tmp, err := os.CreateTemp(dir, ".fetch-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+
+	size, err := io.Copy(io.MultiWriter(tmp, hash), src)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if sum := hex.EncodeToString(hash.Sum(nil)); size != file.Size || sum != file.SHA256 {
+		return fmt.Errorf("%w. %s has %d bytes, sha256 %s, expected %d, %s", ErrBackupCorrupt, file.Name, size, sum, file.Size, file.SHA256)
+	}
+
+	return os.Rename(tmp.Name(), dst)
+}
+
+// VerifyRestored checks the shards and the coordinator in dir, named
+// like the files of the topology, before they are swapped in. Each has
+// to pass PRAGMA integrity_check, the coordinator has to have recorded
+// the topology, and its shard_status has to agree with the key ranges.
+func VerifyRestored(ctx context.Context, topology *models.Topology, dir string) error {
+	coordinator := filepath.Join(dir, filepath.Base(topology.CoordinatorPath))
+
+	paths := []string{coordinator}
+	for _, path := range topology.Paths() {
+		paths = append(paths, filepath.Join(dir, filepath.Base(path)))
+	}
+
+	for _, path := range paths {
+		if err := checkIntegrity(ctx, path); err != nil {
+			return err
+		}
+	}
+
+	conn, err := sql.Open("sqlite3", fmt.Sprintf("%s?mode=ro", coordinator))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	recorded, err := models.NewTopologyRepo(conn).Load(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load the recorded topology. %v", err)
+	}
+
+	if len(recorded.Shards) == 0 {
+		return fmt.Errorf("%w. %s has no topology recorded", ErrBackupCorrupt, coordinator)
+	}
+
+	if diffs := topology.Diff(recorded); len(diffs) > 0 {
+		return fmt.Errorf("%w. %s", models.ErrTopologyMismatch, strings.Join(diffs, "; "))
+	}
+
+	statuses, err := models.NewShardStatusRepo(conn).List(ctx)
+	if err != nil {
+		return err
+	}
+
+	if diffs := topology.StatusDiff(statuses); len(diffs) > 0 {
+		return fmt.Errorf("%w. %s", models.ErrTopologyMismatch, strings.Join(diffs, "; "))
+	}
+
+	return nil
+}
+
+func checkIntegrity(ctx context.Context, path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+
+	conn, err := sql.Open("sqlite3", fmt.Sprintf("%s?mode=ro", path))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	rows, err := conn.QueryContext(ctx, "PRAGMA integrity_check")
+	if err != nil {
+		return fmt.Errorf("%w. %s. %v", ErrBackupCorrupt, path, err)
+	}
+	defer rows.Close()
+
+	problems := []string{}
+
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return err
+		}
+
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+
+	// a page too broken to check fails the pragma itself
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("%w. %s. %v", ErrBackupCorrupt, path, err)
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w. %s. %s", ErrBackupCorrupt, path, strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// StartTimelines moves the shards in dir to a new changelog timeline.
+// The changes after the snapshot were shipped on the old one, the
+// restored shards number theirs from the snapshot again.
+func StartTimelines(ctx context.Context, topology *models.Topology, dir string) (map[string]string, error) {
+	timelines := map[string]string{}
+
+	for _, spec := range topology.Shards {
+		path := filepath.Join(dir, filepath.Base(spec.Path))
+
+		conn, err := sql.Open("sqlite3", path)
+		if err != nil {
+			return nil, err
+		}
+
+		state, err := models.NewChangelogRepo(path, conn).NewTimeline(ctx)
+		conn.Close()
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to start a timeline for %s. %v", spec.KeyRange, err)
+		}
+
+		timelines[spec.KeyRange] = state.Timeline
+	}
+
+	return timelines, nil
+}
+
+// SwapRestored puts the files in dir in place of the shards and the
+// coordinator. It takes the lock of the topology, which the servers
+// hold unless they are stopped, or started in maintenance mode. The
+// files in use are kept, renamed with the returned suffix. Every file
+// is renamed in place, if one fails, the ones already swapped are put
+// back, and the restored files are moved back to dir.
+func SwapRestored(ctx context.Context, topology *models.Topology, dir string) (string, error) {
+	lock, err := db.LockFile(topology.LockPath(), true)
+	if errors.Is(err, db.ErrLocked) {
+		return "", fmt.Errorf("a server has the shards open, stop it or start it in maintenance mode. %v", err)
+	}
+	if err != nil {
+		return "", err
+	}
+	defer lock.Unlock()
+
+	suffix := ".pre-restore-" + time.Now().UTC().Format("20060102T150405Z")
+	targets := append(topology.Paths(), topology.CoordinatorPath)
+
+	// swap is a target, as far as it got. moved is set once the
+	// restored file started moving in, aside once the file in use
+	// started moving out.
+	type swap struct {
+		dst   string
+		aside bool
+		moved bool
+	}
+
+	swaps := []*swap{}
+
+	// rollback puts the files in use back, and the restored ones in dir,
+	// so that the swap can be tried again. A target which had no file
+	// only has the restored one to move out.
+	rollback := func() {
+		for i := len(swaps) - 1; i >= 0; i-- {
+			sw := swaps[i]
+
+			if _, err := os.Stat(sw.dst); err == nil && sw.moved {
+				if err := moveSqliteFiles(sw.dst, sw.dst+".restoring"); err != nil {
+					log.Error().Err(err).Str("path", sw.dst).Msg("failed to move the restored file out")
+					continue
+				}
+			}
+
+			if _, err := os.Stat(sw.dst + suffix); err == nil && sw.aside {
+				if err := moveSqliteFiles(sw.dst+suffix, sw.dst); err != nil {
+					log.Error().Err(err).Str("path", sw.dst).Msg("failed to put back, it's at " + sw.dst + suffix)
+				}
+			}
+		}
+
+		for _, dst := range targets {
+			if _, err := os.Stat(dst + ".restoring"); err != nil {
+				continue
+			}
+
+			if err := moveSqliteFiles(dst+".restoring", filepath.Join(dir, filepath.Base(dst))); err != nil {
+				log.Error().Err(err).Str("path", dst).Msg("failed to move the restored file back, it's at " + dst + ".restoring")
+			}
+		}
+	}
+
+	// the restored files are moved next to the ones in use
+	// first, so that the swap doesn't cross file systems
+	for _, dst := range targets {
+		if err := moveSqliteFiles(filepath.Join(dir, filepath.Base(dst)), dst+".restoring"); err != nil {
+			rollback()
+			return "", err
+		}
+	}
+
+	for _, dst := range targets {
+		sw := &swap{dst: dst}
+		swaps = append(swaps, sw)
+
+		if _, err := os.Stat(dst); err == nil {
+			sw.aside = true
+
+			if err := moveSqliteFiles(dst, dst+suffix); err != nil {
+				rollback()
+				return "", err
+			}
+		}
+
+		sw.moved = true
+
+		if err := moveSqliteFiles(dst+".restoring", dst); err != nil {
+			rollback()
+			return "", err
+		}
+	}
+
+	return suffix, nil
+}
+
+// moveSqliteFiles moves the db with its wal and shm, which are part of
+// it while they exist. It falls back to copying across file systems.
+func moveSqliteFiles(src string, dst string) error {
+	for _, ext := range []string{"", "-wal", "-shm"} {
+		if _, err := os.Stat(dst + ext); err == nil && ext != "" {
+			if err := os.Remove(dst + ext); err != nil {
+				return err
+			}
+		}
+
+		if _, err := os.Stat(src + ext); err != nil {
+			if ext == "" {
+				return err
+			}
+			continue
+		}
+
+		if err := os.Rename(src+ext, dst+ext); err == nil {
+			continue
+		}
+
+		if err := copyFile(src+ext, dst+ext); err != nil {
+			return err
+		}
+
+		if err := os.Remove(src + ext); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+
+	return out.Close()
+}
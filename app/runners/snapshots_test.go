@@ -0,0 +1,196 @@
+package runners_test
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/go-batteries/shortner/app/runners"
+	"github.com/go-batteries/shortner/app/watchers"
+)
+
+func Test_RestoreBackup(t *testing.T) {
+	ctx := context.Background()
+	topology, database := linkTopology(t, 2, "a-m", "n-z")
+
+	if _, err := models.NewURLRepo(database).AssignAlias(ctx, "apple", "https://example.com/apple"); err != nil {
+		t.Fatalf("failed to assign alias %v", err)
+	}
+
+	target := watchers.NewDirTarget(t.TempDir())
+
+	manifest, _, err := runners.BackupShards(ctx, topology, target, &runners.BackupOpts{})
+	if err != nil {
+		t.Fatalf("failed to back up %v", err)
+	}
+
+	fetch := func() string {
+		t.Helper()
+
+		dir := filepath.Join(t.TempDir(), "restored")
+		if _, err := runners.FetchBackup(ctx, target, topology, runners.LatestBackup, dir); err != nil {
+			t.Fatalf("failed to fetch %v", err)
+		}
+
+		return dir
+	}
+
+	if err := runners.VerifyRestored(ctx, topology, fetch()); err != nil {
+		t.Fatalf("expected the backup to verify, got %v", err)
+	}
+
+	// a page of a shard is overwritten
+	corrupt := fetch()
+	shard := filepath.Join(corrupt, filepath.Base(topology.Shards[0].Path))
+
+	f, err := os.OpenFile(shard, os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("failed to open shard %v", err)
+	}
+
+	if _, err := f.WriteAt(bytes.Repeat([]byte{0xff}, 4096), 4096); err != nil {
+		t.Fatalf("failed to corrupt shard %v", err)
+	}
+	f.Close()
+
+	if err := runners.VerifyRestored(ctx, topology, corrupt); !errors.Is(err, runners.ErrBackupCorrupt) {
+		t.Fatalf("expected the integrity check to fail, got %v", err)
+	}
+
+	// the coordinator has a key range, the topology doesn't
+	mismatched := fetch()
+
+	conn, err := sql.Open("sqlite3", filepath.Join(mismatched, filepath.Base(topology.CoordinatorPath)))
+	if err != nil {
+		t.Fatalf("failed to open coordinator %v", err)
+	}
+
+	now := time.Now().UTC()
+	_, err = conn.ExecContext(ctx, `INSERT INTO shard_status (shard_id, shard_char, start, end, status, created_at, updated_at)
+		VALUES ('q-z', 'q', 0, 0, 'active', ?, ?)`, now, now)
+	conn.Close()
+
+	if err != nil {
+		t.Fatalf("failed to insert shard status %v", err)
+	}
+
+	if err := runners.VerifyRestored(ctx, topology, mismatched); !errors.Is(err, models.ErrTopologyMismatch) {
+		t.Fatalf("expected the shard status to mismatch the topology, got %v", err)
+	}
+
+	// a snapshot in the run doesn't match its checksum
+	key := manifest.Files[0].Key
+
+	body, err := target.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("failed to read snapshot %v", err)
+	}
+
+	b, _ := io.ReadAll(body)
+	body.Close()
+
+	b[len(b)-1] ^= 0xff
+	if err := target.Put(ctx, key, bytes.NewReader(b)); err != nil {
+		t.Fatalf("failed to write snapshot %v", err)
+	}
+
+	dir := t.TempDir()
+	if _, err := runners.FetchBackup(ctx, target, topology, manifest.ID, dir); !errors.Is(err, runners.ErrBackupCorrupt) {
+		t.Fatalf("expected the checksum to mismatch, got %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, manifest.Files[0].Name)); !os.IsNotExist(err) {
+		t.Fatalf("expected the corrupt snapshot to not be kept, got %v", err)
+	}
+}
+
+func Test_SwapRestored(t *testing.T) {
+	ctx := context.Background()
+	topology, _ := linkTopology(t, 2, "a-m", "n-z")
+
+	target := watchers.NewDirTarget(t.TempDir())
+
+	if _, _, err := runners.BackupShards(ctx, topology, target, &runners.BackupOpts{}); err != nil {
+		t.Fatalf("failed to back up %v", err)
+	}
+
+	// a coordinator which isn't there yet, restored from the backup
+	restoring := *topology
+	restoring.CoordinatorPath = filepath.Join(t.TempDir(), filepath.Base(topology.CoordinatorPath))
+
+	dir := filepath.Join(t.TempDir(), "restored")
+	if _, err := runners.FetchBackup(ctx, target, &restoring, runners.LatestBackup, dir); err != nil {
+		t.Fatalf("failed to fetch %v", err)
+	}
+
+	stat := func(path string) os.FileInfo {
+		t.Helper()
+
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("expected %s to exist, got %v", path, err)
+		}
+
+		return info
+	}
+
+	inUse := map[string]os.FileInfo{}
+	restored := map[string]os.FileInfo{}
+
+	for _, path := range restoring.Paths() {
+		inUse[path] = stat(path)
+		restored[path] = stat(filepath.Join(dir, filepath.Base(path)))
+	}
+
+	// the wal of the coordinator can't be replaced, the last swap fails
+	blocker := restoring.CoordinatorPath + "-wal"
+	if err := os.MkdirAll(filepath.Join(blocker, "x"), 0755); err != nil {
+		t.Fatalf("failed to create blocker %v", err)
+	}
+
+	if _, err := runners.SwapRestored(ctx, &restoring, dir); err == nil {
+		t.Fatalf("expected the swap to fail")
+	}
+
+	for path, info := range inUse {
+		if !os.SameFile(info, stat(path)) {
+			t.Fatalf("expected %s to be put back", path)
+		}
+
+		if aside, _ := filepath.Glob(path + ".*"); len(aside) > 0 {
+			t.Fatalf("expected nothing left next to %s, got %v", path, aside)
+		}
+
+		stat(filepath.Join(dir, filepath.Base(path)))
+	}
+
+	if _, err := os.Stat(restoring.CoordinatorPath); !os.IsNotExist(err) {
+		t.Fatalf("expected the restored coordinator to be moved out, got %v", err)
+	}
+
+	stat(filepath.Join(dir, filepath.Base(restoring.CoordinatorPath)))
+
+	// the swap can be tried again, once the blocker is gone
+	os.RemoveAll(blocker)
+	os.RemoveAll(filepath.Join(dir, filepath.Base(blocker)))
+
+	suffix, err := runners.SwapRestored(ctx, &restoring, dir)
+	if err != nil {
+		t.Fatalf("failed to swap %v", err)
+	}
+
+	for path, info := range restored {
+		if !os.SameFile(info, stat(path)) || !os.SameFile(inUse[path], stat(path+suffix)) {
+			t.Fatalf("expected %s to be swapped, with the one in use at %s", path, path+suffix)
+		}
+	}
+
+	stat(restoring.CoordinatorPath)
+}
@@ -13,35 +13,6 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-// TODO: this should be config as well
-var startMaps = map[byte]uint64{
-	'a': uint64(1000000000),
-	'f': uint64(2000000000),
-	'k': uint64(3000000000),
-	'q': uint64(4000000000),
-	'v': uint64(5000000000),
-}
-
-var getShardStart = func(startKey byte) uint64 {
-	if startKey >= 'a' && startKey < 'f' {
-		return startMaps['a']
-	}
-
-	if startKey >= 'f' && startKey < 'k' {
-		return startMaps['f']
-	}
-
-	if startKey >= 'k' && startKey < 'q' {
-		return startMaps['k']
-	}
-
-	if startKey >= 'q' && startKey < 'v' {
-		return startMaps['q']
-	}
-
-	return startMaps['v']
-}
-
 type result struct {
 	err        error
 	keyRange   string
@@ -49,11 +20,15 @@ type result struct {
 	shardStats *models.ShardStatus
 }
 
-func SeedSqliteDB(ctx context.Context, shortKeyLen int, batchSize int, seedSize uint64) (errr error) {
-	seeder := seed.RegisterUrlSeeder()
-	keyRanges := seeder.Shards(5)
+// SeedSqliteDB creates the shards of the topology, and fills them with keys
+func SeedSqliteDB(ctx context.Context, seeder *seed.Seeder, topology *models.Topology, shortKeyLen int, batchSize int, seedSize uint64) (errr error) {
+	keyRanges := topology.KeyRanges()
+
+	database := NewTopologyCoordinator(topology)
 
-	database := db.NewSqliteCoordinator(keyRanges)
+	if err := VerifyTopology(ctx, database, topology, true); err != nil {
+		return err
+	}
 
 	err := database.RegisterShards(ctx)
 	if err != nil {
@@ -131,7 +106,7 @@ func SeedSqliteDB(ctx context.Context, shortKeyLen int, batchSize int, seedSize
 				return
 			}
 
-			res.err = GenerateForKeyRange(ctx, start, end, lowers, batchSize, seedSize, repo)
+			res.err = GenerateForKeyRange(ctx, start, end, lowers, topology, batchSize, seedSize, repo)
 
 			for ch := start; ch <= end; ch++ {
 				res.prefixes = append(res.prefixes, ch)
@@ -156,7 +131,7 @@ func SeedSqliteDB(ctx context.Context, shortKeyLen int, batchSize int, seedSize
 		shardID := res.keyRange
 
 		for _, prefix := range prefixes {
-			start := getShardStart(prefix)
+			start := topology.Start(prefix)
 			err := cordDB.Create(ctx, &models.ShardStatus{
 				ShardID:   shardID,
 				ShardChar: string(prefix),
@@ -175,7 +150,7 @@ func SeedSqliteDB(ctx context.Context, shortKeyLen int, batchSize int, seedSize
 	return errr
 }
 
-func GenerateForKeyRange(ctx context.Context, keyStart, keyEnd byte, lowers []string, batchSize int, seedSize uint64, repo *models.URLRepo) error {
+func GenerateForKeyRange(ctx context.Context, keyStart, keyEnd byte, lowers []string, topology *models.Topology, batchSize int, seedSize uint64, repo *models.URLRepo) error {
 	batchShard := []byte{}
 	for _, lower := range lowers {
 		if lower[0] >= byte(keyStart) && lower[0] <= byte(keyEnd) {
@@ -190,7 +165,7 @@ func GenerateForKeyRange(ctx context.Context, keyStart, keyEnd byte, lowers []st
 		log.Info().Msg("") // to add a new line
 		log.Info().Str("shardKey", string(shardKey)).Msg("inserting records for shardkey")
 
-		last := getShardStart(shardKey)
+		last := topology.Start(shardKey)
 		totalCount := last + seedSize
 
 		generator := seed.NewBase58Generator(last, seedSize, string(shardKey))
@@ -0,0 +1,79 @@
+package runners
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-batteries/shortner/app/db"
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/rs/zerolog/log"
+)
+
+// SweepExpiredKeys goes over all the shards, and tombstones the links
+// past their expiry. With recycle, the keys of the links deleted, or
+// expired, more than coolDown ago are recycled, and their pending
+// reports are closed.
+func SweepExpiredKeys(ctx context.Context, topology *models.Topology, recycle bool, coolDown time.Duration) error {
+	database := NewTopologyCoordinator(topology)
+
+	if err := VerifyTopology(ctx, database, topology, false); err != nil {
+		return err
+	}
+	defer database.CoordinatorDB.Close()
+
+	err := database.ConnectShards(ctx, db.DBReadWriteMode)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to connect to databases")
+	}
+
+	defer database.DeInit()
+
+	if err := database.MigrateShards(ctx); err != nil {
+		return err
+	}
+
+	shards, ok := database.GetShards()
+	if !ok {
+		log.Fatal().Msg("should not have failed to create shards")
+	}
+
+	reports := models.NewReportRepo(database.CoordinatorDB)
+
+	var errr error
+
+	for _, shard := range shards {
+		repo := models.NewExpiryRepo(shard.ShardKey(), shard.Conn())
+
+		stats, err := repo.Sweep(ctx, recycle, coolDown)
+		if err != nil {
+			log.Error().Err(err).Str("shard", shard.ShardKey()).Msg("failed to sweep expired keys")
+			errr = fmt.Errorf("failed to sweep %s. %v", shard.ShardKey(), err)
+			continue
+		}
+
+		log.Info().
+			Str("shard", stats.ShardKey).
+			Int64("tombstoned", stats.Tombstoned).
+			Int64("recycled", stats.Recycled).
+			Int64("released", stats.Released).
+			Int64("clicks", stats.Clicks).
+			Int64("quarantined", stats.Quarantined).
+			Msg("swept expired keys")
+
+		if len(stats.Keys) == 0 {
+			continue
+		}
+
+		closed, err := reports.Recycled(ctx, stats.Keys, time.Now().UTC())
+		if err != nil {
+			log.Error().Err(err).Strs("short_keys", stats.Keys).Msg("failed to close the reports of the recycled keys")
+			errr = fmt.Errorf("failed to close the reports of %s. %v", shard.ShardKey(), err)
+			continue
+		}
+
+		log.Info().Str("shard", stats.ShardKey).Int64("reports", closed).Msg("closed the reports of the recycled keys")
+	}
+
+	return errr
+}
@@ -0,0 +1,146 @@
+package runners
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-batteries/shortner/app/config"
+	"github.com/go-batteries/shortner/app/db"
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/go-batteries/shortner/app/seed"
+)
+
+// TopologyFromConfig expands the key ranges of the config into
+// shards, with the start of every prefix the seeder generates.
+func TopologyFromConfig(cfg *config.AppConfig) *models.Topology {
+	lowers := seed.RegisterUrlSeeder().Lowers()
+	topology := &models.Topology{
+		CoordinatorPath: cfg.CoordinatorPath,
+		Changelog:       cfg.ChangelogDest != "",
+	}
+
+	for _, keyRange := range cfg.KeyRanges {
+		path, ok := cfg.ShardPaths[keyRange]
+		if !ok {
+			path = db.DefaultSqliteDBNameBuilder(keyRange) + ".db"
+		}
+
+		spec := &models.ShardSpec{
+			KeyRange: keyRange,
+			Path:     path,
+			Starts:   map[string]uint64{},
+			Replicas: cfg.ShardReplicas[keyRange],
+		}
+		start, end, _ := models.ExplodeKeyRange(keyRange)
+
+		for _, lower := range lowers {
+			if lower[0] < start || lower[0] > end {
+				continue
+			}
+
+			prefixStart, ok := cfg.SeedStarts[lower]
+			if !ok {
+				prefixStart = cfg.SeedStarts[keyRange]
+			}
+
+			spec.Starts[lower] = prefixStart
+		}
+
+		topology.Shards = append(topology.Shards, spec)
+	}
+
+	return topology
+}
+
+// NewTopologyCoordinator is a coordinator for the shard files of the topology
+func NewTopologyCoordinator(topology *models.Topology) *db.SqliteCoordinator[string] {
+	database := db.NewSqliteCoordinator(topology.KeyRanges())
+	database.ToDbName = topology.DBName
+	database.Changelog = topology.Changelog
+
+	if topology.CoordinatorPath != "" {
+		database.CoordinatorPath = topology.CoordinatorPath
+	}
+
+	return database
+}
+
+// VerifyTopology checks the topology against the one recorded in the
+// coordinator db, recording it, if it's the first run. Unless the shards
+// are being created, their files are expected to be on disk.
+func VerifyTopology(ctx context.Context, database *db.SqliteCoordinator[string], topology *models.Topology, creating bool) error {
+	if !creating {
+		if missing := topology.MissingFiles(); len(missing) > 0 {
+			return fmt.Errorf("%w. missing shard files %s, seed them first",
+				models.ErrTopologyMismatch, strings.Join(missing, ", "))
+		}
+	}
+
+	if database.CoordinatorDB == nil {
+		if _, err := database.ConnectCoordinatorDB(ctx); err != nil {
+			return err
+		}
+	}
+
+	if err := database.MigrateCoordinator(ctx); err != nil {
+		return err
+	}
+
+	return models.NewTopologyRepo(database.CoordinatorDB).Verify(ctx, topology)
+}
+
+// RerouteTopology switches a connected coordinator to the shards of
+// the topology, policyFor builds the routing over the new shards.
+func RerouteTopology(ctx context.Context, database *db.SqliteCoordinator[string], topology *models.Topology, mode db.DBmode, policyFor func([]db.Shard[string]) db.ShardingPolicy[string]) error {
+	database.ToDbName = topology.DBName
+
+	if database.ReplicaPaths != nil {
+		database.ReplicaPaths = topology.ReplicaPaths
+	}
+
+	return database.Reroute(ctx, mode, topology.KeyRanges(), policyFor)
+}
+
+// ConfigForTopology is cfg, with the shards of the topology. It's the
+// reverse of TopologyFromConfig, for when the topology changes, and
+// the config has to follow.
+func ConfigForTopology(cfg *config.AppConfig, topology *models.Topology) *config.AppConfig {
+	next := *cfg
+	next.KeyRanges = topology.KeyRanges()
+	next.ShardPaths = map[string]string{}
+	next.SeedStarts = map[string]uint64{}
+	next.ShardReplicas = map[string][]string{}
+
+	for _, spec := range topology.Shards {
+		if spec.Path != db.DefaultSqliteDBNameBuilder(spec.KeyRange)+".db" {
+			next.ShardPaths[spec.KeyRange] = spec.Path
+		}
+
+		if len(spec.Replicas) > 0 {
+			next.ShardReplicas[spec.KeyRange] = spec.Replicas
+		}
+
+		prefixes := make([]string, 0, len(spec.Starts))
+		for prefix := range spec.Starts {
+			prefixes = append(prefixes, prefix)
+		}
+		sort.Strings(prefixes)
+
+		rangeStart := models.DefaultSeedStart
+		if len(prefixes) > 0 {
+			rangeStart = spec.Starts[prefixes[0]]
+		}
+
+		next.SeedStarts[spec.KeyRange] = rangeStart
+
+		for _, prefix := range prefixes {
+			if spec.Starts[prefix] != rangeStart {
+				next.SeedStarts[prefix] = spec.Starts[prefix]
+			}
+		}
+	}
+
+	return &next
+}
@@ -1,9 +1,15 @@
 package seed
 
+import (
+	"errors"
+	"strings"
+)
+
 type Seeder struct {
-	lowers []string
-	uppers []string
-	nums   []string
+	lowers    []string
+	uppers    []string
+	nums      []string
+	keyRanges []string
 }
 
 func RegisterUrlSeeder() *Seeder {
@@ -39,13 +45,74 @@ func (seeder *Seeder) Lowers() []string {
 	return seeder.lowers
 }
 
-func (seeder *Seeder) Shards(batchSize int) []string {
-	// TODO: this should be a config
-	return []string{
-		"a-e",
-		"f-j",
-		"k-p",
-		"q-u",
-		"v-z",
+// DefaultKeyRanges are the shards, when not configured
+var DefaultKeyRanges = []string{
+	"a-e",
+	"f-j",
+	"k-p",
+	"q-u",
+	"v-z",
+}
+
+// WithShards sets the key ranges of the shards
+func (seeder *Seeder) WithShards(keyRanges []string) *Seeder {
+	seeder.keyRanges = keyRanges
+	return seeder
+}
+
+func (seeder *Seeder) Shards() []string {
+	if len(seeder.keyRanges) == 0 {
+		return DefaultKeyRanges
+	}
+
+	return seeder.keyRanges
+}
+
+const (
+	MinAliasLength = 4
+	MaxAliasLength = 12
+)
+
+var (
+	ErrAliasLength   = errors.New("alias_invalid_length")
+	ErrAliasStart    = errors.New("alias_must_start_with_letter")
+	ErrAliasCharset  = errors.New("alias_invalid_characters")
+	ErrAliasReserved = errors.New("alias_reserved")
+)
+
+// reservedAliases are paths already taken by the server
+var reservedAliases = map[string]bool{
+	"api":    true,
+	"images": true,
+}
+
+// ValidateAlias checks a vanity short key. Unlike the generated keys,
+// aliases are meant to be read by humans, so apart from the base58
+// alphabet, they can also use 0, o, O, i, I, l, - and _.
+// The first character has to be a letter, because that is what
+// the key range sharding is done on.
+func (seeder *Seeder) ValidateAlias(alias string) error {
+	if len(alias) < MinAliasLength || len(alias) > MaxAliasLength {
+		return ErrAliasLength
+	}
+
+	if !isLetter(rune(alias[0])) {
+		return ErrAliasStart
+	}
+
+	for _, r := range alias {
+		if !isLetter(r) && !(r >= '0' && r <= '9') && r != '-' && r != '_' {
+			return ErrAliasCharset
+		}
 	}
+
+	if reservedAliases[strings.ToLower(alias)] {
+		return ErrAliasReserved
+	}
+
+	return nil
+}
+
+func isLetter(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
 }
@@ -69,3 +69,29 @@ func contains(slice []string, val string) bool {
 	}
 	return false
 }
+
+func Test_ValidateAlias(t *testing.T) {
+	seeder := RegisterUrlSeeder()
+
+	valid := []string{"spring-sale", "Launch_2024", "docs"}
+	for _, alias := range valid {
+		if err := seeder.ValidateAlias(alias); err != nil {
+			t.Errorf("expected alias %s to be valid, got %v", alias, err)
+		}
+	}
+
+	invalid := map[string]error{
+		"abc":               ErrAliasLength,
+		"a-very-long-alias": ErrAliasLength,
+		"1sale":             ErrAliasStart,
+		"-sale":             ErrAliasStart,
+		"sale/2024":         ErrAliasCharset,
+		"images":            ErrAliasReserved,
+	}
+
+	for alias, expected := range invalid {
+		if err := seeder.ValidateAlias(alias); err != expected {
+			t.Errorf("alias %s, expected %v, got %v", alias, expected, err)
+		}
+	}
+}
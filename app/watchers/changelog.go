@@ -0,0 +1,129 @@
+package watchers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-batteries/shortner/app/db"
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/rs/zerolog/log"
+)
+
+// ChangelogShipper moves the changelog of the shards to the target,
+// in segments of upto segmentSize changes. The shipped changes are
+// removed from the shards. A segment which was put, but not marked
+// as shipped, is shipped again, restore skips the repeated changes.
+type ChangelogShipper struct {
+	database *db.SqliteCoordinator[string]
+	target   BackupTarget
+
+	interval    time.Duration
+	segmentSize int
+
+	done chan struct{}
+}
+
+func NewChangelogShipper(database *db.SqliteCoordinator[string], target BackupTarget, interval time.Duration, segmentSize int) *ChangelogShipper {
+	return &ChangelogShipper{
+		database:    database,
+		target:      target,
+		interval:    interval,
+		segmentSize: segmentSize,
+		done:        make(chan struct{}),
+	}
+}
+
+// Done is closed, once Run has shipped what was
+// left, after the context is cancelled.
+func (s *ChangelogShipper) Done() <-chan struct{} {
+	return s.done
+}
+
+func (s *ChangelogShipper) Run(ctx context.Context) {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// the writes which came in till the shutdown
+			cx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			s.Ship(cx)
+			cancel()
+
+			return
+		case <-ticker.C:
+			s.Ship(ctx)
+		}
+	}
+}
+
+// Ship ships everything which is in the changelog of the shards
+func (s *ChangelogShipper) Ship(ctx context.Context) error {
+	shards, ok := s.database.GetShards()
+	if !ok {
+		return fmt.Errorf("no shards to ship")
+	}
+
+	var errr error
+
+	for _, shard := range shards {
+		shipped, err := s.shipShard(ctx, shard)
+		if err != nil {
+			log.Error().Err(err).Str("shard", shard.ID()).Msg("failed to ship changelog")
+			errr = fmt.Errorf("failed to ship %s. %v", shard.ID(), err)
+		}
+
+		if shipped > 0 {
+			log.Debug().Str("shard", shard.ID()).Int("changes", shipped).Msg("shipped changelog")
+		}
+	}
+
+	return errr
+}
+
+func (s *ChangelogShipper) shipShard(ctx context.Context, shard db.Shard[string]) (int, error) {
+	repo := models.NewChangelogRepo(shard.ID(), shard.Conn())
+
+	state, err := repo.State(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	shipped := 0
+
+	for {
+		entries, err := repo.Read(ctx, state.Shipped, s.segmentSize)
+		if err != nil || len(entries) == 0 {
+			return shipped, err
+		}
+
+		segment := &models.Segment{
+			ShardID:  shard.ID(),
+			Timeline: state.Timeline,
+			First:    entries[0].Seq,
+			Last:     entries[len(entries)-1].Seq,
+		}
+
+		var body bytes.Buffer
+
+		if err := models.WriteSegment(&body, entries); err != nil {
+			return shipped, err
+		}
+
+		if err := s.target.Put(ctx, segment.Key(), bytes.NewReader(body.Bytes())); err != nil {
+			return shipped, err
+		}
+
+		if err := repo.MarkShipped(ctx, segment.Last); err != nil {
+			return shipped, err
+		}
+
+		state.Shipped = segment.Last
+		shipped += len(entries)
+	}
+}
@@ -0,0 +1,148 @@
+package watchers
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/rs/zerolog/log"
+)
+
+// CountryResolver maps an ip to a country code.
+type CountryResolver interface {
+	Country(ip string) string
+}
+
+// StubCountryResolver doesn't have a geoip database,
+// it only knows about local addresses.
+type StubCountryResolver struct{}
+
+func (StubCountryResolver) Country(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ""
+	}
+
+	if addr.IsLoopback() || addr.IsPrivate() {
+		return "LOCAL"
+	}
+
+	return ""
+}
+
+type ClickRecorderOpts struct {
+	BufferSize    int
+	BatchSize     int
+	FlushInterval time.Duration
+}
+
+func DefaultClickRecorderOpts() *ClickRecorderOpts {
+	return &ClickRecorderOpts{
+		BufferSize:    10000,
+		BatchSize:     500,
+		FlushInterval: 5 * time.Second,
+	}
+}
+
+// ClickRecorder buffers click events in memory, and writes them
+// in batches, so that the redirects don't wait on the database.
+// When the buffer is full, the events are dropped.
+type ClickRecorder struct {
+	repo     *models.ClickRepo
+	resolver CountryResolver
+	opts     *ClickRecorderOpts
+
+	events  chan *models.Click
+	done    chan struct{}
+	dropped atomic.Int64
+}
+
+func NewClickRecorder(repo *models.ClickRepo, resolver CountryResolver, opts *ClickRecorderOpts) *ClickRecorder {
+	return &ClickRecorder{
+		repo:     repo,
+		resolver: resolver,
+		opts:     opts,
+		events:   make(chan *models.Click, opts.BufferSize),
+		done:     make(chan struct{}),
+	}
+}
+
+// Record never blocks. It returns false if the event was dropped.
+func (r *ClickRecorder) Record(click *models.Click) bool {
+	select {
+	case r.events <- click:
+		return true
+	default:
+		r.dropped.Add(1)
+		return false
+	}
+}
+
+func (r *ClickRecorder) Dropped() int64 {
+	return r.dropped.Load()
+}
+
+// Done is closed, once Run has flushed the
+// pending events after the context is cancelled.
+func (r *ClickRecorder) Done() <-chan struct{} {
+	return r.done
+}
+
+func (r *ClickRecorder) Run(ctx context.Context) {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*models.Click, 0, r.opts.BatchSize)
+
+	for {
+		select {
+		case <-ctx.Done():
+			// drain whatever is left in the buffer
+			for {
+				select {
+				case click := <-r.events:
+					batch = append(batch, click)
+				default:
+					r.flush(batch)
+					return
+				}
+			}
+		case click := <-r.events:
+			batch = append(batch, click)
+
+			if len(batch) >= r.opts.BatchSize {
+				r.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			r.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+func (r *ClickRecorder) flush(batch []*models.Click) {
+	if len(batch) == 0 {
+		return
+	}
+
+	for _, click := range batch {
+		click.Country = r.resolver.Country(click.IP)
+	}
+
+	// the parent context is cancelled on shutdown
+	// and we still want the last batch to go through
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := r.repo.CreateBatches(ctx, batch); err != nil {
+		log.Error().Err(err).Int("clicks", len(batch)).Msg("failed to flush clicks")
+		return
+	}
+
+	log.Debug().Int("clicks", len(batch)).Msg("flushed clicks")
+}
@@ -0,0 +1,97 @@
+package watchers_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-batteries/shortner/app/db"
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/go-batteries/shortner/app/watchers"
+)
+
+// sqliteShards is a coordinator of a single a-z shard, in a temp dir
+func sqliteShards(t *testing.T) *db.SqliteCoordinator[string] {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "db_a_z")
+
+	database := db.NewSqliteCoordinator([]string{"a-z"})
+	database.ToDbName = func(string) string { return path }
+
+	if err := database.RegisterShards(context.Background()); err != nil {
+		t.Fatalf("failed to create shard %v", err)
+	}
+	t.Cleanup(database.DeInit)
+
+	shards, _ := database.GetShards()
+	database.SetPolicy(&db.KeyOrRoundRobinPolicy[string]{
+		Keyed: &db.KeyBasedPolicy[string]{Shards: db.ShardsByKeyRange([]string{"a-z"}, shards)},
+		Robin: &db.RoundRobinPolicy[string]{Shards: shards},
+	})
+
+	return database
+}
+
+func totalClicks(t *testing.T, repo *models.ClickRepo, shortKey string) int64 {
+	t.Helper()
+
+	stats, err := repo.Stats(context.Background(), shortKey, time.Now().UTC().AddDate(0, 0, -1))
+	if err != nil {
+		t.Fatalf("failed to get stats %v", err)
+	}
+
+	return stats.Total
+}
+
+func Test_ClickRecorder(t *testing.T) {
+	repo := models.NewClickRepo(sqliteShards(t))
+
+	recorder := watchers.NewClickRecorder(repo, watchers.StubCountryResolver{}, &watchers.ClickRecorderOpts{
+		BufferSize:    3,
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+	})
+
+	// nothing reads the buffer yet, the fourth is dropped, not blocked on
+	for i := 0; i < 3; i++ {
+		if !recorder.Record(&models.Click{ShortKey: "sale", ClickedAt: time.Now().UTC(), IP: "127.0.0.1"}) {
+			t.Fatalf("expected click %d to be buffered", i)
+		}
+	}
+
+	if recorder.Record(&models.Click{ShortKey: "sale", ClickedAt: time.Now().UTC()}) || recorder.Dropped() != 1 {
+		t.Fatalf("expected a full buffer to drop the click, dropped %d", recorder.Dropped())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go recorder.Run(ctx)
+
+	// a full batch is written without waiting on the interval
+	deadline := time.Now().Add(5 * time.Second)
+	for totalClicks(t, repo, "sale") < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a batch of 2 to be flushed")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if n := totalClicks(t, repo, "sale"); n != 2 {
+		t.Fatalf("expected only the full batch to be flushed, got %d", n)
+	}
+
+	// the partial batch is written on shutdown
+	cancel()
+
+	select {
+	case <-recorder.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the recorder to stop")
+	}
+
+	if n := totalClicks(t, repo, "sale"); n != 3 {
+		t.Fatalf("expected the pending click to be drained, got %d", n)
+	}
+}
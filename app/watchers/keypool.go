@@ -0,0 +1,214 @@
+package watchers
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-batteries/shortner/app/db"
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/rs/zerolog/log"
+)
+
+type KeyPoolOpts struct {
+	// Size is the most keys held at a time
+	Size int
+	// BlockSize is the keys leased from a shard at a time
+	BlockSize int
+	// LowWater is when the pool is filled again
+	LowWater int
+
+	LeaseTTL       time.Duration
+	RefillInterval time.Duration
+}
+
+func DefaultKeyPoolOpts() *KeyPoolOpts {
+	return &KeyPoolOpts{
+		Size:           2000,
+		BlockSize:      500,
+		LowWater:       1000,
+		LeaseTTL:       10 * time.Minute,
+		RefillInterval: time.Second,
+	}
+}
+
+// KeyPool leases blocks of free keys from the shards, round robin, so
+// that a new link doesn't have to look for one. The leased keys are
+// skipped by everything else, till the lease expires. Keys close to
+// their expiry aren't handed out, and the ones left are released
+// when Run stops.
+type KeyPool struct {
+	database *db.SqliteCoordinator[string]
+	repo     *models.URLRepo
+	opts     *KeyPoolOpts
+
+	keys    chan *models.KeyLease
+	refill  chan struct{}
+	done    chan struct{}
+	next    int
+	expired atomic.Int64
+}
+
+func NewKeyPool(database *db.SqliteCoordinator[string], opts *KeyPoolOpts) *KeyPool {
+	return &KeyPool{
+		database: database,
+		repo:     models.NewURLRepo(database),
+		opts:     opts,
+		keys:     make(chan *models.KeyLease, opts.Size),
+		refill:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// Done is closed, once Run has released the keys
+// left, after the context is cancelled.
+func (p *KeyPool) Done() <-chan struct{} {
+	return p.done
+}
+
+// Expired is the count of keys dropped, as their lease ran out
+func (p *KeyPool) Expired() int64 {
+	return p.expired.Load()
+}
+
+// Take never blocks. It returns false if the pool is empty.
+func (p *KeyPool) Take() (*models.KeyLease, bool) {
+	// a key has to be assigned well before its lease runs out
+	deadline := time.Now().Add(p.opts.LeaseTTL / 10)
+
+	for {
+		select {
+		case lease := <-p.keys:
+			if lease.Expired(deadline) {
+				p.expired.Add(1)
+				continue
+			}
+
+			if len(p.keys) < p.opts.LowWater {
+				p.signal()
+			}
+
+			return lease, true
+		default:
+			p.signal()
+			return nil, false
+		}
+	}
+}
+
+func (p *KeyPool) signal() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+func (p *KeyPool) Run(ctx context.Context) {
+	defer close(p.done)
+
+	ticker := time.NewTicker(p.opts.RefillInterval)
+	defer ticker.Stop()
+
+	p.fill(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			cx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			p.release(cx)
+			cancel()
+
+			return
+		case <-ticker.C:
+			p.fill(ctx)
+		case <-p.refill:
+			p.fill(ctx)
+		}
+	}
+}
+
+// fill leases blocks, a shard after another, till the pool is above
+// the low water mark, or a round of the shards had no free keys.
+func (p *KeyPool) fill(ctx context.Context) {
+	shards, ok := p.database.GetShards()
+	if !ok || len(shards) == 0 {
+		return
+	}
+
+	empty := 0
+
+	for len(p.keys) < p.opts.LowWater && empty < len(shards) {
+		shard := shards[p.next%len(shards)]
+		p.next++
+
+		n := min(p.opts.BlockSize, cap(p.keys)-len(p.keys))
+
+		leases, err := models.LeaseKeys(ctx, shard.Conn(), n, time.Now().Add(p.opts.LeaseTTL))
+		if err != nil {
+			log.Error().Err(err).Str("shard", shard.ID()).Msg("failed to lease keys")
+		}
+
+		if len(leases) == 0 {
+			empty++
+			continue
+		}
+
+		empty = 0
+
+		for _, lease := range leases {
+			p.keys <- lease
+		}
+
+		log.Debug().Str("shard", shard.ID()).Int("keys", len(leases)).Msg("leased keys")
+	}
+}
+
+func (p *KeyPool) release(ctx context.Context) {
+	leases := []*models.KeyLease{}
+
+drain:
+	for {
+		select {
+		case lease := <-p.keys:
+			leases = append(leases, lease)
+		default:
+			break drain
+		}
+	}
+
+	released, err := p.repo.ReleaseLeases(ctx, leases)
+	if err != nil {
+		log.Error().Err(err).Int("released", released).Msg("failed to release leased keys, they are free once the lease expires")
+		return
+	}
+
+	log.Info().Int("released", released).Msg("released leased keys")
+}
+
+// PooledStore assigns the new links the keys of the pool, and falls
+// back to the store, when the pool has none ready.
+type PooledStore struct {
+	models.Store
+	pool *KeyPool
+}
+
+func NewPooledStore(store models.Store, pool *KeyPool) *PooledStore {
+	return &PooledStore{Store: store, pool: pool}
+}
+
+func (store *PooledStore) AssignURL(ctx context.Context, urlStr string, opts ...models.WithAssignOpts) (*models.URL, error) {
+	for {
+		lease, ok := store.pool.Take()
+		if !ok {
+			return store.Store.AssignURL(ctx, urlStr, opts...)
+		}
+
+		u, err := store.pool.repo.AssignLeasedKey(ctx, lease, urlStr, opts...)
+		if errors.Is(err, models.ErrKeyTaken) {
+			continue
+		}
+
+		return u, err
+	}
+}
@@ -0,0 +1,152 @@
+package watchers_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-batteries/shortner/app/db"
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/go-batteries/shortner/app/watchers"
+)
+
+// seededShards is sqliteShards, with n free keys
+func seededShards(t *testing.T, n int) *db.SqliteCoordinator[string] {
+	t.Helper()
+
+	database := sqliteShards(t)
+
+	now := time.Now().UTC()
+	free := []*models.URL{}
+
+	for i := 0; i < n; i++ {
+		free = append(free, &models.URL{ShortKey: fmt.Sprintf("k%03d", i), CreatedAt: now, UpdatedAt: now})
+	}
+
+	if err := models.NewURLRepo(database).CreateBatches(context.Background(), free); err != nil {
+		t.Fatalf("failed to seed keys %v", err)
+	}
+
+	return database
+}
+
+// waitLeased waits for the free keys under a live lease to be n
+func waitLeased(t *testing.T, database *db.SqliteCoordinator[string], n int) {
+	t.Helper()
+
+	shards, _ := database.GetShards()
+	deadline := time.Now().Add(5 * time.Second)
+
+	var leased int
+
+	for time.Now().Before(deadline) {
+		err := shards[0].Conn().QueryRow(`SELECT COUNT(1) FROM urls WHERE url IS NULL AND leased_until > ?`, time.Now().UnixMilli()).Scan(&leased)
+		if err != nil {
+			t.Fatalf("failed to count leased keys %v", err)
+		}
+
+		if leased == n {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("expected %d leased keys, got %d", n, leased)
+}
+
+func Test_KeyPool(t *testing.T) {
+	database := seededShards(t, 20)
+
+	opts := watchers.DefaultKeyPoolOpts()
+	opts.Size = 4
+	opts.BlockSize = 2
+	opts.LowWater = 3
+	opts.RefillInterval = time.Hour
+
+	pool := watchers.NewKeyPool(database, opts)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go pool.Run(ctx)
+
+	// blocks are leased till the pool is above the low water mark
+	waitLeased(t, database, 4)
+
+	store := watchers.NewPooledStore(models.NewURLRepo(database), pool)
+
+	u, err := store.AssignURL(context.Background(), "https://github.com")
+	if err != nil {
+		t.Fatalf("failed to assign url %v", err)
+	}
+
+	lease, ok := pool.Take()
+	if !ok || lease.ShortKey == u.ShortKey {
+		t.Fatalf("expected another key in the pool, got %+v", lease)
+	}
+
+	// the pool went under the low water mark, 2 in the pool,
+	// another block of 2 is leased, and one is held by the test
+	waitLeased(t, database, 5)
+
+	cancel()
+	<-pool.Done()
+
+	// the keys left in the pool are free again, but not the held one
+	waitLeased(t, database, 1)
+
+	if pool.Expired() != 0 {
+		t.Fatalf("expected no lease to expire, got %d", pool.Expired())
+	}
+}
+
+func Test_KeyPoolExpiredLeases(t *testing.T) {
+	database := seededShards(t, 20)
+
+	opts := watchers.DefaultKeyPoolOpts()
+	opts.Size = 4
+	opts.BlockSize = 4
+	opts.LowWater = 1
+	opts.LeaseTTL = 200 * time.Millisecond
+	opts.RefillInterval = time.Hour
+
+	pool := watchers.NewKeyPool(database, opts)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		<-pool.Done()
+	}()
+
+	go pool.Run(ctx)
+
+	waitLeased(t, database, 4)
+
+	// the leases are about to run out, none of them can be handed out
+	time.Sleep(opts.LeaseTTL - opts.LeaseTTL/20)
+
+	if lease, ok := pool.Take(); ok {
+		t.Fatalf("expected the leases close to their expiry to be skipped, got %+v", lease)
+	}
+
+	if pool.Expired() != 4 {
+		t.Fatalf("expected the 4 leases to be dropped, got %d", pool.Expired())
+	}
+
+	// the empty pool is filled again
+	deadline := time.Now().Add(5 * time.Second)
+
+	for time.Now().Before(deadline) {
+		if lease, ok := pool.Take(); ok {
+			if lease.Expired(time.Now()) {
+				t.Fatalf("expected a live lease, got %+v", lease)
+			}
+
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("expected the pool to be filled again")
+}
@@ -0,0 +1,140 @@
+package watchers
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/rs/zerolog/log"
+)
+
+// moderationBatch is the most decisions, or invalidations, read at a time
+const moderationBatch = 500
+
+// invalidationsTrimInterval is how often the old invalidations are trimmed
+const invalidationsTrimInterval = time.Minute
+
+// ModerationWatcher polls the decisions and the invalidations recorded
+// in the coordinator db, and drops the links they changed from the
+// cache. It's how a link marked malicious, deleted or retargeted by
+// another server, or the cli, stops redirecting here, without waiting
+// for the cache ttl.
+type ModerationWatcher struct {
+	reports       *models.ReportRepo
+	invalidations *models.InvalidationRepo
+	cache         *models.LinkCache
+	interval      time.Duration
+
+	lastID             int64
+	lastInvalidationID int64
+	trimmedAt          time.Time
+}
+
+// NewModerationWatcher starts after the last decision and invalidation,
+// the ones before them were made before anything was cached.
+func NewModerationWatcher(ctx context.Context, reports *models.ReportRepo, invalidations *models.InvalidationRepo, cache *models.LinkCache, interval time.Duration) (*ModerationWatcher, error) {
+	lastID, err := reports.LastDecisionID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	lastInvalidationID, err := invalidations.LastID(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ModerationWatcher{
+		reports:            reports,
+		invalidations:      invalidations,
+		cache:              cache,
+		interval:           interval,
+		lastID:             lastID,
+		lastInvalidationID: lastInvalidationID,
+		trimmedAt:          time.Now(),
+	}, nil
+}
+
+func (w *ModerationWatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.check(ctx)
+			w.checkInvalidations(ctx)
+			w.trim(ctx)
+		}
+	}
+}
+
+func (w *ModerationWatcher) check(ctx context.Context) {
+	for {
+		decisions, err := w.reports.DecisionsAfter(ctx, w.lastID, moderationBatch)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to read the decisions")
+			return
+		}
+
+		shortKeys := []string{}
+
+		for _, decision := range decisions {
+			if decision.Action != models.ActionDismiss {
+				shortKeys = append(shortKeys, decision.ShortKey)
+			}
+
+			w.lastID = decision.ID
+		}
+
+		if len(shortKeys) > 0 {
+			w.cache.Invalidate(shortKeys...)
+			log.Debug().Strs("short_keys", shortKeys).Msg("dropped the moderated links from the cache")
+		}
+
+		if len(decisions) < moderationBatch {
+			return
+		}
+	}
+}
+
+func (w *ModerationWatcher) checkInvalidations(ctx context.Context) {
+	for {
+		invalidations, err := w.invalidations.After(ctx, w.lastInvalidationID, moderationBatch)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to read the invalidations")
+			return
+		}
+
+		shortKeys := make([]string, 0, len(invalidations))
+
+		for _, invalidation := range invalidations {
+			shortKeys = append(shortKeys, invalidation.ShortKey)
+			w.lastInvalidationID = invalidation.ID
+		}
+
+		if len(shortKeys) > 0 {
+			w.cache.Invalidate(shortKeys...)
+			log.Debug().Strs("short_keys", shortKeys).Msg("dropped the links changed elsewhere from the cache")
+		}
+
+		if len(invalidations) < moderationBatch {
+			return
+		}
+	}
+}
+
+// trim is run by every server. An invalidation older than the
+// retention was read by the servers up, and is past the cache ttl.
+func (w *ModerationWatcher) trim(ctx context.Context) {
+	if time.Since(w.trimmedAt) < invalidationsTrimInterval {
+		return
+	}
+
+	w.trimmedAt = time.Now()
+
+	if _, err := w.invalidations.Trim(ctx, time.Now().UTC().Add(-models.InvalidationRetention)); err != nil {
+		log.Error().Err(err).Msg("failed to trim the invalidations")
+	}
+}
@@ -0,0 +1,241 @@
+package watchers_test
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/go-batteries/shortner/app/runners"
+	"github.com/go-batteries/shortner/app/watchers"
+)
+
+// coordinatorDB is a migrated coordinator db
+func coordinatorDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	ctx := context.Background()
+
+	database := sqliteShards(t)
+	database.CoordinatorPath = filepath.Join(t.TempDir(), "coordinator.db")
+
+	cdb, err := database.ConnectCoordinatorDB(ctx)
+	if err != nil {
+		t.Fatalf("failed to open coordinator %v", err)
+	}
+	t.Cleanup(func() { cdb.Close() })
+
+	if err := database.MigrateCoordinator(ctx); err != nil {
+		t.Fatalf("failed to migrate coordinator %v", err)
+	}
+
+	return cdb
+}
+
+// fakeMemcached serves the gets, set and add of the text protocol,
+// the expirations are ignored. It returns the address to dial.
+func fakeMemcached(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	var mu sync.Mutex
+	items := map[string][]byte{}
+
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+
+		rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+		for {
+			line, err := rw.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+
+			switch fields[0] {
+			case "gets", "get":
+				mu.Lock()
+				for _, key := range fields[1:] {
+					if value, ok := items[key]; ok {
+						fmt.Fprintf(rw, "VALUE %s 0 %d 1\r\n%s\r\n", key, len(value), value)
+					}
+				}
+				mu.Unlock()
+
+				rw.WriteString("END\r\n")
+			case "set", "add":
+				size, _ := strconv.Atoi(fields[4])
+
+				value := make([]byte, size+2)
+				if _, err := io.ReadFull(rw, value); err != nil {
+					return
+				}
+
+				mu.Lock()
+				_, exists := items[fields[1]]
+				if fields[0] == "set" || !exists {
+					items[fields[1]] = value[:size]
+					rw.WriteString("STORED\r\n")
+				} else {
+					rw.WriteString("NOT_STORED\r\n")
+				}
+				mu.Unlock()
+			default:
+				rw.WriteString("ERROR\r\n")
+			}
+
+			rw.Flush()
+		}
+	}
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+
+			go serve(conn)
+		}
+	}()
+
+	return ln.Addr().String()
+}
+
+func Test_ModerationWatcher(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cdb := coordinatorDB(t)
+	reports := models.NewReportRepo(cdb)
+	memory := models.NewMemoryStore()
+
+	if _, err := memory.AssignAlias(ctx, "phish", "https://phish.example.com"); err != nil {
+		t.Fatalf("failed to assign alias %v", err)
+	}
+
+	// this server caches the link
+	cache := models.NewLinkCache(models.DefaultLinkCacheOpts(), nil)
+	cached := models.NewCachedStore(memory, cache)
+
+	watcher, err := watchers.NewModerationWatcher(ctx, reports, models.NewInvalidationRepo(cdb), cache, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to create watcher %v", err)
+	}
+	go watcher.Run(ctx)
+
+	if _, err := cached.Find(ctx, "phish"); err != nil {
+		t.Fatalf("expected the link to resolve, got %v", err)
+	}
+
+	// another server, or the cli, marks it malicious
+	decision := &models.LinkDecision{ShortKey: "phish", Action: models.ActionMalicious, DecidedBy: "admin"}
+	if err := runners.NewModerator(memory, reports).Decide(ctx, decision, models.AnyGeneration); err != nil {
+		t.Fatalf("failed to decide %v", err)
+	}
+
+	waitFor(t, func() bool {
+		_, err := cached.Find(ctx, "phish")
+		return errors.Is(err, models.ErrLinkMalicious)
+	}, "expected the cached link to be dropped, once the decision was picked up")
+}
+
+func Test_ModerationWatcherInvalidations(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	cdb := coordinatorDB(t)
+	invalidations := models.NewInvalidationRepo(cdb)
+	memory := models.NewMemoryStore()
+
+	for _, alias := range []string{"docs", "blog"} {
+		if _, err := memory.AssignAlias(ctx, alias, "https://example.com/"+alias, models.WithOwner("acc_1")); err != nil {
+			t.Fatalf("failed to assign alias %v", err)
+		}
+	}
+
+	// two servers, sharing memcached
+	addr := fakeMemcached(t)
+
+	this := models.NewLinkCache(models.DefaultLinkCacheOpts(), memcache.New(addr))
+	other := models.NewLinkCache(models.DefaultLinkCacheOpts(), memcache.New(addr))
+
+	reads := models.NewCachedStore(memory, this)
+
+	writes := models.NewCachedStore(memory, other)
+	writes.Broadcaster = invalidations
+
+	watcher, err := watchers.NewModerationWatcher(ctx, models.NewReportRepo(cdb), invalidations, this, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("failed to create watcher %v", err)
+	}
+
+	for _, alias := range []string{"docs", "blog"} {
+		if _, err := reads.Find(ctx, alias); err != nil {
+			t.Fatalf("expected %s to resolve, got %v", alias, err)
+		}
+	}
+
+	// the other server changes the links, it only clears
+	// memcached and its memory, this one still has them
+	if _, err := writes.Retarget(ctx, "acc_1", "docs", "https://example.com/moved", models.AnyGeneration); err != nil {
+		t.Fatalf("failed to retarget %v", err)
+	}
+
+	if err := writes.Delete(ctx, "acc_1", "blog", models.AnyGeneration); err != nil {
+		t.Fatalf("failed to delete %v", err)
+	}
+
+	if u, err := reads.Find(ctx, "docs"); err != nil || *u.Link != "https%3A%2F%2Fexample.com%2Fdocs" {
+		t.Fatalf("expected the link to be served from memory, before the watcher runs, got %v", err)
+	}
+
+	go watcher.Run(ctx)
+
+	waitFor(t, func() bool {
+		u, err := reads.Find(ctx, "docs")
+		return err == nil && *u.Link == url.QueryEscape("https://example.com/moved")
+	}, "expected the retargeted link to be dropped, once the invalidation was picked up")
+
+	waitFor(t, func() bool {
+		_, err := reads.Find(ctx, "blog")
+		return errors.Is(err, models.ErrLinkNotFound)
+	}, "expected the deleted link to be dropped, once the invalidation was picked up")
+
+	// the ids go on after a trim, so the watchers don't miss the next ones
+	last, _ := invalidations.LastID(ctx)
+
+	if trimmed, err := invalidations.Trim(ctx, time.Now().UTC().Add(time.Minute)); err != nil || trimmed != 2 {
+		t.Fatalf("expected the 2 invalidations to be trimmed, got %d. %v", trimmed, err)
+	}
+
+	if err := invalidations.Broadcast(ctx, "docs"); err != nil {
+		t.Fatalf("failed to broadcast %v", err)
+	}
+
+	if next, err := invalidations.After(ctx, last, 10); err != nil || len(next) != 1 {
+		t.Fatalf("expected the invalidation after the trim to be read, got %v. %v", next, err)
+	}
+}
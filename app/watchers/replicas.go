@@ -0,0 +1,72 @@
+package watchers
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-batteries/shortner/app/db"
+	"github.com/rs/zerolog/log"
+)
+
+// ReplicaMonitor beats on the primaries through the write connections,
+// and health checks the replicas of the read connections against them.
+// Replicas which fail, or fall behind, stop being read from, till they
+// catch up again.
+type ReplicaMonitor struct {
+	primaries *db.SqliteCoordinator[string]
+	readers   *db.SqliteCoordinator[string]
+
+	interval time.Duration
+	maxLag   time.Duration
+
+	healthy map[string]bool
+}
+
+func NewReplicaMonitor(primaries, readers *db.SqliteCoordinator[string], interval, maxLag time.Duration) *ReplicaMonitor {
+	return &ReplicaMonitor{
+		primaries: primaries,
+		readers:   readers,
+		interval:  interval,
+		maxLag:    maxLag,
+		healthy:   map[string]bool{},
+	}
+}
+
+// Run checks right away, the replicas aren't read from till they pass
+func (m *ReplicaMonitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		m.check(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check only logs the replicas which went in or out of the rotation
+func (m *ReplicaMonitor) check(ctx context.Context) {
+	if err := m.primaries.Heartbeat(ctx); err != nil {
+		log.Error().Err(err).Msg("failed to write replica heartbeat")
+	}
+
+	for _, status := range m.readers.CheckReplicas(ctx, m.maxLag) {
+		was, seen := m.healthy[status.Path]
+		m.healthy[status.Path] = status.Healthy
+
+		if seen && was == status.Healthy {
+			continue
+		}
+
+		if status.Healthy {
+			log.Info().Str("shard", status.Shard).Str("replica", status.Path).Str("lag", status.Lag).Msg("replica is in rotation")
+			continue
+		}
+
+		log.Warn().Str("shard", status.Shard).Str("replica", status.Path).Str("error", status.Error).Msg("replica is out of rotation")
+	}
+}
@@ -0,0 +1,307 @@
+package watchers
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-batteries/shortner/app/config"
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/rs/zerolog/log"
+)
+
+// ScannerName is who the decisions of the scanner are by
+const ScannerName = "scanner"
+
+// URLScanner finds the issues with a url, config.URLChecker is one.
+// ValidateURL is expected to be fast, ScanURL can take a while.
+type URLScanner interface {
+	ValidateURL(inputURL string) ([]config.Issue, error)
+	ScanURL(inputURL string) ([]config.Issue, error)
+	Score(issues []config.Issue) int
+}
+
+// Decider applies a decision on a link, runners.Moderator is one.
+type Decider interface {
+	Decide(ctx context.Context, decision *models.LinkDecision, generation int64) error
+}
+
+type ScannerOpts struct {
+	Workers int
+	// QueueSize is the most links waiting for a worker
+	QueueSize int
+	// Threshold is the score of the issues, at which
+	// a link is marked malicious
+	Threshold int
+	// RescanAfter is how old a scan gets, before the link is
+	// scanned again. 0 only scans the links never scanned.
+	RescanAfter time.Duration
+	// PollInterval is how often the store is asked for
+	// the links due, BatchSize of them at most.
+	PollInterval time.Duration
+	BatchSize    int
+}
+
+func DefaultScannerOpts() *ScannerOpts {
+	return &ScannerOpts{
+		Workers:      2,
+		QueueSize:    1000,
+		Threshold:    4,
+		RescanAfter:  7 * 24 * time.Hour,
+		PollInterval: time.Minute,
+		BatchSize:    200,
+	}
+}
+
+type scanJob struct {
+	shortKey   string
+	link       string
+	generation int64
+}
+
+// Scanner runs the slow checks of the links in the background, so that
+// creating a link doesn't wait on the host it points to. The new links
+// are enqueued as they are created, and the store is polled for the
+// ones which were missed, like the bulk ones or the ones dropped on a
+// full queue, and for the ones due a rescan.
+//
+// A link scoring Threshold, or more, is marked malicious, with
+// a decision by the scanner, unless a reviewer cleared it last.
+type Scanner struct {
+	store   models.Store
+	checker URLScanner
+	reports *models.ReportRepo
+	decider Decider
+	opts    *ScannerOpts
+
+	jobs chan *scanJob
+	done chan struct{}
+
+	mu     sync.Mutex
+	queued map[string]bool
+
+	dropped atomic.Int64
+	flagged atomic.Int64
+}
+
+func NewScanner(store models.Store, checker URLScanner, reports *models.ReportRepo, decider Decider, opts *ScannerOpts) *Scanner {
+	return &Scanner{
+		store:   store,
+		checker: checker,
+		reports: reports,
+		decider: decider,
+		opts:    opts,
+		jobs:    make(chan *scanJob, opts.QueueSize),
+		done:    make(chan struct{}),
+		queued:  map[string]bool{},
+	}
+}
+
+// Done is closed, once Run has waited for
+// the scans in flight to finish.
+func (s *Scanner) Done() <-chan struct{} {
+	return s.done
+}
+
+// Dropped is the count of links not enqueued, as the queue was full.
+// They are scanned once the poll comes across them.
+func (s *Scanner) Dropped() int64 {
+	return s.dropped.Load()
+}
+
+// Flagged is the count of links marked malicious
+func (s *Scanner) Flagged() int64 {
+	return s.flagged.Load()
+}
+
+// Enqueue never blocks. link is the url as given, not query escaped.
+// It returns false if the link was dropped.
+func (s *Scanner) Enqueue(shortKey string, link string, generation int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.queued[shortKey] {
+		return true
+	}
+
+	select {
+	case s.jobs <- &scanJob{shortKey: shortKey, link: link, generation: generation}:
+		s.queued[shortKey] = true
+		return true
+	default:
+		s.dropped.Add(1)
+		return false
+	}
+}
+
+func (s *Scanner) Run(ctx context.Context) {
+	defer close(s.done)
+
+	var wg sync.WaitGroup
+
+	for w := 0; w < s.opts.Workers; w++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-s.jobs:
+					s.scan(ctx, job)
+
+					s.mu.Lock()
+					delete(s.queued, job.shortKey)
+					s.mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(s.opts.PollInterval)
+	defer ticker.Stop()
+
+	s.poll(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			// the links left in the queue aren't marked as
+			// scanned, the next start picks them up again
+			wg.Wait()
+			return
+		case <-ticker.C:
+			s.poll(ctx)
+		}
+	}
+}
+
+// poll enqueues the links due, upto the room left in the queue
+func (s *Scanner) poll(ctx context.Context) {
+	room := min(s.opts.BatchSize, cap(s.jobs)-len(s.jobs))
+	if room < 1 {
+		return
+	}
+
+	var before time.Time
+	if s.opts.RescanAfter > 0 {
+		before = time.Now().UTC().Add(-s.opts.RescanAfter)
+	}
+
+	urls, err := s.store.ScanDue(ctx, before, room)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to find the links to scan")
+		return
+	}
+
+	for _, u := range urls {
+		link, err := url.QueryUnescape(*u.Link)
+		if err != nil {
+			link = *u.Link
+		}
+
+		if !s.Enqueue(u.ShortKey, link, u.Generation) {
+			break
+		}
+	}
+
+	if len(urls) > 0 {
+		log.Debug().Int("links", len(urls)).Msg("enqueued links to scan")
+	}
+}
+
+func (s *Scanner) scan(ctx context.Context, job *scanJob) {
+	issues, err := s.checker.ValidateURL(job.link)
+	if err == nil {
+		var more []config.Issue
+
+		more, err = s.checker.ScanURL(job.link)
+		issues = append(issues, more...)
+	}
+
+	score := s.checker.Score(issues)
+
+	// not a url at all, it got past the inline checks somehow
+	if err != nil {
+		score = max(score, s.opts.Threshold)
+	}
+
+	if score >= s.opts.Threshold {
+		flagged, err := s.flag(ctx, job, issues)
+		if err != nil {
+			// left unmarked, so that the next poll retries it
+			log.Error().Err(err).Str("shortKey", job.shortKey).Msg("failed to mark scanned link malicious")
+			return
+		}
+
+		if flagged {
+			return
+		}
+	}
+
+	if err := s.store.MarkScanned(ctx, job.shortKey, score, job.generation); err != nil {
+		log.Error().Err(err).Str("shortKey", job.shortKey).Msg("failed to record the scan")
+		return
+	}
+
+	log.Debug().Str("shortKey", job.shortKey).Int("score", score).Msg("scanned link")
+}
+
+// flag marks the link malicious. It returns false, if a reviewer
+// cleared the link last, at the generation it was scanned at, or
+// the link changed since it was enqueued. A link retargeted after
+// the clear is another link, the clear doesn't hold for it.
+func (s *Scanner) flag(ctx context.Context, job *scanJob, issues []config.Issue) (bool, error) {
+	latest, err := s.reports.LatestDecision(ctx, job.shortKey)
+	if err != nil {
+		return false, err
+	}
+
+	// the clears from before the generation was recorded hold
+	cleared := latest != nil && latest.Action == models.ActionClear &&
+		(latest.Generation == models.AnyGeneration || latest.Generation == job.generation)
+
+	if cleared {
+		log.Info().
+			Str("shortKey", job.shortKey).
+			Str("clearedBy", latest.DecidedBy).
+			Strs("issues", config.IssueStrings(issues)).
+			Msg("scanned link was cleared by a reviewer, not marking it")
+
+		return false, nil
+	}
+
+	decision := &models.LinkDecision{
+		ShortKey:  job.shortKey,
+		Action:    models.ActionMalicious,
+		Note:      strings.Join(config.IssueStrings(issues), "; "),
+		DecidedBy: ScannerName,
+	}
+
+	err = s.decider.Decide(ctx, decision, job.generation)
+
+	var conflict *models.GenerationConflict
+	if errors.As(err, &conflict) || errors.Is(err, models.ErrLinkNotFound) {
+		log.Debug().Str("shortKey", job.shortKey).Msg("scanned link changed since, skipping")
+		return true, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	s.flagged.Add(1)
+
+	log.Warn().
+		Str("shortKey", job.shortKey).
+		Strs("issues", config.IssueStrings(issues)).
+		Msg("marked scanned link malicious")
+
+	return true, nil
+}
@@ -0,0 +1,154 @@
+package watchers_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-batteries/shortner/app/config"
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/go-batteries/shortner/app/runners"
+	"github.com/go-batteries/shortner/app/watchers"
+)
+
+// fakeScanner finds the issues of a link in a map, each weighs 1
+type fakeScanner struct {
+	issues map[string][]string
+}
+
+func (s *fakeScanner) ValidateURL(inputURL string) ([]config.Issue, error) {
+	return nil, nil
+}
+
+func (s *fakeScanner) ScanURL(inputURL string) ([]config.Issue, error) {
+	issues := []config.Issue{}
+
+	for _, reason := range s.issues[inputURL] {
+		issues = append(issues, config.Issue{Reason: reason, Weight: 1})
+	}
+
+	return issues, nil
+}
+
+func (s *fakeScanner) Score(issues []config.Issue) int {
+	return len(issues)
+}
+
+func waitFor(t *testing.T, done func() bool, msg string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for time.Now().Before(deadline) {
+		if done() {
+			return
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("timed out, %s", msg)
+}
+
+func Test_ScannerEnqueue(t *testing.T) {
+	opts := watchers.DefaultScannerOpts()
+	opts.QueueSize = 2
+
+	scanner := watchers.NewScanner(models.NewMemoryStore(), &fakeScanner{}, nil, nil, opts)
+
+	for _, shortKey := range []string{"a", "b", "a"} {
+		if !scanner.Enqueue(shortKey, "https://example.com/"+shortKey, 1) {
+			t.Fatalf("expected %s to be enqueued", shortKey)
+		}
+	}
+
+	// the queued link wasn't enqueued twice, so the queue is full now
+	if scanner.Enqueue("c", "https://example.com/c", 1) || scanner.Dropped() != 1 {
+		t.Fatalf("expected the link to be dropped on a full queue, got %d dropped", scanner.Dropped())
+	}
+}
+
+func Test_Scanner(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	store := models.NewMemoryStore()
+	reports := models.NewReportRepo(coordinatorDB(t))
+	moderator := runners.NewModerator(store, reports)
+
+	checker := &fakeScanner{issues: map[string][]string{
+		"https://safe.example.com":        {"new domain"},
+		"https://phish.example.com":       {"new domain", "blocklisted"},
+		"https://phish.example.com/again": {"new domain", "blocklisted"},
+	}}
+
+	for alias, link := range map[string]string{"safe": "https://safe.example.com", "phish": "https://phish.example.com"} {
+		if _, err := store.AssignAlias(ctx, alias, link, models.WithOwner("acc_1")); err != nil {
+			t.Fatalf("failed to assign alias %v", err)
+		}
+	}
+
+	opts := watchers.DefaultScannerOpts()
+	opts.Threshold = 2
+	opts.PollInterval = time.Hour
+
+	scanner := watchers.NewScanner(store, checker, reports, moderator, opts)
+
+	defer func() {
+		cancel()
+		<-scanner.Done()
+	}()
+
+	// the first poll enqueues the links never scanned
+	go scanner.Run(ctx)
+
+	unscanned := func() bool {
+		due, err := store.ScanDue(ctx, time.Time{}, 10)
+		return err == nil && len(due) == 0
+	}
+
+	waitFor(t, unscanned, "expected the links to be scanned")
+
+	if _, err := store.Find(ctx, "safe"); err != nil {
+		t.Fatalf("expected the link under the threshold to resolve, got %v", err)
+	}
+
+	if _, err := store.Find(ctx, "phish"); !errors.Is(err, models.ErrLinkMalicious) || scanner.Flagged() != 1 {
+		t.Fatalf("expected the link over the threshold to be marked malicious, got %v", err)
+	}
+
+	// a reviewer clears it, the rescan of the cleared link leaves it be
+	clear := &models.LinkDecision{ShortKey: "phish", Action: models.ActionClear, DecidedBy: "admin"}
+	if err := moderator.Decide(ctx, clear, models.AnyGeneration); err != nil {
+		t.Fatalf("failed to clear %v", err)
+	}
+
+	latest, err := reports.LatestDecision(ctx, "phish")
+	if err != nil || latest.Generation != clear.Generation || latest.Generation == models.AnyGeneration {
+		t.Fatalf("expected the clear to record the generation, got %+v. %v", latest, err)
+	}
+
+	scanner.Enqueue("phish", "https://phish.example.com", clear.Generation)
+	waitFor(t, unscanned, "expected the cleared link to be scanned")
+
+	if _, err := store.Find(ctx, "phish"); err != nil || scanner.Flagged() != 1 {
+		t.Fatalf("expected the clear to hold, got %v", err)
+	}
+
+	// the cleared link is retargeted, the clear doesn't hold anymore
+	u, err := store.Retarget(ctx, "acc_1", "phish", "https://phish.example.com/again", models.AnyGeneration)
+	if err != nil {
+		t.Fatalf("failed to retarget %v", err)
+	}
+
+	scanner.Enqueue("phish", "https://phish.example.com/again", u.Generation)
+
+	waitFor(t, func() bool {
+		_, err := store.Find(ctx, "phish")
+		return errors.Is(err, models.ErrLinkMalicious)
+	}, "expected the retargeted link to be marked malicious")
+
+	if scanner.Flagged() != 2 {
+		t.Fatalf("expected 2 links flagged, got %d", scanner.Flagged())
+	}
+}
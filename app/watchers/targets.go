@@ -0,0 +1,255 @@
+package watchers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// GCSEndpoint is the s3 compatible api of google cloud storage,
+// it takes HMAC keys, in place of the aws keys.
+const GCSEndpoint = "https://storage.googleapis.com"
+
+// BackupTarget is where the snapshots and the changelog are shipped.
+// The keys are slash separated, and List returns them sorted.
+type BackupTarget interface {
+	Put(ctx context.Context, key string, body io.ReadSeeker) error
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	List(ctx context.Context, prefix string) ([]string, error)
+	Delete(ctx context.Context, key string) error
+}
+
+// S3Options are for the s3 compatible targets. Endpoint is
+// for the ones which aren't aws, like minio.
+type S3Options struct {
+	Region    string
+	AccessKey string
+	SecretKey string
+	Endpoint  string
+}
+
+// NewBackupTarget picks the target by dest. s3://bucket/prefix is s3,
+// or whatever opts.Endpoint points to, gs://bucket/prefix is google
+// cloud storage, and anything else is a local directory.
+func NewBackupTarget(ctx context.Context, dest string, opts S3Options) (BackupTarget, error) {
+	if dest == "" {
+		return nil, errors.New("no destination to ship to")
+	}
+
+	scheme, bucketPath, ok := strings.Cut(dest, "://")
+	if !ok {
+		return NewDirTarget(dest), nil
+	}
+
+	switch scheme {
+	case "s3":
+	case "gs":
+		opts.Endpoint = GCSEndpoint
+		if opts.Region == "" {
+			opts.Region = "auto"
+		}
+	default:
+		return nil, fmt.Errorf("unsupported destination %s, expected s3://, gs:// or a directory", dest)
+	}
+
+	bucket, prefix, _ := strings.Cut(bucketPath, "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("invalid destination %s, expected %s://bucket/prefix", dest, scheme)
+	}
+
+	return NewS3Target(ctx, bucket, prefix, opts)
+}
+
+// DirTarget keeps the objects as files under Root. It stands
+// in for a bucket, and works for a mounted volume of another host.
+type DirTarget struct {
+	Root string
+}
+
+func NewDirTarget(root string) *DirTarget {
+	return &DirTarget{Root: root}
+}
+
+func (t *DirTarget) path(key string) string {
+	return filepath.Join(t.Root, filepath.FromSlash(key))
+}
+
+// Put writes to a temporary file first, so that
+// a partial object is never listed.
+func (t *DirTarget) Put(ctx context.Context, key string, body io.ReadSeeker) error {
+	dst := t.path(key)
+
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".put-*")
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), dst)
+}
+
+func (t *DirTarget) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(t.path(key))
+}
+
+func (t *DirTarget) List(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+
+	err := filepath.WalkDir(t.Root, func(p string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".put-") {
+			return err
+		}
+
+		rel, err := filepath.Rel(t.Root, p)
+		if err != nil {
+			return err
+		}
+
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+
+		return nil
+	})
+
+	sort.Strings(keys)
+	return keys, err
+}
+
+func (t *DirTarget) Delete(ctx context.Context, key string) error {
+	err := os.Remove(t.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// S3Target works with aws, and the s3 compatible stores
+type S3Target struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+func NewS3Target(ctx context.Context, bucket string, prefix string, opts S3Options) (*S3Target, error) {
+	loadOpts := []func(*config.LoadOptions) error{config.WithRegion(opts.Region)}
+
+	if opts.AccessKey != "" && opts.SecretKey != "" {
+		loadOpts = append(loadOpts, config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(opts.AccessKey, opts.SecretKey, ""),
+		))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, loadOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load SDK config, %v", err)
+	}
+
+	client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		if opts.Endpoint != "" {
+			o.BaseEndpoint = aws.String(opts.Endpoint)
+			o.UsePathStyle = true
+		}
+	})
+
+	return &S3Target{
+		client: client,
+		bucket: bucket,
+		prefix: strings.Trim(prefix, "/"),
+	}, nil
+}
+
+func (t *S3Target) key(key string) string {
+	return path.Join(t.prefix, key)
+}
+
+func (t *S3Target) Put(ctx context.Context, key string, body io.ReadSeeker) error {
+	_, err := t.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(t.bucket),
+		Key:    aws.String(t.key(key)),
+		Body:   body,
+	})
+
+	return err
+}
+
+func (t *S3Target) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := t.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(t.bucket),
+		Key:    aws.String(t.key(key)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Body, nil
+}
+
+func (t *S3Target) List(ctx context.Context, prefix string) ([]string, error) {
+	keys := []string{}
+
+	// the keys are returned relative to the prefix of the target
+	root := ""
+	if t.prefix != "" {
+		root = t.prefix + "/"
+	}
+
+	paginator := s3.NewListObjectsV2Paginator(t.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(t.bucket),
+		Prefix: aws.String(root + prefix),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range page.Contents {
+			keys = append(keys, strings.TrimPrefix(aws.ToString(object.Key), root))
+		}
+	}
+
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (t *S3Target) Delete(ctx context.Context, key string) error {
+	_, err := t.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(t.bucket),
+		Key:    aws.String(t.key(key)),
+	})
+
+	return err
+}
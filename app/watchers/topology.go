@@ -0,0 +1,81 @@
+package watchers
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/rs/zerolog/log"
+)
+
+// TopologyReloader switches something over to the new topology.
+// It should be safe to call again, with the same topology.
+type TopologyReloader func(ctx context.Context, topology *models.Topology) error
+
+// TopologyWatcher polls the topology recorded in the coordinator
+// db, which is how a reshard reaches the running servers.
+// When it changes, all the reloaders are called with it.
+type TopologyWatcher struct {
+	repo     *models.TopologyRepo
+	interval time.Duration
+
+	current   *models.Topology
+	reloaders []TopologyReloader
+}
+
+func NewTopologyWatcher(repo *models.TopologyRepo, current *models.Topology, interval time.Duration) *TopologyWatcher {
+	return &TopologyWatcher{
+		repo:     repo,
+		interval: interval,
+		current:  current,
+	}
+}
+
+// OnChange adds a reloader. Not concurrent safe, call before Run.
+func (w *TopologyWatcher) OnChange(reloader TopologyReloader) {
+	w.reloaders = append(w.reloaders, reloader)
+}
+
+func (w *TopologyWatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.check(ctx)
+		}
+	}
+}
+
+// check only moves to the new topology once all the reloaders
+// took it, otherwise they are all retried on the next tick.
+func (w *TopologyWatcher) check(ctx context.Context) {
+	recorded, err := w.repo.Load(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to load shard topology")
+		return
+	}
+
+	diffs := w.current.Diff(recorded)
+	if len(recorded.Shards) == 0 || len(diffs) == 0 {
+		return
+	}
+
+	recorded.KeepLocal(w.current)
+
+	log.Info().Str("changes", strings.Join(diffs, "; ")).Msg("shard topology changed, rerouting")
+
+	for _, reload := range w.reloaders {
+		if err := reload(ctx, recorded); err != nil {
+			log.Error().Err(err).Msg("failed to switch to the new shard topology")
+			return
+		}
+	}
+
+	w.current = recorded
+	log.Info().Strs("key_ranges", recorded.KeyRanges()).Msg("switched to the new shard topology")
+}
@@ -2,20 +2,27 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/bradfitz/gomemcache/memcache"
 	"github.com/go-batteries/shortner/app/config"
 	"github.com/go-batteries/shortner/app/db"
 	"github.com/go-batteries/shortner/app/models"
 	"github.com/go-batteries/shortner/app/runners"
 	"github.com/go-batteries/shortner/app/seed"
 	"github.com/go-batteries/shortner/app/watchers"
+	"github.com/go-batteries/slicendice"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
@@ -34,16 +41,18 @@ func (i *ArrayFlags) Set(value string) error {
 type SeedCmd struct {
 	fs          *flag.FlagSet
 	cmdName     string
+	cfg         *config.AppConfig
 	keyRange    string
 	shortKeyLen int
 	batchSize   int
 	seedSize    string
 }
 
-func NewSeedCmd() *SeedCmd {
+func NewSeedCmd(cfg *config.AppConfig) *SeedCmd {
 	cmd := &SeedCmd{
 		fs:      flag.NewFlagSet("seed", flag.ExitOnError),
 		cmdName: "seed",
+		cfg:     cfg,
 	}
 
 	return cmd
@@ -61,7 +70,7 @@ func (c *SeedCmd) SetArgs() {
 	}
 
 	c.fs.IntVar(&c.batchSize, "batches", 1000, "batch size for bulk insert")
-	c.fs.StringVar(&c.seedSize, "size", "12M", "count of keys to pre-populate per lower case letter in base58 scheme. Allowed values: K, M, B")
+	c.fs.StringVar(&c.seedSize, "size", c.cfg.SeedSize, "count of keys to pre-populate per lower case letter in base58 scheme. Allowed values: K, M, B")
 }
 
 func (c *SeedCmd) Run(ctx context.Context, args []string) {
@@ -70,7 +79,7 @@ func (c *SeedCmd) Run(ctx context.Context, args []string) {
 	}
 
 	seedSize := config.MustParseSeedSize(c.seedSize)
-	err := runners.SeedSqliteDB(ctx, c.shortKeyLen, c.batchSize, seedSize)
+	err := runners.SeedSqliteDB(ctx, seederFor(c.cfg), runners.TopologyFromConfig(c.cfg), c.shortKeyLen, c.batchSize, seedSize)
 	if err != nil {
 		log.Fatal().Msg("failed to seed database")
 	}
@@ -84,19 +93,19 @@ type ProbeCmd struct {
 	keyRange string
 	query    string
 
-	coord  *db.SqliteCoordinator[string]
-	seeder *seed.Seeder
+	coord    *db.SqliteCoordinator[string]
+	seeder   *seed.Seeder
+	topology *models.Topology
 }
 
-func NewProbCmd() *ProbeCmd {
+func NewProbCmd(cfg *config.AppConfig) *ProbeCmd {
 	cmd := &ProbeCmd{
 		fs:      flag.NewFlagSet("probe", flag.ExitOnError),
 		cmdName: "probe",
 	}
 
-	seeder := seed.RegisterUrlSeeder()
-
-	cmd.seeder = seeder
+	cmd.seeder = seederFor(cfg)
+	cmd.topology = runners.TopologyFromConfig(cfg)
 
 	return cmd
 }
@@ -116,7 +125,7 @@ func (c *ProbeCmd) Run(ctx context.Context, args []string) {
 		log.Fatal().Str("keyRange", c.keyRange).Msg("invalid key range. expected format start-end")
 	}
 
-	keyRanges := c.seeder.Shards(5)
+	keyRanges := c.seeder.Shards()
 
 	// this is an interval problem
 	// given keyranges, a-e, f-p, q-s
@@ -142,7 +151,15 @@ func (c *ProbeCmd) Run(ctx context.Context, args []string) {
 		c.query = models.URLKeysProberQuery
 	}
 
-	database := db.NewSqliteCoordinator(filteredRanges)
+	database := runners.NewTopologyCoordinator(c.topology)
+
+	if err := runners.VerifyTopology(ctx, database, c.topology, false); err != nil {
+		log.Fatal().Err(err).Msg("shard topology doesn't match")
+	}
+	defer database.CoordinatorDB.Close()
+
+	database = db.NewSqliteCoordinator(filteredRanges)
+	database.ToDbName = c.topology.DBName
 
 	err := database.ConnectShards(ctx, db.DBReadOnlyMode)
 	if err != nil {
@@ -181,45 +198,87 @@ func (c *ProbeCmd) Run(ctx context.Context, args []string) {
 type BackupCmd struct {
 	fs      *flag.FlagSet
 	cmdName string
+	cfg     *config.AppConfig
+
+	dest     string
+	keep     int
+	maxAge   time.Duration
+	compress bool
 }
 
-// BackupCmd to backup sqlite database
-// Depends on Keys in env
-func NewBackupCmd() *BackupCmd {
+// BackupCmd snapshots the shards and the coordinator, to a new
+// run on -dest, and deletes the runs past the retention.
+func NewBackupCmd(cfg *config.AppConfig) *BackupCmd {
 	return &BackupCmd{
 		fs:      flag.NewFlagSet("backup", flag.ExitOnError),
 		cmdName: "backup",
+		cfg:     cfg,
 	}
 }
 
-func (c *BackupCmd) SetArgs() {}
+func (c *BackupCmd) SetArgs() {
+	dest := c.cfg.BackupDest
+	if bucket := os.Getenv("BUCKET_NAME"); dest == "" && bucket != "" {
+		dest = "s3://" + bucket
+	}
+
+	c.fs.StringVar(&c.dest, "dest", dest, "where to put the snapshots. s3://bucket/prefix, gs://bucket/prefix or a directory")
+	c.fs.IntVar(&c.keep, "keep", c.cfg.BackupKeep, "complete runs to keep. 0 keeps all")
+	c.fs.DurationVar(&c.maxAge, "max_age", c.cfg.BackupMaxAge, "delete runs older than this, the latest is always kept. 0 keeps all")
+	c.fs.BoolVar(&c.compress, "compress", c.cfg.BackupCompress, "gzip the snapshots")
+}
 
 func (c *BackupCmd) Run(ctx context.Context, args []string) {
 	if err := c.fs.Parse(args); err != nil {
 		log.Fatal().Err(err).Msg("failed to parse arguments")
 	}
 
-	seeder := &seed.Seeder{}
-	syncer := watchers.NewDBSyncer(seeder.Shards(5))
+	topology := runners.TopologyFromConfig(c.cfg)
+
+	database := runners.NewTopologyCoordinator(topology)
+	if err := runners.VerifyTopology(ctx, database, topology, false); err != nil {
+		log.Fatal().Err(err).Msg("shard topology doesn't match")
+	}
+	database.CoordinatorDB.Close()
+
+	target, err := watchers.NewBackupTarget(ctx, c.dest, s3Options(c.cfg))
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid -dest")
+	}
+
 	cx, cancel := context.WithTimeout(ctx, 2*time.Hour)
 	defer cancel()
 
-	syncer.Run(cx)
+	manifest, expired, err := runners.BackupShards(cx, topology, target, &runners.BackupOpts{
+		Compress: c.compress,
+		Keep:     c.keep,
+		MaxAge:   c.maxAge,
+	})
+	if manifest == nil {
+		log.Fatal().Err(err).Msg("failed to back up")
+	}
+
+	log.Info().Str("run", manifest.ID).Int("files", len(manifest.Files)).Int("expired", len(expired)).Msg("backup complete")
 
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to delete expired backups")
+	}
 }
 
 type RefillCmd struct {
 	fs      *flag.FlagSet
 	cmdName string
+	cfg     *config.AppConfig
 
 	batchSize int
 	seedSize  string
 }
 
-func NewRefillCmd() *RefillCmd {
+func NewRefillCmd(cfg *config.AppConfig) *RefillCmd {
 	return &RefillCmd{
 		fs:      flag.NewFlagSet("refill", flag.ExitOnError),
 		cmdName: "refill",
+		cfg:     cfg,
 	}
 }
 
@@ -233,10 +292,11 @@ func (c *RefillCmd) Run(ctx context.Context, args []string) error {
 		log.Fatal().Err(err).Msg("invalid cli args for refill")
 	}
 
+	requireShardLinks(c.cfg, "refill")
+
 	seedSize := config.MustParseSeedSize(c.seedSize, "100K")
-	seeder := &seed.Seeder{}
 
-	err := runners.RefillKeys(ctx, seeder, c.batchSize, seedSize)
+	err := runners.RefillKeys(ctx, seederFor(c.cfg), runners.TopologyFromConfig(c.cfg), c.cfg.FillThreshold, c.batchSize, seedSize)
 	if err != nil {
 		log.Fatal().Err(err).Msg("failed to repopulate database")
 	}
@@ -244,10 +304,989 @@ func (c *RefillCmd) Run(ctx context.Context, args []string) error {
 	return err
 }
 
+type SweepCmd struct {
+	fs      *flag.FlagSet
+	cmdName string
+	cfg     *config.AppConfig
+
+	recycle  bool
+	coolDown time.Duration
+}
+
+// SweepCmd tombstones expired links. With -recycle the keys of
+// the deleted and expired links are put back to use, after the
+// cool down.
+func NewSweepCmd(cfg *config.AppConfig) *SweepCmd {
+	return &SweepCmd{
+		fs:      flag.NewFlagSet("sweep", flag.ExitOnError),
+		cmdName: "sweep",
+		cfg:     cfg,
+	}
+}
+
+func (c *SweepCmd) SetArgs() {
+	c.fs.BoolVar(&c.recycle, "recycle", false, "put the keys of deleted and expired links back in the free pool, after -cool_down")
+	c.fs.DurationVar(&c.coolDown, "cool_down", c.cfg.KeyRecycleAfter, "how long the deleted and expired links are kept, before their keys are recycled")
+}
+
+func (c *SweepCmd) Run(ctx context.Context, args []string) error {
+	if err := c.fs.Parse(args); err != nil {
+		log.Fatal().Err(err).Msg("invalid cli args for sweep")
+	}
+
+	requireShardLinks(c.cfg, "sweep")
+
+	err := runners.SweepExpiredKeys(ctx, runners.TopologyFromConfig(c.cfg), c.recycle, c.coolDown)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to sweep expired keys")
+	}
+
+	return err
+}
+
+type KeysCmd struct {
+	cmdName string
+	cfg     *config.AppConfig
+
+	createFs *flag.FlagSet
+	revokeFs *flag.FlagSet
+	listFs   *flag.FlagSet
+	adoptFs  *flag.FlagSet
+
+	account     string
+	scopes      string
+	keyID       string
+	legacyKey   string
+	legacyOwner string
+}
+
+// KeysCmd manages the api keys in the coordinator db.
+// keys create|revoke|list|adopt
+func NewKeysCmd(cfg *config.AppConfig) *KeysCmd {
+	return &KeysCmd{
+		cmdName:  "keys",
+		cfg:      cfg,
+		createFs: flag.NewFlagSet("keys create", flag.ExitOnError),
+		revokeFs: flag.NewFlagSet("keys revoke", flag.ExitOnError),
+		listFs:   flag.NewFlagSet("keys list", flag.ExitOnError),
+		adoptFs:  flag.NewFlagSet("keys adopt", flag.ExitOnError),
+	}
+}
+
+func (c *KeysCmd) SetArgs() {
+	c.createFs.StringVar(&c.account, "account", "", "name of the account, created if it doesn't exist")
+	c.createFs.StringVar(&c.scopes, "scopes", "links:read,links:write", "comma separated scopes. links:read, links:write, admin")
+
+	c.revokeFs.StringVar(&c.keyID, "id", "", "id of the key to revoke, as shown by keys list")
+
+	c.listFs.StringVar(&c.account, "account", "", "only list keys of the account")
+
+	c.adoptFs.StringVar(&c.account, "account", "", "name of the account to move the links to")
+	c.adoptFs.StringVar(&c.legacyKey, "legacy-key", "", "AuthKey the links were created with, before the accounts")
+	c.adoptFs.StringVar(&c.legacyOwner, "legacy-owner", "", "owner_id of the links, the sha256 of the AuthKey, if the key isn't known")
+}
+
+func (c *KeysCmd) Run(ctx context.Context, args []string) {
+	if len(args) < 1 {
+		log.Fatal().Msg("expected one of create, revoke, list, adopt")
+	}
+
+	database := db.NewSqliteCoordinator([]string{})
+	database.CoordinatorPath = c.cfg.CoordinatorPath
+
+	cdb, err := database.ConnectCoordinatorDB(ctx)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to connect to coordinator db")
+	}
+	defer cdb.Close()
+
+	if err := database.MigrateCoordinator(ctx); err != nil {
+		log.Fatal().Err(err).Msg("failed to migrate coordinator db")
+	}
+
+	repo := models.NewAccountRepo(cdb)
+
+	switch args[0] {
+	case "create":
+		if err := c.createFs.Parse(args[1:]); err != nil {
+			log.Fatal().Err(err).Msg("invalid cli args for keys create")
+		}
+
+		if c.account == "" {
+			log.Fatal().Msg("-account is required")
+		}
+
+		scopes, err := models.ParseScopes(c.scopes)
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid scopes")
+		}
+
+		account, err := repo.FindOrCreate(ctx, c.account)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to create account")
+		}
+
+		rawKey, key, err := repo.CreateKey(ctx, account, scopes)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to create key")
+		}
+
+		fmt.Printf("account: %s (%s)\nkey id: %s\nscopes: %v\n\n%s\n\nthe key is not stored, keep it safe.\n",
+			account.Name, account.ID, key.ID, key.Scopes, rawKey)
+	case "revoke":
+		if err := c.revokeFs.Parse(args[1:]); err != nil {
+			log.Fatal().Err(err).Msg("invalid cli args for keys revoke")
+		}
+
+		if err := repo.RevokeKey(ctx, c.keyID); err != nil {
+			log.Fatal().Err(err).Str("id", c.keyID).Msg("failed to revoke key")
+		}
+
+		log.Info().Str("id", c.keyID).Msg("revoked key")
+	case "list":
+		if err := c.listFs.Parse(args[1:]); err != nil {
+			log.Fatal().Err(err).Msg("invalid cli args for keys list")
+		}
+
+		keys, err := repo.ListKeys(ctx, c.account)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to list keys")
+		}
+
+		for _, key := range keys {
+			status := "active"
+			if key.RevokedAt != nil {
+				status = "revoked " + key.RevokedAt.Format(time.RFC3339)
+			}
+
+			fmt.Printf("%s\t%s\t%s\t%s\t%s\n",
+				key.ID, key.AccountName, strings.Join(key.Scopes, ","), key.CreatedAt.Format(time.RFC3339), status)
+		}
+	case "adopt":
+		if err := c.adoptFs.Parse(args[1:]); err != nil {
+			log.Fatal().Err(err).Msg("invalid cli args for keys adopt")
+		}
+
+		legacyOwner := c.legacyOwner
+		if c.legacyKey != "" {
+			legacyOwner = models.LegacyOwnerID(c.legacyKey)
+		}
+
+		if c.account == "" || legacyOwner == "" {
+			log.Fatal().Msg("-account, and one of -legacy-key or -legacy-owner are required")
+		}
+
+		account, err := repo.FindByName(ctx, c.account)
+		if err != nil {
+			log.Fatal().Err(err).Str("account", c.account).Msg("failed to find account, create a key for it first")
+		}
+
+		var reassigner runners.OwnerReassigner
+		if store := storeFor(ctx, c.cfg, "adopted"); store != nil {
+			reassigner = store.(runners.OwnerReassigner)
+		}
+
+		moved, err := runners.AdoptLegacyLinks(ctx, runners.TopologyFromConfig(c.cfg), reassigner, legacyOwner, account.ID)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to adopt the legacy links")
+		}
+
+		log.Info().Str("account", account.ID).Int64("links", moved).Msg("moved the legacy links to the account")
+	default:
+		log.Fatal().Msgf("invalid keys command %s, expected one of create, revoke, list, adopt", args[0])
+	}
+}
+
+type ReportsCmd struct {
+	cmdName string
+	cfg     *config.AppConfig
+
+	queueFs  *flag.FlagSet
+	showFs   *flag.FlagSet
+	decideFs *flag.FlagSet
+
+	limit      int
+	shortKey   string
+	action     string
+	note       string
+	decidedBy  string
+	generation int64
+}
+
+// ReportsCmd is the review queue of the reported links.
+// reports queue|show|decide
+func NewReportsCmd(cfg *config.AppConfig) *ReportsCmd {
+	return &ReportsCmd{
+		cmdName:  "reports",
+		cfg:      cfg,
+		queueFs:  flag.NewFlagSet("reports queue", flag.ExitOnError),
+		showFs:   flag.NewFlagSet("reports show", flag.ExitOnError),
+		decideFs: flag.NewFlagSet("reports decide", flag.ExitOnError),
+	}
+}
+
+func (c *ReportsCmd) SetArgs() {
+	c.queueFs.IntVar(&c.limit, "limit", models.DefaultListLimit, "most links to list, the most reported first")
+
+	c.showFs.StringVar(&c.shortKey, "key", "", "short key of the link, to show its reports and decisions")
+
+	reviewer := os.Getenv("USER")
+	if reviewer == "" {
+		reviewer = "cli"
+	}
+
+	c.decideFs.StringVar(&c.shortKey, "key", "", "short key of the link to decide on")
+	c.decideFs.StringVar(&c.action, "action", "", "one of "+strings.Join(models.ReviewActions, ", "))
+	c.decideFs.StringVar(&c.note, "note", "", "why, kept in the history of the link")
+	c.decideFs.StringVar(&c.decidedBy, "by", reviewer, "name of the reviewer")
+	c.decideFs.Int64Var(&c.generation, "generation", models.AnyGeneration, "only decide if the link is still at the generation. 0 to skip the check")
+}
+
+// storeFor is nil for sqlite, the shards of the topology are used.
+// The memory store is of the server, the cli can't change its links.
+func storeFor(ctx context.Context, cfg *config.AppConfig, verb string) models.Store {
+	switch cfg.StoreDriver {
+	case "", models.StoreDriverSqlite:
+		return nil
+	case models.StoreDriverPostgres:
+		store, err := models.ConnectPostgresStore(ctx, cfg.StoreDSN)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to connect to postgres store")
+		}
+
+		return store
+	}
+
+	log.Fatal().Str("driver", cfg.StoreDriver).Msgf("links of the store driver can't be %s from the cli", verb)
+	return nil
+}
+
+// requireShardLinks stops the commands which only work on the links
+// in the shards. With the other drivers, the shards have the clicks.
+func requireShardLinks(cfg *config.AppConfig, command string) {
+	switch cfg.StoreDriver {
+	case "", models.StoreDriverSqlite:
+		return
+	}
+
+	log.Fatal().Str("driver", cfg.StoreDriver).Msgf("links of the store driver aren't in the shards, %s only works with sqlite", command)
+}
+
+func (c *ReportsCmd) Run(ctx context.Context, args []string) {
+	if len(args) < 1 {
+		log.Fatal().Msg("expected one of queue, show, decide")
+	}
+
+	var store models.Store
+
+	if args[0] == "decide" {
+		store = storeFor(ctx, c.cfg, "moderated")
+	}
+
+	moderator, reports, done, err := runners.OpenModeration(ctx, runners.TopologyFromConfig(c.cfg), store)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to open the shards")
+	}
+	defer done()
+
+	switch args[0] {
+	case "queue":
+		if err := c.queueFs.Parse(args[1:]); err != nil {
+			log.Fatal().Err(err).Msg("invalid cli args for reports queue")
+		}
+
+		items, err := reports.Queue(ctx, c.limit)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to list the review queue")
+		}
+
+		for _, item := range items {
+			fmt.Printf("%s\t%d reports\t%s\t%s\t%s\t%d decisions\n",
+				item.ShortKey, item.Reports, strings.Join(item.Reasons, ","),
+				item.FirstAt.Format(time.RFC3339), item.LastAt.Format(time.RFC3339), item.Decisions)
+		}
+	case "show":
+		if err := c.showFs.Parse(args[1:]); err != nil {
+			log.Fatal().Err(err).Msg("invalid cli args for reports show")
+		}
+
+		if c.shortKey == "" {
+			log.Fatal().Msg("-key is required")
+		}
+
+		history, err := reports.History(ctx, c.shortKey)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to get the report history")
+		}
+
+		for _, report := range history.Reports {
+			fmt.Printf("report\t%d\t%s\t%s\t%s\t%s\t%s\n",
+				report.ID, report.CreatedAt.Format(time.RFC3339), report.Status, report.Reason, report.Reporter, report.Details)
+		}
+
+		for _, decision := range history.Decisions {
+			fmt.Printf("decision\t%d\t%s\t%s\t%s\t%d reports\t%s\n",
+				decision.ID, decision.CreatedAt.Format(time.RFC3339), decision.Action, decision.DecidedBy, decision.Reports, decision.Note)
+		}
+	case "decide":
+		if err := c.decideFs.Parse(args[1:]); err != nil {
+			log.Fatal().Err(err).Msg("invalid cli args for reports decide")
+		}
+
+		if c.shortKey == "" || c.action == "" {
+			log.Fatal().Msg("-key and -action are required")
+		}
+
+		decision := &models.LinkDecision{
+			ShortKey:  c.shortKey,
+			Action:    c.action,
+			Note:      c.note,
+			DecidedBy: c.decidedBy,
+		}
+
+		if err := moderator.Decide(ctx, decision, c.generation); err != nil {
+			log.Fatal().Err(err).Str("shortKey", c.shortKey).Msg("failed to decide")
+		}
+
+		// the servers share memcached, they drop the copies they hold
+		// in memory, when they pick up the decision from the coordinator
+		if len(c.cfg.CacheAddrs) > 0 {
+			models.NewLinkCache(models.DefaultLinkCacheOpts(), memcache.New(c.cfg.CacheAddrs...)).Invalidate(c.shortKey)
+		}
+
+		cachedFor := c.cfg.ModerationInterval
+		if cachedFor == 0 {
+			cachedFor = models.DefaultLinkCacheTTL
+		}
+
+		log.Info().
+			Str("shortKey", decision.ShortKey).
+			Str("action", decision.Action).
+			Int64("reports", decision.Reports).
+			Dur("cached_for", cachedFor).
+			Msg("decided, the servers stop serving their cached copy of the link within cached_for")
+	default:
+		log.Fatal().Msgf("invalid reports command %s, expected one of queue, show, decide", args[0])
+	}
+}
+
+type ImportCmd struct {
+	fs      *flag.FlagSet
+	cmdName string
+	cfg     *config.AppConfig
+
+	filePath  string
+	account   string
+	batchSize int
+}
+
+// ImportCmd shortens the links in a csv file of url[,alias]
+// and prints the result of each row as csv.
+func NewImportCmd(cfg *config.AppConfig) *ImportCmd {
+	return &ImportCmd{
+		fs:      flag.NewFlagSet("import", flag.ExitOnError),
+		cmdName: "import",
+		cfg:     cfg,
+	}
+}
+
+func (c *ImportCmd) SetArgs() {
+	c.fs.StringVar(&c.filePath, "file", "", "csv file with url[,alias] rows")
+	c.fs.StringVar(&c.account, "account", "", "name of the account owning the links")
+	c.fs.IntVar(&c.batchSize, "batch", runners.DefaultBulkBatchSize, "number of keys to reserve per transaction")
+}
+
+func (c *ImportCmd) Run(ctx context.Context, args []string) {
+	if err := c.fs.Parse(args); err != nil {
+		log.Fatal().Err(err).Msg("invalid cli args for import")
+	}
+
+	requireShardLinks(c.cfg, "import")
+
+	if c.filePath == "" {
+		log.Fatal().Msg("-file is required")
+	}
+
+	checker, err := config.LoadURLChecker(c.cfg.URLChecker)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load the url checker")
+	}
+
+	err = runners.ImportLinks(ctx, runners.TopologyFromConfig(c.cfg), checker, c.filePath, c.account, c.batchSize, os.Stdout)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to import links")
+	}
+}
+
+type ExportCmd struct {
+	fs      *flag.FlagSet
+	cmdName string
+	cfg     *config.AppConfig
+
+	format     string
+	outPath    string
+	checkpoint string
+	from       string
+	to         string
+	status     string
+	keyRange   string
+	pageSize   int
+}
+
+// ExportCmd dumps the assigned keys of all the shards
+func NewExportCmd(cfg *config.AppConfig) *ExportCmd {
+	return &ExportCmd{
+		fs:      flag.NewFlagSet("export", flag.ExitOnError),
+		cmdName: "export",
+		cfg:     cfg,
+	}
+}
+
+func (c *ExportCmd) SetArgs() {
+	c.fs.StringVar(&c.format, "format", runners.ExportFormatCSV, "output format. csv, jsonl or columnar")
+	c.fs.StringVar(&c.outPath, "out", "", "output file. defaults to stdout")
+	c.fs.StringVar(&c.checkpoint, "checkpoint", "", "file to track progress in. an existing checkpoint resumes the export")
+	c.fs.StringVar(&c.from, "from", "", "only links created at or after. 2006-01-02 or RFC3339")
+	c.fs.StringVar(&c.to, "to", "", "only links created before. 2006-01-02 or RFC3339")
+	c.fs.StringVar(&c.status, "status", models.ExportStatusAll, "all, active, deleted or malicious")
+	c.fs.StringVar(&c.keyRange, "keyrange", "", "only keys starting with characters in the range, like a-e")
+	c.fs.IntVar(&c.pageSize, "page", runners.DefaultExportPageSize, "rows read per shard query, and between checkpoints")
+}
+
+func parseExportTime(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return &t, nil
+		}
+	}
+
+	return nil, fmt.Errorf("invalid time %s. expected 2006-01-02 or RFC3339", value)
+}
+
+func (c *ExportCmd) Run(ctx context.Context, args []string) {
+	if err := c.fs.Parse(args); err != nil {
+		log.Fatal().Err(err).Msg("invalid cli args for export")
+	}
+
+	requireShardLinks(c.cfg, "export")
+
+	filter := &models.ExportFilter{Status: c.status}
+
+	switch c.status {
+	case models.ExportStatusAll, models.ExportStatusActive, models.ExportStatusDeleted, models.ExportStatusMalicious:
+	default:
+		log.Fatal().Str("status", c.status).Msg("invalid status")
+	}
+
+	var err error
+
+	if filter.CreatedFrom, err = parseExportTime(c.from); err != nil {
+		log.Fatal().Err(err).Msg("invalid -from")
+	}
+
+	if filter.CreatedTo, err = parseExportTime(c.to); err != nil {
+		log.Fatal().Err(err).Msg("invalid -to")
+	}
+
+	if c.keyRange != "" {
+		start, end, ok := models.ExplodeKeyRange(c.keyRange)
+		if !ok {
+			log.Fatal().Str("keyRange", c.keyRange).Msg("invalid key range. expected format start-end")
+		}
+
+		filter.KeyStart, filter.KeyEnd = start, end
+	}
+
+	err = runners.ExportLinks(ctx, runners.TopologyFromConfig(c.cfg), &runners.ExportOpts{
+		Format:     c.format,
+		OutPath:    c.outPath,
+		PageSize:   c.pageSize,
+		Filter:     filter,
+		Checkpoint: c.checkpoint,
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to export links")
+	}
+}
+
+type ReshardCmd struct {
+	fs      *flag.FlagSet
+	cmdName string
+	cfg     *config.AppConfig
+
+	from      string
+	into      string
+	paths     string
+	batchSize int
+	grace     time.Duration
+}
+
+// ReshardCmd splits a key range into new shard files, while
+// the servers are running. It prints the config to use from
+// then on, since the servers check it against the new topology
+// when they restart.
+func NewReshardCmd(cfg *config.AppConfig) *ReshardCmd {
+	return &ReshardCmd{
+		fs:      flag.NewFlagSet("reshard", flag.ExitOnError),
+		cmdName: "reshard",
+		cfg:     cfg,
+	}
+}
+
+func (c *ReshardCmd) SetArgs() {
+	c.fs.StringVar(&c.from, "from", "", "key range to split, like a-e")
+	c.fs.StringVar(&c.into, "into", "", "comma separated key ranges to split into, like a-c,d-e. the first keeps the db file")
+	c.fs.StringVar(&c.paths, "paths", "", "comma separated key_range=file.db for the new shards. defaults to db_<start>_<end>.db")
+	c.fs.IntVar(&c.batchSize, "batch", runners.DefaultReshardBatchSize, "rows copied per statement")
+	c.fs.DurationVar(&c.grace, "grace", 2*c.cfg.ReloadInterval+time.Second, "time the running servers get to switch, before the moved rows are removed")
+}
+
+func (c *ReshardCmd) Run(ctx context.Context, args []string) {
+	if err := c.fs.Parse(args); err != nil {
+		log.Fatal().Err(err).Msg("invalid cli args for reshard")
+	}
+
+	requireShardLinks(c.cfg, "reshard")
+
+	if c.from == "" || c.into == "" {
+		log.Fatal().Msg("-from and -into are required")
+	}
+
+	paths := map[string]string{}
+
+	for _, pair := range strings.Split(c.paths, ",") {
+		if pair == "" {
+			continue
+		}
+
+		keyRange, path, ok := strings.Cut(pair, "=")
+		if !ok {
+			log.Fatal().Str("path", pair).Msg("expected key_range=file.db")
+		}
+
+		paths[strings.TrimSpace(keyRange)] = strings.TrimSpace(path)
+	}
+
+	topology := runners.TopologyFromConfig(c.cfg)
+
+	split, stats, err := runners.Reshard(ctx, topology, &runners.ReshardOpts{
+		From:      c.from,
+		Into:      strings.Split(c.into, ","),
+		Paths:     paths,
+		BatchSize: c.batchSize,
+		Grace:     c.grace,
+	})
+
+	if split != nil {
+		log.Info().Msg("update the config to the one below, before restarting anything")
+
+		if err := config.Print(os.Stdout, runners.ConfigForTopology(c.cfg, split), config.PrintFormatTOML); err != nil {
+			log.Error().Err(err).Msg("failed to print config")
+		}
+	}
+
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to reshard")
+	}
+
+	for _, stat := range stats {
+		log.Info().
+			Str("key_range", stat.KeyRange).
+			Int64("free_keys", stat.FreeKeys).
+			Int64("links", stat.Links).
+			Int64("clicks", stat.Clicks).
+			Int64("caught_up", stat.CaughtUp).
+			Int("conflicts", len(stat.Conflicts)).
+			Int64("purged", stat.Purged).
+			Msg("moved key range")
+	}
+}
+
+type RingCmd struct {
+	fs      *flag.FlagSet
+	cmdName string
+	cfg     *config.AppConfig
+
+	current        string
+	proposed       string
+	currentWeights string
+	weights        string
+	vnodes         int
+	sample         int
+	format         string
+}
+
+// RingCmd reports how many keys a consistent hash ring would
+// move, going from the current nodes to the proposed ones.
+func NewRingCmd(cfg *config.AppConfig) *RingCmd {
+	return &RingCmd{
+		fs:      flag.NewFlagSet("ring", flag.ExitOnError),
+		cmdName: "ring",
+		cfg:     cfg,
+	}
+}
+
+func (c *RingCmd) SetArgs() {
+	c.fs.StringVar(&c.current, "current", "", "comma separated nodes on the ring now. defaults to the shards of the config")
+	c.fs.StringVar(&c.proposed, "proposed", "", "comma separated nodes on the ring after the change")
+	c.fs.StringVar(&c.currentWeights, "current_weights", "", "comma separated node=weight of the current ring. defaults to 1")
+	c.fs.StringVar(&c.weights, "weights", "", "comma separated node=weight of the proposed ring. defaults to 1")
+	c.fs.IntVar(&c.vnodes, "vnodes", db.DefaultVirtualNodes, "virtual nodes of a node with weight 1")
+	c.fs.IntVar(&c.sample, "sample", 0, "place this many random keys, instead of the assigned keys of the shards")
+	c.fs.StringVar(&c.format, "format", "text", "text or json")
+}
+
+func parseWeights(value string) (map[string]float64, error) {
+	weights := map[string]float64{}
+
+	for _, pair := range strings.Split(value, ",") {
+		if pair == "" {
+			continue
+		}
+
+		node, raw, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected node=weight, got %q", pair)
+		}
+
+		weight, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid weight %q", pair)
+		}
+
+		weights[strings.TrimSpace(node)] = weight
+	}
+
+	return weights, nil
+}
+
+func (c *RingCmd) ring(nodes string, weights string) *db.HashRing {
+	parsed, err := parseWeights(weights)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid weights")
+	}
+
+	ring, err := db.NewHashRing(strings.Split(nodes, ","), &db.HashRingOpts{VirtualNodes: c.vnodes, Weights: parsed})
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid ring")
+	}
+
+	return ring
+}
+
+func (c *RingCmd) Run(ctx context.Context, args []string) {
+	if err := c.fs.Parse(args); err != nil {
+		log.Fatal().Err(err).Msg("invalid cli args for ring")
+	}
+
+	if c.proposed == "" {
+		log.Fatal().Msg("-proposed is required")
+	}
+
+	topology := runners.TopologyFromConfig(c.cfg)
+
+	if c.current == "" {
+		c.current = strings.Join(slicendice.Map(topology.KeyRanges(), func(keyRange string, _ int) string {
+			return topology.DBName(keyRange)
+		}), ",")
+	}
+
+	moves, err := runners.ReportRingMoves(ctx, topology, c.ring(c.current, c.currentWeights), c.ring(c.proposed, c.weights), c.sample)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to place keys")
+	}
+
+	if c.format == "json" {
+		json.NewEncoder(os.Stdout).Encode(moves)
+		return
+	}
+
+	fmt.Printf("keys %d, moving %d (%.1f%%)\n\n", moves.Total, moves.Moved, 100*moves.MovedRatio())
+
+	nodes := map[string]bool{}
+	for node := range moves.Before {
+		nodes[node] = true
+	}
+	for node := range moves.After {
+		nodes[node] = true
+	}
+
+	names := make([]string, 0, len(nodes))
+	for node := range nodes {
+		names = append(names, node)
+	}
+	sort.Strings(names)
+
+	fmt.Printf("%-24s %12s %12s\n", "node", "before", "after")
+	for _, node := range names {
+		fmt.Printf("%-24s %12d %12d\n", node, moves.Before[node], moves.After[node])
+	}
+
+	fmt.Println()
+	for _, from := range names {
+		for _, to := range names {
+			if count := moves.Flows[from][to]; count > 0 {
+				fmt.Printf("%s -> %s %d\n", from, to, count)
+			}
+		}
+	}
+}
+
+type RestoreCmd struct {
+	fs      *flag.FlagSet
+	cmdName string
+	cfg     *config.AppConfig
+
+	list       bool
+	snapshot   string
+	backupDest string
+	swap       bool
+
+	until    string
+	keyRange string
+	baseDir  string
+	outDir   string
+	timeline string
+	dest     string
+}
+
+// RestoreCmd restores the shards and the coordinator from a backup
+// run, and with -until, replays the shipped changelog on top of the
+// snapshots. With -swap, the verified files are put in place.
+func NewRestoreCmd(cfg *config.AppConfig) *RestoreCmd {
+	return &RestoreCmd{
+		fs:      flag.NewFlagSet("restore", flag.ExitOnError),
+		cmdName: "restore",
+		cfg:     cfg,
+	}
+}
+
+func (c *RestoreCmd) SetArgs() {
+	c.fs.BoolVar(&c.list, "list", false, "list the backup runs on -backup_dest")
+	c.fs.StringVar(&c.snapshot, "snapshot", "", "backup run to restore, like 20261016T221000Z, or latest")
+	c.fs.StringVar(&c.backupDest, "backup_dest", c.cfg.BackupDest, "where the backup runs are. s3://bucket/prefix, gs://bucket/prefix or a directory")
+	c.fs.BoolVar(&c.swap, "swap", false, "put the restored files in place of the ones in use. the servers have to be stopped, or in maintenance mode")
+
+	c.fs.StringVar(&c.until, "until", "", "replay the changelog upto this time. 2006-01-02 or RFC3339")
+	c.fs.StringVar(&c.keyRange, "keyrange", "", "only replay the changelog of this key range, like a-e")
+	c.fs.StringVar(&c.baseDir, "base", "", "directory with the snapshots, named like the shard files, without -snapshot. empty replays from empty shards")
+	c.fs.StringVar(&c.outDir, "out", "restored", "directory to write the restored files to")
+	c.fs.StringVar(&c.timeline, "timeline", "", "changelog timeline to replay. defaults to the one of the snapshot, or of the shard in use")
+	c.fs.StringVar(&c.dest, "dest", c.cfg.ChangelogDest, "where the changelog was shipped. s3://bucket/prefix, gs://bucket/prefix or a directory")
+}
+
+func (c *RestoreCmd) Run(ctx context.Context, args []string) {
+	if err := c.fs.Parse(args); err != nil {
+		log.Fatal().Err(err).Msg("invalid cli args for restore")
+	}
+
+	if c.list {
+		c.listBackups(ctx)
+		return
+	}
+
+	if c.snapshot == "" && c.until == "" {
+		log.Fatal().Msg("pass -list, -snapshot or -until")
+	}
+
+	if c.swap && (c.snapshot == "" || c.keyRange != "") {
+		log.Fatal().Msg("-swap needs every shard and the coordinator restored, from a -snapshot, without -keyrange")
+	}
+
+	topology := runners.TopologyFromConfig(c.cfg)
+	baseDir := c.baseDir
+
+	if c.snapshot != "" {
+		target, err := watchers.NewBackupTarget(ctx, c.backupDest, s3Options(c.cfg))
+		if err != nil {
+			log.Fatal().Err(err).Msg("invalid -backup_dest")
+		}
+
+		// the changelog is replayed on top of the snapshots, into out
+		baseDir = c.outDir
+		if c.until != "" {
+			baseDir = filepath.Join(c.outDir, "snapshot")
+		}
+
+		manifest, err := runners.FetchBackup(ctx, target, topology, c.snapshot, baseDir)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to fetch the backup")
+		}
+
+		log.Info().Str("run", manifest.ID).Time("created_at", manifest.CreatedAt).Msg("fetched backup run")
+
+		if c.until == "" {
+			timelines, err := runners.StartTimelines(ctx, topology, c.outDir)
+			if err != nil {
+				log.Fatal().Err(err).Msg("failed to start new timelines")
+			}
+
+			log.Info().Interface("timelines", timelines).Msg("restored shards are on new timelines")
+		}
+	}
+
+	if c.until != "" {
+		c.replayChangelog(ctx, topology, baseDir)
+
+		if c.snapshot != "" {
+			coordinator := filepath.Base(topology.CoordinatorPath)
+			if err := os.Rename(filepath.Join(baseDir, coordinator), filepath.Join(c.outDir, coordinator)); err != nil {
+				log.Fatal().Err(err).Msg("failed to move the coordinator")
+			}
+		}
+	}
+
+	if c.snapshot == "" || c.keyRange != "" {
+		log.Info().Str("out", c.outDir).Msg("swap the restored files in with the servers down. take a snapshot of them, later restores need one on the new timeline")
+		return
+	}
+
+	if err := runners.VerifyRestored(ctx, topology, c.outDir); err != nil {
+		log.Fatal().Err(err).Msg("restored files failed verification")
+	}
+
+	log.Info().Str("out", c.outDir).Msg("restored files verified")
+
+	if !c.swap {
+		log.Info().Msg("rerun with -swap, or swap the restored files in with the servers down. take a backup after, later restores need one on the new timeline")
+		return
+	}
+
+	suffix, err := runners.SwapRestored(ctx, topology, c.outDir)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to swap the restored files in")
+	}
+
+	log.Info().Str("previous", "*"+suffix).Msg("restored files swapped in, the previous ones are kept. take a backup, later restores need one on the new timeline")
+}
+
+func (c *RestoreCmd) replayChangelog(ctx context.Context, topology *models.Topology, baseDir string) {
+	until, err := parseExportTime(c.until)
+	if err != nil || until == nil {
+		log.Fatal().Err(err).Msg("invalid -until. 2006-01-02 or RFC3339")
+	}
+
+	target, err := watchers.NewBackupTarget(ctx, c.dest, s3Options(c.cfg))
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid -dest")
+	}
+
+	stats, err := runners.RestoreShards(ctx, topology, target, &runners.RestoreOpts{
+		Until:    *until,
+		KeyRange: c.keyRange,
+		BaseDir:  baseDir,
+		OutDir:   c.outDir,
+		Timeline: c.timeline,
+	})
+
+	for _, stat := range stats {
+		log.Info().
+			Str("key_range", stat.KeyRange).
+			Str("path", stat.Path).
+			Str("timeline", stat.Timeline).
+			Str("new_timeline", stat.NewTimeline).
+			Int64("from", stat.From).
+			Int64("to", stat.To).
+			Int64("replayed", stat.Replayed).
+			Time("last_change", stat.LastChange).
+			Msg("restored shard")
+	}
+
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to restore")
+	}
+}
+
+func (c *RestoreCmd) listBackups(ctx context.Context) {
+	target, err := watchers.NewBackupTarget(ctx, c.backupDest, s3Options(c.cfg))
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid -backup_dest")
+	}
+
+	runs, manifests, err := runners.ListBackups(ctx, target)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to list backups")
+	}
+
+	fmt.Printf("%-20s %-10s %6s %14s %14s\n", "run", "complete", "files", "size", "stored")
+	for _, run := range runs {
+		manifest, ok := manifests[run.ID]
+		if !ok {
+			fmt.Printf("%-20s %-10t %6d %14s %14s\n", run.ID, false, len(run.Keys), "-", "-")
+			continue
+		}
+
+		var size, stored int64
+		for _, file := range manifest.Files {
+			size += file.Size
+			stored += file.StoredSize
+		}
+
+		fmt.Printf("%-20s %-10t %6d %14d %14d\n", run.ID, true, len(manifest.Files), size, stored)
+	}
+}
+
+func s3Options(cfg *config.AppConfig) watchers.S3Options {
+	return watchers.S3Options{
+		Region:    cfg.AWSRegion,
+		AccessKey: cfg.AWSAccessKey,
+		SecretKey: cfg.AWSSecretKey,
+		Endpoint:  cfg.AWSEndpoint,
+	}
+}
+
+type ConfigCmd struct {
+	fs      *flag.FlagSet
+	cmdName string
+	cfg     *config.AppConfig
+
+	format string
+}
+
+// ConfigCmd shows the effective config, after all the layers.
+// config print
+func NewConfigCmd(cfg *config.AppConfig) *ConfigCmd {
+	return &ConfigCmd{
+		fs:      flag.NewFlagSet("config print", flag.ExitOnError),
+		cmdName: "config",
+		cfg:     cfg,
+	}
+}
+
+func (c *ConfigCmd) SetArgs() {
+	c.fs.StringVar(&c.format, "format", config.PrintFormatTOML, "toml, yaml or json")
+}
+
+func (c *ConfigCmd) Run(ctx context.Context, args []string) {
+	if len(args) < 1 || args[0] != "print" {
+		log.Fatal().Msg("expected config print")
+	}
+
+	if err := c.fs.Parse(args[1:]); err != nil {
+		log.Fatal().Err(err).Msg("invalid cli args for config print")
+	}
+
+	if err := config.Print(os.Stdout, c.cfg, c.format); err != nil {
+		log.Fatal().Err(err).Msg("failed to print config")
+	}
+}
+
+func seederFor(cfg *config.AppConfig) *seed.Seeder {
+	return seed.RegisterUrlSeeder().WithShards(cfg.KeyRanges)
+}
+
 func main() {
 	zerolog.SetGlobalLevel(zerolog.InfoLevel)
 
-	if len(os.Args) < 2 {
+	// the flags before the command are for the config,
+	// like cli -config shortner.toml seed -size 1K
+	cfg, args := config.MustLoad(flag.NewFlagSet("cli", flag.ExitOnError), os.Args[1:])
+
+	if len(args) < 1 {
 		log.Fatal().Msg("Expected 'seed' subcommands")
 	}
 
@@ -255,29 +1294,74 @@ func main() {
 	ctx, cancel := signal.NotifyContext(ctx, syscall.SIGABRT, syscall.SIGTERM)
 	defer cancel()
 
-	scmd := NewSeedCmd()
+	scmd := NewSeedCmd(cfg)
 	scmd.SetArgs()
 
-	pcmd := NewProbCmd()
+	pcmd := NewProbCmd(cfg)
 	pcmd.SetArgs()
 
-	bcmd := NewBackupCmd()
+	bcmd := NewBackupCmd(cfg)
 	bcmd.SetArgs()
 
-	rcmd := NewRefillCmd()
+	rcmd := NewRefillCmd(cfg)
 	rcmd.SetArgs()
 
-	switch os.Args[1] {
+	swcmd := NewSweepCmd(cfg)
+	swcmd.SetArgs()
+
+	kcmd := NewKeysCmd(cfg)
+	kcmd.SetArgs()
+
+	rpcmd := NewReportsCmd(cfg)
+	rpcmd.SetArgs()
+
+	icmd := NewImportCmd(cfg)
+	icmd.SetArgs()
+
+	ecmd := NewExportCmd(cfg)
+	ecmd.SetArgs()
+
+	ccmd := NewConfigCmd(cfg)
+	ccmd.SetArgs()
+
+	rscmd := NewReshardCmd(cfg)
+	rscmd.SetArgs()
+
+	rgcmd := NewRingCmd(cfg)
+	rgcmd.SetArgs()
+
+	rstcmd := NewRestoreCmd(cfg)
+	rstcmd.SetArgs()
+
+	switch args[0] {
 	case scmd.cmdName:
-		scmd.Run(ctx, os.Args[2:])
+		scmd.Run(ctx, args[1:])
 	case pcmd.cmdName:
-		pcmd.Run(ctx, os.Args[2:])
+		pcmd.Run(ctx, args[1:])
 	case bcmd.cmdName:
-		bcmd.Run(ctx, os.Args[2:])
+		bcmd.Run(ctx, args[1:])
 	case rcmd.cmdName:
-		rcmd.Run(ctx, os.Args[2:])
+		rcmd.Run(ctx, args[1:])
+	case swcmd.cmdName:
+		swcmd.Run(ctx, args[1:])
+	case kcmd.cmdName:
+		kcmd.Run(ctx, args[1:])
+	case rpcmd.cmdName:
+		rpcmd.Run(ctx, args[1:])
+	case icmd.cmdName:
+		icmd.Run(ctx, args[1:])
+	case ecmd.cmdName:
+		ecmd.Run(ctx, args[1:])
+	case ccmd.cmdName:
+		ccmd.Run(ctx, args[1:])
+	case rscmd.cmdName:
+		rscmd.Run(ctx, args[1:])
+	case rgcmd.cmdName:
+		rgcmd.Run(ctx, args[1:])
+	case rstcmd.cmdName:
+		rstcmd.Run(ctx, args[1:])
 	default:
-		log.Fatal().Msgf("invalid command %s", os.Args[1])
+		log.Fatal().Msgf("invalid command %s", args[0])
 	}
 
 }
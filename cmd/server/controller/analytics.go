@@ -0,0 +1,96 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-batteries/shortner/app/db"
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultStatsDays = 30
+	MaxStatsDays     = 365
+)
+
+// ClickRecorder is implemented by watchers.ClickRecorder
+type ClickRecorder interface {
+	Record(click *models.Click) bool
+}
+
+type ClickStatsCtrl struct {
+	clickRepo *models.ClickRepo
+	store     models.Store
+}
+
+func NewClickStatsCtrl(clickRepo *models.ClickRepo, store models.Store) *ClickStatsCtrl {
+	return &ClickStatsCtrl{clickRepo: clickRepo, store: store}
+}
+
+// Get returns the total clicks and a per day histogram
+// for the last ?days=30 days. Only the owner of the link
+// gets them, the others get a 404.
+func (ctrl *ClickStatsCtrl) Get(c echo.Context) error {
+	shortKey := strings.TrimSpace(c.Param("shortKey"))
+
+	if shortKey == "" || len(shortKey) > 12 {
+		return apiError(c, http.StatusBadRequest, "invalid_short_key")
+	}
+
+	_, err := ctrl.store.FindOwned(c.Request().Context(), OwnerFrom(c), shortKey)
+	if errors.Is(err, models.ErrLinkNotFound) {
+		return apiError(c, http.StatusNotFound, "not_found")
+	}
+
+	if err != nil {
+		log.Error().Err(err).Str("shortKey", shortKey).Msg("failed to find link")
+		return apiError(c, http.StatusInternalServerError, "something went wrong")
+	}
+
+	days, err := strconv.Atoi(c.QueryParam("days"))
+	if err != nil || days < 1 || days > MaxStatsDays {
+		days = DefaultStatsDays
+	}
+
+	since := time.Now().UTC().AddDate(0, 0, -days)
+
+	stats, err := ctrl.clickRepo.Stats(c.Request().Context(), shortKey, since)
+	if err != nil {
+		log.Error().Err(err).Str("shortKey", shortKey).Msg("failed to get click stats")
+
+		return apiError(c, http.StatusInternalServerError, "something went wrong")
+	}
+
+	return c.JSON(http.StatusOK, stats)
+}
+
+type CacheStatsCtrl struct {
+	cache *models.LinkCache
+}
+
+func NewCacheStatsCtrl(cache *models.LinkCache) *CacheStatsCtrl {
+	return &CacheStatsCtrl{cache: cache}
+}
+
+// Get GET /api/cache/stats, the hit and miss counters of the link cache
+func (ctrl *CacheStatsCtrl) Get(c echo.Context) error {
+	return c.JSON(http.StatusOK, ctrl.cache.Stats())
+}
+
+type ReplicaStatusCtrl struct {
+	database *db.SqliteCoordinator[string]
+}
+
+func NewReplicaStatusCtrl(database *db.SqliteCoordinator[string]) *ReplicaStatusCtrl {
+	return &ReplicaStatusCtrl{database: database}
+}
+
+// Get GET /api/shards/replicas, the last health check of every replica
+func (ctrl *ReplicaStatusCtrl) Get(c echo.Context) error {
+	return c.JSON(http.StatusOK, ctrl.database.ReplicaStatuses())
+}
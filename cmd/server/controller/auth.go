@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+const HeaderAuthKey = "AuthKey"
+
+// AccountFrom returns the account resolved from the AuthKey,
+// nil for anonymous requests.
+func AccountFrom(c echo.Context) *models.Account {
+	return models.AccountFromContext(c.Request().Context())
+}
+
+// OwnerFrom returns the account id, which owns the links.
+// Empty for anonymous requests.
+func OwnerFrom(c echo.Context) string {
+	account := AccountFrom(c)
+	if account == nil {
+		return ""
+	}
+
+	return account.ID
+}
+
+func resolveAccount(c echo.Context, accounts *models.AccountRepo) (*models.Account, error) {
+	authKey := strings.TrimSpace(c.Request().Header.Get(HeaderAuthKey))
+	if authKey == "" {
+		return nil, models.ErrInvalidAPIKey
+	}
+
+	account, err := accounts.FindByKey(c.Request().Context(), authKey)
+	if err != nil {
+		return nil, err
+	}
+
+	req := c.Request()
+	c.SetRequest(req.WithContext(models.ContextWithAccount(req.Context(), account)))
+
+	return account, nil
+}
+
+// ResolveAccount puts the account on the request context, if the
+// AuthKey is a known api key. Otherwise the request is anonymous.
+// The index page sends a random AuthKey, so unknown keys aren't an error.
+func ResolveAccount(accounts *models.AccountRepo) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			_, err := resolveAccount(c, accounts)
+			if err != nil && !errors.Is(err, models.ErrInvalidAPIKey) {
+				log.Error().Err(err).Msg("failed to resolve account")
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// RequireAccount rejects requests without a valid api key,
+// or whose key doesn't have all the scopes.
+func RequireAccount(accounts *models.AccountRepo, scopes ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			account, err := resolveAccount(c, accounts)
+			if errors.Is(err, models.ErrInvalidAPIKey) {
+				return apiError(c, http.StatusUnauthorized, "invalid_auth_key")
+			}
+
+			if err != nil {
+				log.Error().Err(err).Msg("failed to resolve account")
+				return apiError(c, http.StatusInternalServerError, "something went wrong")
+			}
+
+			for _, scope := range scopes {
+				if !account.HasScope(scope) {
+					return apiError(c, http.StatusForbidden, "missing_scope_"+scope)
+				}
+			}
+
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package controller
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/go-batteries/shortner/app/runners"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	MaxBulkRows = 10000
+	// MaxBulkBytes is the largest body, MaxBulkRows of
+	// long urls fit in it.
+	MaxBulkBytes = 16 << 20
+
+	ContentTypeNDJSON = "application/x-ndjson"
+	ContentTypeJSONL  = "application/jsonl"
+)
+
+type BulkCtrl struct {
+	shortener *runners.BulkShortener
+	shortner  *URLShortner
+}
+
+func NewBulkCtrl(shortener *runners.BulkShortener, shortner *URLShortner) *BulkCtrl {
+	return &BulkCtrl{shortener: shortener, shortner: shortner}
+}
+
+type BulkRowResponse struct {
+	*runners.BulkResult
+	Link string `json:"link,omitempty"`
+}
+
+type BulkResponse struct {
+	Total   int                `json:"total"`
+	Failed  int                `json:"failed"`
+	Results []*BulkRowResponse `json:"results"`
+}
+
+// ErrTooManyBulkRows is returned by readBulkItems, as
+// soon as it reads more than MaxBulkRows rows.
+var ErrTooManyBulkRows = fmt.Errorf("at most %d rows are allowed", MaxBulkRows)
+
+// readBulkItems reads a json array, or one json object per line
+// for jsonl / ndjson content types. The rows are decoded one by
+// one, and it stops at the first row over MaxBulkRows.
+func readBulkItems(contentType string, body io.Reader) ([]*runners.BulkItem, error) {
+	items := []*runners.BulkItem{}
+
+	if !strings.HasPrefix(contentType, ContentTypeNDJSON) && !strings.HasPrefix(contentType, ContentTypeJSONL) {
+		dec := json.NewDecoder(body)
+
+		if token, err := dec.Token(); err != nil || token != json.Delim('[') {
+			return nil, bulkReadError(err, "expected a json array of {url, alias}")
+		}
+
+		for dec.More() {
+			if len(items) == MaxBulkRows {
+				return nil, ErrTooManyBulkRows
+			}
+
+			item := &runners.BulkItem{}
+			if err := dec.Decode(item); err != nil {
+				return nil, bulkReadError(err, fmt.Sprintf("invalid json in row %d", len(items)+1))
+			}
+
+			items = append(items, item)
+		}
+
+		if _, err := dec.Token(); err != nil {
+			return nil, bulkReadError(err, "expected a json array of {url, alias}")
+		}
+
+		return items, nil
+	}
+
+	scanner := bufio.NewScanner(body)
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		if len(items) == MaxBulkRows {
+			return nil, ErrTooManyBulkRows
+		}
+
+		item := &runners.BulkItem{}
+		if err := json.Unmarshal([]byte(text), item); err != nil {
+			return nil, fmt.Errorf("invalid json on line %d", line)
+		}
+
+		items = append(items, item)
+	}
+
+	return items, scanner.Err()
+}
+
+// bulkReadError keeps the error of a body over MaxBulkBytes,
+// the others are a bad request, with msg.
+func bulkReadError(err error, msg string) error {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return err
+	}
+
+	return errors.New(msg)
+}
+
+// Post POST /api/bulk
+func (ctrl *BulkCtrl) Post(c echo.Context) error {
+	req := c.Request()
+	body := http.MaxBytesReader(c.Response(), req.Body, MaxBulkBytes)
+
+	items, err := readBulkItems(req.Header.Get(echo.HeaderContentType), body)
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return apiError(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("at most %d bytes are allowed", MaxBulkBytes))
+	}
+
+	if errors.Is(err, ErrTooManyBulkRows) {
+		return apiError(c, http.StatusRequestEntityTooLarge, err.Error())
+	}
+
+	if err != nil {
+		return apiError(c, http.StatusBadRequest, err.Error())
+	}
+
+	if len(items) == 0 {
+		return apiError(c, http.StatusBadRequest, "no rows")
+	}
+
+	results := ctrl.shortener.Shorten(req.Context(), items, models.WithOwner(OwnerFrom(c)))
+
+	resp := &BulkResponse{Total: len(results), Results: make([]*BulkRowResponse, len(results))}
+
+	for i, res := range results {
+		row := &BulkRowResponse{BulkResult: res}
+
+		if res.OK() {
+			row.Link = ctrl.shortner.BuildResponse(&models.URL{ShortKey: res.ShortKey}).Link
+		} else {
+			resp.Failed++
+		}
+
+		resp.Results[i] = row
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
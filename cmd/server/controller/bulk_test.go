@@ -0,0 +1,72 @@
+package controller_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-batteries/shortner/app/config"
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/go-batteries/shortner/app/runners"
+	"github.com/go-batteries/shortner/cmd/server/controller"
+	"github.com/labstack/echo/v4"
+)
+
+func Test_BulkPost(t *testing.T) {
+	store := models.NewMemoryStore()
+	checker := config.NewURLChecker(config.DefaultOptions())
+	ctrl := controller.NewBulkCtrl(runners.NewBulkShortener(store, checker, 2), newShortner(store))
+
+	post := func(contentType string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/bulk", strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, contentType)
+
+		return serve(ctrl.Post, asAccount(req, "acc_1"))
+	}
+
+	for _, tc := range []struct {
+		contentType string
+		body        string
+	}{
+		{contentType: echo.MIMEApplicationJSON, body: `[{"url": "https://github.com"}, {"url": "https://go.dev", "alias": "9lives"}]`},
+		{contentType: controller.ContentTypeNDJSON, body: "{\"url\": \"https://github.com\"}\n\n{\"url\": \"https://go.dev\", \"alias\": \"9lives\"}\n"},
+	} {
+		rec := post(tc.contentType, tc.body)
+
+		resp := &controller.BulkResponse{}
+		if err := json.Unmarshal(rec.Body.Bytes(), resp); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("expected 200 for %s, got %d %s", tc.contentType, rec.Code, rec.Body)
+		}
+
+		if resp.Total != 2 || resp.Failed != 1 || resp.Results[0].Link == "" || resp.Results[1].Error == "" {
+			t.Fatalf("expected a row shortened and a row failed for %s, got %s", tc.contentType, rec.Body)
+		}
+	}
+
+	rows := strings.Repeat(`{"url": "https://github.com"},`, controller.MaxBulkRows)
+
+	for _, tc := range []struct {
+		contentType string
+		body        string
+		status      int
+	}{
+		{contentType: echo.MIMEApplicationJSON, body: `{"url": "https://github.com"}`, status: http.StatusBadRequest},
+		{contentType: echo.MIMEApplicationJSON, body: `[{"url": "https://github.com"}`, status: http.StatusBadRequest},
+		{contentType: echo.MIMEApplicationJSON, body: `[]`, status: http.StatusBadRequest},
+		{contentType: controller.ContentTypeNDJSON, body: "{\"url\": \"https://github.com\"}\nnope\n", status: http.StatusBadRequest},
+		{contentType: echo.MIMEApplicationJSON, body: "[" + rows + `{"url": "https://go.dev"}]`, status: http.StatusRequestEntityTooLarge},
+		{contentType: controller.ContentTypeNDJSON, body: strings.ReplaceAll(rows, "},", "}\n") + "{}", status: http.StatusRequestEntityTooLarge},
+		{contentType: echo.MIMEApplicationJSON, body: "[" + strings.Repeat(" ", controller.MaxBulkBytes) + "]", status: http.StatusRequestEntityTooLarge},
+	} {
+		if rec := post(tc.contentType, tc.body); rec.Code != tc.status {
+			t.Fatalf("expected %d for %.60q, got %d %s", tc.status, tc.body, rec.Code, rec.Body)
+		}
+	}
+
+	if links, _, _ := store.ListByOwner(context.Background(), "acc_1", "", 10); len(links) != 2 {
+		t.Fatalf("expected only the rows of the accepted requests to be shortened, got %d", len(links))
+	}
+}
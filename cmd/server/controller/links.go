@@ -0,0 +1,224 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-batteries/shortner/app/config"
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// LinksCtrl is the management api for the links of an owner
+type LinksCtrl struct {
+	keyShardedRepo   models.Store
+	robinShardedRepo models.Store
+	shortner         *URLShortner
+}
+
+func NewLinksCtrl(keyShardedRepo models.Store, robinShardedRepo models.Store, shortner *URLShortner) *LinksCtrl {
+	return &LinksCtrl{
+		keyShardedRepo:   keyShardedRepo,
+		robinShardedRepo: robinShardedRepo,
+		shortner:         shortner,
+	}
+}
+
+type LinkResponse struct {
+	ShortKey  string     `json:"short_key"`
+	Link      string     `json:"link"`
+	URL       string     `json:"url"`
+	Vanity    bool       `json:"vanity"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Generation has to be sent back with an update or a delete,
+	// which fails with a 409, if the link changed since
+	Generation int64 `json:"generation"`
+}
+
+type ListLinksResponse struct {
+	Links []*LinkResponse `json:"links"`
+	Next  string          `json:"next,omitempty"`
+}
+
+type UpdateLinkReq struct {
+	URL        string `form:"url" json:"url"`
+	Generation int64  `form:"generation" json:"generation"`
+}
+
+func (ctrl *LinksCtrl) buildLink(u *models.URL) *LinkResponse {
+	target := ""
+
+	if u.Link != nil {
+		link, err := url.QueryUnescape(*u.Link)
+		if err != nil {
+			link = *u.Link
+		}
+
+		target = link
+	}
+
+	resp := &LinkResponse{
+		ShortKey:   u.ShortKey,
+		Link:       ctrl.shortner.BuildResponse(u).Link,
+		URL:        target,
+		Vanity:     u.Vanity,
+		UpdatedAt:  u.UpdatedAt,
+		ExpiresAt:  u.ExpiresAt,
+		Generation: u.Generation,
+	}
+
+	if !u.CreatedAt.IsZero() {
+		resp.CreatedAt = &u.CreatedAt
+	}
+
+	return resp
+}
+
+func apiError(c echo.Context, status int, msg string) error {
+	return c.JSON(status, map[string]interface{}{
+		"success": false,
+		"error":   msg,
+	})
+}
+
+// conflictError is the 409 of a write, which expected a generation
+// of the link it no longer has. It has the current generation, so
+// that the client can retry with it.
+func conflictError(c echo.Context, conflict *models.GenerationConflict) error {
+	return c.JSON(http.StatusConflict, map[string]interface{}{
+		"success":    false,
+		"error":      models.ErrGenerationConflict.Error(),
+		"generation": conflict.Current,
+	})
+}
+
+// requireGeneration checks the generation a write expects the link at,
+// and the status to refuse it with. It's required, so that a client
+// can't overwrite a change it hasn't seen, models.AnyGeneration is
+// for the writes of the server itself.
+func requireGeneration(generation int64) (int, error) {
+	if generation == models.AnyGeneration {
+		return http.StatusPreconditionRequired, errors.New("expected generation")
+	}
+
+	if generation < 0 {
+		return http.StatusBadRequest, errors.New("invalid generation")
+	}
+
+	return http.StatusOK, nil
+}
+
+// List GET /api/links?after=<short_key>&limit=50
+func (ctrl *LinksCtrl) List(c echo.Context) error {
+	limit, err := strconv.Atoi(c.QueryParam("limit"))
+	if err != nil {
+		limit = models.DefaultListLimit
+	}
+
+	urls, next, err := ctrl.keyShardedRepo.ListByOwner(
+		c.Request().Context(),
+		OwnerFrom(c),
+		strings.TrimSpace(c.QueryParam("after")),
+		limit,
+	)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to list links")
+		return apiError(c, http.StatusInternalServerError, "something went wrong")
+	}
+
+	resp := &ListLinksResponse{Links: []*LinkResponse{}, Next: next}
+
+	for _, u := range urls {
+		resp.Links = append(resp.Links, ctrl.buildLink(u))
+	}
+
+	return c.JSON(http.StatusOK, resp)
+}
+
+// Update PATCH /api/links/:shortKey, points the link to a new url.
+// The link is only updated if it's still at the generation.
+func (ctrl *LinksCtrl) Update(c echo.Context) error {
+	shortKey := strings.TrimSpace(c.Param("shortKey"))
+
+	body := &UpdateLinkReq{}
+	if err := c.Bind(body); err != nil || strings.TrimSpace(body.URL) == "" {
+		return apiError(c, http.StatusBadRequest, "expected url")
+	}
+
+	if status, err := requireGeneration(body.Generation); err != nil {
+		return apiError(c, status, err.Error())
+	}
+
+	issues, err := ctrl.shortner.checker.ValidateURL(body.URL)
+	if err != nil || ctrl.shortner.checker.Score(issues) > config.CutoffMaxIssues {
+		log.Info().Msgf("issues %v", issues)
+		return apiError(c, http.StatusBadRequest, "url seems suspicious")
+	}
+
+	u, err := ctrl.robinShardedRepo.Retarget(c.Request().Context(), OwnerFrom(c), shortKey, body.URL, body.Generation)
+	if errors.Is(err, models.ErrLinkNotFound) {
+		return apiError(c, http.StatusNotFound, "not_found")
+	}
+
+	if errors.Is(err, models.ErrLinkExpired) {
+		return apiError(c, http.StatusGone, "expired")
+	}
+
+	var conflict *models.GenerationConflict
+	if errors.As(err, &conflict) {
+		return conflictError(c, conflict)
+	}
+
+	if err != nil {
+		log.Error().Err(err).Str("shortKey", shortKey).Msg("failed to retarget link")
+		return apiError(c, http.StatusInternalServerError, "something went wrong")
+	}
+
+	ctrl.shortner.scan(u)
+
+	return c.JSON(http.StatusOK, ctrl.buildLink(u))
+}
+
+// Delete DELETE /api/links/:shortKey?generation=<generation>
+func (ctrl *LinksCtrl) Delete(c echo.Context) error {
+	shortKey := strings.TrimSpace(c.Param("shortKey"))
+
+	generation := models.AnyGeneration
+
+	if param := strings.TrimSpace(c.QueryParam("generation")); param != "" {
+		n, err := strconv.ParseInt(param, 10, 64)
+		if err != nil {
+			return apiError(c, http.StatusBadRequest, "invalid generation")
+		}
+
+		generation = n
+	}
+
+	if status, err := requireGeneration(generation); err != nil {
+		return apiError(c, status, err.Error())
+	}
+
+	err := ctrl.robinShardedRepo.Delete(c.Request().Context(), OwnerFrom(c), shortKey, generation)
+	if errors.Is(err, models.ErrLinkNotFound) {
+		return apiError(c, http.StatusNotFound, "not_found")
+	}
+
+	var conflict *models.GenerationConflict
+	if errors.As(err, &conflict) {
+		return conflictError(c, conflict)
+	}
+
+	if err != nil {
+		log.Error().Err(err).Str("shortKey", shortKey).Msg("failed to delete link")
+		return apiError(c, http.StatusInternalServerError, "something went wrong")
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
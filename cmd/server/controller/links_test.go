@@ -0,0 +1,130 @@
+package controller_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/go-batteries/shortner/cmd/server/controller"
+	"github.com/labstack/echo/v4"
+)
+
+// asAccount puts the account on the request, the way RequireAccount does
+func asAccount(req *http.Request, accountID string) *http.Request {
+	account := &models.Account{ID: accountID, Scopes: []string{models.ScopeLinksRead, models.ScopeLinksWrite}}
+	return req.WithContext(models.ContextWithAccount(req.Context(), account))
+}
+
+func patchForm(accountID string, values url.Values) *http.Request {
+	req := httptest.NewRequest(http.MethodPatch, "/", strings.NewReader(values.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+
+	return asAccount(req, accountID)
+}
+
+func Test_LinksOwner(t *testing.T) {
+	ctx := context.Background()
+	store := models.NewMemoryStore()
+	ctrl := controller.NewLinksCtrl(store, store, newShortner(store))
+
+	u, err := store.AssignURL(ctx, "https://github.com", models.WithOwner("acc_1"))
+	if err != nil {
+		t.Fatalf("failed to assign url %v", err)
+	}
+
+	past := time.Now().UTC().Add(-time.Minute)
+
+	expired, err := store.AssignURL(ctx, "https://sale.com", models.WithOwner("acc_1"), models.WithExpiry(&past))
+	if err != nil {
+		t.Fatalf("failed to assign url %v", err)
+	}
+
+	for _, tc := range []struct {
+		accountID string
+		link      *models.URL
+		status    int
+	}{
+		{accountID: "acc_2", link: u, status: http.StatusNotFound},
+		{accountID: "acc_1", link: expired, status: http.StatusGone},
+		{accountID: "acc_1", link: u, status: http.StatusOK},
+	} {
+		values := url.Values{"url": {"https://gitlab.com"}, "generation": {strconv.FormatInt(tc.link.Generation, 10)}}
+
+		rec := serve(ctrl.Update, patchForm(tc.accountID, values), "shortKey", tc.link.ShortKey)
+		if rec.Code != tc.status {
+			t.Fatalf("expected %d for %s retargeting %s, got %d %s", tc.status, tc.accountID, tc.link.ShortKey, rec.Code, rec.Body)
+		}
+	}
+
+	rec := serve(ctrl.List, asAccount(httptest.NewRequest(http.MethodGet, "/api/links", nil), "acc_2"))
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), u.ShortKey) {
+		t.Fatalf("expected the links of another owner to not be listed, got %d %s", rec.Code, rec.Body)
+	}
+
+	del := asAccount(httptest.NewRequest(http.MethodDelete, "/api/links/"+u.ShortKey+"?generation=2", nil), "acc_2")
+	if rec := serve(ctrl.Delete, del, "shortKey", u.ShortKey); rec.Code != http.StatusNotFound {
+		t.Fatalf("expected another owner to not delete the link, got %d", rec.Code)
+	}
+}
+
+func Test_LinksGeneration(t *testing.T) {
+	ctx := context.Background()
+	store := models.NewMemoryStore()
+	ctrl := controller.NewLinksCtrl(store, store, newShortner(store))
+
+	u, err := store.AssignURL(ctx, "https://github.com", models.WithOwner("acc_1"))
+	if err != nil {
+		t.Fatalf("failed to assign url %v", err)
+	}
+
+	del := func(query string) *httptest.ResponseRecorder {
+		req := asAccount(httptest.NewRequest(http.MethodDelete, "/api/links/"+u.ShortKey+query, nil), "acc_1")
+		return serve(ctrl.Delete, req, "shortKey", u.ShortKey)
+	}
+
+	update := func(values url.Values) *httptest.ResponseRecorder {
+		values.Set("url", "https://gitlab.com")
+		return serve(ctrl.Update, patchForm("acc_1", values), "shortKey", u.ShortKey)
+	}
+
+	// the writes without a generation would skip the check
+	if rec := update(url.Values{}); rec.Code != http.StatusPreconditionRequired {
+		t.Fatalf("expected an update without a generation to be refused, got %d %s", rec.Code, rec.Body)
+	}
+
+	if rec := del(""); rec.Code != http.StatusPreconditionRequired {
+		t.Fatalf("expected a delete without a generation to be refused, got %d %s", rec.Code, rec.Body)
+	}
+
+	for _, query := range []string{"?generation=x", "?generation=-1"} {
+		if rec := del(query); rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected %s to be invalid, got %d %s", query, rec.Code, rec.Body)
+		}
+	}
+
+	current := strconv.FormatInt(u.Generation, 10)
+
+	if rec := update(url.Values{"generation": {current}}); rec.Code != http.StatusOK {
+		t.Fatalf("expected the update at the current generation to pass, got %d %s", rec.Code, rec.Body)
+	}
+
+	// the update moved the link past the generation
+	rec := update(url.Values{"generation": {current}})
+	if rec.Code != http.StatusConflict || !strings.Contains(rec.Body.String(), `"generation":`+strconv.FormatInt(u.Generation+1, 10)) {
+		t.Fatalf("expected a stale update to conflict, with the current generation, got %d %s", rec.Code, rec.Body)
+	}
+
+	if rec := del("?generation=" + current); rec.Code != http.StatusConflict {
+		t.Fatalf("expected a stale delete to conflict, got %d %s", rec.Code, rec.Body)
+	}
+
+	if rec := del("?generation=" + strconv.FormatInt(u.Generation+1, 10)); rec.Code != http.StatusNoContent {
+		t.Fatalf("expected the delete at the current generation to pass, got %d %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,17 @@
+package controller
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Maintenance answers every request while the server runs in
+// maintenance mode, with the shards closed for a restore.
+func Maintenance(c echo.Context) error {
+	c.Response().Header().Set("Retry-After", "60")
+
+	return c.JSON(http.StatusServiceUnavailable, map[string]string{
+		"message": "Down for maintenance. Please try again later.",
+	})
+}
@@ -0,0 +1,160 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/go-batteries/shortner/app/runners"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// ReportsCtrl takes the reports of links from the end users,
+// and is the review queue api for the admins.
+type ReportsCtrl struct {
+	keyShardedRepo models.Store
+	reports        *models.ReportRepo
+	moderator      *runners.Moderator
+}
+
+func NewReportsCtrl(keyShardedRepo models.Store, reports *models.ReportRepo, moderator *runners.Moderator) *ReportsCtrl {
+	return &ReportsCtrl{
+		keyShardedRepo: keyShardedRepo,
+		reports:        reports,
+		moderator:      moderator,
+	}
+}
+
+type ReportLinkReq struct {
+	Reason  string `form:"reason" json:"reason"`
+	Details string `form:"details" json:"details"`
+}
+
+type DecideReq struct {
+	Action     string `form:"action" json:"action"`
+	Note       string `form:"note" json:"note"`
+	Generation int64  `form:"generation" json:"generation"`
+}
+
+// Report POST /:shortKey/report. The reporter is the account of
+// the request, or the ip for anonymous ones. A repeated report of
+// the same reporter is accepted, but not recorded again.
+func (ctrl *ReportsCtrl) Report(c echo.Context) error {
+	req := c.Request()
+	shortKey := strings.TrimSpace(c.Param("shortKey"))
+	expectsJSONResp := strings.EqualFold(req.Header.Get("Accept"), AcceptTypeJSON)
+
+	body := &ReportLinkReq{}
+	if err := c.Bind(body); err != nil {
+		return apiError(c, http.StatusBadRequest, "expected reason")
+	}
+
+	// a link already marked malicious can be reported still
+	_, err := ctrl.keyShardedRepo.Find(req.Context(), shortKey)
+	if err != nil && !errors.Is(err, models.ErrLinkMalicious) {
+		return apiError(c, http.StatusNotFound, "not_found")
+	}
+
+	reporter := "ip:" + c.RealIP()
+	if owner := OwnerFrom(c); owner != "" {
+		reporter = "account:" + owner
+	}
+
+	report := &models.LinkReport{
+		ShortKey: shortKey,
+		Reason:   strings.TrimSpace(body.Reason),
+		Details:  strings.TrimSpace(body.Details),
+		Reporter: reporter,
+	}
+
+	err = ctrl.reports.Create(req.Context(), report)
+	if errors.Is(err, models.ErrInvalidReason) || errors.Is(err, models.ErrReportTooDetailed) {
+		return apiError(c, http.StatusBadRequest, err.Error())
+	}
+
+	if err != nil && !errors.Is(err, models.ErrDuplicateReport) {
+		log.Error().Err(err).Str("shortKey", shortKey).Msg("failed to report link")
+		return apiError(c, http.StatusInternalServerError, "something went wrong")
+	}
+
+	if expectsJSONResp {
+		return c.JSON(http.StatusAccepted, map[string]interface{}{"success": true})
+	}
+
+	return c.HTML(http.StatusAccepted, `<html><body>Thanks, the link will be reviewed</body></html>`)
+}
+
+// Queue GET /api/reports?limit=50, the links with pending reports
+func (ctrl *ReportsCtrl) Queue(c echo.Context) error {
+	limit, err := strconv.Atoi(c.QueryParam("limit"))
+	if err != nil {
+		limit = models.DefaultListLimit
+	}
+
+	items, err := ctrl.reports.Queue(c.Request().Context(), limit)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to list the review queue")
+		return apiError(c, http.StatusInternalServerError, "something went wrong")
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{"links": items})
+}
+
+// History GET /api/reports/:shortKey
+func (ctrl *ReportsCtrl) History(c echo.Context) error {
+	shortKey := strings.TrimSpace(c.Param("shortKey"))
+
+	history, err := ctrl.reports.History(c.Request().Context(), shortKey)
+	if err != nil {
+		log.Error().Err(err).Str("shortKey", shortKey).Msg("failed to get the report history")
+		return apiError(c, http.StatusInternalServerError, "something went wrong")
+	}
+
+	return c.JSON(http.StatusOK, history)
+}
+
+// Decide POST /api/reports/:shortKey/decision, with the action,
+// one of malicious, clear or dismiss.
+func (ctrl *ReportsCtrl) Decide(c echo.Context) error {
+	shortKey := strings.TrimSpace(c.Param("shortKey"))
+
+	body := &DecideReq{}
+	if err := c.Bind(body); err != nil {
+		return apiError(c, http.StatusBadRequest, "expected action")
+	}
+
+	decidedBy := "admin"
+	if account := AccountFrom(c); account != nil {
+		decidedBy = account.Name
+	}
+
+	decision := &models.LinkDecision{
+		ShortKey:  shortKey,
+		Action:    strings.TrimSpace(body.Action),
+		Note:      strings.TrimSpace(body.Note),
+		DecidedBy: decidedBy,
+	}
+
+	err := ctrl.moderator.Decide(c.Request().Context(), decision, body.Generation)
+
+	var conflict *models.GenerationConflict
+
+	switch {
+	case err == nil:
+		return c.JSON(http.StatusOK, decision)
+	case errors.As(err, &conflict):
+		return conflictError(c, conflict)
+	case errors.Is(err, models.ErrLinkNotFound):
+		return apiError(c, http.StatusNotFound, "not_found")
+	case errors.Is(err, models.ErrInvalidAction):
+		return apiError(c, http.StatusBadRequest, err.Error())
+	case errors.Is(err, models.ErrNoPendingReports):
+		return apiError(c, http.StatusBadRequest, models.ErrNoPendingReports.Error())
+	}
+
+	log.Error().Err(err).Str("shortKey", shortKey).Msg("failed to decide on link")
+	return apiError(c, http.StatusInternalServerError, "something went wrong")
+}
@@ -6,9 +6,11 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/go-batteries/shortner/app/config"
 	"github.com/go-batteries/shortner/app/models"
+	"github.com/go-batteries/shortner/app/seed"
 	"github.com/labstack/echo/v4"
 	"github.com/rs/zerolog/log"
 )
@@ -19,16 +21,40 @@ const (
 )
 
 type URLShortner struct {
-	keyShardedRepo   *models.URLRepo
-	robinShardedRepo *models.URLRepo
+	keyShardedRepo   models.Store
+	robinShardedRepo models.Store
 	domainName       string
+	seeder           *seed.Seeder
+	recorder         ClickRecorder
+	checker          *config.URLChecker
+	scanner          LinkScanner
 }
 
-func NewURLShortnerCtrl(keyShardedRepo *models.URLRepo, robinShardedRepo *models.URLRepo, domainName string) *URLShortner {
+// LinkScanner runs the slow checks of the new links in the
+// background, watchers.Scanner is one. nil turns them off.
+type LinkScanner interface {
+	Enqueue(shortKey string, link string, generation int64) bool
+}
+
+// NewURLShortnerCtrl, the robinShardedRepo is used for writes.
+// New keys are handed out round robin, but writes for a
+// known key (like aliases) are routed to the key range shard.
+func NewURLShortnerCtrl(
+	keyShardedRepo models.Store,
+	robinShardedRepo models.Store,
+	recorder ClickRecorder,
+	checker *config.URLChecker,
+	scanner LinkScanner,
+	domainName string,
+) *URLShortner {
 	return &URLShortner{
 		keyShardedRepo:   keyShardedRepo,
 		robinShardedRepo: robinShardedRepo,
+		recorder:         recorder,
+		checker:          checker,
+		scanner:          scanner,
 		domainName:       domainName,
+		seeder:           seed.RegisterUrlSeeder(),
 	}
 }
 
@@ -51,7 +77,54 @@ func (ctrl *URLShortner) BuildResponse(u *models.URL) *URLCreatedResponse {
 }
 
 type CreateURLReq struct {
-	URL string `form:"url" json:"url" query:"url"`
+	URL   string `form:"url" json:"url" query:"url"`
+	Alias string `form:"alias" json:"alias" query:"alias"`
+
+	// TTL is a duration like 72h, ExpiresAt is an RFC3339 timestamp.
+	// Only one of them can be set.
+	TTL       string `form:"ttl" json:"ttl" query:"ttl"`
+	ExpiresAt string `form:"expires_at" json:"expires_at" query:"expires_at"`
+
+	// Distinct skips reusing an existing short key for the same url.
+	// Useful to have separate links for tracking.
+	Distinct bool `form:"distinct" json:"distinct" query:"distinct"`
+}
+
+var (
+	ErrAmbiguousExpiry = errors.New("only_one_of_ttl_or_expires_at")
+	ErrInvalidExpiry   = errors.New("invalid_expiry")
+)
+
+// Expiry returns nil, if the link never expires
+func (req *CreateURLReq) Expiry(now time.Time) (*time.Time, error) {
+	ttl, expiresAt := strings.TrimSpace(req.TTL), strings.TrimSpace(req.ExpiresAt)
+
+	if ttl != "" && expiresAt != "" {
+		return nil, ErrAmbiguousExpiry
+	}
+
+	var expiry time.Time
+
+	switch {
+	case ttl != "":
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return nil, ErrInvalidExpiry
+		}
+
+		expiry = now.Add(d)
+	case expiresAt != "":
+		t, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil || !t.After(now) {
+			return nil, ErrInvalidExpiry
+		}
+
+		expiry = t.UTC()
+	default:
+		return nil, nil
+	}
+
+	return &expiry, nil
 }
 
 func (ctrl *URLShortner) Post(c echo.Context) error {
@@ -71,8 +144,30 @@ func (ctrl *URLShortner) Post(c echo.Context) error {
 		return c.HTML(http.StatusBadRequest, `<html><body>Missing URL</body></html>`)
 	}
 
-	checker := config.NewURLChecker(config.DefaultOptions())
-	issues, err := checker.ValidateURL(body.URL)
+	body.Alias = strings.TrimSpace(body.Alias)
+
+	if body.Alias != "" {
+		if err := ctrl.seeder.ValidateAlias(body.Alias); err != nil {
+			log.Error().Err(err).Str("alias", body.Alias).Msg("invalid alias")
+
+			if expectsJSONResp {
+				return c.JSON(http.StatusBadRequest, fmt.Sprintf(`{"success": false, "error": "%s"}`, err.Error()))
+			}
+
+			return c.HTML(http.StatusBadRequest, `<html><body>Invalid alias</body></html>`)
+		}
+	}
+
+	expiry, err := body.Expiry(time.Now().UTC())
+	if err != nil {
+		if expectsJSONResp {
+			return c.JSON(http.StatusBadRequest, fmt.Sprintf(`{"success": false, "error": "%s"}`, err.Error()))
+		}
+
+		return c.HTML(http.StatusBadRequest, `<html><body>Invalid expiry</body></html>`)
+	}
+
+	issues, err := ctrl.checker.ValidateURL(body.URL)
 	fmt.Println("kkkkkkk", err)
 
 	if err != nil {
@@ -88,7 +183,7 @@ func (ctrl *URLShortner) Post(c echo.Context) error {
 
 	log.Info().Msgf("issues %v", issues)
 
-	if len(issues) > config.CutoffMaxIssues {
+	if ctrl.checker.Score(issues) > config.CutoffMaxIssues {
 		if expectsJSONResp {
 			return c.JSON(http.StatusBadRequest, `{"success": false, "error": "url seems suspicious"}`)
 		}
@@ -96,7 +191,38 @@ func (ctrl *URLShortner) Post(c echo.Context) error {
 		return c.HTML(http.StatusBadRequest, `<html><body>URL is too malicious</body></html>`)
 	}
 
-	u, err := ctrl.robinShardedRepo.AssignURL(ctx, body.URL)
+	var u *models.URL
+
+	if body.Alias == "" && expiry == nil && !body.Distinct {
+		existing, err := ctrl.keyShardedRepo.FindByHash(ctx, OwnerFrom(c), body.URL)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to look up existing url")
+		}
+
+		if existing != nil {
+			return ctrl.respondCreated(c, http.StatusOK, existing, expectsJSONResp)
+		}
+	}
+
+	opts := []models.WithAssignOpts{
+		models.WithExpiry(expiry),
+		models.WithOwner(OwnerFrom(c)),
+	}
+
+	if body.Alias != "" {
+		u, err = ctrl.robinShardedRepo.AssignAlias(ctx, body.Alias, body.URL, opts...)
+	} else {
+		u, err = ctrl.robinShardedRepo.AssignURL(ctx, body.URL, opts...)
+	}
+
+	if errors.Is(err, models.ErrAliasTaken) {
+		if expectsJSONResp {
+			return c.JSON(http.StatusConflict, `{"success": false, "error": "alias_taken"}`)
+		}
+
+		return c.HTML(http.StatusConflict, `<html><body>Alias is already taken</body></html>`)
+	}
+
 	if err != nil {
 		if expectsJSONResp {
 			return c.JSON(http.StatusInternalServerError, `{"success": false, "error": "something went wrong"}`)
@@ -105,13 +231,27 @@ func (ctrl *URLShortner) Post(c echo.Context) error {
 		return c.HTML(http.StatusInternalServerError, `<html><body>Something went wrong</body></html>`)
 	}
 
+	ctrl.scan(u)
+
+	return ctrl.respondCreated(c, http.StatusCreated, u, expectsJSONResp)
+}
+
+// scan enqueues the link for the slow checks. If the queue
+// is full, the scanner comes across it later, when polling.
+func (ctrl *URLShortner) scan(u *models.URL) {
+	if ctrl.scanner != nil && u.Link != nil {
+		ctrl.scanner.Enqueue(u.ShortKey, *u.Link, u.Generation)
+	}
+}
+
+func (ctrl *URLShortner) respondCreated(c echo.Context, status int, u *models.URL, expectsJSONResp bool) error {
 	resp := ctrl.BuildResponse(u)
 
 	if expectsJSONResp {
-		return c.JSON(http.StatusCreated, resp)
+		return c.JSON(status, resp)
 	}
 
-	return c.HTML(http.StatusCreated, fmt.Sprintf(`<html><body>%s</html></body>`, resp.Link))
+	return c.HTML(status, fmt.Sprintf(`<html><body>%s</html></body>`, resp.Link))
 }
 
 func (ctrl *URLShortner) Get(c echo.Context) error {
@@ -138,6 +278,27 @@ func (ctrl *URLShortner) Get(c echo.Context) error {
 		err = errors.New("unassigned")
 	}
 
+	// a link marked malicious doesn't redirect, the page
+	// warns about it instead, without linking to the target
+	if errors.Is(err, models.ErrLinkMalicious) {
+		if expectsJSONResp {
+			return c.JSON(http.StatusForbidden, `{"success": false, "error": "malicious"}`)
+		}
+
+		return c.Render(http.StatusForbidden, "warning.html", map[string]interface{}{
+			"DomainName": ctrl.domainName,
+			"ShortKey":   shortKey,
+		})
+	}
+
+	if errors.Is(err, models.ErrLinkExpired) {
+		if expectsJSONResp {
+			return c.JSON(http.StatusGone, `{"success": false, "error": "expired"}`)
+		}
+
+		return c.HTML(http.StatusGone, `<html><body>Link has expired</body></html>`)
+	}
+
 	if err != nil {
 		log.Error().Err(err).Msgf("failed to get url from short key %s", shortKey)
 
@@ -153,6 +314,14 @@ func (ctrl *URLShortner) Get(c echo.Context) error {
 		link = *u.Link
 	}
 
+	ctrl.recorder.Record(&models.Click{
+		ShortKey:  shortKey,
+		ClickedAt: time.Now().UTC(),
+		Referrer:  req.Referer(),
+		UserAgent: req.UserAgent(),
+		IP:        c.RealIP(),
+	})
+
 	if expectsJSONResp {
 		return c.JSON(http.StatusOK, fmt.Sprintf(`{"success": true, "url": "%s"}`, link))
 	}
@@ -0,0 +1,196 @@
+package controller_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-batteries/shortner/app/config"
+	"github.com/go-batteries/shortner/app/models"
+	"github.com/go-batteries/shortner/cmd/server/controller"
+	"github.com/labstack/echo/v4"
+)
+
+type stubRecorder struct {
+	clicks []*models.Click
+}
+
+func (r *stubRecorder) Record(click *models.Click) bool {
+	r.clicks = append(r.clicks, click)
+	return true
+}
+
+func newShortner(store models.Store) *controller.URLShortner {
+	return controller.NewURLShortnerCtrl(
+		store,
+		store,
+		&stubRecorder{},
+		config.NewURLChecker(config.DefaultOptions()),
+		nil,
+		"http://localhost:9091",
+	)
+}
+
+// serve runs the handler on a request, with the path params
+// given as name, value pairs.
+func serve(handler echo.HandlerFunc, req *http.Request, params ...string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	names, values := []string{}, []string{}
+	for i := 0; i+1 < len(params); i += 2 {
+		names = append(names, params[i])
+		values = append(values, params[i+1])
+	}
+
+	c.SetParamNames(names...)
+	c.SetParamValues(values...)
+
+	if err := handler(c); err != nil {
+		echo.New().HTTPErrorHandler(err, c)
+	}
+
+	return rec
+}
+
+func postForm(values url.Values) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(values.Encode()))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	req.Header.Set(echo.HeaderAccept, controller.AcceptTypeJSON)
+
+	return req
+}
+
+func Test_CreateURLReqExpiry(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		req    controller.CreateURLReq
+		expiry *time.Time
+		err    error
+	}{
+		{req: controller.CreateURLReq{}},
+		{req: controller.CreateURLReq{TTL: "72h"}, expiry: ptr(now.Add(72 * time.Hour))},
+		{req: controller.CreateURLReq{ExpiresAt: "2026-04-01T00:00:00+05:30"}, expiry: ptr(time.Date(2026, 3, 31, 18, 30, 0, 0, time.UTC))},
+		{req: controller.CreateURLReq{TTL: "1h", ExpiresAt: "2026-04-01T00:00:00Z"}, err: controller.ErrAmbiguousExpiry},
+		{req: controller.CreateURLReq{TTL: "-1h"}, err: controller.ErrInvalidExpiry},
+		{req: controller.CreateURLReq{TTL: "3 days"}, err: controller.ErrInvalidExpiry},
+		{req: controller.CreateURLReq{ExpiresAt: "2026-02-01T00:00:00Z"}, err: controller.ErrInvalidExpiry},
+		{req: controller.CreateURLReq{ExpiresAt: "2026-04-01"}, err: controller.ErrInvalidExpiry},
+	} {
+		expiry, err := tc.req.Expiry(now)
+
+		if !errors.Is(err, tc.err) {
+			t.Fatalf("expected %v for %+v, got %v", tc.err, tc.req, err)
+		}
+
+		if (expiry == nil) != (tc.expiry == nil) || (expiry != nil && !expiry.Equal(*tc.expiry)) {
+			t.Fatalf("expected expiry %v for %+v, got %v", tc.expiry, tc.req, expiry)
+		}
+	}
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+func Test_GetExpiredLink(t *testing.T) {
+	store := models.NewMemoryStore()
+	ctrl := newShortner(store)
+
+	rec := serve(ctrl.Post, postForm(url.Values{"url": {"https://sale.com"}, "ttl": {"1h"}}))
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201 for a link with a ttl, got %d %s", rec.Code, rec.Body)
+	}
+
+	rec = serve(ctrl.Post, postForm(url.Values{"url": {"https://sale.com"}, "expires_at": {"2020-01-01T00:00:00Z"}}))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an expiry in the past, got %d", rec.Code)
+	}
+
+	past := time.Now().UTC().Add(-time.Minute)
+
+	expired, err := store.AssignAlias(context.Background(), "old-sale", "https://sale.com", models.WithExpiry(&past))
+	if err != nil {
+		t.Fatalf("failed to assign alias %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/"+expired.ShortKey, nil)
+
+	rec = serve(ctrl.Get, req, "shortKey", expired.ShortKey)
+	if rec.Code != http.StatusGone {
+		t.Fatalf("expected 410 for an expired link, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/"+expired.ShortKey, nil)
+	req.Header.Set(echo.HeaderAccept, controller.AcceptTypeJSON)
+
+	rec = serve(ctrl.Get, req, "shortKey", expired.ShortKey)
+	if rec.Code != http.StatusGone || !strings.Contains(rec.Body.String(), "expired") {
+		t.Fatalf("expected 410 json for an expired link, got %d %s", rec.Code, rec.Body)
+	}
+
+	rec = serve(ctrl.Get, httptest.NewRequest(http.MethodGet, "/nope", nil), "shortKey", "nope")
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown link, got %d", rec.Code)
+	}
+}
+
+func createdKey(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+
+	resp := &controller.URLCreatedResponse{}
+	if err := json.Unmarshal(rec.Body.Bytes(), resp); err != nil {
+		t.Fatalf("failed to read response %v. %s", err, rec.Body)
+	}
+
+	return resp.Link[strings.LastIndex(resp.Link, "/")+1:]
+}
+
+func Test_PostReusesExistingLink(t *testing.T) {
+	ctrl := newShortner(models.NewMemoryStore())
+	first := ""
+
+	for _, tc := range []struct {
+		form   url.Values
+		status int
+		reused bool
+	}{
+		{form: url.Values{"url": {"https://github.com"}}, status: http.StatusCreated},
+		{form: url.Values{"url": {"https://github.com"}}, status: http.StatusOK, reused: true},
+		{form: url.Values{"url": {"https://github.com"}, "ttl": {"1h"}}, status: http.StatusCreated},
+		{form: url.Values{"url": {"https://github.com"}, "alias": {"gh-home"}}, status: http.StatusCreated},
+		{form: url.Values{"url": {"https://github.com"}}, status: http.StatusOK, reused: true},
+		// last, after it either of the two can be reused
+		{form: url.Values{"url": {"https://github.com"}, "distinct": {"true"}}, status: http.StatusCreated},
+	} {
+		rec := serve(ctrl.Post, postForm(tc.form))
+		if rec.Code != tc.status {
+			t.Fatalf("expected %d for %v, got %d %s", tc.status, tc.form, rec.Code, rec.Body)
+		}
+
+		key := createdKey(t, rec)
+		if first == "" {
+			first = key
+			continue
+		}
+
+		if (key == first) != tc.reused {
+			t.Fatalf("expected %v to reuse %s %v, got %s", tc.form, first, tc.reused, key)
+		}
+	}
+
+	// only the link without an expiry is reused
+	expiring := createdKey(t, serve(ctrl.Post, postForm(url.Values{"url": {"https://gitlab.com"}, "ttl": {"1h"}})))
+
+	rec := serve(ctrl.Post, postForm(url.Values{"url": {"https://gitlab.com"}}))
+	if rec.Code != http.StatusCreated || createdKey(t, rec) == expiring {
+		t.Fatalf("expected a link with an expiry to not be reused, got %d", rec.Code)
+	}
+}
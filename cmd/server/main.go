@@ -2,18 +2,20 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"os/signal"
 	"strings"
-	"time"
 
 	"github.com/go-batteries/shortner/app/config"
 	"github.com/go-batteries/shortner/app/db"
 	"github.com/go-batteries/shortner/app/models"
-	"github.com/go-batteries/shortner/app/seed"
+	"github.com/go-batteries/shortner/app/runners"
+	"github.com/go-batteries/shortner/app/watchers"
 	"github.com/go-batteries/shortner/cmd/server/controller"
 	"github.com/go-batteries/slicendice"
 	"github.com/labstack/echo/v4"
@@ -27,8 +29,11 @@ import (
 
 type EchoServer struct{}
 
-func CreateReadDatabaseConn(ctx context.Context, keyRanges []string) *db.SqliteCoordinator[string] {
-	database := db.NewSqliteCoordinator(keyRanges)
+// CreateReadDatabaseConn connects the replicas of the shards too,
+// the reads go to them while they are healthy.
+func CreateReadDatabaseConn(ctx context.Context, topology *models.Topology) *db.SqliteCoordinator[string] {
+	database := runners.NewTopologyCoordinator(topology)
+	database.ReplicaPaths = topology.ReplicaPaths
 
 	if err := database.ConnectShards(ctx, db.DBReadOnlyMode); err != nil {
 		log.Fatal().Err(err).Msg("failed to connect to databases")
@@ -43,34 +48,47 @@ func CreateReadDatabaseConn(ctx context.Context, keyRanges []string) *db.SqliteC
 		log.Fatal().Msg("should not have failed to create shards")
 	}
 
-	var shardMapper = slicendice.Reduce(
-		keyRanges,
-		func(acc map[string]db.Shard[string], keyRange string, _ int) map[string]db.Shard[string] {
-			for _, shard := range shards {
-				if shard.ShardKey() == keyRange {
-					acc[keyRange] = shard
-				}
-			}
-			return acc
-		},
-		map[string]db.Shard[string]{},
-	)
-
-	database.SetPolicy(&db.KeyBasedPolicy[string]{Shards: shardMapper})
+	database.SetPolicy(ReadPolicy(shards))
 
 	return database
 
 }
 
-func CreateWriteDatabaseConn(ctx context.Context, keyRanges []string) *db.SqliteCoordinator[string] {
-	database := db.NewSqliteCoordinator(keyRanges)
+func shardKeys(shards []db.Shard[string]) []string {
+	return slicendice.Map(shards, func(shard db.Shard[string], _ int) string {
+		return shard.ShardKey()
+	})
+}
+
+// ReadPolicy routes to the key range shard of the short key
+func ReadPolicy(shards []db.Shard[string]) db.ShardingPolicy[string] {
+	return &db.KeyBasedPolicy[string]{Shards: db.ShardsByKeyRange(shardKeys(shards), shards)}
+}
+
+// WritePolicy routes the writes for a key to its key range shard,
+// and spreads the new key assignments across all of them.
+func WritePolicy(shards []db.Shard[string]) db.ShardingPolicy[string] {
+	return &db.KeyOrRoundRobinPolicy[string]{
+		Keyed: &db.KeyBasedPolicy[string]{Shards: db.ShardsByKeyRange(shardKeys(shards), shards)},
+		Robin: &db.RoundRobinPolicy[string]{Shards: shards},
+	}
+}
+
+// CreateWriteDatabaseConn verifies the topology against the
+// coordinator db, before anything is written to the shards.
+func CreateWriteDatabaseConn(ctx context.Context, topology *models.Topology) *db.SqliteCoordinator[string] {
+	database := runners.NewTopologyCoordinator(topology)
+
+	if err := runners.VerifyTopology(ctx, database, topology, false); err != nil {
+		log.Fatal().Err(err).Msg("shard topology doesn't match")
+	}
 
 	if err := database.ConnectShards(ctx, db.DBReadWriteMode); err != nil {
 		log.Fatal().Err(err).Msg("failed to connect to databases")
 	}
 
-	if _, err := database.ConnectCoordinatorDB(ctx); err != nil {
-		log.Fatal().Err(err).Msg("failed to connect to coordinator db")
+	if err := database.MigrateShards(ctx); err != nil {
+		log.Fatal().Err(err).Msg("failed to migrate databases")
 	}
 
 	shards, ok := database.GetShards()
@@ -78,10 +96,55 @@ func CreateWriteDatabaseConn(ctx context.Context, keyRanges []string) *db.Sqlite
 		log.Fatal().Msg("should not have failed to create shards")
 	}
 
-	database.SetPolicy(&db.RoundRobinPolicy[string]{Shards: shards})
+	database.SetPolicy(WritePolicy(shards))
 	return database
 }
 
+// WatchTopology switches both the connections to the
+// topology recorded by a reshard, without a restart.
+func WatchTopology(ctx context.Context, cfg *config.AppConfig, topology *models.Topology, keyShardedDB, robinShardedDB *db.SqliteCoordinator[string]) {
+	watcher := watchers.NewTopologyWatcher(
+		models.NewTopologyRepo(robinShardedDB.CoordinatorDB),
+		topology,
+		cfg.ReloadInterval,
+	)
+
+	watcher.OnChange(func(ctx context.Context, next *models.Topology) error {
+		return runners.RerouteTopology(ctx, robinShardedDB, next, db.DBReadWriteMode, WritePolicy)
+	})
+
+	watcher.OnChange(func(ctx context.Context, next *models.Topology) error {
+		return runners.RerouteTopology(ctx, keyShardedDB, next, db.DBReadOnlyMode, ReadPolicy)
+	})
+
+	watcher.Run(ctx)
+}
+
+// CreateStores returns the stores for reads and writes. With sqlite,
+// reads go to the key range shard and writes round robin. The other
+// drivers are not sharded, the same store does both. Only the links
+// are in them, the shards are still opened for the clicks, and the
+// coordinator db for the accounts, reports and topology.
+func CreateStores(ctx context.Context, cfg *config.AppConfig, keyShardedDB, robinShardedDB db.Coordinator[string]) (models.Store, models.Store) {
+	switch cfg.StoreDriver {
+	case "", models.StoreDriverSqlite:
+		return models.NewURLRepo(keyShardedDB), models.NewURLRepo(robinShardedDB)
+	case models.StoreDriverPostgres:
+		store, err := models.ConnectPostgresStore(ctx, cfg.StoreDSN)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to connect to postgres store")
+		}
+
+		return store, store
+	case models.StoreDriverMemory:
+		store := models.NewMemoryStore()
+		return store, store
+	}
+
+	log.Fatal().Str("driver", cfg.StoreDriver).Msg("unknown store driver")
+	return nil, nil
+}
+
 type TemplateRenderer struct {
 	templates *template.Template
 }
@@ -92,18 +155,162 @@ func (t *TemplateRenderer) Render(w io.Writer, name string, data interface{}, c
 }
 
 func (app *EchoServer) StartHTTPServer(ctx context.Context, cfg *config.AppConfig) {
-	seeder := seed.RegisterUrlSeeder()
-	keyRanges := seeder.Shards(5)
+	topology := runners.TopologyFromConfig(cfg)
 
-	keyShardedDB := CreateReadDatabaseConn(ctx, keyRanges)
-	robinShardedDB := CreateWriteDatabaseConn(ctx, keyRanges)
+	// held while the shards are open, cli restore can't swap them till then
+	lock, err := db.LockFile(topology.LockPath(), false)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to lock the shards, a restore is running")
+	}
+	defer lock.Unlock()
+
+	robinShardedDB := CreateWriteDatabaseConn(ctx, topology)
+	keyShardedDB := CreateReadDatabaseConn(ctx, topology)
+
+	clickRecorder := watchers.NewClickRecorder(
+		models.NewClickRepo(robinShardedDB),
+		watchers.StubCountryResolver{},
+		watchers.DefaultClickRecorderOpts(),
+	)
+
+	checker, err := config.LoadURLChecker(cfg.URLChecker)
+	if err != nil {
+		log.Fatal().Err(err).Msg("failed to load the url checker")
+	}
+
+	recorderCtx, stopRecorder := context.WithCancel(context.Background())
+	go clickRecorder.Run(recorderCtx)
+
+	if cfg.ReloadInterval > 0 {
+		go WatchTopology(recorderCtx, cfg, topology, keyShardedDB, robinShardedDB)
+	}
+
+	if len(cfg.ShardReplicas) > 0 {
+		monitor := watchers.NewReplicaMonitor(robinShardedDB, keyShardedDB, cfg.ReplicaCheckInterval, cfg.ReplicaMaxLag)
+		go monitor.Run(recorderCtx)
+	}
+
+	var shipper *watchers.ChangelogShipper
+
+	if cfg.ChangelogDest != "" {
+		target, err := watchers.NewBackupTarget(ctx, cfg.ChangelogDest, watchers.S3Options{
+			Region:    cfg.AWSRegion,
+			AccessKey: cfg.AWSAccessKey,
+			SecretKey: cfg.AWSSecretKey,
+			Endpoint:  cfg.AWSEndpoint,
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to set up the changelog target")
+		}
+
+		shipper = watchers.NewChangelogShipper(robinShardedDB, target, cfg.ChangelogInterval, cfg.ChangelogSegmentSize)
+		go shipper.Run(recorderCtx)
+	}
+
+	var mc *memcache.Client
+
+	if len(cfg.CacheAddrs) > 0 {
+		mc = memcache.New(cfg.CacheAddrs...)
+		if mc == nil {
+			log.Fatal().Msg("Failed to connect to Memcached")
+		}
+	}
+
+	readStore, writeStore := CreateStores(ctx, cfg, keyShardedDB, robinShardedDB)
+
+	var pool *watchers.KeyPool
+
+	// the other drivers have their own keys, there are none to lease
+	if cfg.KeyPoolSize > 0 && (cfg.StoreDriver == "" || cfg.StoreDriver == models.StoreDriverSqlite) {
+		poolOpts := watchers.DefaultKeyPoolOpts()
+		poolOpts.Size = cfg.KeyPoolSize
+		poolOpts.BlockSize = max(1, cfg.KeyPoolSize/4)
+		poolOpts.LowWater = cfg.KeyPoolSize / 2
+		poolOpts.LeaseTTL = cfg.KeyLeaseTTL
+
+		pool = watchers.NewKeyPool(robinShardedDB, poolOpts)
+		go pool.Run(recorderCtx)
+
+		writeStore = watchers.NewPooledStore(writeStore, pool)
+	}
+
+	reports := models.NewReportRepo(robinShardedDB.CoordinatorDB)
+	invalidations := models.NewInvalidationRepo(robinShardedDB.CoordinatorDB)
+
+	var linkCache *models.LinkCache
+
+	if cfg.LinkCacheSize > 0 {
+		cacheOpts := models.DefaultLinkCacheOpts()
+		cacheOpts.Size = cfg.LinkCacheSize
+
+		linkCache = models.NewLinkCache(cacheOpts, mc)
+		readStore = models.NewCachedStore(readStore, linkCache)
+
+		cachedWrites := models.NewCachedStore(writeStore, linkCache)
+		cachedWrites.Broadcaster = invalidations
+		writeStore = cachedWrites
+	}
+
+	moderator := runners.NewModerator(writeStore, reports)
+
+	if linkCache != nil && cfg.ModerationInterval > 0 {
+		watcher, err := watchers.NewModerationWatcher(ctx, reports, invalidations, linkCache, cfg.ModerationInterval)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to read the decisions")
+		}
+
+		go watcher.Run(recorderCtx)
+	}
+
+	var linkScanner controller.LinkScanner
+	var scanner *watchers.Scanner
+
+	if cfg.ScanWorkers > 0 {
+		scanOpts := watchers.DefaultScannerOpts()
+		scanOpts.Workers = cfg.ScanWorkers
+		scanOpts.Threshold = cfg.ScanThreshold
+		scanOpts.RescanAfter = cfg.RescanAfter
+
+		scanner = watchers.NewScanner(writeStore, checker, reports, moderator, scanOpts)
+		go scanner.Run(recorderCtx)
+
+		linkScanner = scanner
+	}
 
 	ctrl := controller.NewURLShortnerCtrl(
-		models.NewURLRepo(keyShardedDB),
-		models.NewURLRepo(robinShardedDB),
+		readStore,
+		writeStore,
+		clickRecorder,
+		checker,
+		linkScanner,
 		cfg.DomainName,
 	)
 
+	statsCtrl := controller.NewClickStatsCtrl(models.NewClickRepo(keyShardedDB), writeStore)
+
+	accounts := models.NewAccountRepo(robinShardedDB.CoordinatorDB)
+
+	bulkCtrl := controller.NewBulkCtrl(
+		runners.NewBulkShortener(
+			writeStore,
+			checker,
+			runners.DefaultBulkBatchSize,
+		),
+		ctrl,
+	)
+
+	linksCtrl := controller.NewLinksCtrl(
+		readStore,
+		writeStore,
+		ctrl,
+	)
+
+	reportsCtrl := controller.NewReportsCtrl(
+		readStore,
+		reports,
+		moderator,
+	)
+
 	port := cfg.AppPort
 
 	e := echo.New()
@@ -122,6 +329,7 @@ func (app *EchoServer) StartHTTPServer(ctx context.Context, cfg *config.AppConfi
 			echo.HeaderConnection,
 			echo.HeaderCacheControl,
 			// Access Token Headers,
+			controller.HeaderAuthKey,
 		},
 		ExposeHeaders: []string{
 			echo.HeaderContentLength,
@@ -148,14 +356,10 @@ func (app *EchoServer) StartHTTPServer(ctx context.Context, cfg *config.AppConfi
 		}
 	})
 
-	if len(cfg.CacheAddrs) > 0 {
-		mc := memcache.New(cfg.CacheAddrs...)
-		if mc == nil {
-			log.Fatal().Msg("Failed to connect to Memcached")
-		}
+	if mc != nil {
 		rateLimitConfig := controller.RateLimitConfig{
-			Limit:  100,
-			Window: 60 * time.Second,
+			Limit:  cfg.RateLimit,
+			Window: cfg.RateLimitWindow,
 		}
 
 		e.Use(controller.RateLimiter(mc, rateLimitConfig))
@@ -177,18 +381,80 @@ func (app *EchoServer) StartHTTPServer(ctx context.Context, cfg *config.AppConfi
 	})
 
 	e.GET("/:shortKey", ctrl.Get)
-	e.POST("/", ctrl.Post)
+	e.GET("/:shortKey/stats", statsCtrl.Get, controller.RequireAccount(accounts, models.ScopeLinksRead))
+	e.POST("/", ctrl.Post, controller.ResolveAccount(accounts))
+	e.POST("/:shortKey/report", reportsCtrl.Report, controller.ResolveAccount(accounts))
+
+	api := e.Group("/api")
+	api.GET("/links", linksCtrl.List, controller.RequireAccount(accounts, models.ScopeLinksRead))
+	api.PATCH("/links/:shortKey", linksCtrl.Update, controller.RequireAccount(accounts, models.ScopeLinksWrite))
+	api.DELETE("/links/:shortKey", linksCtrl.Delete, controller.RequireAccount(accounts, models.ScopeLinksWrite))
+	api.POST("/bulk", bulkCtrl.Post, controller.RequireAccount(accounts, models.ScopeLinksWrite))
+
+	api.GET("/reports", reportsCtrl.Queue, controller.RequireAccount(accounts, models.ScopeAdmin))
+	api.GET("/reports/:shortKey", reportsCtrl.History, controller.RequireAccount(accounts, models.ScopeAdmin))
+	api.POST("/reports/:shortKey/decision", reportsCtrl.Decide, controller.RequireAccount(accounts, models.ScopeAdmin))
+
+	api.GET("/shards/replicas", controller.NewReplicaStatusCtrl(keyShardedDB).Get, controller.RequireAccount(accounts, models.ScopeAdmin))
+
+	if linkCache != nil {
+		api.GET("/cache/stats", controller.NewCacheStatsCtrl(linkCache).Get, controller.RequireAccount(accounts, models.ScopeAdmin))
+	}
 
 	srv := &http.Server{
 		Addr:    fmt.Sprintf(":%s", port),
 		Handler: e,
 	}
 
+	serveUntilInterrupt(srv)
+
+	stopRecorder()
+	<-clickRecorder.Done()
+
+	log.Info().Int64("dropped", clickRecorder.Dropped()).Msg("flushed pending clicks")
+
+	// the keys left in the pool are free again
+	if pool != nil {
+		<-pool.Done()
+	}
+
+	// ships what was written till the shutdown
+	if shipper != nil {
+		<-shipper.Done()
+	}
+
+	if scanner != nil {
+		<-scanner.Done()
+
+		log.Info().
+			Int64("flagged", scanner.Flagged()).
+			Int64("dropped", scanner.Dropped()).
+			Msg("stopped the link scanner")
+	}
+}
+
+// StartMaintenanceServer answers every request with a 503. The shards
+// aren't opened, nor locked, so that they can be restored in place.
+func (app *EchoServer) StartMaintenanceServer(ctx context.Context, cfg *config.AppConfig) {
+	e := echo.New()
+	e.Use(middleware.Logger())
+	e.Use(middleware.Recover())
+	e.Any("/*", controller.Maintenance)
+
+	log.Warn().Msg("running in maintenance mode")
+
+	serveUntilInterrupt(&http.Server{
+		Addr:    fmt.Sprintf(":%s", cfg.AppPort),
+		Handler: e,
+	})
+}
+
+func serveUntilInterrupt(srv *http.Server) {
 	go func() {
-		log.Info().Str("port", port).Msg("server started at")
+		log.Info().Str("addr", srv.Addr).Msg("server started at")
 
 		err := srv.ListenAndServe()
-		if err != nil {
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatal().Err(err).Msg("server failed")
 		}
 	}()
@@ -208,28 +474,12 @@ func main() {
 	srvr := &EchoServer{}
 	ctx := context.Background()
 
-	memcachedAddrsStr := os.Getenv("MEMCACHED_URLS")
-	addresses := []string{}
-
-	if memcachedAddrsStr != "" {
-		addresses = strings.Split(memcachedAddrsStr, ",")
-	}
+	cfg, _ := config.MustLoad(flag.CommandLine, os.Args[1:])
 
-	// Define rate limit configuration
-	appPort := os.Getenv("PORT")
-	if appPort == "" {
-		appPort = "9091"
+	if cfg.Maintenance {
+		srvr.StartMaintenanceServer(ctx, cfg)
+		return
 	}
 
-	domain := os.Getenv("DOMAIN")
-	if domain == "" {
-		domain = "http://localhost:" + appPort
-	}
-
-	srvr.StartHTTPServer(ctx, &config.AppConfig{
-		AppPort:    appPort,
-		SeedSize:   "1M",
-		DomainName: domain,
-		CacheAddrs: addresses,
-	})
+	srvr.StartHTTPServer(ctx, cfg)
 }
@@ -55,6 +55,8 @@ sudo cp /app/shortner/systemd/syncs3.service /etc/systemd/system/
 sudo cp /app/shortner/systemd/syncs3.timer /etc/systemd/system/
 sudo cp /app/shortner/systemd/refiller.service /etc/systemd/system/
 sudo cp /app/shortner/systemd/refiller.timer /etc/systemd/system/
+sudo cp /app/shortner/systemd/sweeper.service /etc/systemd/system/
+sudo cp /app/shortner/systemd/sweeper.timer /etc/systemd/system/
 
 
 sudo systemctl daemon-reload